@@ -0,0 +1,361 @@
+// Package audit keeps a tamper evident record of the operations that
+// change the state of the service. Records are written as JSON lines,
+// each carrying the hash of the one before it, so editing, removing or
+// reordering records breaks the chain.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/logging"
+)
+
+// Record is an audited operation.
+type Record struct {
+	// Seq numbers the records of a chain from 1.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// ClientIP is the address of the client that asked for the
+	// operation, if it came over HTTP.
+	ClientIP string `json:"clientIP,omitempty"`
+	// Principal is who asked for the operation: a tenant, "admin",
+	// "anonymous" or "local" for operations of the service itself.
+	Principal string `json:"principal"`
+	// Operation names what was done, such as "token.create".
+	Operation string `json:"operation"`
+	// Namespace, Token, Member and Tenant are what the operation
+	// changed, as far as they apply.
+	Namespace string `json:"namespace,omitempty"`
+	Token     string `json:"token,omitempty"`
+	Member    string `json:"member,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+	// Result is "ok", "denied", "rejected" or "error", and Status the
+	// HTTP status of the response.
+	Result string `json:"result"`
+	Status int    `json:"status,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	// PrevHash is the Hash of the record before this one, and Hash
+	// the hex SHA-256 of this record with an empty Hash.
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+// Results of audited operations.
+const (
+	ResultOK       = "ok"
+	ResultDenied   = "denied"
+	ResultRejected = "rejected"
+	ResultError    = "error"
+)
+
+// Principals that are not tenants.
+const (
+	PrincipalAdmin     = "admin"
+	PrincipalAnonymous = "anonymous"
+	PrincipalLocal     = "local"
+)
+
+// ResultOf returns the result of an operation answered with the HTTP
+// status code.
+func ResultOf(code int) string {
+	switch {
+	case code < 400:
+		return ResultOK
+	case code == 401 || code == 403:
+		return ResultDenied
+	case code < 500:
+		return ResultRejected
+	default:
+		return ResultError
+	}
+}
+
+func (r Record) digest() string {
+	r.Hash = ""
+	b, _ := json.Marshal(r)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Logger writes hash chained records to a writer, or to a file it
+// rotates.
+type Logger struct {
+	mu   sync.Mutex
+	w    io.Writer
+	seq  uint64
+	last string
+
+	// set for files
+	f       *os.File
+	path    string
+	size    int64
+	maxSize int64
+	backups int
+}
+
+// NewLogger returns a logger writing to w, starting a new chain.
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{w: w}
+}
+
+// NewFileLogger returns a logger appending to the file at path, which
+// continues the chain of the records already in it. Once the file
+// would grow past maxSize bytes it is rotated to path.1, path.1 to
+// path.2 and so on, keeping backups old files. A maxSize of 0 never
+// rotates.
+func NewFileLogger(path string, maxSize int64, backups int) (*Logger, error) {
+	l := &Logger{path: path, maxSize: maxSize, backups: backups}
+	if err := l.resume(path); err != nil {
+		return nil, err
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// resume picks the chain up from the last record of the file at path,
+// or of its newest backup if the file is empty.
+func (l *Logger) resume(path string) error {
+	for _, p := range []string{path, path + ".1"} {
+		b, err := lastLine(p)
+		if err != nil {
+			return err
+		}
+		if len(b) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return fmt.Errorf("audit: cannot continue the chain of %s: %v", p, err)
+		}
+		l.seq, l.last = rec.Seq, rec.Hash
+		return nil
+	}
+	return nil
+}
+
+// lastLine returns the last line of the file at path, nil if it is
+// empty or does not exist.
+func lastLine(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var last []byte
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		if line := bytes.TrimSpace(s.Bytes()); len(line) > 0 {
+			last = append(last[:0], line...)
+		}
+	}
+	return last, s.Err()
+}
+
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.w, l.size = f, f, fi.Size()
+	return nil
+}
+
+// rotate moves the current file out of the way and starts a new one.
+func (l *Logger) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	if l.backups <= 0 {
+		if err := os.Remove(l.path); err != nil {
+			return err
+		}
+		return l.open()
+	}
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.backups))
+	for i := l.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Log chains rec to the records before it and writes it.
+func (l *Logger) Log(rec Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	rec.Time = rec.Time.UTC()
+	rec.Seq = l.seq + 1
+	rec.PrevHash = l.last
+	rec.Hash = rec.digest()
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.w.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	l.seq, l.last = rec.Seq, rec.Hash
+	return nil
+}
+
+// Close closes the file of the logger, if it writes to one.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// Verify checks the chain of records read from r, which must follow
+// the record hashed prevHash, or may start anywhere if prevHash is
+// empty. It returns the hash of the last record and how many records
+// it read.
+func Verify(r io.Reader, prevHash string) (string, int, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	n := 0
+	var prevSeq uint64
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		n++
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return prevHash, n - 1, fmt.Errorf("record %d: %v", n, err)
+		}
+		if (n > 1 || prevHash != "") && rec.PrevHash != prevHash {
+			return prevHash, n - 1, fmt.Errorf("record %d (seq %d) does not follow the record before it", n, rec.Seq)
+		}
+		if n > 1 && rec.Seq != prevSeq+1 {
+			return prevHash, n - 1, fmt.Errorf("record %d has seq %d after seq %d", n, rec.Seq, prevSeq)
+		}
+		if rec.digest() != rec.Hash {
+			return prevHash, n - 1, fmt.Errorf("record %d (seq %d) was modified", n, rec.Seq)
+		}
+		prevHash, prevSeq = rec.Hash, rec.Seq
+	}
+	return prevHash, n, s.Err()
+}
+
+var global struct {
+	mu     sync.RWMutex
+	logger *Logger
+}
+
+// SetLogger makes l the logger of Log, nil to stop auditing.
+func SetLogger(l *Logger) {
+	global.mu.Lock()
+	global.logger = l
+	global.mu.Unlock()
+}
+
+// Enabled reports whether records are being written.
+func Enabled() bool {
+	global.mu.RLock()
+	defer global.mu.RUnlock()
+	return global.logger != nil
+}
+
+// Log writes rec with the logger set with SetLogger, if any.
+func Log(rec Record) {
+	global.mu.RLock()
+	l := global.logger
+	global.mu.RUnlock()
+	if l == nil {
+		return
+	}
+	if err := l.Log(rec); err != nil {
+		logging.Errorf("failed to write audit record of %s: %v", rec.Operation, err)
+	}
+}
+
+type requestKey struct{}
+
+// request holds what handlers found out about a request: who it acts
+// as and which token it created.
+type request struct {
+	mu        sync.Mutex
+	principal string
+	token     string
+}
+
+// NewContext returns a copy of ctx that handlers can record the
+// principal and token of a request in.
+func NewContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestKey{}, &request{})
+}
+
+// CopyContext carries what was recorded about the request of src, if
+// anything can be, over to dst.
+func CopyContext(dst, src context.Context) context.Context {
+	if req, ok := src.Value(requestKey{}).(*request); ok {
+		return context.WithValue(dst, requestKey{}, req)
+	}
+	return dst
+}
+
+func update(ctx context.Context, f func(*request)) {
+	if req, ok := ctx.Value(requestKey{}).(*request); ok {
+		req.mu.Lock()
+		f(req)
+		req.mu.Unlock()
+	}
+}
+
+// SetPrincipal records who the request of ctx acts as.
+func SetPrincipal(ctx context.Context, name string) {
+	update(ctx, func(req *request) { req.principal = name })
+}
+
+// SetToken records the token the request of ctx created.
+func SetToken(ctx context.Context, token string) {
+	update(ctx, func(req *request) { req.token = token })
+}
+
+// FromContext returns the principal and token recorded for the request
+// of ctx, empty where no handler said.
+func FromContext(ctx context.Context) (principal, token string) {
+	update(ctx, func(req *request) { principal, token = req.principal, req.token })
+	return principal, token
+}
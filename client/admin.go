@@ -0,0 +1,262 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TokenInfo is a token as listed by the admin API.
+type TokenInfo struct {
+	Namespace string            `json:"namespace"`
+	Token     string            `json:"token"`
+	Shard     string            `json:"shard"`
+	Tenant    string            `json:"tenant"`
+	Size      int               `json:"size"`
+	Members   int               `json:"members"`
+	Created   time.Time         `json:"created"`
+	Labels    map[string]string `json:"labels"`
+}
+
+// Durations summarizes how long bootstraps took.
+type Durations struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50Seconds"`
+	P90   float64 `json:"p90Seconds"`
+	Max   float64 `json:"maxSeconds"`
+}
+
+// Stats are the bootstrap statistics reported by the admin API.
+type Stats struct {
+	Live        int            `json:"live"`
+	Completed   int            `json:"completed"`
+	Stalled     int            `json:"stalled"`
+	Sizes       map[string]int `json:"sizes"`
+	Namespaces  map[string]int `json:"namespaces"`
+	Tenants     map[string]int `json:"tenants"`
+	FirstMember Durations      `json:"firstMember"`
+	Complete    Durations      `json:"complete"`
+}
+
+// admin sends an admin API request and decodes the response into v,
+// unless it is nil.
+func (c *Client) admin(ctx context.Context, method, p string, v interface{}) error {
+	header := http.Header{"Authorization": {"Bearer " + c.AdminToken}}
+	resp, err := c.do(ctx, method, c.endpoint()+p, nil, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Tokens lists the tokens of every namespace.
+func (c *Client) Tokens(ctx context.Context) ([]TokenInfo, error) {
+	var ts []TokenInfo
+	err := c.admin(ctx, http.MethodGet, "/admin/tokens", &ts)
+	return ts, err
+}
+
+// DeleteToken deletes a token of namespace, the default namespace if
+// empty, with all its members.
+func (c *Client) DeleteToken(ctx context.Context, namespace, token string) error {
+	p := "/admin/tokens/" + url.PathEscape(token)
+	if namespace != "" {
+		p += "?namespace=" + url.QueryEscape(namespace)
+	}
+	return c.admin(ctx, http.MethodDelete, p, nil)
+}
+
+// StaticToken is a token created with its members already registered.
+type StaticToken struct {
+	Token   string   `json:"token"`
+	URL     string   `json:"url"`
+	Members []Member `json:"members"`
+}
+
+// CreateStatic creates a token of namespace, the default namespace if
+// empty, with the members of an etcd --initial-cluster value
+// registered. The members must be started with exactly the returned
+// url as their discovery url, which their ids are derived from. A ttl
+// of 0 keeps the default of the namespace.
+func (c *Client) CreateStatic(ctx context.Context, namespace, initialCluster string, ttl time.Duration) (StaticToken, error) {
+	q := url.Values{}
+	if namespace != "" {
+		q.Set("namespace", namespace)
+	}
+	if ttl > 0 {
+		q.Set("ttl", ttl.String())
+	}
+	p := "/admin/tokens"
+	if len(q) > 0 {
+		p += "?" + q.Encode()
+	}
+	header := http.Header{
+		"Authorization": {"Bearer " + c.AdminToken},
+		"Content-Type":  {"text/plain"},
+	}
+	var t StaticToken
+	resp, err := c.do(ctx, http.MethodPost, c.endpoint()+p, strings.NewReader(initialCluster), header)
+	if err != nil {
+		return t, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&t)
+	return t, err
+}
+
+// Stats returns the bootstrap statistics of the service.
+func (c *Client) Stats(ctx context.Context) (Stats, error) {
+	var s Stats
+	err := c.admin(ctx, http.MethodGet, "/admin/stats", &s)
+	return s, err
+}
+
+// ImportReport tells what an import restored, or would restore in a
+// dry run.
+type ImportReport struct {
+	DryRun  bool     `json:"dryRun"`
+	Tenants int      `json:"tenants"`
+	Tokens  int      `json:"tokens"`
+	Members int      `json:"members"`
+	Skipped []string `json:"skipped"`
+}
+
+// Export writes the tenants and tokens of the service to w, as JSON
+// lines Import reads. Only the tokens of namespace are exported when
+// it is not nil.
+func (c *Client) Export(ctx context.Context, w io.Writer, namespace *string) error {
+	p := "/admin/export"
+	if namespace != nil {
+		p += "?namespace=" + url.QueryEscape(*namespace)
+	}
+	header := http.Header{"Authorization": {"Bearer " + c.AdminToken}}
+	resp, err := c.do(ctx, http.MethodGet, c.endpoint()+p, nil, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Import restores an export read from r. Existing tenants and tokens
+// are skipped. With dryRun nothing is written, and the report tells
+// what would have been.
+func (c *Client) Import(ctx context.Context, r io.Reader, dryRun bool) (ImportReport, error) {
+	p := "/admin/import"
+	if dryRun {
+		p += "?dry-run=true"
+	}
+	header := http.Header{
+		"Authorization": {"Bearer " + c.AdminToken},
+		"Content-Type":  {"application/x-ndjson"},
+	}
+	var report ImportReport
+	resp, err := c.do(ctx, http.MethodPost, c.endpoint()+p, r, header)
+	if err != nil {
+		return report, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	return report, err
+}
+
+// MigrationReport compares the v2 registry with its v3 copy.
+type MigrationReport struct {
+	Time       time.Time `json:"time"`
+	Tokens     int       `json:"tokens"`
+	Keys       int       `json:"keys"`
+	Missing    []string  `json:"missing"`
+	Extra      []string  `json:"extra"`
+	Mismatched []string  `json:"mismatched"`
+	// Pending are the tokens written since they were verified, whose
+	// copy was still to be made.
+	Pending []string `json:"pending"`
+}
+
+// MigrationStatus is the progress of the migration of the registry to
+// etcd v3.
+type MigrationStatus struct {
+	Phase        string           `json:"phase"`
+	Rounds       int              `json:"rounds"`
+	SyncedTokens int              `json:"syncedTokens"`
+	WrittenKeys  int              `json:"writtenKeys"`
+	LastError    string           `json:"lastError"`
+	Report       *MigrationReport `json:"report"`
+}
+
+// Migration returns the progress of the migration to v3, with the
+// report of its last verification.
+func (c *Client) Migration(ctx context.Context) (MigrationStatus, error) {
+	var s MigrationStatus
+	err := c.admin(ctx, http.MethodGet, "/admin/migration", &s)
+	return s, err
+}
+
+// SyncMigration copies and verifies the whole registry right away.
+func (c *Client) SyncMigration(ctx context.Context) (MigrationStatus, error) {
+	var s MigrationStatus
+	err := c.admin(ctx, http.MethodPost, "/admin/migration", &s)
+	return s, err
+}
+
+// ShardStatus describes an etcd cluster holding part of the tokens.
+type ShardStatus struct {
+	Name      string `json:"name"`
+	Endpoint  string `json:"endpoint"`
+	Healthy   bool   `json:"healthy"`
+	Error     string `json:"error"`
+	Tokens    int    `json:"tokens"`
+	Misplaced int    `json:"misplaced"`
+}
+
+// ShardsReport lists the shards of the service. Rebalance is set while
+// tokens may not be on the shard they belong on.
+type ShardsReport struct {
+	Rebalance bool          `json:"rebalance"`
+	Shards    []ShardStatus `json:"shards"`
+}
+
+// Shards returns the health and the token counts of every shard.
+func (c *Client) Shards(ctx context.Context) (ShardsReport, error) {
+	var s ShardsReport
+	err := c.admin(ctx, http.MethodGet, "/admin/shards", &s)
+	return s, err
+}
+
+// MovedToken is a token a rebalance moved between shards.
+type MovedToken struct {
+	Namespace string `json:"namespace"`
+	Token     string `json:"token"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+}
+
+// RebalanceReport tells which tokens a rebalance moved, or would move
+// in a dry run, and which it left for a later rebalance because members
+// may still be waiting on them.
+type RebalanceReport struct {
+	DryRun  bool         `json:"dryRun"`
+	Moved   []MovedToken `json:"moved"`
+	Skipped []MovedToken `json:"skipped"`
+}
+
+// Rebalance moves the tokens to the shards they belong on. With dryRun
+// nothing is moved, and the report tells what would have been.
+func (c *Client) Rebalance(ctx context.Context, dryRun bool) (RebalanceReport, error) {
+	p := "/admin/shards/rebalance"
+	if dryRun {
+		p += "?dry-run=true"
+	}
+	var report RebalanceReport
+	err := c.admin(ctx, http.MethodPost, p, &report)
+	return report, err
+}
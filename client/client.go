@@ -0,0 +1,195 @@
+// Package client talks to a discovery service: it creates tokens,
+// registers members with them and waits for their clusters to fill up,
+// the way etcd does when started with --discovery.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultEndpoint is the public discovery service.
+const DefaultEndpoint = "https://discovery.etcd.io"
+
+// APIKeyHeader is the request header API keys are sent in.
+const APIKeyHeader = "X-Api-Key"
+
+// Client is a discovery service client. Its zero value talks to
+// DefaultEndpoint with http.DefaultClient.
+type Client struct {
+	// Endpoint is the url of the discovery service.
+	Endpoint string
+	// APIKey identifies the tenant tokens are created for, if set.
+	APIKey string
+	// AdminToken authenticates requests to the admin API.
+	AdminToken string
+	// HTTPClient sends the requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// New returns a client of the discovery service at endpoint.
+func New(endpoint string) *Client {
+	return &Client{Endpoint: endpoint}
+}
+
+// Error is a response of the discovery service, or of the etcd
+// cluster behind it, reporting a failed request.
+type Error struct {
+	// StatusCode is the HTTP status of the response.
+	StatusCode int
+	// Code is the etcd error code, if the error came from etcd.
+	Code int
+	// Message describes the error.
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("discovery: %s (status %d, etcd error %d)", e.Message, e.StatusCode, e.Code)
+	}
+	return fmt.Sprintf("discovery: %s (status %d)", e.Message, e.StatusCode)
+}
+
+// IsNotFound reports whether err says a token or member does not
+// exist.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// IsExist reports whether err says a member is already registered.
+func IsExist(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusPreconditionFailed
+}
+
+// IsIncomplete reports whether err says a token has fewer members
+// than its size.
+func IsIncomplete(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusConflict
+}
+
+func (c *Client) endpoint() string {
+	if c.Endpoint == "" {
+		return DefaultEndpoint
+	}
+	return strings.TrimRight(c.Endpoint, "/")
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// do sends a request and returns the response if it succeeded. Failed
+// requests are returned as *Error.
+func (c *Client) do(ctx context.Context, method, u string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := c.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	e := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+	var ee struct {
+		ErrorCode int    `json:"errorCode"`
+		Message   string `json:"message"`
+		Cause     string `json:"cause"`
+	}
+	if json.Unmarshal(b, &ee) == nil && ee.ErrorCode != 0 {
+		e.Code, e.Message = ee.ErrorCode, ee.Message
+		if ee.Cause != "" {
+			e.Message += ": " + ee.Cause
+		}
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	return nil, e
+}
+
+// CreateOptions adjust the tokens made by Create.
+type CreateOptions struct {
+	// Size is the expected cluster size, the service default if 0.
+	Size int
+	// Namespace is the namespace to create the token in, the default
+	// namespace if empty.
+	Namespace string
+	// TTL is how long the token lives, the namespace default if 0.
+	TTL time.Duration
+	// Labels are stored with the token and listed by the admin API.
+	Labels map[string]string
+	// Expect names the members expected to register, as name, or as
+	// name=host to also require their peer urls on host. The size
+	// defaults to their number.
+	Expect []string
+	// ExpectPattern is a regular expression the names of other members
+	// must match to register.
+	ExpectPattern string
+}
+
+// Create makes a new token and returns its discovery url, to be
+// passed to etcd as --discovery.
+func (c *Client) Create(ctx context.Context, opts CreateOptions) (string, error) {
+	u := c.endpoint()
+	if opts.Namespace != "" {
+		u += "/ns/" + url.PathEscape(opts.Namespace)
+	}
+	q := url.Values{}
+	if opts.Size > 0 {
+		q.Set("size", strconv.Itoa(opts.Size))
+	}
+	if opts.TTL > 0 {
+		q.Set("ttl", opts.TTL.String())
+	}
+	for k, v := range opts.Labels {
+		q.Add("label", k+"="+v)
+	}
+	for _, e := range opts.Expect {
+		q.Add("expect", e)
+	}
+	if opts.ExpectPattern != "" {
+		q.Set("expect-pattern", opts.ExpectPattern)
+	}
+	u += "/new"
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	header := http.Header{}
+	if c.APIKey != "" {
+		header.Set(APIKeyHeader, c.APIKey)
+	}
+	resp, err := c.do(ctx, http.MethodPost, u, nil, header)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
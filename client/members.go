@@ -0,0 +1,497 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Member is a member registered with a token.
+type Member struct {
+	// ID is the member id, the key it is registered under.
+	ID string `json:"id"`
+	// Name is the member name.
+	Name string `json:"name"`
+	// PeerURLs are the urls the member listens to its peers on.
+	PeerURLs []string `json:"peerURLs"`
+	// CreatedIndex orders the registrations. The first members to
+	// register, as many as the cluster size, form the cluster.
+	CreatedIndex uint64 `json:"createdIndex"`
+	// Quorum is whether the member is one of the first members, as
+	// many as the cluster size, rather than an overflow registration
+	// that etcd turns into a proxy. It is nil if the service did not
+	// say.
+	Quorum *bool `json:"quorum,omitempty"`
+	// Metadata is what the member told about itself when it
+	// registered, such as its zone, rack, ip and etcd version. Member
+	// listings leave it out, summaries include it.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// value returns the registration value of m, as etcd writes it.
+func (m Member) value() string {
+	pairs := make([]string, len(m.PeerURLs))
+	for i, u := range m.PeerURLs {
+		pairs[i] = m.Name + "=" + u
+	}
+	return strings.Join(pairs, ",")
+}
+
+// parseMember reads a member out of its registration, whose value is
+// a list of name=peerURL pairs.
+func parseMember(n *node) Member {
+	m := Member{ID: path.Base(n.Key), CreatedIndex: n.CreatedIndex, Quorum: n.Quorum}
+	for _, pair := range strings.Split(n.Value, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if m.Name == "" {
+			m.Name = kv[0]
+		}
+		m.PeerURLs = append(m.PeerURLs, kv[1])
+	}
+	return m
+}
+
+// node and response are the parts of etcd v2 responses the client
+// reads.
+type node struct {
+	Key           string  `json:"key"`
+	Value         string  `json:"value"`
+	Dir           bool    `json:"dir"`
+	Nodes         []*node `json:"nodes"`
+	CreatedIndex  uint64  `json:"createdIndex"`
+	ModifiedIndex uint64  `json:"modifiedIndex"`
+	Quorum        *bool   `json:"quorum"`
+}
+
+type response struct {
+	Action   string `json:"action"`
+	Node     *node  `json:"node"`
+	PrevNode *node  `json:"prevNode"`
+}
+
+// get fetches u and decodes the response. It also returns the etcd
+// index the response reflects.
+func (c *Client) get(ctx context.Context, u string) (*response, uint64, error) {
+	resp, err := c.do(ctx, http.MethodGet, u, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, 0, err
+	}
+	if r.Node == nil {
+		r.Node = &node{}
+	}
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Etcd-Index"), 10, 64)
+	return &r, index, nil
+}
+
+// Size returns the cluster size of the token at tokenURL.
+func (c *Client) Size(ctx context.Context, tokenURL string) (int, error) {
+	r, _, err := c.get(ctx, strings.TrimRight(tokenURL, "/")+"/_config/size")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(r.Node.Value)
+}
+
+// Members returns the members registered with the token at tokenURL,
+// in registration order and marked with their quorum membership, and
+// the etcd index of the listing.
+func (c *Client) Members(ctx context.Context, tokenURL string) ([]Member, uint64, error) {
+	r, index, err := c.get(ctx, strings.TrimRight(tokenURL, "/")+"?mark=quorum")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ms []Member
+	for _, n := range r.Node.Nodes {
+		if !n.Dir {
+			ms = append(ms, parseMember(n))
+		}
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].CreatedIndex < ms[j].CreatedIndex })
+	return ms, index, nil
+}
+
+// Register registers m with the token at tokenURL, along with its
+// metadata. Like etcd, it fails if a member with the same id is
+// already registered, see IsExist.
+func (c *Client) Register(ctx context.Context, tokenURL string, m Member) (Member, error) {
+	q := url.Values{"prevExist": {"false"}}
+	for k, v := range m.Metadata {
+		q.Add("meta", k+"="+v)
+	}
+	u := strings.TrimRight(tokenURL, "/") + "/" + url.PathEscape(m.ID) + "?" + q.Encode()
+	form := url.Values{"value": {m.value()}}
+	header := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	resp, err := c.do(ctx, http.MethodPut, u, strings.NewReader(form.Encode()), header)
+	if err != nil {
+		return Member{}, err
+	}
+	defer resp.Body.Close()
+
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return Member{}, err
+	}
+	if r.Node == nil {
+		return m, nil
+	}
+	reg := parseMember(r.Node)
+	reg.Metadata = m.Metadata
+	return reg, nil
+}
+
+// Unregister removes the member with the given id from the token at
+// tokenURL.
+func (c *Client) Unregister(ctx context.Context, tokenURL, id string) error {
+	u := strings.TrimRight(tokenURL, "/") + "/" + url.PathEscape(id)
+	resp, err := c.do(ctx, http.MethodDelete, u, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Backoff bounds the delays between retries of WaitFull.
+var (
+	MinBackoff = 100 * time.Millisecond
+	MaxBackoff = 10 * time.Second
+)
+
+// WaitFull waits until as many members as the cluster size registered
+// with the token at tokenURL, and returns the members forming the
+// cluster. It watches the token for registrations, and backs off
+// exponentially when requests fail, until ctx is done.
+func (c *Client) WaitFull(ctx context.Context, tokenURL string) ([]Member, error) {
+	tokenURL = strings.TrimRight(tokenURL, "/")
+	backoff := MinBackoff
+	retry := func(err error) error {
+		if e, ok := err.(*Error); ok && e.StatusCode/100 == 4 && e.StatusCode != http.StatusTooManyRequests {
+			// retrying will not help
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > MaxBackoff {
+			backoff = MaxBackoff
+		}
+		return nil
+	}
+
+	var size int
+	for {
+		var err error
+		if size, err = c.Size(ctx, tokenURL); err == nil {
+			break
+		}
+		if err := retry(err); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		ms, index, err := c.Members(ctx, tokenURL)
+		if err != nil {
+			if err := retry(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if len(ms) >= size {
+			return ms[:size], nil
+		}
+
+		// wait for any change past the listing, then list again
+		u := tokenURL + "?wait=true&recursive=true&waitIndex=" + strconv.FormatUint(index+1, 10)
+		if _, _, err := c.get(ctx, u); err != nil {
+			if e, ok := err.(*Error); ok && e.Code != 0 {
+				// e.g. the event index was cleared, just list again
+				continue
+			}
+			if err := retry(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		backoff = MinBackoff
+	}
+}
+
+// Event is a change to the members of a token.
+type Event struct {
+	// Action is the etcd action, such as "create", "set", "delete" or
+	// "expire".
+	Action string `json:"action"`
+	// Member is the member after the change, or before it if it was
+	// removed.
+	Member Member `json:"member"`
+	// Index is the etcd index of the change.
+	Index uint64 `json:"index"`
+}
+
+// Watch waits for the next change to the members of the token at
+// tokenURL after index, as returned by Members or a previous Watch,
+// until ctx is done. Changes to hidden keys, such as the token size,
+// are skipped.
+func (c *Client) Watch(ctx context.Context, tokenURL string, index uint64) (Event, error) {
+	tokenURL = strings.TrimRight(tokenURL, "/")
+	token := "/" + path.Base(tokenURL) + "/"
+	for {
+		u := tokenURL + "?wait=true&recursive=true&waitIndex=" + strconv.FormatUint(index+1, 10)
+		r, _, err := c.get(ctx, u)
+		if err != nil {
+			return Event{}, err
+		}
+		index = r.Node.ModifiedIndex
+		if i := strings.Index(r.Node.Key, token); i >= 0 && strings.HasPrefix(r.Node.Key[i+len(token):], "_") {
+			continue
+		}
+
+		n := r.Node
+		if n.Value == "" && r.PrevNode != nil {
+			n = r.PrevNode
+		}
+		return Event{Action: r.Action, Member: parseMember(n), Index: index}, nil
+	}
+}
+
+// InitialCluster returns the --initial-cluster flag value of members:
+// their name=peerURL pairs, comma separated.
+func InitialCluster(members []Member) string {
+	values := make([]string, len(members))
+	for i, m := range members {
+		values[i] = m.value()
+	}
+	return strings.Join(values, ",")
+}
+
+// BootstrapConfig is the initial cluster of a full token.
+type BootstrapConfig struct {
+	// InitialCluster is the --initial-cluster flag value of Members.
+	InitialCluster string `json:"initialCluster"`
+	// Members are the members the cluster is made of.
+	Members []Member `json:"members"`
+}
+
+// BootstrapConfig returns the initial cluster of a full token. It
+// fails with an error IsIncomplete reports on until the token has as
+// many members as its size.
+func (c *Client) BootstrapConfig(ctx context.Context, tokenURL string) (*BootstrapConfig, error) {
+	header := http.Header{}
+	header.Set("Accept", "application/json")
+	resp, err := c.do(ctx, http.MethodGet, strings.TrimRight(tokenURL, "/")+"/initial-cluster", nil, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var bc BootstrapConfig
+	if err := json.NewDecoder(resp.Body).Decode(&bc); err != nil {
+		return nil, err
+	}
+	return &bc, nil
+}
+
+// Finding is a problem the service found with the registrations of a
+// token.
+type Finding struct {
+	// Severity is "error" for problems that keep the cluster from
+	// forming, "warning" for those that may.
+	Severity string `json:"severity"`
+	// Check names the check that failed, such as "duplicate-name".
+	Check string `json:"check"`
+	// Message describes the problem.
+	Message string `json:"message"`
+	// Members are the ids of the members concerned.
+	Members []string `json:"members,omitempty"`
+}
+
+// Diagnosis is the report of Diagnose.
+type Diagnosis struct {
+	Token   string   `json:"token"`
+	Size    int      `json:"size"`
+	Members []Member `json:"members"`
+	// Probed is whether the peer urls of the members were dialed.
+	Probed   bool      `json:"probed"`
+	Findings []Finding `json:"findings"`
+}
+
+// Diagnose checks the registrations of a token for the usual reasons
+// a cluster fails to form. If probeTimeout is not 0, the service also
+// dials the peer urls of the members, each for at most probeTimeout;
+// that takes the admin token or an API key of the tenant that created
+// the token.
+func (c *Client) Diagnose(ctx context.Context, tokenURL string, probeTimeout time.Duration) (*Diagnosis, error) {
+	u := strings.TrimRight(tokenURL, "/") + "/diagnose"
+	header := http.Header{}
+	header.Set("Accept", "application/json")
+	if probeTimeout > 0 {
+		u += "?" + url.Values{"probe": {"true"}, "timeout": {probeTimeout.String()}}.Encode()
+		if c.AdminToken != "" {
+			header.Set("Authorization", "Bearer "+c.AdminToken)
+		} else if c.APIKey != "" {
+			header.Set(APIKeyHeader, c.APIKey)
+		}
+	}
+	resp, err := c.do(ctx, http.MethodGet, u, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var d Diagnosis
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Summary splits the members of a token into those that form its
+// cluster and the overflow.
+type Summary struct {
+	Token string `json:"token"`
+	Size  int    `json:"size"`
+	// Registered is how many members registered with the token.
+	Registered int `json:"registered"`
+	// Full is whether as many members as Size registered.
+	Full bool `json:"full"`
+	// Quorum are the first Size members, which form the cluster.
+	Quorum []Member `json:"quorum"`
+	// Overflow are the members that registered after the token was
+	// full, which etcd turns into proxies.
+	Overflow []Member `json:"overflow"`
+	// Expected are the members the token expects by name, and Missing
+	// the names of those that have not registered yet.
+	Expected []ExpectedMember `json:"expected"`
+	Missing  []string         `json:"missing"`
+	// PeerChecks are the last peer url checks of the members that
+	// registered, refused ones included, when the service checks them.
+	PeerChecks []PeerCheck `json:"peerChecks"`
+}
+
+// PeerCheck is the outcome of the checks of the peer urls a member
+// last registered with.
+type PeerCheck struct {
+	Member   string    `json:"member"`
+	Time     time.Time `json:"time"`
+	PeerURLs []string  `json:"peerURLs"`
+	Passed   bool      `json:"passed"`
+	// Probed is whether the service connected to the peer urls.
+	Probed bool `json:"probed"`
+	// Problems tell why the registration was refused.
+	Problems []string `json:"problems"`
+}
+
+// ExpectedMember is a member a token expects to register. Unless Host
+// is empty, its peer urls must be on it.
+type ExpectedMember struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+}
+
+// Summary returns the members of the token at tokenURL split into the
+// cluster and the overflow.
+func (c *Client) Summary(ctx context.Context, tokenURL string) (*Summary, error) {
+	resp, err := c.do(ctx, http.MethodGet, strings.TrimRight(tokenURL, "/")+"/summary", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var s Summary
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Reset removes every member registered with the token at tokenURL so
+// its machines can retry a failed bootstrap, and changes its size
+// unless size is 0. It authenticates with the admin token if set, or
+// else with the API key of the tenant that created the token. It
+// returns the ids of the removed members.
+func (c *Client) Reset(ctx context.Context, tokenURL string, size int) ([]string, error) {
+	u := strings.TrimRight(tokenURL, "/") + "/reset"
+	if size > 0 {
+		u += "?size=" + strconv.Itoa(size)
+	}
+	header := http.Header{}
+	if c.AdminToken != "" {
+		header.Set("Authorization", "Bearer "+c.AdminToken)
+	} else if c.APIKey != "" {
+		header.Set(APIKeyHeader, c.APIKey)
+	}
+	resp, err := c.do(ctx, http.MethodPost, u, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ev struct {
+		Removed []string `json:"removed"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ev); err != nil {
+		return nil, err
+	}
+	return ev.Removed, nil
+}
+
+// HistoryEvent is an entry of the history of a token.
+type HistoryEvent struct {
+	Time time.Time `json:"time"`
+	// Type is one of "created", "registered", "unregistered",
+	// "rejected", "full" and "reset".
+	Type string `json:"type"`
+	// Actor is the tenant, or "admin", that caused the event.
+	Actor string `json:"actor,omitempty"`
+	// ClientIP is the address of the client that caused the event.
+	ClientIP string `json:"clientIP,omitempty"`
+	// Size is the size of the token after the event, and PrevSize
+	// the size before it, if the event changed it.
+	Size     int `json:"size,omitempty"`
+	PrevSize int `json:"prevSize,omitempty"`
+	// Member and PeerURLs describe the member the event is about.
+	Member   string   `json:"member,omitempty"`
+	PeerURLs []string `json:"peerURLs,omitempty"`
+	// Status and Reason tell why a member request was rejected.
+	Status int    `json:"status,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Removed are the ids of the members a reset removed.
+	Removed []string `json:"removed,omitempty"`
+}
+
+// History returns the recorded events of the token at tokenURL,
+// oldest first.
+func (c *Client) History(ctx context.Context, tokenURL string) ([]HistoryEvent, error) {
+	resp, err := c.do(ctx, http.MethodGet, strings.TrimRight(tokenURL, "/")+"/history", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var h struct {
+		Events []HistoryEvent `json:"events"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		return nil, err
+	}
+	return h.Events, nil
+}
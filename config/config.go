@@ -0,0 +1,558 @@
+// Package config defines the settings the discovery server runs with,
+// and loads them from flags, DISC_ environment variables and an
+// optional YAML, TOML or JSON config file.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/logging"
+)
+
+// DefaultStallThreshold is how long a partially filled token may wait
+// for its remaining members before it is reported as stalled.
+const DefaultStallThreshold = time.Hour
+
+// DefaultStatsInterval is how often the registry is scanned to refresh
+// the token gauges.
+const DefaultStatsInterval = time.Minute
+
+// DefaultRegistryPrefix is the etcd key prefix tokens are kept under.
+const DefaultRegistryPrefix = "_etcd/registry"
+
+// DefaultAuditMaxSize is how many megabytes the audit log grows to
+// before it is rotated, and DefaultAuditMaxBackups how many rotated
+// logs are kept.
+const (
+	DefaultAuditMaxSize    = 100
+	DefaultAuditMaxBackups = 10
+)
+
+// Defaults of the embedded etcd server.
+const (
+	DefaultEmbeddedDataDir        = "discovery.etcd"
+	DefaultEmbeddedClientURL      = "http://127.0.0.1:2379"
+	DefaultEmbeddedPeerURL        = "http://127.0.0.1:2380"
+	DefaultEmbeddedSnapshotCount  = 10000
+	DefaultEmbeddedAutoCompaction = time.Hour
+)
+
+// DefaultBoltClientURL is the url the bolt backend serves the etcd v2
+// keys API on.
+const DefaultBoltClientURL = "http://127.0.0.1:2379"
+
+// DefaultMirrorSyncInterval is how often a mirror refreshes the tokens
+// it caches from its upstream.
+const DefaultMirrorSyncInterval = 30 * time.Second
+
+// DefaultShard is the name of the shard of the etcd cluster given by
+// Etcd.
+const DefaultShard = "default"
+
+// DefaultTenantPrefix is the etcd key prefix tenants and their API
+// keys are kept under.
+const DefaultTenantPrefix = "_discovery/tenants"
+
+// Limits bound the tokens a tenant may create. Zero values mean no
+// limit.
+type Limits struct {
+	// MaxSize is the largest cluster size /new accepts.
+	MaxSize int `json:"maxSize"`
+	// MaxTokens is how many live tokens the tenant may have.
+	MaxTokens int `json:"maxTokens"`
+	// CreateRate is how many tokens the tenant may create per minute.
+	CreateRate int `json:"createRate"`
+}
+
+// Validate checks that no limit is negative.
+func (l Limits) Validate() error {
+	if l.MaxSize < 0 || l.MaxTokens < 0 || l.CreateRate < 0 {
+		return fmt.Errorf("Expected limits of at least 0 (%+v)", l)
+	}
+	return nil
+}
+
+// EmbeddedEtcd configures the etcd server the service can run
+// in-process instead of using a separate cluster.
+type EmbeddedEtcd struct {
+	// Enabled starts the embedded server and backs the service with
+	// it, in place of Etcd.
+	Enabled bool
+	// DataDir is the directory the server keeps its data in.
+	DataDir string
+	// ClientURL and PeerURL are the urls the server listens on for
+	// clients and peers.
+	ClientURL string
+	PeerURL   string
+	// SnapshotCount is how many committed transactions trigger a
+	// snapshot.
+	SnapshotCount int
+	// AutoCompaction is how much revision history is kept, or 0 to
+	// keep all of it.
+	AutoCompaction time.Duration
+}
+
+// Bolt configures the backend that keeps the registry in a local bbolt
+// file instead of etcd.
+type Bolt struct {
+	// Path is the bbolt file, or empty to use etcd.
+	Path string
+	// ClientURL is the url the backend serves the etcd v2 keys API on.
+	ClientURL string
+}
+
+// Mirror configures forwarding the tokens of the default namespace to
+// an upstream discovery service, caching them in etcd.
+type Mirror struct {
+	// Upstream is the url of the upstream discovery service, or empty
+	// to serve tokens locally.
+	Upstream string
+	// SyncInterval is how often the cached tokens are refreshed from
+	// the upstream.
+	SyncInterval time.Duration
+	// APIKey is the upstream API key the mirror creates and resets
+	// tokens with, or empty to do so anonymously.
+	APIKey string
+}
+
+// MaxPeerProbeTimeout is the longest a registration may wait for each
+// of its peer urls to accept a connection. etcd gives up on a
+// registration after 5s.
+const MaxPeerProbeTimeout = 2 * time.Second
+
+// PeerCheck configures the checks of the peer urls members register
+// with. The zero value checks nothing.
+type PeerCheck struct {
+	// RejectLocal refuses peer urls on loopback, link-local or
+	// unspecified addresses, which other machines cannot reach.
+	RejectLocal bool
+	// AllowedCIDRs are the networks peer urls must be in, or empty to
+	// allow any network.
+	AllowedCIDRs []string
+	// ProbeTimeout is how long the service waits for each peer url to
+	// accept a connection, or 0 to not connect to them. Probes need
+	// AllowedCIDRs, which bound where they connect to.
+	ProbeTimeout time.Duration
+}
+
+// Enabled reports whether any check is configured.
+func (pc PeerCheck) Enabled() bool {
+	return pc.RejectLocal || len(pc.AllowedCIDRs) > 0 || pc.ProbeTimeout > 0
+}
+
+// Shard is an etcd cluster tokens are spread across.
+type Shard struct {
+	// Name places tokens on the shard; it must not change while the
+	// shard holds tokens.
+	Name string
+	// URL is the url of the etcd endpoint of the shard.
+	URL string
+}
+
+// Namespace is a part of the registry with its own key prefix and
+// token settings. Named namespaces are served under /ns/<name>/.
+type Namespace struct {
+	// Name is the namespace path element, empty for the default
+	// namespace.
+	Name string
+	// Prefix is the etcd key prefix the tokens are kept under.
+	Prefix string
+	// MaxSize is the largest cluster size /new accepts, or 0 for no
+	// limit.
+	MaxSize int
+	// TokenTTL is how long tokens live, or 0 to keep them forever.
+	TokenTTL time.Duration
+}
+
+// Config is the discovery server configuration.
+type Config struct {
+	// Etcd is the url of the etcd endpoint backing the instance. It is
+	// the client url of the embedded server when that is enabled.
+	Etcd string
+	// Embedded configures the embedded etcd server.
+	Embedded EmbeddedEtcd
+	// Bolt configures the bbolt backend.
+	Bolt Bolt
+	// Mirror configures the upstream tokens are forwarded to.
+	Mirror Mirror
+	// Shards are the etcd clusters tokens are spread across, besides
+	// the one of Etcd, ordered by name.
+	Shards []Shard
+	// Host is the url prepended to tokens returned by /new.
+	Host string
+	// AllowedHosts are the scheme://host urls /new may derive the
+	// token url from, when a request is addressed to one of them.
+	// Requests to any other host get tokens prefixed with Host.
+	AllowedHosts []string
+	// TrustedProxies are the networks, as CIDRs, of the proxies whose
+	// Forwarded and X-Forwarded-For headers tell the client address.
+	// The headers of any other peer are ignored.
+	TrustedProxies []string
+	// PeerCheck configures the checks of member peer urls at
+	// registration.
+	PeerCheck PeerCheck
+	// Addr is the address the web service listens on.
+	Addr string
+
+	// AdminToken is the bearer token required by the admin API.
+	// The admin API is disabled when it is empty.
+	AdminToken string
+	// StallThreshold is how old a partially filled token must be
+	// before it is counted as a stalled bootstrap.
+	StallThreshold time.Duration
+	// StatsInterval is how often the registry is scanned to refresh
+	// the token gauges.
+	StatsInterval time.Duration
+
+	// TraceEndpoint is the url of an OTLP/HTTP collector traces
+	// resource that request spans are exported to.
+	TraceEndpoint string
+	// TraceFile is a file request spans are appended to as JSON lines.
+	TraceFile string
+
+	// LogLevel is the minimum level of logged messages.
+	LogLevel string
+	// MaxSize is the largest cluster size /new accepts, or 0 for no
+	// limit.
+	MaxSize int
+
+	// RegistryPrefix is the etcd key prefix of the default namespace.
+	RegistryPrefix string
+	// TokenTTL is how long tokens of the default namespace live, or 0
+	// to keep them forever.
+	TokenTTL time.Duration
+	// Namespaces are the named namespaces, sorted by name.
+	Namespaces []Namespace
+
+	// TenantPrefix is the etcd key prefix tenants and their API keys
+	// are kept under.
+	TenantPrefix string
+	// AnonymousDisabled requires an API key to create tokens.
+	AnonymousDisabled bool
+	// Anonymous limits the tokens created without an API key.
+	Anonymous Limits
+
+	// AuditLog is the file the audit log is appended to, "-" for
+	// standard output. Mutating operations are not audited when it
+	// is empty.
+	AuditLog string
+	// AuditMaxSize is how many megabytes the audit log may grow to
+	// before it is rotated, or 0 to never rotate it.
+	AuditMaxSize int
+	// AuditMaxBackups is how many rotated audit logs are kept.
+	AuditMaxBackups int
+
+	// MigrateV3 copies the registry from the etcd v2 store to the v3
+	// keyspace, and keeps the copy in sync while serving from v2.
+	MigrateV3 bool
+}
+
+// Validate checks the embedded server settings and normalizes its
+// urls.
+func (e *EmbeddedEtcd) Validate() error {
+	if e.DataDir == "" {
+		return settingError(KeyEmbeddedDataDir, errors.New("Expected data directory (none given)"))
+	}
+	for _, u := range []struct {
+		key string
+		url *string
+	}{{KeyEmbeddedClientURL, &e.ClientURL}, {KeyEmbeddedPeerURL, &e.PeerURL}} {
+		v, err := HostOnlyURL(*u.url)
+		if err != nil {
+			return settingError(u.key, err)
+		}
+		if !strings.HasPrefix(v, "http://") && !strings.HasPrefix(v, "https://") {
+			return settingError(u.key, fmt.Errorf("Expected http or https url (%v)", *u.url))
+		}
+		*u.url = v
+	}
+	if e.SnapshotCount < 0 {
+		return settingError(KeyEmbeddedSnapshotCount, fmt.Errorf("Expected count of at least 0 (%d)", e.SnapshotCount))
+	}
+	if e.AutoCompaction < 0 {
+		return settingError(KeyEmbeddedAutoCompaction, fmt.Errorf("Expected duration of at least 0 (%v)", e.AutoCompaction))
+	}
+	return nil
+}
+
+// Namespace returns the namespace called name. The empty name is the
+// default namespace, made of the top level settings.
+func (cfg Config) Namespace(name string) (Namespace, bool) {
+	if name == "" {
+		return Namespace{
+			Prefix:   cfg.RegistryPrefix,
+			MaxSize:  cfg.MaxSize,
+			TokenTTL: cfg.TokenTTL,
+		}, true
+	}
+	for _, ns := range cfg.Namespaces {
+		if ns.Name == name {
+			return ns, true
+		}
+	}
+	return Namespace{}, false
+}
+
+// AllNamespaces returns the default namespace followed by the named
+// ones.
+func (cfg Config) AllNamespaces() []Namespace {
+	def, _ := cfg.Namespace("")
+	return append([]Namespace{def}, cfg.Namespaces...)
+}
+
+// AllShards returns the default shard followed by the configured ones.
+func (cfg Config) AllShards() []Shard {
+	return append([]Shard{{Name: DefaultShard, URL: cfg.Etcd}}, cfg.Shards...)
+}
+
+var namespaceName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// cleanPrefix returns p without leading, trailing or duplicate slashes.
+func cleanPrefix(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// New returns a configuration for the given etcd endpoint and
+// discovery host, with defaults for everything else.
+func New(etcd, host string) Config {
+	return Config{
+		Etcd:           etcd,
+		Host:           host,
+		StallThreshold: DefaultStallThreshold,
+		StatsInterval:  DefaultStatsInterval,
+		LogLevel:       "info",
+		RegistryPrefix: DefaultRegistryPrefix,
+		TenantPrefix:   DefaultTenantPrefix,
+
+		AuditMaxSize:    DefaultAuditMaxSize,
+		AuditMaxBackups: DefaultAuditMaxBackups,
+
+		Embedded: EmbeddedEtcd{
+			DataDir:        DefaultEmbeddedDataDir,
+			ClientURL:      DefaultEmbeddedClientURL,
+			PeerURL:        DefaultEmbeddedPeerURL,
+			SnapshotCount:  DefaultEmbeddedSnapshotCount,
+			AutoCompaction: DefaultEmbeddedAutoCompaction,
+		},
+		Bolt:   Bolt{ClientURL: DefaultBoltClientURL},
+		Mirror: Mirror{SyncInterval: DefaultMirrorSyncInterval},
+	}
+}
+
+// HostOnlyURL checks that givenUrl has a scheme and host and nothing
+// else, and returns it in its scheme://host form.
+func HostOnlyURL(givenUrl string) (string, error) {
+	u, err := url.Parse(givenUrl)
+
+	if err != nil {
+		return "", fmt.Errorf("Invalid url given: %v", err)
+	}
+
+	if len(u.Path) != 0 && u.Path != "/" {
+		return "", fmt.Errorf("Expected url without path (%v)", u.Path)
+	}
+
+	if u.RawQuery != "" {
+		return "", fmt.Errorf("Expected url without query (?%v)", u.RawQuery)
+	}
+
+	if u.Fragment != "" {
+		return "", fmt.Errorf("Expected url without fragment (%v)", u.Fragment)
+	}
+
+	if u.Host == "" {
+		return "", errors.New("Expected hostname (none given)")
+	}
+
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// settingError reports an invalid value of the setting key.
+func settingError(key string, err error) error {
+	return fmt.Errorf("invalid %s: %v", key, err)
+}
+
+// Validate checks cfg and normalizes its urls.
+func (cfg *Config) Validate() error {
+	var err error
+	if cfg.Embedded.Enabled {
+		if err := cfg.Embedded.Validate(); err != nil {
+			return err
+		}
+		cfg.Etcd = cfg.Embedded.ClientURL
+	}
+	if cfg.Bolt.Path != "" {
+		if cfg.Embedded.Enabled {
+			return settingError(KeyBoltPath, fmt.Errorf("Expected at most one of %s and %s", KeyEmbeddedEtcd, KeyBoltPath))
+		}
+		if cfg.MigrateV3 {
+			return settingError(KeyMigrateV3, errors.New("Expected etcd backend (bolt has no v3 keyspace)"))
+		}
+		if cfg.Bolt.ClientURL, err = HostOnlyURL(cfg.Bolt.ClientURL); err != nil {
+			return settingError(KeyBoltClientURL, err)
+		}
+		if !strings.HasPrefix(cfg.Bolt.ClientURL, "http://") {
+			return settingError(KeyBoltClientURL, fmt.Errorf("Expected http url (%v)", cfg.Bolt.ClientURL))
+		}
+		cfg.Etcd = cfg.Bolt.ClientURL
+	}
+	if cfg.Etcd, err = HostOnlyURL(cfg.Etcd); err != nil {
+		return settingError(KeyEtcd, err)
+	}
+	if cfg.Mirror.Upstream != "" {
+		if cfg.Mirror.Upstream, err = HostOnlyURL(cfg.Mirror.Upstream); err != nil {
+			return settingError(KeyMirrorUpstream, err)
+		}
+		if !strings.HasPrefix(cfg.Mirror.Upstream, "http://") && !strings.HasPrefix(cfg.Mirror.Upstream, "https://") {
+			return settingError(KeyMirrorUpstream, fmt.Errorf("Expected http or https url (%v)", cfg.Mirror.Upstream))
+		}
+		if cfg.Mirror.SyncInterval <= 0 {
+			return settingError(KeyMirrorSyncInterval, fmt.Errorf("Expected positive interval (%v)", cfg.Mirror.SyncInterval))
+		}
+	}
+	for i := range cfg.Shards {
+		sh := &cfg.Shards[i]
+		key := KeyShards + "." + sh.Name
+		if !namespaceName.MatchString(sh.Name) {
+			return settingError(key, errors.New("Expected name of lower case letters, digits and dashes"))
+		}
+		if sh.Name == DefaultShard {
+			return settingError(key, fmt.Errorf("Expected name other than %s, the shard of %s", DefaultShard, KeyEtcd))
+		}
+		if sh.URL, err = HostOnlyURL(sh.URL); err != nil {
+			return settingError(key, err)
+		}
+		if !strings.HasPrefix(sh.URL, "http://") && !strings.HasPrefix(sh.URL, "https://") {
+			return settingError(key, fmt.Errorf("Expected http or https url (%v)", sh.URL))
+		}
+	}
+	sort.Slice(cfg.Shards, func(i, j int) bool { return cfg.Shards[i].Name < cfg.Shards[j].Name })
+	shards := cfg.AllShards()
+	for i, a := range shards {
+		for _, b := range shards[i+1:] {
+			if a.Name == b.Name || a.URL == b.URL {
+				return settingError(KeyShards, fmt.Errorf("Expected separate shards (%s and %s)", a.Name, b.Name))
+			}
+		}
+	}
+	if len(cfg.Shards) > 0 && cfg.MigrateV3 {
+		return settingError(KeyMigrateV3, fmt.Errorf("Expected no %s (only %s is migrated)", KeyShards, KeyEtcd))
+	}
+	if cfg.Host, err = HostOnlyURL(cfg.Host); err != nil {
+		return settingError(KeyHost, err)
+	}
+	for i, h := range cfg.AllowedHosts {
+		u, err := HostOnlyURL(h)
+		if err != nil {
+			return settingError(KeyAllowedHosts, err)
+		}
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return settingError(KeyAllowedHosts, fmt.Errorf("Expected http or https url (%v)", h))
+		}
+		cfg.AllowedHosts[i] = u
+	}
+	for _, cidr := range cfg.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return settingError(KeyTrustedProxies, fmt.Errorf("Expected CIDR (%v)", cidr))
+		}
+	}
+	for _, cidr := range cfg.PeerCheck.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return settingError(KeyPeerCheckAllowedCIDRs, fmt.Errorf("Expected CIDR (%v)", cidr))
+		}
+	}
+	if cfg.PeerCheck.ProbeTimeout < 0 || cfg.PeerCheck.ProbeTimeout > MaxPeerProbeTimeout {
+		return settingError(KeyPeerCheckProbeTimeout, fmt.Errorf("Expected duration from 0 to %v (%v)", MaxPeerProbeTimeout, cfg.PeerCheck.ProbeTimeout))
+	}
+	if cfg.PeerCheck.ProbeTimeout > 0 && len(cfg.PeerCheck.AllowedCIDRs) == 0 {
+		return settingError(KeyPeerCheckProbeTimeout, fmt.Errorf("Expected %s to bound the probes", KeyPeerCheckAllowedCIDRs))
+	}
+	if cfg.Addr == "" {
+		return settingError(KeyAddr, errors.New("Expected web service address (none given)"))
+	}
+	if cfg.StallThreshold <= 0 {
+		return settingError(KeyStallThreshold, fmt.Errorf("Expected positive duration (%v)", cfg.StallThreshold))
+	}
+	if cfg.StatsInterval <= 0 {
+		return settingError(KeyStatsInterval, fmt.Errorf("Expected positive duration (%v)", cfg.StatsInterval))
+	}
+	if cfg.TraceEndpoint != "" && cfg.TraceFile != "" {
+		return settingError(KeyTraceEndpoint, fmt.Errorf("Expected at most one of %s and %s", KeyTraceEndpoint, KeyTraceFile))
+	}
+	if cfg.TraceEndpoint != "" {
+		u, err := url.Parse(cfg.TraceEndpoint)
+		if err != nil {
+			return settingError(KeyTraceEndpoint, fmt.Errorf("Invalid url given: %v", err))
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return settingError(KeyTraceEndpoint, fmt.Errorf("Expected http or https url (%v)", cfg.TraceEndpoint))
+		}
+	}
+	if _, err := logging.ParseLevel(cfg.LogLevel); err != nil {
+		return settingError(KeyLogLevel, err)
+	}
+	if cfg.MaxSize < 0 {
+		return settingError(KeyMaxSize, fmt.Errorf("Expected size of at least 0 (%d)", cfg.MaxSize))
+	}
+	if cfg.TokenTTL < 0 {
+		return settingError(KeyTokenTTL, fmt.Errorf("Expected duration of at least 0 (%v)", cfg.TokenTTL))
+	}
+	if err := cfg.Anonymous.Validate(); err != nil {
+		return settingError("anonymous", err)
+	}
+	if cfg.AuditMaxSize < 0 {
+		return settingError(KeyAuditMaxSize, fmt.Errorf("Expected size of at least 0 (%d)", cfg.AuditMaxSize))
+	}
+	if cfg.AuditMaxBackups < 0 {
+		return settingError(KeyAuditMaxBackups, fmt.Errorf("Expected count of at least 0 (%d)", cfg.AuditMaxBackups))
+	}
+	if cfg.TenantPrefix = cleanPrefix(cfg.TenantPrefix); cfg.TenantPrefix == "" {
+		return settingError(KeyTenantPrefix, errors.New("Expected key prefix (none given)"))
+	}
+	if cfg.RegistryPrefix = cleanPrefix(cfg.RegistryPrefix); cfg.RegistryPrefix == "" {
+		return settingError(KeyRegistryPrefix, errors.New("Expected key prefix (none given)"))
+	}
+	names := make(map[string]bool)
+	for i := range cfg.Namespaces {
+		ns := &cfg.Namespaces[i]
+		key := KeyNamespaces + "." + ns.Name
+		if !namespaceName.MatchString(ns.Name) {
+			return settingError(key, errors.New("Expected name of lower case letters, digits and dashes"))
+		}
+		// Namespace would only ever find the first of two namesakes
+		if names[ns.Name] {
+			return settingError(key, errors.New("Expected unique name (given twice)"))
+		}
+		names[ns.Name] = true
+		if ns.Prefix = cleanPrefix(ns.Prefix); ns.Prefix == "" {
+			return settingError(key+".prefix", errors.New("Expected key prefix (none given)"))
+		}
+		if ns.MaxSize < 0 {
+			return settingError(key+".max-size", fmt.Errorf("Expected size of at least 0 (%d)", ns.MaxSize))
+		}
+		if ns.TokenTTL < 0 {
+			return settingError(key+".token-ttl", fmt.Errorf("Expected duration of at least 0 (%v)", ns.TokenTTL))
+		}
+	}
+	sort.Slice(cfg.Namespaces, func(i, j int) bool { return cfg.Namespaces[i].Name < cfg.Namespaces[j].Name })
+
+	// tokens of one namespace must never show up in another, or
+	// among the tenants
+	all := append(cfg.AllNamespaces(), Namespace{Name: "tenants", Prefix: cfg.TenantPrefix})
+	for i, a := range all {
+		for _, b := range all[i+1:] {
+			if a.Prefix == b.Prefix || strings.HasPrefix(a.Prefix, b.Prefix+"/") || strings.HasPrefix(b.Prefix, a.Prefix+"/") {
+				return settingError(KeyNamespaces, fmt.Errorf("Expected separate key prefixes (%s and %s overlap)", a.Prefix, b.Prefix))
+			}
+		}
+	}
+	return nil
+}
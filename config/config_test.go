@@ -0,0 +1,300 @@
+package config
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// base is the smallest valid config file.
+const base = `
+etcd: http://127.0.0.1:2379
+host: https://discovery.example.com
+addr: :8087
+stall-threshold: 10m
+log-level: info
+registry-prefix: _etcd/registry
+tenant-prefix: _discovery/tenants
+`
+
+// writeConfig writes content as the config file discovery.yaml in dir.
+func writeConfig(t *testing.T, dir, content string) string {
+	file := filepath.Join(dir, "discovery.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// newViper returns a viper reading the config file file, with the
+// defaults of the durations that the flags give otherwise.
+func newViper(t *testing.T, file string) *viper.Viper {
+	v := viper.New()
+	v.SetDefault(KeyTokenTTL, time.Duration(0))
+	v.SetDefault(KeyStatsInterval, DefaultStatsInterval)
+	v.SetDefault(KeyEmbeddedAutoCompaction, DefaultEmbeddedAutoCompaction)
+	v.SetDefault(KeyMirrorSyncInterval, DefaultMirrorSyncInterval)
+	v.SetDefault(KeyPeerCheckProbeTimeout, time.Duration(0))
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// readConfig returns a viper reading content as a config file.
+func readConfig(t *testing.T, content string) *viper.Viper {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	return newViper(t, writeConfig(t, dir, content))
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		err    string
+	}{
+		{"defaults", func(cfg *Config) {}, ""},
+		{"bad etcd url", func(cfg *Config) { cfg.Etcd = "127.0.0.1:2379" }, "invalid etcd"},
+		{"no addr", func(cfg *Config) { cfg.Addr = "" }, "invalid addr"},
+		{"zero stall threshold", func(cfg *Config) { cfg.StallThreshold = 0 }, "invalid stall-threshold"},
+		{"zero stats interval", func(cfg *Config) { cfg.StatsInterval = 0 }, "invalid stats-interval"},
+		{"bad log level", func(cfg *Config) { cfg.LogLevel = "loud" }, "invalid log-level"},
+		{"negative max size", func(cfg *Config) { cfg.MaxSize = -1 }, "invalid limits.max-size"},
+		{"negative anonymous limits", func(cfg *Config) { cfg.Anonymous.MaxTokens = -1 }, "invalid anonymous"},
+		{"empty registry prefix", func(cfg *Config) { cfg.RegistryPrefix = "/" }, "invalid registry-prefix"},
+		{"both tracers", func(cfg *Config) { cfg.TraceEndpoint, cfg.TraceFile = "http://127.0.0.1:9411", "spans" }, "invalid trace-endpoint"},
+		{"bad trusted proxy", func(cfg *Config) { cfg.TrustedProxies = []string{"10.0.0.1"} }, "invalid trusted-proxies"},
+		{"bad peer network", func(cfg *Config) { cfg.PeerCheck.AllowedCIDRs = []string{"10.0.0.0/33"} }, "invalid peer-check.allowed-cidrs"},
+		{"long peer probe", func(cfg *Config) { cfg.PeerCheck.ProbeTimeout = time.Minute }, "invalid peer-check.probe-timeout"},
+		{"unbounded peer probe", func(cfg *Config) { cfg.PeerCheck.ProbeTimeout = time.Second }, "invalid peer-check.probe-timeout"},
+		{"mirror without interval", func(cfg *Config) { cfg.Mirror = Mirror{Upstream: "https://discovery.etcd.io"} }, "invalid mirror.sync-interval"},
+		{"namespace", func(cfg *Config) {
+			cfg.Namespaces = []Namespace{{Name: "staging", Prefix: "/_discovery/staging/"}}
+		}, ""},
+		{"bad namespace name", func(cfg *Config) {
+			cfg.Namespaces = []Namespace{{Name: "Staging", Prefix: "staging"}}
+		}, "invalid namespaces.Staging"},
+		{"duplicate namespace", func(cfg *Config) {
+			cfg.Namespaces = []Namespace{{Name: "staging", Prefix: "a"}, {Name: "staging", Prefix: "b"}}
+		}, "invalid namespaces.staging: Expected unique name"},
+		{"overlapping namespaces", func(cfg *Config) {
+			cfg.Namespaces = []Namespace{{Name: "staging", Prefix: "a"}, {Name: "testing", Prefix: "a/b"}}
+		}, "Expected separate key prefixes"},
+		{"namespace among tenants", func(cfg *Config) {
+			cfg.Namespaces = []Namespace{{Name: "staging", Prefix: DefaultTenantPrefix + "/staging"}}
+		}, "Expected separate key prefixes"},
+		{"shard", func(cfg *Config) { cfg.Shards = []Shard{{Name: "b", URL: "http://10.0.0.2:2379"}} }, ""},
+		{"shard named default", func(cfg *Config) { cfg.Shards = []Shard{{Name: DefaultShard, URL: "http://10.0.0.2:2379"}} }, "Expected name other than"},
+		{"shard of etcd", func(cfg *Config) { cfg.Shards = []Shard{{Name: "b", URL: cfg.Etcd}} }, "Expected separate shards"},
+		{"embedded and bolt", func(cfg *Config) { cfg.Embedded.Enabled, cfg.Bolt.Path = true, "discovery.db" }, "invalid bolt.path"},
+	}
+	for _, tt := range tests {
+		cfg := New("http://127.0.0.1:2379/", "https://discovery.example.com")
+		cfg.Addr = ":8087"
+		tt.modify(&cfg)
+		err := cfg.Validate()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: expected valid config, got %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: expected error %q, got %v", tt.name, tt.err, err)
+		}
+	}
+
+	cfg := New("http://127.0.0.1:2379/", "https://discovery.example.com/")
+	cfg.Addr = ":8087"
+	cfg.Namespaces = []Namespace{{Name: "b", Prefix: "/b//x/"}, {Name: "a", Prefix: "a"}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Etcd != "http://127.0.0.1:2379" || cfg.Host != "https://discovery.example.com" {
+		t.Errorf("expected urls without paths, got %s and %s", cfg.Etcd, cfg.Host)
+	}
+	if want := []Namespace{{Name: "a", Prefix: "a"}, {Name: "b", Prefix: "b/x"}}; !reflect.DeepEqual(cfg.Namespaces, want) {
+		t.Errorf("expected sorted namespaces with clean prefixes %+v, got %+v", want, cfg.Namespaces)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"base", base, ""},
+		{"limits and sections", base + `
+limits:
+  max-size: 9
+anonymous:
+  max-tokens: 5
+trusted-proxies: [10.0.0.0/8]
+peer-check:
+  reject-local: true
+  allowed-cidrs: 10.0.0.0/8, 192.168.0.0/16
+  probe-timeout: 2s
+shards:
+  b: http://10.0.0.2:2379
+namespaces:
+  staging:
+    prefix: _discovery/staging
+    max-size: 5
+    token-ttl: 24h
+`, ""},
+		{"unknown setting", base + "tll: 1h\n", "unknown settings in"},
+		{"unknown section setting", base + "anonymous:\n  max-sizes: 3\n", "anonymous.max-sizes"},
+		{"unknown namespace setting", base + "namespaces:\n  staging:\n    prefixes: a\n", "namespaces.staging.prefixes"},
+		{"bad duration", base + "token-ttl: forever\n", "invalid token-ttl"},
+		{"bad number", base + "limits:\n  max-size: many\n", "invalid limits.max-size"},
+		{"invalid", base + "log-level: loud\n", "invalid log-level"},
+	}
+	for _, tt := range tests {
+		cfg, err := Load(readConfig(t, tt.content))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: expected config to load, got %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: expected error %q, got %v", tt.name, tt.err, err)
+		case tt.err == "" && cfg.Addr != ":8087":
+			t.Errorf("%s: expected addr :8087, got %+v", tt.name, cfg)
+		}
+	}
+
+	cfg, err := Load(readConfig(t, tests[1].content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxSize != 9 || cfg.Anonymous.MaxTokens != 5 || len(cfg.TrustedProxies) != 1 {
+		t.Errorf("expected the limits and proxies of the file, got %+v", cfg)
+	}
+	if want := (PeerCheck{true, []string{"10.0.0.0/8", "192.168.0.0/16"}, 2 * time.Second}); !reflect.DeepEqual(cfg.PeerCheck, want) {
+		t.Errorf("expected the peer checks of the file %+v, got %+v", want, cfg.PeerCheck)
+	}
+	if ns, ok := cfg.Namespace("staging"); !ok || ns.MaxSize != 5 || ns.TokenTTL != 24*time.Hour {
+		t.Errorf("expected the staging namespace of the file, got %+v", cfg.Namespaces)
+	}
+	if len(cfg.Shards) != 1 || cfg.Shards[0] != (Shard{Name: "b", URL: "http://10.0.0.2:2379"}) {
+		t.Errorf("expected shard b of the file, got %+v", cfg.Shards)
+	}
+}
+
+func TestReload(t *testing.T) {
+	cur := New("http://127.0.0.1:2379", "https://discovery.example.com")
+	cur.Addr = ":8087"
+
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		restart []string
+	}{
+		{"unchanged", func(cfg *Config) {}, nil},
+		{"log level", func(cfg *Config) { cfg.LogLevel = "debug" }, nil},
+		{"limits", func(cfg *Config) { cfg.MaxSize, cfg.Anonymous.MaxTokens = 9, 3 }, nil},
+		{"trusted proxies", func(cfg *Config) { cfg.TrustedProxies = []string{"10.0.0.0/8"} }, nil},
+		{"peer checks", func(cfg *Config) {
+			cfg.PeerCheck = PeerCheck{RejectLocal: true, AllowedCIDRs: []string{"10.0.0.0/8"}, ProbeTimeout: time.Second}
+		}, nil},
+		{"etcd", func(cfg *Config) { cfg.Etcd = "http://10.0.0.1:2379" }, []string{KeyEtcd}},
+		{"addr and audit log", func(cfg *Config) { cfg.Addr, cfg.AuditLog = ":9000", "audit.log" }, []string{KeyAddr, KeyAuditLog}},
+		{"stats interval", func(cfg *Config) { cfg.StatsInterval = time.Hour }, []string{KeyStatsInterval}},
+		{"namespaces", func(cfg *Config) { cfg.Namespaces = []Namespace{{Name: "staging", Prefix: "staging"}} }, []string{KeyNamespaces}},
+		{"mixed", func(cfg *Config) { cfg.LogLevel, cfg.RegistryPrefix = "warn", "registry" }, []string{KeyRegistryPrefix}},
+	}
+	for _, tt := range tests {
+		next := cur
+		tt.modify(&next)
+		got, restart := Reload(cur, next)
+		if !reflect.DeepEqual(restart, tt.restart) {
+			t.Errorf("%s: expected restart of %v, got %v", tt.name, tt.restart, restart)
+		}
+
+		// the reloadable settings are taken, the rest is kept
+		want := cur
+		want.AllowedHosts = next.AllowedHosts
+		want.TrustedProxies = next.TrustedProxies
+		want.PeerCheck = next.PeerCheck
+		want.AdminToken = next.AdminToken
+		want.StallThreshold = next.StallThreshold
+		want.LogLevel = next.LogLevel
+		want.MaxSize = next.MaxSize
+		want.TokenTTL = next.TokenTTL
+		want.AnonymousDisabled = next.AnonymousDisabled
+		want.Anonymous = next.Anonymous
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %+v, got %+v", tt.name, want, got)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	v := newViper(t, writeConfig(t, dir, base))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	applied := make(chan Config, 10)
+	if err := Watch(ctx, v, func(cfg Config) { applied <- cfg }); err != nil {
+		t.Fatal(err)
+	}
+	// next returns the next configuration applied after writing
+	// content, if not empty, or sending SIGHUP otherwise
+	next := func(content string) (Config, bool) {
+		for len(applied) > 0 {
+			<-applied
+		}
+		if content != "" {
+			writeConfig(t, dir, content)
+		} else if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case cfg := <-applied:
+			// an editor may write a file in more than one go
+			for {
+				select {
+				case cfg = <-applied:
+					continue
+				case <-time.After(200 * time.Millisecond):
+				}
+				return cfg, true
+			}
+		case <-time.After(2 * time.Second):
+			return Config{}, false
+		}
+	}
+
+	if cfg, ok := next(base + "log-level: debug\n"); !ok || cfg.LogLevel != "debug" {
+		t.Fatalf("expected the changed file to be applied, got %+v (%v)", cfg, ok)
+	}
+	if cfg, ok := next(""); !ok || cfg.LogLevel != "debug" {
+		t.Fatalf("expected SIGHUP to apply the file again, got %+v (%v)", cfg, ok)
+	}
+	if cfg, ok := next(base + "log-level: loud\n"); ok {
+		t.Fatalf("expected an invalid file to be ignored, got %+v", cfg)
+	}
+	if cfg, ok := next(""); ok {
+		t.Fatalf("expected SIGHUP to ignore the invalid file, got %+v", cfg)
+	}
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	if cfg, ok := next(base + "log-level: error\n"); ok {
+		t.Fatalf("expected no reloads after the watch ended, got %+v", cfg)
+	}
+}
@@ -0,0 +1,425 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Keys of the settings, as used in config files. Flags use the last
+// element of the key, prefixed with the section name for the
+// anonymous, audit, embedded, bolt, mirror and peer-check sections, and
+// environment variables are the key in upper case with "." and "-"
+// replaced by "_", prefixed with DISC_.
+const (
+	KeyConfig         = "config"
+	KeyEtcd           = "etcd"
+	KeyHost           = "host"
+	KeyAllowedHosts   = "allowed-hosts"
+	KeyTrustedProxies = "trusted-proxies"
+	KeyAddr           = "addr"
+	KeyAdminToken     = "admin-token"
+	KeyStallThreshold = "stall-threshold"
+	KeyStatsInterval  = "stats-interval"
+	KeyTraceEndpoint  = "trace-endpoint"
+	KeyTraceFile      = "trace-file"
+	KeyLogLevel       = "log-level"
+	KeyMaxSize        = "limits.max-size"
+	KeyRegistryPrefix = "registry-prefix"
+	KeyTokenTTL       = "token-ttl"
+	KeyNamespaces     = "namespaces"
+	KeyShards         = "shards"
+	KeyTenantPrefix   = "tenant-prefix"
+
+	KeyAnonymousDisabled   = "anonymous.disabled"
+	KeyAnonymousMaxSize    = "anonymous.max-size"
+	KeyAnonymousMaxTokens  = "anonymous.max-tokens"
+	KeyAnonymousCreateRate = "anonymous.create-rate"
+
+	KeyAuditLog        = "audit.log"
+	KeyAuditMaxSize    = "audit.max-size"
+	KeyAuditMaxBackups = "audit.max-backups"
+
+	KeyMigrateV3 = "migrate-v3"
+
+	KeyEmbeddedEtcd           = "embedded-etcd"
+	KeyEmbeddedDataDir        = "embedded.data-dir"
+	KeyEmbeddedClientURL      = "embedded.client-url"
+	KeyEmbeddedPeerURL        = "embedded.peer-url"
+	KeyEmbeddedSnapshotCount  = "embedded.snapshot-count"
+	KeyEmbeddedAutoCompaction = "embedded.auto-compaction"
+
+	KeyBoltPath      = "bolt.path"
+	KeyBoltClientURL = "bolt.client-url"
+
+	KeyMirrorUpstream     = "mirror.upstream"
+	KeyMirrorSyncInterval = "mirror.sync-interval"
+	KeyMirrorAPIKey       = "mirror.api-key"
+
+	KeyPeerCheckRejectLocal  = "peer-check.reject-local"
+	KeyPeerCheckAllowedCIDRs = "peer-check.allowed-cidrs"
+	KeyPeerCheckProbeTimeout = "peer-check.probe-timeout"
+)
+
+// namespaceKeys are the settings of each namespace, under
+// namespaces.<name>.
+var namespaceKeys = map[string]bool{
+	"prefix":    true,
+	"max-size":  true,
+	"token-ttl": true,
+}
+
+// reloadable lists the settings that may change while serving. Changes
+// to any other setting only take effect after a restart.
+var reloadable = map[string]bool{
+	KeyAllowedHosts:   true,
+	KeyTrustedProxies: true,
+	KeyAdminToken:     true,
+	KeyStallThreshold: true,
+	KeyLogLevel:       true,
+	KeyMaxSize:        true,
+	KeyTokenTTL:       true,
+
+	KeyAnonymousDisabled:   true,
+	KeyAnonymousMaxSize:    true,
+	KeyAnonymousMaxTokens:  true,
+	KeyAnonymousCreateRate: true,
+
+	KeyPeerCheckRejectLocal:  true,
+	KeyPeerCheckAllowedCIDRs: true,
+	KeyPeerCheckProbeTimeout: true,
+}
+
+// known lists every setting a config file may contain.
+var known = map[string]bool{
+	KeyConfig:         true,
+	KeyEtcd:           true,
+	KeyHost:           true,
+	KeyAllowedHosts:   true,
+	KeyTrustedProxies: true,
+	KeyAddr:           true,
+	KeyAdminToken:     true,
+	KeyStallThreshold: true,
+	KeyStatsInterval:  true,
+	KeyTraceEndpoint:  true,
+	KeyTraceFile:      true,
+	KeyLogLevel:       true,
+	KeyMaxSize:        true,
+	KeyRegistryPrefix: true,
+	KeyTokenTTL:       true,
+	KeyShards:         true,
+	KeyTenantPrefix:   true,
+
+	KeyAnonymousDisabled:   true,
+	KeyAnonymousMaxSize:    true,
+	KeyAnonymousMaxTokens:  true,
+	KeyAnonymousCreateRate: true,
+
+	KeyAuditLog:        true,
+	KeyAuditMaxSize:    true,
+	KeyAuditMaxBackups: true,
+
+	KeyMigrateV3: true,
+
+	KeyEmbeddedEtcd:           true,
+	KeyEmbeddedDataDir:        true,
+	KeyEmbeddedClientURL:      true,
+	KeyEmbeddedPeerURL:        true,
+	KeyEmbeddedSnapshotCount:  true,
+	KeyEmbeddedAutoCompaction: true,
+
+	KeyBoltPath:      true,
+	KeyBoltClientURL: true,
+
+	KeyMirrorUpstream:     true,
+	KeyMirrorSyncInterval: true,
+	KeyMirrorAPIKey:       true,
+
+	KeyPeerCheckRejectLocal:  true,
+	KeyPeerCheckAllowedCIDRs: true,
+	KeyPeerCheckProbeTimeout: true,
+}
+
+// isKnown reports whether a config file may contain key.
+func isKnown(key string) bool {
+	if known[key] {
+		return true
+	}
+	parts := strings.Split(key, ".")
+	if len(parts) == 2 && parts[0] == KeyShards {
+		return true
+	}
+	return len(parts) == 3 && parts[0] == KeyNamespaces && namespaceKeys[parts[2]]
+}
+
+// Load reads the configuration out of v, and validates it.
+func Load(v *viper.Viper) (Config, error) {
+	var unknown []string
+	for _, k := range v.AllKeys() {
+		if !isKnown(k) {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return Config{}, fmt.Errorf("unknown settings in %s: %s", v.ConfigFileUsed(), strings.Join(unknown, ", "))
+	}
+
+	var (
+		cfg Config
+		err error
+	)
+	if cfg.Etcd, err = cast.ToStringE(v.Get(KeyEtcd)); err != nil {
+		return cfg, settingError(KeyEtcd, err)
+	}
+	if cfg.Host, err = cast.ToStringE(v.Get(KeyHost)); err != nil {
+		return cfg, settingError(KeyHost, err)
+	}
+	if cfg.AllowedHosts, err = toStringList(v.Get(KeyAllowedHosts)); err != nil {
+		return cfg, settingError(KeyAllowedHosts, err)
+	}
+	if cfg.TrustedProxies, err = toStringList(v.Get(KeyTrustedProxies)); err != nil {
+		return cfg, settingError(KeyTrustedProxies, err)
+	}
+	if cfg.PeerCheck.RejectLocal, err = cast.ToBoolE(v.Get(KeyPeerCheckRejectLocal)); err != nil {
+		return cfg, settingError(KeyPeerCheckRejectLocal, err)
+	}
+	if cfg.PeerCheck.AllowedCIDRs, err = toStringList(v.Get(KeyPeerCheckAllowedCIDRs)); err != nil {
+		return cfg, settingError(KeyPeerCheckAllowedCIDRs, err)
+	}
+	if cfg.PeerCheck.ProbeTimeout, err = cast.ToDurationE(v.Get(KeyPeerCheckProbeTimeout)); err != nil {
+		return cfg, settingError(KeyPeerCheckProbeTimeout, err)
+	}
+	if cfg.Addr, err = cast.ToStringE(v.Get(KeyAddr)); err != nil {
+		return cfg, settingError(KeyAddr, err)
+	}
+	if cfg.AdminToken, err = cast.ToStringE(v.Get(KeyAdminToken)); err != nil {
+		return cfg, settingError(KeyAdminToken, err)
+	}
+	if cfg.StallThreshold, err = cast.ToDurationE(v.Get(KeyStallThreshold)); err != nil {
+		return cfg, settingError(KeyStallThreshold, err)
+	}
+	if cfg.StatsInterval, err = cast.ToDurationE(v.Get(KeyStatsInterval)); err != nil {
+		return cfg, settingError(KeyStatsInterval, err)
+	}
+	if cfg.TraceEndpoint, err = cast.ToStringE(v.Get(KeyTraceEndpoint)); err != nil {
+		return cfg, settingError(KeyTraceEndpoint, err)
+	}
+	if cfg.TraceFile, err = cast.ToStringE(v.Get(KeyTraceFile)); err != nil {
+		return cfg, settingError(KeyTraceFile, err)
+	}
+	if cfg.LogLevel, err = cast.ToStringE(v.Get(KeyLogLevel)); err != nil {
+		return cfg, settingError(KeyLogLevel, err)
+	}
+	if cfg.MaxSize, err = cast.ToIntE(v.Get(KeyMaxSize)); err != nil {
+		return cfg, settingError(KeyMaxSize, err)
+	}
+	if cfg.RegistryPrefix, err = cast.ToStringE(v.Get(KeyRegistryPrefix)); err != nil {
+		return cfg, settingError(KeyRegistryPrefix, err)
+	}
+	if cfg.TokenTTL, err = cast.ToDurationE(v.Get(KeyTokenTTL)); err != nil {
+		return cfg, settingError(KeyTokenTTL, err)
+	}
+	if cfg.Namespaces, err = loadNamespaces(v); err != nil {
+		return cfg, err
+	}
+	if cfg.Shards, err = loadShards(v); err != nil {
+		return cfg, err
+	}
+	if cfg.TenantPrefix, err = cast.ToStringE(v.Get(KeyTenantPrefix)); err != nil {
+		return cfg, settingError(KeyTenantPrefix, err)
+	}
+	if cfg.AnonymousDisabled, err = cast.ToBoolE(v.Get(KeyAnonymousDisabled)); err != nil {
+		return cfg, settingError(KeyAnonymousDisabled, err)
+	}
+	if cfg.Anonymous.MaxSize, err = cast.ToIntE(v.Get(KeyAnonymousMaxSize)); err != nil {
+		return cfg, settingError(KeyAnonymousMaxSize, err)
+	}
+	if cfg.Anonymous.MaxTokens, err = cast.ToIntE(v.Get(KeyAnonymousMaxTokens)); err != nil {
+		return cfg, settingError(KeyAnonymousMaxTokens, err)
+	}
+	if cfg.Anonymous.CreateRate, err = cast.ToIntE(v.Get(KeyAnonymousCreateRate)); err != nil {
+		return cfg, settingError(KeyAnonymousCreateRate, err)
+	}
+	if cfg.Embedded.Enabled, err = cast.ToBoolE(v.Get(KeyEmbeddedEtcd)); err != nil {
+		return cfg, settingError(KeyEmbeddedEtcd, err)
+	}
+	if cfg.Embedded.DataDir, err = cast.ToStringE(v.Get(KeyEmbeddedDataDir)); err != nil {
+		return cfg, settingError(KeyEmbeddedDataDir, err)
+	}
+	if cfg.Embedded.ClientURL, err = cast.ToStringE(v.Get(KeyEmbeddedClientURL)); err != nil {
+		return cfg, settingError(KeyEmbeddedClientURL, err)
+	}
+	if cfg.Embedded.PeerURL, err = cast.ToStringE(v.Get(KeyEmbeddedPeerURL)); err != nil {
+		return cfg, settingError(KeyEmbeddedPeerURL, err)
+	}
+	if cfg.Embedded.SnapshotCount, err = cast.ToIntE(v.Get(KeyEmbeddedSnapshotCount)); err != nil {
+		return cfg, settingError(KeyEmbeddedSnapshotCount, err)
+	}
+	if cfg.Embedded.AutoCompaction, err = cast.ToDurationE(v.Get(KeyEmbeddedAutoCompaction)); err != nil {
+		return cfg, settingError(KeyEmbeddedAutoCompaction, err)
+	}
+	if cfg.Bolt.Path, err = cast.ToStringE(v.Get(KeyBoltPath)); err != nil {
+		return cfg, settingError(KeyBoltPath, err)
+	}
+	if cfg.Bolt.ClientURL, err = cast.ToStringE(v.Get(KeyBoltClientURL)); err != nil {
+		return cfg, settingError(KeyBoltClientURL, err)
+	}
+	if cfg.Mirror.Upstream, err = cast.ToStringE(v.Get(KeyMirrorUpstream)); err != nil {
+		return cfg, settingError(KeyMirrorUpstream, err)
+	}
+	if cfg.Mirror.SyncInterval, err = cast.ToDurationE(v.Get(KeyMirrorSyncInterval)); err != nil {
+		return cfg, settingError(KeyMirrorSyncInterval, err)
+	}
+	if cfg.Mirror.APIKey, err = cast.ToStringE(v.Get(KeyMirrorAPIKey)); err != nil {
+		return cfg, settingError(KeyMirrorAPIKey, err)
+	}
+	if cfg.MigrateV3, err = cast.ToBoolE(v.Get(KeyMigrateV3)); err != nil {
+		return cfg, settingError(KeyMigrateV3, err)
+	}
+	if cfg.AuditLog, err = cast.ToStringE(v.Get(KeyAuditLog)); err != nil {
+		return cfg, settingError(KeyAuditLog, err)
+	}
+	if cfg.AuditMaxSize, err = cast.ToIntE(v.Get(KeyAuditMaxSize)); err != nil {
+		return cfg, settingError(KeyAuditMaxSize, err)
+	}
+	if cfg.AuditMaxBackups, err = cast.ToIntE(v.Get(KeyAuditMaxBackups)); err != nil {
+		return cfg, settingError(KeyAuditMaxBackups, err)
+	}
+	return cfg, cfg.Validate()
+}
+
+// loadShards reads the shards out of v, given as a shards section
+// mapping names to urls, or as a list of name=url pairs.
+func loadShards(v *viper.Viper) ([]Shard, error) {
+	urls := make(map[string]string)
+	switch val := v.Get(KeyShards).(type) {
+	case nil:
+	case string, []string, []interface{}:
+		list, err := toStringList(val)
+		if err != nil {
+			return nil, settingError(KeyShards, err)
+		}
+		for _, e := range list {
+			kv := strings.SplitN(e, "=", 2)
+			if len(kv) != 2 {
+				return nil, settingError(KeyShards, fmt.Errorf("Expected name=url (%s)", e))
+			}
+			urls[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	default:
+		m, err := cast.ToStringMapStringE(val)
+		if err != nil {
+			return nil, settingError(KeyShards, err)
+		}
+		urls = m
+	}
+	var shards []Shard
+	for name, u := range urls {
+		shards = append(shards, Shard{Name: name, URL: u})
+	}
+	return shards, nil
+}
+
+// loadNamespaces reads the namespaces.<name> sections out of v.
+func loadNamespaces(v *viper.Viper) ([]Namespace, error) {
+	var nss []Namespace
+	for name := range v.GetStringMap(KeyNamespaces) {
+		key := KeyNamespaces + "." + name
+		ns := Namespace{Name: name}
+		// settings left out of the section are zero
+		get := func(setting string, zero interface{}) interface{} {
+			if val := v.Get(key + "." + setting); val != nil {
+				return val
+			}
+			return zero
+		}
+
+		var err error
+		if ns.Prefix, err = cast.ToStringE(get("prefix", "")); err != nil {
+			return nil, settingError(key+".prefix", err)
+		}
+		if ns.MaxSize, err = cast.ToIntE(get("max-size", 0)); err != nil {
+			return nil, settingError(key+".max-size", err)
+		}
+		if ns.TokenTTL, err = cast.ToDurationE(get("token-ttl", time.Duration(0))); err != nil {
+			return nil, settingError(key+".token-ttl", err)
+		}
+		nss = append(nss, ns)
+	}
+	return nss, nil
+}
+
+// toStringList reads a list setting, given either as a list or as a
+// comma separated string such as an environment variable.
+func toStringList(v interface{}) ([]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return cast.ToStringSliceE(v)
+	}
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list, nil
+}
+
+// Reload returns the configuration to run with after cur was reloaded
+// as next: the reloadable settings are taken from next, everything
+// else is kept from cur. It also returns the keys of the settings
+// that changed but need a restart.
+func Reload(cur, next Config) (Config, []string) {
+	var restart []string
+	changed := func(key string, differs bool) {
+		if differs && !reloadable[key] {
+			restart = append(restart, key)
+		}
+	}
+	changed(KeyEtcd, cur.Etcd != next.Etcd)
+	changed(KeyHost, cur.Host != next.Host)
+	changed(KeyAddr, cur.Addr != next.Addr)
+	changed(KeyStatsInterval, cur.StatsInterval != next.StatsInterval)
+	changed(KeyTraceEndpoint, cur.TraceEndpoint != next.TraceEndpoint)
+	changed(KeyTraceFile, cur.TraceFile != next.TraceFile)
+	changed(KeyRegistryPrefix, cur.RegistryPrefix != next.RegistryPrefix)
+	changed(KeyTenantPrefix, cur.TenantPrefix != next.TenantPrefix)
+	changed(KeyNamespaces, !reflect.DeepEqual(cur.Namespaces, next.Namespaces))
+	changed(KeyShards, !reflect.DeepEqual(cur.Shards, next.Shards))
+	changed(KeyEmbeddedEtcd, cur.Embedded.Enabled != next.Embedded.Enabled)
+	changed(KeyEmbeddedDataDir, cur.Embedded.DataDir != next.Embedded.DataDir)
+	changed(KeyEmbeddedClientURL, cur.Embedded.ClientURL != next.Embedded.ClientURL)
+	changed(KeyEmbeddedPeerURL, cur.Embedded.PeerURL != next.Embedded.PeerURL)
+	changed(KeyEmbeddedSnapshotCount, cur.Embedded.SnapshotCount != next.Embedded.SnapshotCount)
+	changed(KeyEmbeddedAutoCompaction, cur.Embedded.AutoCompaction != next.Embedded.AutoCompaction)
+	changed(KeyBoltPath, cur.Bolt.Path != next.Bolt.Path)
+	changed(KeyBoltClientURL, cur.Bolt.ClientURL != next.Bolt.ClientURL)
+	changed(KeyMirrorUpstream, cur.Mirror.Upstream != next.Mirror.Upstream)
+	changed(KeyMirrorSyncInterval, cur.Mirror.SyncInterval != next.Mirror.SyncInterval)
+	changed(KeyMirrorAPIKey, cur.Mirror.APIKey != next.Mirror.APIKey)
+	changed(KeyMigrateV3, cur.MigrateV3 != next.MigrateV3)
+	changed(KeyAuditLog, cur.AuditLog != next.AuditLog)
+	changed(KeyAuditMaxSize, cur.AuditMaxSize != next.AuditMaxSize)
+	changed(KeyAuditMaxBackups, cur.AuditMaxBackups != next.AuditMaxBackups)
+
+	cur.AllowedHosts = next.AllowedHosts
+	cur.TrustedProxies = next.TrustedProxies
+	cur.PeerCheck = next.PeerCheck
+	cur.AdminToken = next.AdminToken
+	cur.StallThreshold = next.StallThreshold
+	cur.LogLevel = next.LogLevel
+	cur.MaxSize = next.MaxSize
+	cur.TokenTTL = next.TokenTTL
+	cur.AnonymousDisabled = next.AnonymousDisabled
+	cur.Anonymous = next.Anonymous
+	return cur, restart
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/coreos/discovery.etcd.io/audit"
+	"github.com/coreos/discovery.etcd.io/logging"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// Watch re-reads the config file of v whenever it changes on disk or
+// the process receives SIGHUP, until ctx is canceled. Every valid
+// configuration read is handed to apply; invalid ones are logged and
+// ignored, so a bad edit never takes the server down. Each reload is
+// audited.
+func Watch(ctx context.Context, v *viper.Viper, apply func(Config)) error {
+	file := filepath.Clean(v.ConfigFileUsed())
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// watch the directory to pick up editors that replace the file
+	if err = watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer watcher.Close()
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-watcher.Errors:
+				logging.Warnf("config watch error: %v", err)
+				continue
+			case ev := <-watcher.Events:
+				if filepath.Clean(ev.Name) != file || ev.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+			case <-hup:
+			}
+
+			cfg, err := reload(v)
+			if err != nil {
+				logging.Errorf("config reload failed: %v", err)
+				auditReload(file, err)
+				continue
+			}
+			apply(cfg)
+			auditReload(file, nil)
+		}
+	}()
+	return nil
+}
+
+// reload reads the config file of v again and loads it.
+func reload(v *viper.Viper) (Config, error) {
+	if err := v.ReadInConfig(); err != nil {
+		return Config{}, err
+	}
+	return Load(v)
+}
+
+// auditReload records a reload of file that failed with err, if not
+// nil.
+func auditReload(file string, err error) {
+	rec := audit.Record{Principal: audit.PrincipalLocal, Operation: "config.reload", Result: audit.ResultOK, Detail: file}
+	if err != nil {
+		rec.Result, rec.Detail = audit.ResultError, err.Error()
+	}
+	audit.Log(rec)
+}
@@ -5,10 +5,17 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
+	"strings"
 
+	"github.com/coreos/discovery.etcd.io/audit"
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/embedded"
+	"github.com/coreos/discovery.etcd.io/handlers"
 	handling "github.com/coreos/discovery.etcd.io/http"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/discovery.etcd.io/standalone"
+	"github.com/coreos/discovery.etcd.io/tracing"
 
 	"github.com/coreos/go-systemd/activation"
 	"github.com/spf13/pflag"
@@ -21,58 +28,191 @@ func fail(err string) {
 	os.Exit(2) // default go flag error code
 }
 
-func mustHostOnlyURL(givenUrl string) string {
-	u, err := url.Parse(givenUrl)
-
-	if err != nil {
-		fail(fmt.Sprintf("Invalid url given: %v", err))
+func setupTracing(cfg config.Config) {
+	switch {
+	case cfg.TraceEndpoint != "":
+		tracing.SetExporter(tracing.NewOTLPExporter(cfg.TraceEndpoint))
+	case cfg.TraceFile != "":
+		e, err := tracing.NewFileExporter(cfg.TraceFile)
+		if err != nil {
+			fail(fmt.Sprintf("Unable to open trace file: %v", err))
+		}
+		tracing.SetExporter(e)
 	}
+}
 
-	if len(u.Path) != 0 && u.Path != "/" {
-		fail(fmt.Sprintf("Expected url without path (%v)", u.Path))
+func setupAudit(cfg config.Config) {
+	switch cfg.AuditLog {
+	case "":
+		return
+	case "-":
+		audit.SetLogger(audit.NewLogger(os.Stdout))
+	default:
+		l, err := audit.NewFileLogger(cfg.AuditLog, int64(cfg.AuditMaxSize)<<20, cfg.AuditMaxBackups)
+		if err != nil {
+			fail(fmt.Sprintf("Unable to open audit log: %v", err))
+		}
+		audit.SetLogger(l)
 	}
+}
 
-	if u.RawQuery != "" {
-		fail(fmt.Sprintf("Expected url without query (?%v)", u.RawQuery))
+func setupEmbedded(cfg config.Config) {
+	if !cfg.Embedded.Enabled {
+		return
 	}
-
-	if u.Fragment != "" {
-		fail(fmt.Sprintf("Expected url without fragment (%v)", u.Fragment))
+	if _, err := embedded.Start(cfg.Embedded); err != nil {
+		fail(fmt.Sprintf("Unable to start embedded etcd: %v", err))
 	}
+	log.Printf("embedded etcd serving on %s with data in %s", cfg.Embedded.ClientURL, cfg.Embedded.DataDir)
+}
 
-	if u.Host == "" {
-		fail(fmt.Sprint("Expected hostname (none given)"))
+func setupBolt(cfg config.Config) {
+	if cfg.Bolt.Path == "" {
+		return
+	}
+	if _, err := standalone.Start(cfg.Bolt); err != nil {
+		fail(fmt.Sprintf("Unable to start bolt backend: %v", err))
 	}
+	log.Printf("bolt backend serving %s on %s", cfg.Bolt.Path, cfg.Bolt.ClientURL)
+}
+
+func setLogLevel(cfg config.Config) {
+	l, _ := logging.ParseLevel(cfg.LogLevel) // validated by config.Load
+	logging.SetLevel(l)
+}
 
-	return u.Scheme + "://" + u.Host
+// watchConfig applies the reloadable settings of the config file to st
+// whenever the file changes or the process receives SIGHUP.
+func watchConfig(st *handlers.State) {
+	err := config.Watch(context.Background(), viper.GetViper(), func(cfg config.Config) {
+		restart := st.Reload(cfg)
+		setLogLevel(cfg)
+		log.Printf("configuration reloaded from %s", viper.ConfigFileUsed())
+		if len(restart) > 0 {
+			log.Printf("changes to %s need a restart to take effect", strings.Join(restart, ", "))
+		}
+	})
+	if err != nil {
+		fail(fmt.Sprintf("Unable to watch config file: %v", err))
+	}
 }
 
 func init() {
 	viper.SetEnvPrefix("disc")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
 	viper.AutomaticEnv()
 
+	pflag.StringP("config", "c", "", "YAML, TOML or JSON config file")
 	pflag.StringP("etcd", "e", "http://127.0.0.1:2379", "etcd endpoint location")
 	pflag.StringP("host", "h", "https://discovery.etcd.io", "discovery url prefix")
 	pflag.StringP("addr", "a", ":8087", "web service address")
-
-	viper.BindPFlag("etcd", pflag.Lookup("etcd"))
-	viper.BindPFlag("host", pflag.Lookup("host"))
-	viper.BindPFlag("addr", pflag.Lookup("addr"))
+	pflag.StringSlice("allowed-hosts", nil, "discovery urls /new may derive token urls from, by request host")
+	pflag.StringSlice("trusted-proxies", nil, "networks of the proxies whose forwarded headers tell the client address")
+	pflag.Bool("peer-check-reject-local", false, "refuse member peer urls on loopback or link-local addresses")
+	pflag.StringSlice("peer-check-allowed-cidrs", nil, "networks member peer urls must be in (any when empty)")
+	pflag.Duration("peer-check-probe-timeout", 0, "how long to wait for member peer urls in the allowed networks to accept a connection at registration (0 to not connect)")
+	pflag.String("admin-token", "", "bearer token for the admin API (disabled when empty)")
+	pflag.Duration("stall-threshold", config.DefaultStallThreshold, "age after which a partially filled token counts as stalled")
+	pflag.Duration("stats-interval", config.DefaultStatsInterval, "how often the registry is scanned to refresh the token gauges")
+	pflag.String("trace-endpoint", "", "OTLP/HTTP collector url to export request spans to")
+	pflag.String("trace-file", "", "file to append request spans to as JSON lines")
+	pflag.String("log-level", "info", "minimum level of logged messages (debug, info, warn or error)")
+	pflag.Int("max-size", 0, "largest cluster size accepted by /new (0 for no limit)")
+	pflag.String("registry-prefix", config.DefaultRegistryPrefix, "etcd key prefix tokens are kept under")
+	pflag.Duration("token-ttl", 0, "how long new tokens live (0 to keep them forever)")
+	pflag.String("tenant-prefix", config.DefaultTenantPrefix, "etcd key prefix tenants and API keys are kept under")
+	pflag.Bool("anonymous-disabled", false, "require an API key to create tokens")
+	pflag.Int("anonymous-max-size", 0, "largest cluster size accepted without an API key (0 for no limit)")
+	pflag.Int("anonymous-max-tokens", 0, "live tokens allowed without an API key (0 for no limit)")
+	pflag.Int("anonymous-create-rate", 0, "tokens created per minute without an API key (0 for no limit)")
+	pflag.Bool("migrate-v3", false, "copy the registry to the etcd v3 keyspace and keep it in sync")
+	pflag.Bool("embedded-etcd", false, "run an etcd server in-process and use it instead of --etcd")
+	pflag.String("embedded-data-dir", config.DefaultEmbeddedDataDir, "directory the embedded etcd keeps its data in")
+	pflag.String("embedded-client-url", config.DefaultEmbeddedClientURL, "url the embedded etcd serves clients on")
+	pflag.String("embedded-peer-url", config.DefaultEmbeddedPeerURL, "url the embedded etcd serves peers on")
+	pflag.Int("embedded-snapshot-count", config.DefaultEmbeddedSnapshotCount, "committed transactions that trigger a snapshot of the embedded etcd (0 for the etcd default)")
+	pflag.Duration("embedded-auto-compaction", config.DefaultEmbeddedAutoCompaction, "revision history the embedded etcd keeps (0 to never compact)")
+	pflag.String("bolt-path", "", "bbolt file to keep the registry in instead of etcd")
+	pflag.String("bolt-client-url", config.DefaultBoltClientURL, "url the bolt backend serves the etcd v2 keys API on")
+	pflag.String("mirror-upstream", "", "upstream discovery url to forward tokens of the default namespace to, caching them in etcd")
+	pflag.Duration("mirror-sync-interval", config.DefaultMirrorSyncInterval, "how often a mirror refreshes its cached tokens from the upstream")
+	pflag.String("mirror-api-key", "", "upstream API key a mirror creates and resets tokens with")
+	pflag.StringSlice("shards", nil, "more etcd clusters to spread tokens across, as name=url pairs")
+	pflag.String("audit-log", "", "file to append the audit log of mutating operations to (- for stdout)")
+	pflag.Int("audit-max-size", config.DefaultAuditMaxSize, "megabytes the audit log grows to before it is rotated (0 to never rotate)")
+	pflag.Int("audit-max-backups", config.DefaultAuditMaxBackups, "rotated audit logs to keep")
+
+	viper.BindPFlag(config.KeyConfig, pflag.Lookup("config"))
+	viper.BindPFlag(config.KeyEtcd, pflag.Lookup("etcd"))
+	viper.BindPFlag(config.KeyHost, pflag.Lookup("host"))
+	viper.BindPFlag(config.KeyAllowedHosts, pflag.Lookup("allowed-hosts"))
+	viper.BindPFlag(config.KeyTrustedProxies, pflag.Lookup("trusted-proxies"))
+	viper.BindPFlag(config.KeyPeerCheckRejectLocal, pflag.Lookup("peer-check-reject-local"))
+	viper.BindPFlag(config.KeyPeerCheckAllowedCIDRs, pflag.Lookup("peer-check-allowed-cidrs"))
+	viper.BindPFlag(config.KeyPeerCheckProbeTimeout, pflag.Lookup("peer-check-probe-timeout"))
+	viper.BindPFlag(config.KeyAddr, pflag.Lookup("addr"))
+	viper.BindPFlag(config.KeyAdminToken, pflag.Lookup("admin-token"))
+	viper.BindPFlag(config.KeyStallThreshold, pflag.Lookup("stall-threshold"))
+	viper.BindPFlag(config.KeyStatsInterval, pflag.Lookup("stats-interval"))
+	viper.BindPFlag(config.KeyTraceEndpoint, pflag.Lookup("trace-endpoint"))
+	viper.BindPFlag(config.KeyTraceFile, pflag.Lookup("trace-file"))
+	viper.BindPFlag(config.KeyLogLevel, pflag.Lookup("log-level"))
+	viper.BindPFlag(config.KeyMaxSize, pflag.Lookup("max-size"))
+	viper.BindPFlag(config.KeyRegistryPrefix, pflag.Lookup("registry-prefix"))
+	viper.BindPFlag(config.KeyTokenTTL, pflag.Lookup("token-ttl"))
+	viper.BindPFlag(config.KeyTenantPrefix, pflag.Lookup("tenant-prefix"))
+	viper.BindPFlag(config.KeyAnonymousDisabled, pflag.Lookup("anonymous-disabled"))
+	viper.BindPFlag(config.KeyAnonymousMaxSize, pflag.Lookup("anonymous-max-size"))
+	viper.BindPFlag(config.KeyAnonymousMaxTokens, pflag.Lookup("anonymous-max-tokens"))
+	viper.BindPFlag(config.KeyAnonymousCreateRate, pflag.Lookup("anonymous-create-rate"))
+	viper.BindPFlag(config.KeyMigrateV3, pflag.Lookup("migrate-v3"))
+	viper.BindPFlag(config.KeyEmbeddedEtcd, pflag.Lookup("embedded-etcd"))
+	viper.BindPFlag(config.KeyEmbeddedDataDir, pflag.Lookup("embedded-data-dir"))
+	viper.BindPFlag(config.KeyEmbeddedClientURL, pflag.Lookup("embedded-client-url"))
+	viper.BindPFlag(config.KeyEmbeddedPeerURL, pflag.Lookup("embedded-peer-url"))
+	viper.BindPFlag(config.KeyEmbeddedSnapshotCount, pflag.Lookup("embedded-snapshot-count"))
+	viper.BindPFlag(config.KeyEmbeddedAutoCompaction, pflag.Lookup("embedded-auto-compaction"))
+	viper.BindPFlag(config.KeyBoltPath, pflag.Lookup("bolt-path"))
+	viper.BindPFlag(config.KeyBoltClientURL, pflag.Lookup("bolt-client-url"))
+	viper.BindPFlag(config.KeyMirrorUpstream, pflag.Lookup("mirror-upstream"))
+	viper.BindPFlag(config.KeyMirrorSyncInterval, pflag.Lookup("mirror-sync-interval"))
+	viper.BindPFlag(config.KeyMirrorAPIKey, pflag.Lookup("mirror-api-key"))
+	viper.BindPFlag(config.KeyShards, pflag.Lookup("shards"))
+	viper.BindPFlag(config.KeyAuditLog, pflag.Lookup("audit-log"))
+	viper.BindPFlag(config.KeyAuditMaxSize, pflag.Lookup("audit-max-size"))
+	viper.BindPFlag(config.KeyAuditMaxBackups, pflag.Lookup("audit-max-backups"))
 
 	pflag.Parse()
 }
 
 func main() {
 	log.SetFlags(0)
-	etcdHost := mustHostOnlyURL(viper.GetString("etcd"))
-	discHost := mustHostOnlyURL(viper.GetString("host"))
-	webAddr := viper.GetString("addr")
 
-	handling.Setup(context.Background(), etcdHost, discHost)
+	configFile := viper.GetString(config.KeyConfig)
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+		if err := viper.ReadInConfig(); err != nil {
+			fail(fmt.Sprintf("Unable to read config file: %v", err))
+		}
+	}
+	cfg, err := config.Load(viper.GetViper())
+	if err != nil {
+		fail(err.Error())
+	}
+
+	setLogLevel(cfg)
+	setupTracing(cfg)
+	setupAudit(cfg)
+	setupEmbedded(cfg)
+	setupBolt(cfg)
+	st := handling.Setup(context.Background(), cfg)
+	if configFile != "" {
+		watchConfig(st)
+	}
 
-	log.Printf("discovery server started with etcd %q and host %q", etcdHost, discHost)
-	log.Printf("discovery serving on %s", webAddr)
-	err := http.ListenAndServe(webAddr, nil)
+	log.Printf("discovery server started with etcd %q and host %q", cfg.Etcd, cfg.Host)
+	log.Printf("discovery serving on %s", cfg.Addr)
+	err = http.ListenAndServe(cfg.Addr, nil)
 	if err != nil {
 		panic(err)
 	}
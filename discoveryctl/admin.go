@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/spf13/pflag"
+)
+
+func init() {
+	var listNamespace string
+	var listAll bool
+	register(&command{
+		name:  "list",
+		short: "list the tokens in the registry (admin)",
+		flags: func(fs *pflag.FlagSet) {
+			fs.StringVar(&listNamespace, "namespace", "", "only list tokens of this namespace")
+			fs.BoolVar(&listAll, "all", false, "list tokens of every namespace")
+		},
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 0, "no arguments"); err != nil {
+				return err
+			}
+			all, err := c.Tokens(ctx)
+			if err != nil {
+				return err
+			}
+			ts := []client.TokenInfo{}
+			for _, t := range all {
+				if listAll || t.Namespace == listNamespace {
+					ts = append(ts, t)
+				}
+			}
+			if *output == "json" {
+				return printJSON(ts)
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(tw, "NAMESPACE\tTOKEN\tTENANT\tMEMBERS\tCREATED\tLABELS")
+			for _, t := range ts {
+				ns := t.Namespace
+				if ns == "" {
+					ns = "-"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%d/%d\t%s\t%s\n", ns, t.Token, t.Tenant, t.Members, t.Size, timeString(t.Created), labelString(t.Labels))
+			}
+			return tw.Flush()
+		},
+	})
+
+	var deleteNamespace string
+	register(&command{
+		name:  "delete",
+		args:  "<token>",
+		short: "delete a token with all its members (admin)",
+		flags: func(fs *pflag.FlagSet) {
+			fs.StringVar(&deleteNamespace, "namespace", "", "namespace of the token")
+		},
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 1, "a token"); err != nil {
+				return err
+			}
+			return c.DeleteToken(ctx, deleteNamespace, args[0])
+		},
+	})
+
+	var importNamespace string
+	var importTTL time.Duration
+	register(&command{
+		name:  "import-cluster",
+		args:  "<initial-cluster>",
+		short: "create a token with the members of an --initial-cluster registered (admin)",
+		flags: func(fs *pflag.FlagSet) {
+			fs.StringVar(&importNamespace, "namespace", "", "namespace of the token")
+			fs.DurationVar(&importTTL, "ttl", 0, "how long the token lives, the default of the namespace if 0")
+		},
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 1, "an initial cluster"); err != nil {
+				return err
+			}
+			t, err := c.CreateStatic(ctx, importNamespace, args[0], importTTL)
+			if err != nil {
+				return err
+			}
+			if *output == "json" {
+				return printJSON(t)
+			}
+			fmt.Println(t.URL)
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(tw, "ID\tNAME\tPEER URLS")
+			for _, m := range t.Members {
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", m.ID, m.Name, strings.Join(m.PeerURLs, ","))
+			}
+			return tw.Flush()
+		},
+	})
+
+	register(&command{
+		name:  "stats",
+		short: "show bootstrap statistics (admin)",
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 0, "no arguments"); err != nil {
+				return err
+			}
+			s, err := c.Stats(ctx)
+			if err != nil {
+				return err
+			}
+			if *output == "json" {
+				return printJSON(s)
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintf(tw, "live\t%d\n", s.Live)
+			fmt.Fprintf(tw, "completed\t%d\n", s.Completed)
+			fmt.Fprintf(tw, "stalled\t%d\n", s.Stalled)
+			fmt.Fprintf(tw, "first member\t%s\n", durationsString(s.FirstMember))
+			fmt.Fprintf(tw, "complete\t%s\n", durationsString(s.Complete))
+			for _, k := range sortedKeys(s.Sizes) {
+				fmt.Fprintf(tw, "size %s\t%d\n", k, s.Sizes[k])
+			}
+			for _, k := range sortedKeys(s.Namespaces) {
+				fmt.Fprintf(tw, "namespace %s\t%d\n", k, s.Namespaces[k])
+			}
+			for _, k := range sortedKeys(s.Tenants) {
+				fmt.Fprintf(tw, "tenant %s\t%d\n", k, s.Tenants[k])
+			}
+			return tw.Flush()
+		},
+	})
+}
+
+func init() {
+	var exportNamespace string
+	var exportFlags *pflag.FlagSet
+	register(&command{
+		name:  "export",
+		args:  "[file]",
+		short: "export the tenants and tokens to a file or stdout (admin)",
+		flags: func(fs *pflag.FlagSet) {
+			fs.StringVar(&exportNamespace, "namespace", "", "only export tokens of this namespace")
+			exportFlags = fs
+		},
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("expected at most a file, got %d arguments", len(args))
+			}
+			var namespace *string
+			if exportFlags.Changed("namespace") {
+				namespace = &exportNamespace
+			}
+			if len(args) == 0 || args[0] == "-" {
+				return c.Export(ctx, os.Stdout, namespace)
+			}
+			f, err := os.Create(args[0])
+			if err != nil {
+				return err
+			}
+			if err := c.Export(ctx, f, namespace); err != nil {
+				f.Close()
+				os.Remove(args[0])
+				return err
+			}
+			return f.Close()
+		},
+	})
+
+	var dryRun bool
+	register(&command{
+		name:  "import",
+		args:  "<file>",
+		short: "import an export, - for stdin (admin)",
+		flags: func(fs *pflag.FlagSet) {
+			fs.BoolVar(&dryRun, "dry-run", false, "only check the export and report what would be imported")
+		},
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 1, "a file"); err != nil {
+				return err
+			}
+			in := os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in = f
+			}
+			report, err := c.Import(ctx, in, dryRun)
+			if err != nil {
+				return err
+			}
+			if *output == "json" {
+				return printJSON(report)
+			}
+			verb := "imported"
+			if report.DryRun {
+				verb = "would import"
+			}
+			fmt.Printf("%s %d tenants, %d tokens and %d members\n", verb, report.Tenants, report.Tokens, report.Members)
+			for _, s := range report.Skipped {
+				fmt.Printf("skipped %s\n", s)
+			}
+			return nil
+		},
+	})
+}
+
+func init() {
+	var sync bool
+	register(&command{
+		name:  "migration",
+		short: "show the progress of the migration to etcd v3 (admin)",
+		flags: func(fs *pflag.FlagSet) {
+			fs.BoolVar(&sync, "sync", false, "copy and verify the whole registry first")
+		},
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 0, "no arguments"); err != nil {
+				return err
+			}
+			status := c.Migration
+			if sync {
+				status = c.SyncMigration
+			}
+			s, err := status(ctx)
+			if err != nil {
+				return err
+			}
+			if *output == "json" {
+				if err := printJSON(s); err != nil {
+					return err
+				}
+			} else {
+				tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintf(tw, "phase\t%s\n", s.Phase)
+				fmt.Fprintf(tw, "rounds\t%d\n", s.Rounds)
+				fmt.Fprintf(tw, "synced tokens\t%d\n", s.SyncedTokens)
+				fmt.Fprintf(tw, "written keys\t%d\n", s.WrittenKeys)
+				if s.LastError != "" {
+					fmt.Fprintf(tw, "last error\t%s\n", s.LastError)
+				}
+				if r := s.Report; r != nil {
+					fmt.Fprintf(tw, "verified\t%s, %d tokens, %d keys\n", timeString(r.Time), r.Tokens, r.Keys)
+					for _, k := range r.Missing {
+						fmt.Fprintf(tw, "missing\t%s\n", k)
+					}
+					for _, k := range r.Extra {
+						fmt.Fprintf(tw, "extra\t%s\n", k)
+					}
+					for _, k := range r.Mismatched {
+						fmt.Fprintf(tw, "mismatched\t%s\n", k)
+					}
+					for _, k := range r.Pending {
+						fmt.Fprintf(tw, "pending\t%s\n", k)
+					}
+				}
+				if err := tw.Flush(); err != nil {
+					return err
+				}
+			}
+			if s.Phase == "out-of-sync" {
+				return fmt.Errorf("the v3 copy is out of sync")
+			}
+			return nil
+		},
+	})
+}
+
+func init() {
+	register(&command{
+		name:  "shards",
+		short: "show the health and tokens of every shard (admin)",
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 0, "no arguments"); err != nil {
+				return err
+			}
+			s, err := c.Shards(ctx)
+			if err != nil {
+				return err
+			}
+			if *output == "json" {
+				return printJSON(s)
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(tw, "SHARD\tENDPOINT\tHEALTHY\tTOKENS\tMISPLACED")
+			for _, sh := range s.Shards {
+				healthy := "yes"
+				if !sh.Healthy {
+					healthy = "no: " + sh.Error
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\n", sh.Name, sh.Endpoint, healthy, sh.Tokens, sh.Misplaced)
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			if s.Rebalance {
+				fmt.Println("the shards changed, run rebalance to move the tokens")
+			}
+			return nil
+		},
+	})
+
+	var dryRun bool
+	register(&command{
+		name:  "rebalance",
+		short: "move tokens to the shards they belong on (admin)",
+		flags: func(fs *pflag.FlagSet) {
+			fs.BoolVar(&dryRun, "dry-run", false, "only report which tokens would move")
+		},
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 0, "no arguments"); err != nil {
+				return err
+			}
+			report, err := c.Rebalance(ctx, dryRun)
+			if err != nil {
+				return err
+			}
+			if *output == "json" {
+				return printJSON(report)
+			}
+			verb := "moved"
+			if report.DryRun {
+				verb = "would move"
+			}
+			for _, t := range report.Moved {
+				fmt.Printf("%s %s from %s to %s\n", verb, t.Token, t.From, t.To)
+			}
+			fmt.Printf("%s %d tokens\n", verb, len(report.Moved))
+			if len(report.Skipped) > 0 {
+				fmt.Printf("skipped %d tokens members may still be waiting on, rebalance again later\n", len(report.Skipped))
+			}
+			return nil
+		},
+	})
+}
+
+func durationsString(d client.Durations) string {
+	if d.Count == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d tokens, p50 %.0fs, p90 %.0fs, max %.0fs", d.Count, d.P50, d.P90, d.Max)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/coreos/discovery.etcd.io/audit"
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/spf13/pflag"
+)
+
+func init() {
+	var prevHash string
+	register(&command{
+		name:  "audit-verify",
+		args:  "<file>...",
+		short: "check the hash chain of audit logs, given oldest first",
+		flags: func(fs *pflag.FlagSet) {
+			fs.StringVar(&prevHash, "prev-hash", "", "hash of the record the first log follows")
+		},
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("expected audit log files, got none")
+			}
+			result := struct {
+				Records  int    `json:"records"`
+				LastHash string `json:"lastHash"`
+			}{LastHash: prevHash}
+			for _, name := range args {
+				f, err := os.Open(name)
+				if err != nil {
+					return err
+				}
+				var n int
+				result.LastHash, n, err = audit.Verify(f, result.LastHash)
+				f.Close()
+				result.Records += n
+				if err != nil {
+					return fmt.Errorf("%s: %v", name, err)
+				}
+			}
+			if *output == "json" {
+				return printJSON(result)
+			}
+			fmt.Printf("verified %d records, last hash %s\n", result.Records, result.LastHash)
+			return nil
+		},
+	})
+}
@@ -0,0 +1,177 @@
+// discoveryctl is a command line client of the discovery service.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/spf13/pflag"
+)
+
+// command is a discoveryctl subcommand.
+type command struct {
+	name  string
+	args  string
+	short string
+	flags func(fs *pflag.FlagSet)
+	run   func(ctx context.Context, c *client.Client, args []string) error
+}
+
+var commands []*command
+
+func register(cmd *command) {
+	commands = append(commands, cmd)
+}
+
+var (
+	globals = pflag.NewFlagSet("discoveryctl", pflag.ContinueOnError)
+
+	endpoint   = globals.String("endpoint", envOr("DISCOVERY_ENDPOINT", client.DefaultEndpoint), "discovery service url")
+	apiKey     = globals.String("api-key", os.Getenv("DISCOVERY_API_KEY"), "API key tokens are created with")
+	adminToken = globals.String("admin-token", os.Getenv("DISCOVERY_ADMIN_TOKEN"), "bearer token of the admin API")
+	timeout    = globals.Duration("timeout", 0, "give up after this long (0 for never)")
+	output     = globals.StringP("output", "o", "table", "output format, table or json")
+)
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: discoveryctl [flags] <command> [command flags] [args]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.short)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n%s", globals.FlagUsages())
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "discoveryctl: %v\n", err)
+	os.Exit(1)
+}
+
+func main() {
+	globals.SetInterspersed(false)
+	globals.Usage = usage
+	if err := globals.Parse(os.Args[1:]); err != nil {
+		if err == pflag.ErrHelp {
+			return
+		}
+		os.Exit(2)
+	}
+	if globals.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var cmd *command
+	for _, c := range commands {
+		if c.name == globals.Arg(0) {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		fail(fmt.Errorf("unknown command %q", globals.Arg(0)))
+	}
+
+	fs := pflag.NewFlagSet(cmd.name, pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: discoveryctl %s [flags] %s\n\n%s\n", cmd.name, cmd.args, cmd.short)
+		if fs.HasFlags() {
+			fmt.Fprintf(os.Stderr, "\nFlags:\n%s", fs.FlagUsages())
+		}
+	}
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	if err := fs.Parse(globals.Args()[1:]); err != nil {
+		if err == pflag.ErrHelp {
+			return
+		}
+		os.Exit(2)
+	}
+	if *output != "table" && *output != "json" {
+		fail(fmt.Errorf("unknown output format %q", *output))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		cancel()
+	}()
+
+	c := &client.Client{Endpoint: *endpoint, APIKey: *apiKey, AdminToken: *adminToken}
+	if err := cmd.run(ctx, c, fs.Args()); err != nil {
+		fail(err)
+	}
+}
+
+// tokenURL returns the discovery url of a token given either as an
+// url or as a bare token of the configured endpoint.
+func tokenURL(arg string) string {
+	if strings.Contains(arg, "/") {
+		return arg
+	}
+	return strings.TrimRight(*endpoint, "/") + "/" + arg
+}
+
+// exactArgs fails unless n arguments were given.
+func exactArgs(args []string, n int, names string) error {
+	if len(args) != n {
+		return fmt.Errorf("expected %s, got %d arguments", names, len(args))
+	}
+	return nil
+}
+
+// printJSON writes v as indented JSON.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// labelString formats labels as sorted key=value pairs.
+func labelString(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// timeString formats t for tables, "-" if it is zero.
+func timeString(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/spf13/pflag"
+)
+
+func init() {
+	var (
+		newOpts client.CreateOptions
+		labels  []string
+	)
+	register(&command{
+		name:  "new",
+		short: "create a token and print its discovery url",
+		flags: func(fs *pflag.FlagSet) {
+			fs.IntVar(&newOpts.Size, "size", 0, "cluster size (service default if 0)")
+			fs.DurationVar(&newOpts.TTL, "ttl", 0, "how long the token lives (namespace default if 0)")
+			fs.StringArrayVar(&labels, "label", nil, "key=value label of the token, may be repeated")
+			fs.StringVar(&newOpts.Namespace, "namespace", "", "namespace to create the token in")
+			fs.StringArrayVar(&newOpts.Expect, "expect", nil, "name or name=host of a member expected to register, may be repeated")
+			fs.StringVar(&newOpts.ExpectPattern, "expect-pattern", "", "regular expression the names of other members must match")
+		},
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 0, "no arguments"); err != nil {
+				return err
+			}
+			var err error
+			if newOpts.Labels, err = parsePairs(labels, "label"); err != nil {
+				return err
+			}
+			u, err := c.Create(ctx, newOpts)
+			if err != nil {
+				return err
+			}
+			fmt.Println(u)
+			return nil
+		},
+	})
+
+	var filters []string
+	register(&command{
+		name:  "get",
+		args:  "<token>",
+		short: "show the members of a token with their metadata",
+		flags: func(fs *pflag.FlagSet) {
+			fs.StringArrayVar(&filters, "filter", nil, "key=value metadata the members must have, may be repeated")
+		},
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 1, "a token"); err != nil {
+				return err
+			}
+			want, err := parsePairs(filters, "filter")
+			if err != nil {
+				return err
+			}
+			s, err := c.Summary(ctx, tokenURL(args[0]))
+			if err != nil {
+				return err
+			}
+			var ms []client.Member
+			for _, m := range append(s.Quorum, s.Overflow...) {
+				if matchMetadata(m.Metadata, want) {
+					ms = append(ms, m)
+				}
+			}
+			return printMembers(ms)
+		},
+	})
+
+	register(&command{
+		name:  "watch",
+		args:  "<token>",
+		short: "print changes to the members of a token as they happen",
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 1, "a token"); err != nil {
+				return err
+			}
+			u := tokenURL(args[0])
+			_, index, err := c.Members(ctx, u)
+			if err != nil {
+				return err
+			}
+			for {
+				ev, err := c.Watch(ctx, u, index)
+				if err != nil {
+					if ctx.Err() != nil {
+						return nil
+					}
+					if e, ok := err.(*client.Error); ok && e.Code != 0 {
+						// the watched index is gone, start over from now
+						if _, index, err = c.Members(ctx, u); err != nil {
+							return err
+						}
+						continue
+					}
+					return err
+				}
+				index = ev.Index
+				if *output == "json" {
+					printJSON(ev)
+					continue
+				}
+				fmt.Printf("%s\t%s\t%s\t%s\n", ev.Action, ev.Member.ID, ev.Member.Name, strings.Join(ev.Member.PeerURLs, ","))
+			}
+		},
+	})
+
+	var id, name string
+	var peerURLs, meta []string
+	register(&command{
+		name:  "register",
+		args:  "<token>",
+		short: "register a member with a token",
+		flags: func(fs *pflag.FlagSet) {
+			fs.StringVar(&id, "id", "", "member id (required)")
+			fs.StringVar(&name, "name", "", "member name (required)")
+			fs.StringSliceVar(&peerURLs, "peer-urls", nil, "member peer urls (required)")
+			fs.StringArrayVar(&meta, "meta", nil, "key=value metadata of the member, such as zone=us-east-1a, may be repeated")
+		},
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 1, "a token"); err != nil {
+				return err
+			}
+			if id == "" || name == "" || len(peerURLs) == 0 {
+				return fmt.Errorf("--id, --name and --peer-urls are required")
+			}
+			md, err := parsePairs(meta, "metadata")
+			if err != nil {
+				return err
+			}
+			m, err := c.Register(ctx, tokenURL(args[0]), client.Member{ID: id, Name: name, PeerURLs: peerURLs, Metadata: md})
+			if err != nil {
+				return err
+			}
+			return printMembers([]client.Member{m})
+		},
+	})
+
+	register(&command{
+		name:  "unregister",
+		args:  "<token> <id>",
+		short: "remove a member from a token",
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 2, "a token and a member id"); err != nil {
+				return err
+			}
+			return c.Unregister(ctx, tokenURL(args[0]), args[1])
+		},
+	})
+
+	register(&command{
+		name:  "wait",
+		args:  "<token>",
+		short: "wait until a token is full, then show its cluster members",
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 1, "a token"); err != nil {
+				return err
+			}
+			ms, err := c.WaitFull(ctx, tokenURL(args[0]))
+			if err != nil {
+				return err
+			}
+			return printMembers(ms)
+		},
+	})
+
+	var wait bool
+	register(&command{
+		name:  "initial-cluster",
+		args:  "<token>",
+		short: "print the --initial-cluster flag value of a full token",
+		flags: func(fs *pflag.FlagSet) {
+			fs.BoolVar(&wait, "wait", false, "wait for the token to be full")
+		},
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 1, "a token"); err != nil {
+				return err
+			}
+			u := tokenURL(args[0])
+			if wait {
+				ms, err := c.WaitFull(ctx, u)
+				if err != nil {
+					return err
+				}
+				fmt.Println(client.InitialCluster(ms))
+				return nil
+			}
+
+			bc, err := c.BootstrapConfig(ctx, u)
+			if err != nil {
+				if client.IsIncomplete(err) {
+					return fmt.Errorf("%v, use --wait to wait for the rest", err)
+				}
+				return err
+			}
+			if *output == "json" {
+				return printJSON(bc)
+			}
+			fmt.Println(bc.InitialCluster)
+			return nil
+		},
+	})
+
+	register(&command{
+		name:  "history",
+		args:  "<token>",
+		short: "show what happened to a token",
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 1, "a token"); err != nil {
+				return err
+			}
+			events, err := c.History(ctx, tokenURL(args[0]))
+			if err != nil {
+				return err
+			}
+			if *output == "json" {
+				return printJSON(events)
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(tw, "TIME\tEVENT\tBY\tDETAILS")
+			for _, ev := range events {
+				by := strings.TrimSpace(ev.Actor + " " + ev.ClientIP)
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", timeString(ev.Time), ev.Type, by, eventDetails(ev))
+			}
+			return tw.Flush()
+		},
+	})
+
+	var resetSize int
+	register(&command{
+		name:  "reset",
+		args:  "<token>",
+		short: "remove the members of a token to retry a failed bootstrap",
+		flags: func(fs *pflag.FlagSet) {
+			fs.IntVar(&resetSize, "size", 0, "new cluster size (unchanged if 0)")
+		},
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 1, "a token"); err != nil {
+				return err
+			}
+			removed, err := c.Reset(ctx, tokenURL(args[0]), resetSize)
+			if err != nil {
+				return err
+			}
+			if *output == "json" {
+				if removed == nil {
+					removed = []string{}
+				}
+				return printJSON(removed)
+			}
+			fmt.Printf("removed %d members\n", len(removed))
+			return nil
+		},
+	})
+
+	var probe bool
+	var probeTimeout time.Duration
+	register(&command{
+		name:  "diagnose",
+		args:  "<token>",
+		short: "check the registrations of a token for problems, failing on errors",
+		flags: func(fs *pflag.FlagSet) {
+			fs.BoolVar(&probe, "probe", false, "have the service dial the peer urls of the members")
+			fs.DurationVar(&probeTimeout, "probe-timeout", 2*time.Second, "how long to dial each peer url")
+		},
+		run: func(ctx context.Context, c *client.Client, args []string) error {
+			if err := exactArgs(args, 1, "a token"); err != nil {
+				return err
+			}
+			if !probe {
+				probeTimeout = 0
+			}
+			d, err := c.Diagnose(ctx, tokenURL(args[0]), probeTimeout)
+			if err != nil {
+				return err
+			}
+			if *output == "json" {
+				if err := printJSON(d); err != nil {
+					return err
+				}
+			} else if len(d.Findings) == 0 {
+				fmt.Println("no problems found")
+			} else {
+				tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(tw, "SEVERITY\tCHECK\tMEMBERS\tMESSAGE")
+				for _, f := range d.Findings {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", f.Severity, f.Check, strings.Join(f.Members, ","), f.Message)
+				}
+				if err := tw.Flush(); err != nil {
+					return err
+				}
+			}
+
+			errs := 0
+			for _, f := range d.Findings {
+				if f.Severity == "error" {
+					errs++
+				}
+			}
+			if errs > 0 {
+				return fmt.Errorf("%d errors found", errs)
+			}
+			return nil
+		},
+	})
+}
+
+// eventDetails summarizes what a history event is about.
+func eventDetails(ev client.HistoryEvent) string {
+	var details []string
+	if ev.Member != "" {
+		details = append(details, "member "+ev.Member)
+	}
+	if len(ev.PeerURLs) > 0 {
+		details = append(details, strings.Join(ev.PeerURLs, ","))
+	}
+	if ev.Status != 0 {
+		details = append(details, fmt.Sprintf("status %d: %s", ev.Status, ev.Reason))
+	}
+	if ev.PrevSize != 0 {
+		details = append(details, fmt.Sprintf("size %d -> %d", ev.PrevSize, ev.Size))
+	} else if ev.Size != 0 {
+		details = append(details, fmt.Sprintf("size %d", ev.Size))
+	}
+	if len(ev.Removed) > 0 {
+		details = append(details, "removed "+strings.Join(ev.Removed, ","))
+	}
+	return strings.Join(details, ", ")
+}
+
+// printMembers shows members in the configured output format.
+func printMembers(ms []client.Member) error {
+	if *output == "json" {
+		if ms == nil {
+			ms = []client.Member{}
+		}
+		return printJSON(ms)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tPEER URLS\tQUORUM\tMETADATA")
+	for _, m := range ms {
+		quorum := "-"
+		if m.Quorum != nil && *m.Quorum {
+			quorum = "yes"
+		} else if m.Quorum != nil {
+			quorum = "overflow"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", m.ID, m.Name, strings.Join(m.PeerURLs, ","), quorum, labelString(m.Metadata))
+	}
+	return tw.Flush()
+}
+
+// parsePairs reads key=value flag values, named what in errors.
+func parsePairs(pairs []string, what string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected %s as key=value, got %q", what, p)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
+// matchMetadata reports whether md has every key=value of want.
+func matchMetadata(md, want map[string]string) bool {
+	for k, v := range want {
+		if md[k] != v {
+			return false
+		}
+	}
+	return true
+}
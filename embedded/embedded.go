@@ -0,0 +1,63 @@
+// Package embedded runs a single member etcd server inside the discovery
+// service, so that it can be deployed as one binary.
+package embedded
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/config"
+
+	"github.com/coreos/etcd/compactor"
+	"github.com/coreos/etcd/embed"
+)
+
+// name is the member name of the embedded server.
+const name = "discovery"
+
+// startTimeout is how long Start waits for the server to be ready.
+const startTimeout = time.Minute
+
+// Start starts the etcd server configured by cfg and waits until it
+// serves clients. Data already in cfg.DataDir is picked up again.
+func Start(cfg config.EmbeddedEtcd) (*embed.Etcd, error) {
+	curl, err := url.Parse(cfg.ClientURL)
+	if err != nil {
+		return nil, err
+	}
+	purl, err := url.Parse(cfg.PeerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	ecfg := embed.NewConfig()
+	ecfg.Name = name
+	ecfg.Dir = cfg.DataDir
+	ecfg.LCUrls, ecfg.ACUrls = []url.URL{*curl}, []url.URL{*curl}
+	ecfg.LPUrls, ecfg.APUrls = []url.URL{*purl}, []url.URL{*purl}
+	ecfg.InitialCluster = fmt.Sprintf("%s=%s", name, purl)
+	if cfg.SnapshotCount > 0 {
+		ecfg.SnapCount = uint64(cfg.SnapshotCount)
+	}
+	if cfg.AutoCompaction > 0 {
+		ecfg.AutoCompactionMode = compactor.ModePeriodic
+		ecfg.AutoCompactionRetention = cfg.AutoCompaction.String()
+	}
+
+	e, err := embed.StartEtcd(ecfg)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+		return e, nil
+	case err := <-e.Err():
+		e.Close()
+		return nil, err
+	case <-time.After(startTimeout):
+		e.Server.Stop()
+		e.Close()
+		return nil, fmt.Errorf("embedded etcd not ready after %v", startTimeout)
+	}
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/audit"
+	"github.com/coreos/discovery.etcd.io/handlers/httperror"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/discovery.etcd.io/metrics"
+	"github.com/coreos/etcd/client"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var adminCounter *prometheus.CounterVec
+
+func init() {
+	adminCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "endpoint_admin_requests_total",
+			Help: "How many /admin requests processed, partitioned by status code and HTTP method.",
+		},
+		[]string{"code", "method"},
+	)
+	metrics.Registry.MustRegister(adminCounter)
+}
+
+// isAdmin reports whether r carries the configured admin bearer token.
+func (st *State) isAdmin(r *http.Request) bool {
+	want := st.config().AdminToken
+	if want == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	got := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// RequireAdmin only lets requests authenticated with the admin token
+// through to h.
+func RequireAdmin(h ContextHandler) ContextHandler {
+	return ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		st := ctx.Value(stateKey).(*State)
+
+		if st.config().AdminToken == "" {
+			httperror.Error(w, r, "admin API is disabled", http.StatusForbidden, adminCounter)
+			return
+		}
+		if !st.isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httperror.Error(w, r, "invalid admin credentials", http.StatusUnauthorized, adminCounter)
+			return
+		}
+		audit.SetPrincipal(ctx, audit.PrincipalAdmin)
+		h.ServeHTTPContext(ctx, w, r)
+	})
+}
+
+// writeJSON writes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// StatsHandler reports bootstrap statistics over every token in the
+// registry.
+func StatsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	infos, err := st.listTokens(ctx)
+	if err != nil {
+		logging.Errorf("stats failed to list tokens: %v", err)
+		httperror.Error(w, r, "Unable to list tokens", http.StatusInternalServerError, adminCounter)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, summarizeTokens(infos, st.config().StallThreshold, time.Now()))
+	adminCounter.WithLabelValues("200", r.Method).Add(1)
+}
+
+// TokensHandler lists every token in the registry, or only those of
+// the namespace given as a query parameter.
+func TokensHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	infos, err := st.listTokens(ctx)
+	if err != nil {
+		logging.Errorf("failed to list tokens: %v", err)
+		httperror.Error(w, r, "Unable to list tokens", http.StatusInternalServerError, adminCounter)
+		return
+	}
+
+	_, filter := r.URL.Query()["namespace"]
+	views := []tokenView{}
+	for _, ti := range infos {
+		if !filter || ti.namespace == r.URL.Query().Get("namespace") {
+			views = append(views, ti.view())
+		}
+	}
+	writeJSON(w, http.StatusOK, views)
+	adminCounter.WithLabelValues("200", r.Method).Add(1)
+}
+
+// DeleteTokenHandler deletes a token with all its members. The token
+// is looked up in the namespace given as a query parameter.
+func DeleteTokenHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	ns, ok := st.config().Namespace(r.URL.Query().Get("namespace"))
+	if !ok {
+		httperror.Error(w, r, "unknown namespace", http.StatusNotFound, adminCounter)
+		return
+	}
+	token := mux.Vars(r)["token"]
+	cfg, _ := st.tokenConfig(ctx, ns, token)
+	if err := st.deleteToken(ctx, ns, token); err != nil {
+		if client.IsKeyNotFound(err) {
+			httperror.Error(w, r, "token not found", http.StatusNotFound, adminCounter)
+			return
+		}
+		logging.Errorf("failed to delete %s: %v", token, err)
+		httperror.Error(w, r, "Unable to delete token", http.StatusInternalServerError, adminCounter)
+		return
+	}
+	st.quotas.remove(configTenant(cfg))
+	st.migrateToken(ns, token)
+	logging.Infof("token %s deleted", token)
+
+	w.WriteHeader(http.StatusNoContent)
+	adminCounter.WithLabelValues("204", r.Method).Add(1)
+}
@@ -0,0 +1,530 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/handlers/httperror"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/etcd/client"
+)
+
+// backupVersion is the version of the export format written by
+// ExportHandler. ImportHandler refuses exports of other versions.
+const backupVersion = 1
+
+// maxBackupLine is the longest line of an export, which holds a token
+// with all its members and history.
+const maxBackupLine = 4 * 1024 * 1024
+
+// Types of export records.
+const (
+	recordHeader = "header"
+	recordTenant = "tenant"
+	recordToken  = "token"
+	recordEnd    = "end"
+)
+
+var (
+	tokenName = regexp.MustCompile(`^[a-f0-9]{32}$`)
+	keyHash   = regexp.MustCompile(`^[a-f0-9]{64}$`)
+)
+
+// backupRecord is a line of an export. An export is a header, the
+// tenants, the tokens and an end record counting what came before it,
+// so truncated exports are detected.
+type backupRecord struct {
+	Type   string        `json:"type"`
+	Header *backupHeader `json:"header,omitempty"`
+	Tenant *backupTenant `json:"tenant,omitempty"`
+	Token  *backupToken  `json:"token,omitempty"`
+	End    *backupCounts `json:"end,omitempty"`
+}
+
+type backupHeader struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	// Host is the discovery host of the exporting service.
+	Host string `json:"host"`
+}
+
+type backupTenant struct {
+	Name   string        `json:"name"`
+	Limits config.Limits `json:"limits"`
+	// Keys are the hashes of the API keys of the tenant, by id.
+	Keys map[string]string `json:"keys"`
+}
+
+type backupToken struct {
+	Namespace string `json:"namespace,omitempty"`
+	Token     string `json:"token"`
+	// Expires is when the token expires, if it does.
+	Expires *time.Time `json:"expires,omitempty"`
+	// Config holds the _config values of the token, such as its size.
+	Config map[string]string `json:"config"`
+	// Members are the registrations, in the order they were made.
+	Members  []backupMember    `json:"members"`
+	Progress map[string]string `json:"progress,omitempty"`
+	// History holds the history events of the token, oldest first.
+	History []json.RawMessage `json:"history,omitempty"`
+}
+
+type backupMember struct {
+	ID       string            `json:"id"`
+	Value    string            `json:"value"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type backupCounts struct {
+	Tenants int `json:"tenants"`
+	Tokens  int `json:"tokens"`
+	Members int `json:"members"`
+}
+
+// exportTenants reads every tenant with its key hashes.
+func (st *State) exportTenants(ctx context.Context) ([]backupTenant, error) {
+	ctx, done := startEtcd(ctx, "tenant_list", st.endpoint())
+	resp, err := st.keysAPI().Get(ctx, st.tenantKey(), &client.GetOptions{Recursive: true, Sort: true})
+	done(err)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var ts []backupTenant
+	for _, n := range resp.Node.Nodes {
+		t, err := parseTenant(n)
+		if err != nil {
+			return nil, err
+		}
+		bt := backupTenant{Name: t.Name, Limits: t.Limits, Keys: make(map[string]string)}
+		for _, c := range n.Nodes {
+			if path.Base(c.Key) != "keys" {
+				continue
+			}
+			for _, k := range c.Nodes {
+				bt.Keys[path.Base(k.Key)] = k.Value
+			}
+		}
+		ts = append(ts, bt)
+	}
+	return ts, nil
+}
+
+// exportTokens reads every token of ns on the shard of ctx with its
+// members, their metadata, config, progress and history.
+func (st *State) exportTokens(ctx context.Context, ns config.Namespace) ([]backupToken, error) {
+	sh := st.ctxShard(ctx)
+	scanCtx, done := startEtcd(ctx, "registry_scan", sh.endpoint)
+	resp, err := sh.keysAPI().Get(scanCtx, ns.Prefix, &client.GetOptions{Recursive: true, Sort: true})
+	done(err)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	progress, err := st.namespaceProgress(ctx, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	var ts []backupToken
+	for _, n := range resp.Node.Nodes {
+		if !n.Dir {
+			continue
+		}
+		bt := backupToken{
+			Namespace: ns.Name,
+			Token:     path.Base(n.Key),
+			Expires:   n.Expiration,
+			Members:   []backupMember{},
+			Progress:  progress[path.Base(n.Key)],
+		}
+		if bt.Config, err = st.tokenConfig(ctx, ns, bt.Token); err != nil && !client.IsKeyNotFound(err) {
+			return nil, err
+		}
+		nodes := append(client.Nodes(nil), n.Nodes...)
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].CreatedIndex < nodes[j].CreatedIndex })
+		mds, err := st.membersMetadata(ctx, ns, bt.Token)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range nodes {
+			id := path.Base(m.Key)
+			bt.Members = append(bt.Members, backupMember{ID: id, Value: m.Value, Metadata: mds[id]})
+		}
+
+		histCtx, done := startEtcd(ctx, "history_get", sh.endpoint)
+		hist, err := sh.keysAPI().Get(histCtx, historyKey(ns, bt.Token), &client.GetOptions{Sort: true})
+		done(err)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			for _, ev := range hist.Node.Nodes {
+				if json.Valid([]byte(ev.Value)) {
+					bt.History = append(bt.History, json.RawMessage(ev.Value))
+				}
+			}
+		}
+		ts = append(ts, bt)
+	}
+	return ts, nil
+}
+
+// ExportHandler writes the tenants and the tokens of every namespace,
+// or only of the namespace given as a query parameter, as JSON lines
+// that ImportHandler restores.
+func ExportHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+	cfg := st.config()
+
+	namespaces := cfg.AllNamespaces()
+	if _, filter := r.URL.Query()["namespace"]; filter {
+		ns, ok := cfg.Namespace(r.URL.Query().Get("namespace"))
+		if !ok {
+			httperror.Error(w, r, "unknown namespace", http.StatusNotFound, adminCounter)
+			return
+		}
+		namespaces = []config.Namespace{ns}
+	}
+
+	// read everything first, so a failure can still be reported
+	tenants, err := st.exportTenants(ctx)
+	if err != nil {
+		logging.Errorf("export failed to list tenants: %v", err)
+		httperror.Error(w, r, "Unable to export tenants", http.StatusInternalServerError, adminCounter)
+		return
+	}
+	var tokens []backupToken
+	for _, sh := range st.shardList() {
+		for _, ns := range namespaces {
+			ts, err := st.exportTokens(withShard(ctx, sh), ns)
+			if err != nil {
+				logging.Errorf("export failed to read tokens of shard %s: %v", sh.name, err)
+				httperror.Error(w, r, "Unable to export tokens", http.StatusInternalServerError, adminCounter)
+				return
+			}
+			tokens = append(tokens, ts...)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	enc.Encode(backupRecord{Type: recordHeader, Header: &backupHeader{Version: backupVersion, Time: time.Now().UTC(), Host: cfg.Host}})
+	var counts backupCounts
+	for i := range tenants {
+		enc.Encode(backupRecord{Type: recordTenant, Tenant: &tenants[i]})
+		counts.Tenants++
+	}
+	for i := range tokens {
+		enc.Encode(backupRecord{Type: recordToken, Token: &tokens[i]})
+		counts.Tokens++
+		counts.Members += len(tokens[i].Members)
+	}
+	enc.Encode(backupRecord{Type: recordEnd, End: &counts})
+	logging.Infof("exported %d tenants and %d tokens", counts.Tenants, counts.Tokens)
+	adminCounter.WithLabelValues("200", r.Method).Add(1)
+}
+
+// readBackup reads the records of an export.
+func readBackup(r io.Reader) ([]backupRecord, error) {
+	var recs []backupRecord
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxBackupLine)
+	for line := 1; s.Scan(); line++ {
+		if len(strings.TrimSpace(s.Text())) == 0 {
+			continue
+		}
+		var rec backupRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, s.Err()
+}
+
+// checkBackup returns what is wrong with the records of an export to
+// be imported with cfg, nothing if they can be imported.
+func checkBackup(recs []backupRecord, cfg config.Config) []string {
+	var problems []string
+	problem := func(i int, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("record %d: ", i+1)+fmt.Sprintf(format, args...))
+	}
+
+	if len(recs) == 0 || recs[0].Type != recordHeader || recs[0].Header == nil {
+		return []string{"missing header, not an export"}
+	}
+	if v := recs[0].Header.Version; v != backupVersion {
+		return []string{fmt.Sprintf("unsupported export version %d, expected %d", v, backupVersion)}
+	}
+	last := recs[len(recs)-1]
+	if last.Type != recordEnd || last.End == nil {
+		problems = append(problems, "missing end record, the export is truncated")
+	}
+
+	var counts backupCounts
+	tenants := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for i, rec := range recs[1:] {
+		i++
+		switch {
+		case rec.Type == recordTenant && rec.Tenant != nil:
+			t := rec.Tenant
+			counts.Tenants++
+			if !tenantName.MatchString(t.Name) || t.Name == anonymousTenant {
+				problem(i, "invalid tenant name %q", t.Name)
+			}
+			if tenants[t.Name] {
+				problem(i, "duplicate tenant %s", t.Name)
+			}
+			tenants[t.Name] = true
+			if err := t.Limits.Validate(); err != nil {
+				problem(i, "tenant %s: %v", t.Name, err)
+			}
+			for id, hash := range t.Keys {
+				if id == "" || strings.Contains(id, "/") || !keyHash.MatchString(hash) {
+					problem(i, "tenant %s: invalid API key %q", t.Name, id)
+				}
+			}
+		case rec.Type == recordToken && rec.Token != nil:
+			t := rec.Token
+			counts.Tokens++
+			counts.Members += len(t.Members)
+			if !tokenName.MatchString(t.Token) {
+				problem(i, "invalid token %q", t.Token)
+			}
+			if _, ok := cfg.Namespace(t.Namespace); !ok {
+				problem(i, "token %s: unknown namespace %q", t.Token, t.Namespace)
+			}
+			if id := t.Namespace + "/" + t.Token; tokens[id] {
+				problem(i, "duplicate token %s", t.Token)
+			} else {
+				tokens[id] = true
+			}
+			if size, err := strconv.Atoi(t.Config["size"]); err != nil || size < 1 {
+				problem(i, "token %s: invalid size %q", t.Token, t.Config["size"])
+			}
+			for name := range t.Config {
+				if name == "" || strings.Contains(name, "/") {
+					problem(i, "token %s: invalid config %q", t.Token, name)
+				}
+			}
+			ids := make(map[string]bool)
+			for _, m := range t.Members {
+				if m.ID == "" || strings.Contains(m.ID, "/") || strings.HasPrefix(m.ID, "_") {
+					problem(i, "token %s: invalid member id %q", t.Token, m.ID)
+				}
+				if ids[m.ID] {
+					problem(i, "token %s: duplicate member %s", t.Token, m.ID)
+				}
+				ids[m.ID] = true
+			}
+			for name := range t.Progress {
+				if name == "" || strings.Contains(name, "/") {
+					problem(i, "token %s: invalid progress %q", t.Token, name)
+				}
+			}
+		case rec.Type == recordEnd && rec.End != nil:
+			if i != len(recs)-1 {
+				problem(i, "records after the end record")
+			} else if *rec.End != counts {
+				problem(i, "export holds %d tenants, %d tokens and %d members, the end record counts %d, %d and %d",
+					counts.Tenants, counts.Tokens, counts.Members, rec.End.Tenants, rec.End.Tokens, rec.End.Members)
+			}
+		default:
+			problem(i, "unexpected %q record", rec.Type)
+		}
+	}
+	return problems
+}
+
+// importReport describes what an import did, or would do in a dry run.
+type importReport struct {
+	DryRun  bool `json:"dryRun"`
+	Tenants int  `json:"tenants"`
+	Tokens  int  `json:"tokens"`
+	Members int  `json:"members"`
+	// Skipped lists what was left out, and why.
+	Skipped []string `json:"skipped"`
+}
+
+// restoreTenant creates the tenant t.
+func (st *State) restoreTenant(ctx context.Context, t backupTenant) error {
+	if err := st.putTenant(ctx, t.Name, t.Limits); err != nil {
+		return err
+	}
+	for id, hash := range t.Keys {
+		keyCtx, done := startEtcd(ctx, "key_create", st.endpoint())
+		_, err := st.keysAPI().Set(keyCtx, st.tenantKey(t.Name, "keys", id), hash, nil)
+		done(err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreToken creates the token t in ns, expiring after ttl unless it
+// is 0. Members are registered in their original order, which keeps
+// their quorum membership.
+func (st *State) restoreToken(ctx context.Context, ns config.Namespace, t backupToken, ttl time.Duration) error {
+	sh := st.tokenShard(ctx, ns, t.Token)
+	kapi := sh.keysAPI()
+	dirCtx, done := startEtcd(ctx, "token_create", sh.endpoint)
+	_, err := kapi.Set(dirCtx, tokenKey(ns, t.Token), "", &client.SetOptions{Dir: true, TTL: ttl, PrevExist: client.PrevNoExist})
+	done(err)
+	if err != nil {
+		return err
+	}
+	if err := st.createStateDirs(ctx, ns, t.Token, ttl, tokenStateKeys(ns, t.Token)...); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(t.Config))
+	for name := range t.Config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := st.setTokenValue(ctx, ns, t.Token, name, t.Config[name], true); err != nil {
+			return err
+		}
+	}
+	for _, m := range t.Members {
+		memberCtx, done := startEtcd(ctx, "member_create", sh.endpoint)
+		_, err := kapi.Set(memberCtx, tokenKey(ns, t.Token, m.ID), m.Value, nil)
+		done(err)
+		if err != nil {
+			return err
+		}
+		if len(m.Metadata) > 0 {
+			if err := st.setMemberMetadata(ctx, ns, t.Token, m.ID, m.Metadata, ttl); err != nil {
+				return err
+			}
+		}
+	}
+	for name, v := range t.Progress {
+		progressCtx, done := startEtcd(ctx, "progress_set", sh.endpoint)
+		_, err := kapi.Set(progressCtx, progressKey(ns, t.Token, name), v, &client.SetOptions{TTL: ttl})
+		done(err)
+		if err != nil {
+			return err
+		}
+	}
+	for _, ev := range t.History {
+		appendCtx, done := startEtcd(ctx, "history_append", sh.endpoint)
+		_, err := kapi.CreateInOrder(appendCtx, historyKey(ns, t.Token), string(ev), &client.CreateInOrderOptions{TTL: ttl})
+		done(err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importBackup restores the checked records of an export. Tenants and
+// tokens that already exist are left alone, as are tokens that expired
+// since the export. In a dry run nothing is written.
+func (st *State) importBackup(ctx context.Context, recs []backupRecord, dryRun bool) (importReport, error) {
+	cfg := st.config()
+	report := importReport{DryRun: dryRun, Skipped: []string{}}
+	for _, rec := range recs {
+		switch {
+		case rec.Tenant != nil:
+			t := *rec.Tenant
+			_, _, err := st.getTenant(ctx, t.Name)
+			if err == nil {
+				report.Skipped = append(report.Skipped, fmt.Sprintf("tenant %s exists", t.Name))
+				continue
+			}
+			if !client.IsKeyNotFound(err) {
+				return report, err
+			}
+			if !dryRun {
+				if err := st.restoreTenant(ctx, t); err != nil {
+					return report, fmt.Errorf("tenant %s: %v", t.Name, err)
+				}
+			}
+			report.Tenants++
+		case rec.Token != nil:
+			t := *rec.Token
+			ns, _ := cfg.Namespace(t.Namespace)
+			var ttl time.Duration
+			if t.Expires != nil {
+				if ttl = time.Until(*t.Expires).Round(time.Second); ttl < time.Second {
+					report.Skipped = append(report.Skipped, fmt.Sprintf("token %s expired", t.Token))
+					continue
+				}
+			}
+			_, err := st.tokenTTL(ctx, ns, t.Token)
+			if err == nil {
+				report.Skipped = append(report.Skipped, fmt.Sprintf("token %s exists", t.Token))
+				continue
+			}
+			if !client.IsKeyNotFound(err) {
+				return report, err
+			}
+			if !dryRun {
+				err := st.restoreToken(ctx, ns, t, ttl)
+				st.migrateToken(ns, t.Token)
+				if err != nil {
+					return report, fmt.Errorf("token %s: %v", t.Token, err)
+				}
+			}
+			report.Tokens++
+			report.Members += len(t.Members)
+		}
+	}
+	return report, nil
+}
+
+// ImportHandler restores an export written by ExportHandler, possibly
+// by another instance backed by another etcd cluster. The export is
+// checked as a whole before anything is written; with dry-run=true the
+// import stops after reporting what it would do.
+func ImportHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	dryRun, err := strconv.ParseBool(r.URL.Query().Get("dry-run"))
+	if err != nil && r.URL.Query().Get("dry-run") != "" {
+		httperror.Error(w, r, "invalid dry-run", http.StatusBadRequest, adminCounter)
+		return
+	}
+	recs, err := readBackup(r.Body)
+	if err != nil {
+		httperror.Error(w, r, fmt.Sprintf("invalid export: %v", err), http.StatusBadRequest, adminCounter)
+		return
+	}
+	if problems := checkBackup(recs, st.config()); len(problems) > 0 {
+		httperror.Error(w, r, "inconsistent export: "+strings.Join(problems, "; "), http.StatusBadRequest, adminCounter)
+		return
+	}
+
+	report, err := st.importBackup(ctx, recs, dryRun)
+	if err != nil {
+		logging.Errorf("import failed after %d tenants and %d tokens: %v", report.Tenants, report.Tokens, err)
+		httperror.Error(w, r, fmt.Sprintf("Unable to import %v", err), http.StatusInternalServerError, adminCounter)
+		return
+	}
+	if !dryRun {
+		logging.Infof("imported %d tenants and %d tokens, skipped %d", report.Tenants, report.Tokens, len(report.Skipped))
+	}
+	writeJSON(w, http.StatusOK, report)
+	adminCounter.WithLabelValues("200", r.Method).Add(1)
+}
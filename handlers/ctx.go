@@ -3,6 +3,9 @@ package handlers
 import (
 	"context"
 	"net/http"
+
+	"github.com/coreos/discovery.etcd.io/audit"
+	"github.com/coreos/discovery.etcd.io/tracing"
 )
 
 type ContextHandler interface {
@@ -21,13 +24,18 @@ type ContextAdapter struct {
 }
 
 func (ca *ContextAdapter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	ca.Handler.ServeHTTPContext(ca.Ctx, w, req)
+	// carry the request span and audit details over to the handler
+	// context
+	ctx := tracing.ContextWithSpan(ca.Ctx, tracing.FromContext(req.Context()))
+	ctx = audit.CopyContext(ctx, req.Context())
+	ca.Handler.ServeHTTPContext(ctx, w, req)
 }
 
 type key int
 
 const (
 	stateKey key = iota
+	shardKey
 )
 
 func With(h ContextHandler, st *State) ContextHandler {
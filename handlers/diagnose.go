@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/handlers/httperror"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/etcd/client"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultProbeTimeout and maxProbeTimeout bound how long
+	// /diagnose?probe=true waits for each peer URL.
+	defaultProbeTimeout = 2 * time.Second
+	maxProbeTimeout     = 10 * time.Second
+
+	// maxProbeURLs and maxProbeDials bound how many peer urls
+	// /diagnose?probe=true dials in all and at once.
+	maxProbeURLs  = 32
+	maxProbeDials = 8
+)
+
+// Severities of diagnose findings. Errors keep a cluster from forming,
+// warnings may.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// finding is a problem diagnose found with a token.
+type finding struct {
+	Severity string   `json:"severity"`
+	Check    string   `json:"check"`
+	Message  string   `json:"message"`
+	Members  []string `json:"members,omitempty"`
+}
+
+// diagnosis is the report of /diagnose.
+type diagnosis struct {
+	Token    string    `json:"token"`
+	Size     int       `json:"size"`
+	Members  []member  `json:"members"`
+	Probed   bool      `json:"probed"`
+	Findings []finding `json:"findings"`
+}
+
+// diagnose checks the registrations ms of a token of the given size
+// for the usual reasons clusters fail to form.
+func diagnose(size int, ms []member) []finding {
+	var fs []finding
+	add := func(severity, check, msg string, ids ...string) {
+		fs = append(fs, finding{Severity: severity, Check: check, Message: msg, Members: ids})
+	}
+
+	switch {
+	case size <= 0:
+		add(severityError, "size", "the token has no valid size, etcd cannot bootstrap from it")
+	case size%2 == 0:
+		add(severityWarning, "size", fmt.Sprintf("size %d tolerates no more failures than size %d", size, size-1))
+	}
+	if size > 0 && len(ms) > size {
+		var ids []string
+		for _, m := range ms[size:] {
+			ids = append(ids, m.ID)
+		}
+		add(severityWarning, "overflow", fmt.Sprintf("%d members registered beyond size %d, they become proxies or exit", len(ms)-size, size), ids...)
+	}
+
+	// etcd parses member ids as hex, so 0a and a are the same member
+	names := make(map[string][]string)
+	sameIDs := make(map[string][]string)
+	peers := make(map[string][]string)
+	schemes := make(map[string]bool)
+	for _, m := range ms {
+		if id, err := strconv.ParseUint(m.ID, 16, 64); err == nil {
+			k := strconv.FormatUint(id, 16)
+			sameIDs[k] = append(sameIDs[k], m.ID)
+		}
+		if m.Name == "" || len(m.PeerURLs) == 0 {
+			add(severityError, "registration", fmt.Sprintf("registration %q is not a list of name=peerURL pairs", m.value), m.ID)
+			continue
+		}
+		names[m.Name] = append(names[m.Name], m.ID)
+		for _, pair := range strings.Split(m.value, ",") {
+			if kv := strings.SplitN(pair, "=", 2); kv[0] != m.Name {
+				add(severityError, "registration", fmt.Sprintf("registration %q mixes member names", m.value), m.ID)
+				break
+			}
+		}
+
+		for _, p := range m.PeerURLs {
+			peers[p] = append(peers[p], m.ID)
+			u, err := url.Parse(p)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Port() == "" {
+				add(severityError, "peer-url", fmt.Sprintf("peer url %q is not an http(s) url with a port", p), m.ID)
+				continue
+			}
+			schemes[u.Scheme] = true
+			for _, ip := range literalAddrs(u.Hostname()) {
+				if kind := localKind(ip); kind != "" {
+					add(severityWarning, "peer-url", fmt.Sprintf("peer url %q is on the %s address %s, other machines cannot reach it", p, kind, ip), m.ID)
+					break
+				}
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(names) {
+		if ids := names[name]; len(ids) > 1 {
+			add(severityError, "duplicate-name", fmt.Sprintf("%d members are named %q", len(ids), name), ids...)
+		}
+	}
+	for _, id := range sortedKeys(sameIDs) {
+		if dup := sameIDs[id]; len(dup) > 1 {
+			add(severityError, "duplicate-id", fmt.Sprintf("member ids %s are the same id", strings.Join(dup, ", ")), dup...)
+		}
+	}
+	for _, p := range sortedKeys(peers) {
+		if ids := peers[p]; len(ids) > 1 {
+			add(severityError, "duplicate-peer-url", fmt.Sprintf("%d members registered peer url %q", len(ids), p), ids...)
+		}
+	}
+	if len(schemes) > 1 {
+		add(severityWarning, "peer-url", "members mix http and https peer urls")
+	}
+	return append(fs, diagnoseMetadata(size, ms)...)
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// probe checks that the peer urls of ms, at most maxProbeURLs of them
+// and maxProbeDials at once, accept connections within timeout.
+func probe(ctx context.Context, ms []member, timeout time.Duration) []finding {
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		fs    []finding
+		n     int
+		dials = make(chan struct{}, maxProbeDials)
+	)
+	dialer := net.Dialer{Timeout: timeout}
+	for _, m := range ms {
+		for _, p := range m.PeerURLs {
+			u, err := url.Parse(p)
+			if err != nil || u.Port() == "" {
+				continue
+			}
+			if n++; n > maxProbeURLs {
+				continue
+			}
+			wg.Add(1)
+			dials <- struct{}{}
+			go func(id, p, addr string) {
+				defer func() {
+					<-dials
+					wg.Done()
+				}()
+				conn, err := dialer.DialContext(ctx, "tcp", addr)
+				if err == nil {
+					conn.Close()
+					return
+				}
+				mu.Lock()
+				fs = append(fs, finding{
+					Severity: severityError,
+					Check:    "unreachable",
+					Message:  fmt.Sprintf("cannot connect to peer url %q: %s", p, probeFailure(err)),
+					Members:  []string{id},
+				})
+				mu.Unlock()
+			}(m.ID, p, u.Host)
+		}
+	}
+	wg.Wait()
+	sort.Slice(fs, func(i, j int) bool {
+		if fs[i].Message != fs[j].Message {
+			return fs[i].Message < fs[j].Message
+		}
+		return fs[i].Members[0] < fs[j].Members[0]
+	})
+	if n > maxProbeURLs {
+		fs = append(fs, finding{
+			Severity: severityWarning,
+			Check:    "probe",
+			Message:  fmt.Sprintf("only the first %d of %d peer urls were probed", maxProbeURLs, n),
+		})
+	}
+	return fs
+}
+
+// probeFailure tells whether dialing a peer url timed out or failed
+// otherwise, leaving out the error, which may describe the network of
+// the service.
+func probeFailure(err error) string {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timeout"
+	}
+	if err == context.DeadlineExceeded {
+		return "timeout"
+	}
+	return "unreachable"
+}
+
+// DiagnoseHandler checks the registrations of a token for the usual
+// reasons a cluster fails to form. With probe=true it also dials the
+// peer urls of the members, each for at most timeout, if r comes with
+// the admin token or an API key of the tenant that created the token.
+func DiagnoseHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	ns, ok := st.namespace(r)
+	if !ok {
+		httperror.Error(w, r, "unknown namespace", http.StatusNotFound, tokenCounter)
+		return
+	}
+
+	mediaType := negotiate(r, []string{mediaText, mediaJSON})
+	switch f := r.URL.Query().Get("format"); f {
+	case "":
+	case "text", "json":
+		mediaType = initialClusterFormats[f]
+	default:
+		httperror.Error(w, r, fmt.Sprintf("unknown format %q", f), http.StatusBadRequest, tokenCounter)
+		return
+	}
+	if mediaType == "" {
+		httperror.Error(w, r, "supported types are text/plain and application/json", http.StatusNotAcceptable, tokenCounter)
+		return
+	}
+
+	timeout := defaultProbeTimeout
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 || d > maxProbeTimeout {
+			httperror.Error(w, r, fmt.Sprintf("timeout must be a duration up to %v", maxProbeTimeout), http.StatusBadRequest, tokenCounter)
+			return
+		}
+		timeout = d
+	}
+
+	token := mux.Vars(r)["token"]
+	size, ms, err := st.tokenMembers(ctx, ns, token)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			httperror.Error(w, r, "token not found", http.StatusNotFound, tokenCounter)
+			return
+		}
+		logging.Errorf("Error reading token members: %v", err)
+		httperror.Error(w, r, "", http.StatusInternalServerError, tokenCounter)
+		return
+	}
+
+	probed := r.URL.Query().Get("probe") == "true"
+	if probed {
+		cfg, err := st.tokenConfig(ctx, ns, token)
+		if err != nil && !client.IsKeyNotFound(err) {
+			logging.Errorf("failed to read config of %s: %v", token, err)
+			httperror.Error(w, r, "", http.StatusInternalServerError, tokenCounter)
+			return
+		}
+		if _, err := st.tokenActor(ctx, r, cfg); err != nil {
+			actorError(w, r, err)
+			return
+		}
+	}
+
+	d := diagnosis{Token: token, Size: size, Members: ms, Findings: diagnose(size, ms)}
+	if ex, err := st.tokenExpectation(ctx, ns, token); err != nil && !client.IsKeyNotFound(err) {
+		logging.Warnf("failed to read expected members of %s: %v", token, err)
+	} else if ex != nil {
+		d.Findings = append(d.Findings, diagnoseExpected(ex, ms)...)
+	}
+	if d.Members == nil {
+		d.Members = []member{}
+	}
+	if probed {
+		d.Probed = true
+		d.Findings = append(d.Findings, probe(r.Context(), ms, timeout)...)
+	}
+	if d.Findings == nil {
+		d.Findings = []finding{}
+	}
+
+	w.Header().Set("Vary", "Accept")
+	if mediaType == mediaJSON {
+		writeJSON(w, http.StatusOK, d)
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, d.String())
+	}
+	tokenCounter.WithLabelValues("200", r.Method).Add(1)
+}
+
+// String reports d for people.
+func (d diagnosis) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "token %s: size %d, %d members registered\n", d.Token, d.Size, len(d.Members))
+	for _, m := range d.Members {
+		if len(m.Metadata) > 0 {
+			fmt.Fprintf(&b, "member %s (%s): %s\n", m.ID, m.Name, metadataString(m.Metadata))
+		}
+	}
+	if len(d.Findings) == 0 {
+		b.WriteString("no problems found\n")
+	}
+	for _, f := range d.Findings {
+		fmt.Fprintf(&b, "%-7s %s: %s", f.Severity, f.Check, f.Message)
+		if len(f.Members) > 0 {
+			fmt.Fprintf(&b, " (%s)", strings.Join(f.Members, ", "))
+		}
+		b.WriteString("\n")
+	}
+	if !d.Probed {
+		b.WriteString("peer urls were not probed, add probe=true to check they are reachable\n")
+	}
+	return b.String()
+}
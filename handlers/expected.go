@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/etcd/client"
+)
+
+// maxExpected is how many members a token may expect by name.
+const maxExpected = 128
+
+// expectedMember is a member a token expects to register. Unless Host
+// is empty, the peer urls of the member must be on it.
+type expectedMember struct {
+	Name string `json:"name"`
+	Host string `json:"host,omitempty"`
+}
+
+// expectation restricts who may register with a token to the members
+// it names, and to those whose name matches its pattern.
+type expectation struct {
+	Members []expectedMember `json:"members,omitempty"`
+	Pattern string           `json:"pattern,omitempty"`
+	pattern *regexp.Regexp
+}
+
+// compilePattern anchors a name pattern to match whole names.
+func compilePattern(p string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + p + ")$")
+}
+
+// parseExpectation reads the expect parameters of /new, given as name
+// or name=host, and its expect-pattern. It returns nil if neither is
+// given.
+func parseExpectation(pairs []string, pattern string) (*expectation, error) {
+	if len(pairs) == 0 && pattern == "" {
+		return nil, nil
+	}
+	if len(pairs) > maxExpected {
+		return nil, fmt.Errorf("more than %d expected members", maxExpected)
+	}
+	ex := &expectation{Pattern: pattern}
+	seen := make(map[string]bool)
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		m := expectedMember{Name: kv[0]}
+		if len(kv) == 2 {
+			m.Host = kv[1]
+		}
+		if m.Name == "" || strings.Contains(m.Name, ",") || (len(kv) == 2 && (m.Host == "" || strings.ContainsAny(m.Host, "/,"))) {
+			return nil, fmt.Errorf("invalid expected member %q, expected name or name=host", pair)
+		}
+		if seen[m.Name] {
+			return nil, fmt.Errorf("member %s expected twice", m.Name)
+		}
+		seen[m.Name] = true
+		ex.Members = append(ex.Members, m)
+	}
+	if pattern != "" {
+		re, err := compilePattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expect-pattern: %v", err)
+		}
+		ex.pattern = re
+	}
+	return ex, nil
+}
+
+// parseTokenExpectation reads the expectation recorded in the config
+// of a token, nil if it has none.
+func parseTokenExpectation(cfg map[string]string) (*expectation, error) {
+	v, ok := cfg["expected"]
+	if !ok {
+		return nil, nil
+	}
+	var ex expectation
+	if err := json.Unmarshal([]byte(v), &ex); err != nil {
+		return nil, err
+	}
+	if ex.Pattern != "" {
+		re, err := compilePattern(ex.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		ex.pattern = re
+	}
+	return &ex, nil
+}
+
+// tokenExpectation returns the expectation of token, nil if it has
+// none.
+func (st *State) tokenExpectation(ctx context.Context, ns config.Namespace, token string) (*expectation, error) {
+	cfg, err := st.tokenConfig(ctx, ns, token)
+	if err != nil {
+		return nil, err
+	}
+	return parseTokenExpectation(cfg)
+}
+
+// names returns the names of the expected members.
+func (ex *expectation) names() []string {
+	names := make([]string, len(ex.Members))
+	for i, m := range ex.Members {
+		names[i] = m.Name
+	}
+	return names
+}
+
+// admit checks the registration m against ex, and tells why it is
+// refused.
+func (ex *expectation) admit(m member) error {
+	if m.Name == "" {
+		return fmt.Errorf("registration %q is not a list of name=peerURL pairs", m.value)
+	}
+	for _, pair := range strings.Split(m.value, ",") {
+		if kv := strings.SplitN(pair, "=", 2); kv[0] != m.Name {
+			return fmt.Errorf("registration %q mixes member names", m.value)
+		}
+	}
+
+	for _, e := range ex.Members {
+		if e.Name != m.Name {
+			continue
+		}
+		if e.Host == "" {
+			return nil
+		}
+		for _, p := range m.PeerURLs {
+			u, err := url.Parse(p)
+			if err != nil || (u.Host != e.Host && u.Hostname() != e.Host) {
+				return fmt.Errorf("peer url %q of member %s is not on the expected host %s", p, m.Name, e.Host)
+			}
+		}
+		return nil
+	}
+	if ex.pattern != nil && ex.pattern.MatchString(m.Name) {
+		return nil
+	}
+
+	var expected []string
+	if len(ex.Members) > 0 {
+		expected = append(expected, "one of "+strings.Join(ex.names(), ", "))
+	}
+	if ex.Pattern != "" {
+		expected = append(expected, fmt.Sprintf("a name matching %q", ex.Pattern))
+	}
+	return fmt.Errorf("member %s is not expected by the token, expected %s", m.Name, strings.Join(expected, " or "))
+}
+
+// missing returns the names of the expected members that have not
+// registered among ms.
+func (ex *expectation) missing(ms []member) []string {
+	registered := make(map[string]bool)
+	for _, m := range ms {
+		registered[m.Name] = true
+	}
+	var names []string
+	for _, e := range ex.Members {
+		if !registered[e.Name] {
+			names = append(names, e.Name)
+		}
+	}
+	return names
+}
+
+// diagnoseExpected reports the expected members missing from ms, and
+// the members of ms the token does not expect.
+func diagnoseExpected(ex *expectation, ms []member) []finding {
+	var fs []finding
+	if missing := ex.missing(ms); len(missing) > 0 {
+		fs = append(fs, finding{
+			Severity: severityWarning,
+			Check:    "missing",
+			Message:  fmt.Sprintf("expected members %s have not registered", strings.Join(missing, ", ")),
+		})
+	}
+	for _, m := range ms {
+		if err := ex.admit(m); err != nil {
+			fs = append(fs, finding{Severity: severityError, Check: "unexpected", Message: err.Error(), Members: []string{m.ID}})
+		}
+	}
+	return fs
+}
+
+// refusal returns the body of the answer to a registration refused for
+// err, in the form etcd refuses requests, so that etcd reports why it
+// cannot bootstrap.
+func refusal(err error) []byte {
+	b, _ := json.Marshal(client.Error{Code: client.ErrorCodeUnauthorized, Message: err.Error()})
+	return b
+}
+
+// refuseMember answers a registration with the refusal b.
+func refuseMember(w http.ResponseWriter, r *http.Request, b []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(b)
+	tokenCounter.WithLabelValues("403", r.Method).Add(1)
+}
@@ -3,10 +3,11 @@ package handlers
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/http"
 
 	"github.com/coreos/discovery.etcd.io/handlers/httperror"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/discovery.etcd.io/metrics"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -20,24 +21,29 @@ func init() {
 		},
 		[]string{"code", "method"},
 	)
-	prometheus.MustRegister(healthCounter)
+	metrics.Registry.MustRegister(healthCounter)
 }
 
 func HealthHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	st := ctx.Value(stateKey).(*State)
 
-	token, err := st.setupToken(0)
-	if err != nil || token == "" {
-		log.Printf("health failed to setupToken %v", err)
-		httperror.Error(w, r, "health failed to setupToken", 400, healthCounter)
-		return
-	}
-
-	err = st.deleteToken(token)
-	if err != nil {
-		log.Printf("health failed to deleteToken %v", err)
-		httperror.Error(w, r, "health failed to deleteToken", 400, healthCounter)
-		return
+	// every shard has to take tokens
+	ns, _ := st.config().Namespace("")
+	for _, sh := range st.shardList() {
+		shardCtx := withShard(ctx, sh)
+		token, err := st.setupToken(shardCtx, ns, 0, ns.TokenTTL)
+		if err != nil || token == "" {
+			logging.Errorf("health failed to setupToken on shard %s: %v", sh.name, err)
+			httperror.Error(w, r, "health failed to setupToken", 400, healthCounter)
+			return
+		}
+
+		err = st.deleteToken(shardCtx, ns, token)
+		if err != nil {
+			logging.Errorf("health failed to deleteToken on shard %s: %v", sh.name, err)
+			httperror.Error(w, r, "health failed to deleteToken", 400, healthCounter)
+			return
+		}
 	}
 
 	fmt.Fprintf(w, "OK")
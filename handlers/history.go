@@ -0,0 +1,344 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/handlers/httperror"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/etcd/client"
+	"github.com/gorilla/mux"
+)
+
+// maxHistory is how many events the history of a token keeps; older
+// events are no longer shown, and dropped by the next registry scan.
+const maxHistory = 256
+
+// Types of token history events.
+const (
+	eventCreated      = "created"
+	eventRegistered   = "registered"
+	eventUnregistered = "unregistered"
+	eventRejected     = "rejected"
+	eventFull         = "full"
+	eventReset        = "reset"
+)
+
+// event is an entry of the history of a token.
+type event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Actor is who caused the event, a tenant or "admin".
+	Actor string `json:"actor,omitempty"`
+	// ClientIP is the address of the client that caused the event.
+	ClientIP string `json:"clientIP,omitempty"`
+	// Size is the size of the token after the event, and PrevSize
+	// the size before it, if the event changed it.
+	Size     int `json:"size,omitempty"`
+	PrevSize int `json:"prevSize,omitempty"`
+	// Member and PeerURLs describe the member the event is about.
+	Member   string   `json:"member,omitempty"`
+	PeerURLs []string `json:"peerURLs,omitempty"`
+	// Status and Reason tell why etcd rejected a member request.
+	Status int    `json:"status,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Removed are the ids of the members the event removed.
+	Removed []string `json:"removed,omitempty"`
+}
+
+// tokenRef names a token of a namespace.
+type tokenRef struct {
+	ns    config.Namespace
+	token string
+}
+
+// historyKey returns the etcd key of the history of token in ns,
+// joined with elems. Like progress, history is written while members
+// watch the token, so it is kept out of the token directory.
+func historyKey(ns config.Namespace, token string, elems ...string) string {
+	return path.Join(append([]string{ns.Prefix, "_history", token}, elems...)...)
+}
+
+// recordEvent appends ev to the history of token, expiring along with
+// the token after ttl unless it is 0. The oldest events past
+// maxHistory are dropped by the registry scans.
+func (st *State) recordEvent(ctx context.Context, ns config.Namespace, token string, ev event, ttl time.Duration) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	sh := st.tokenShard(ctx, ns, token)
+	appendCtx, done := startEtcd(ctx, "history_append", sh.endpoint)
+	_, err = sh.keysAPI().CreateInOrder(appendCtx, historyKey(ns, token), string(b), &client.CreateInOrderOptions{TTL: ttl})
+	done(err)
+	if err == nil {
+		st.historyGrew(tokenRef{ns, token})
+	}
+	return err
+}
+
+// historyGrew marks the history of ref to be trimmed by the next
+// registry scan.
+func (st *State) historyGrew(ref tokenRef) {
+	st.historyMu.Lock()
+	if st.grown == nil {
+		st.grown = make(map[tokenRef]bool)
+	}
+	st.grown[ref] = true
+	st.historyMu.Unlock()
+}
+
+// trimHistories drops the oldest events past maxHistory from the
+// histories that grew since they were last trimmed.
+func (st *State) trimHistories(ctx context.Context) {
+	st.historyMu.Lock()
+	grown := st.grown
+	st.grown = nil
+	st.historyMu.Unlock()
+
+	for ref := range grown {
+		if err := st.trimHistory(ctx, ref.ns, ref.token); err != nil && ctx.Err() == nil {
+			logging.Warnf("failed to trim the history of %s: %v", ref.token, err)
+			st.historyGrew(ref)
+		}
+	}
+}
+
+// trimHistory drops the oldest events past maxHistory from the history
+// of token in ns.
+func (st *State) trimHistory(ctx context.Context, ns config.Namespace, token string) error {
+	sh := st.tokenShard(ctx, ns, token)
+	kapi := sh.keysAPI()
+	getCtx, done := startEtcd(ctx, "history_get", sh.endpoint)
+	resp, err := kapi.Get(getCtx, historyKey(ns, token), &client.GetOptions{Sort: true})
+	done(err)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	for i := 0; i < len(resp.Node.Nodes)-maxHistory; i++ {
+		delCtx, done := startEtcd(ctx, "history_trim", sh.endpoint)
+		_, err := kapi.Delete(delCtx, resp.Node.Nodes[i].Key, nil)
+		done(err)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// memberWorkTimeout bounds the bookkeeping of one member request,
+// which is done after the member was answered.
+const memberWorkTimeout = 5 * time.Second
+
+// memberWork is the bookkeeping of one member request.
+type memberWork struct {
+	ctx context.Context
+	do  func(context.Context)
+}
+
+// memberQueue is the bookkeeping of the member requests of one token
+// that is still to be done, oldest first.
+type memberQueue struct {
+	work []memberWork
+	// done is closed once the queue is drained.
+	done chan struct{}
+}
+
+// queueMemberWork runs do in the background once the bookkeeping queued
+// before for ref is done, so that the requests of the members of a
+// token are recorded in the order they were answered.
+func (st *State) queueMemberWork(ctx context.Context, ref tokenRef, do func(context.Context)) {
+	st.memberMu.Lock()
+	defer st.memberMu.Unlock()
+	q := st.memberQueues[ref]
+	if q == nil {
+		if st.memberQueues == nil {
+			st.memberQueues = make(map[tokenRef]*memberQueue)
+		}
+		q = &memberQueue{done: make(chan struct{})}
+		st.memberQueues[ref] = q
+		go st.runMemberWork(ref, q)
+	}
+	q.work = append(q.work, memberWork{ctx, do})
+}
+
+// runMemberWork does the bookkeeping queued in q until it is drained.
+func (st *State) runMemberWork(ref tokenRef, q *memberQueue) {
+	for {
+		st.memberMu.Lock()
+		if len(q.work) == 0 {
+			delete(st.memberQueues, ref)
+			close(q.done)
+			st.memberMu.Unlock()
+			return
+		}
+		w := q.work[0]
+		q.work = q.work[1:]
+		st.memberMu.Unlock()
+
+		ctx, cancel := context.WithTimeout(w.ctx, memberWorkTimeout)
+		w.do(ctx)
+		cancel()
+	}
+}
+
+// awaitMemberWork waits, for at most memberWorkTimeout, until the
+// bookkeeping queued for ref is done, so that what is read about a
+// token includes the member requests answered before.
+func (st *State) awaitMemberWork(ctx context.Context, ref tokenRef) {
+	st.memberMu.Lock()
+	q := st.memberQueues[ref]
+	st.memberMu.Unlock()
+	if q == nil {
+		return
+	}
+	t := time.NewTimer(memberWorkTimeout)
+	defer t.Stop()
+	select {
+	case <-q.done:
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// recordMemberRequest records, after the member was answered, a member
+// registration or removal with token, made at the time at, in the
+// history of token, given the status and body of the response.
+// Successful requests also update the metadata md of the member, and
+// successful registrations advance the bootstrap progress of the
+// token. Members are not kept waiting on the bookkeeping, which is
+// queued per token so that its events keep the order of the requests.
+func (st *State) recordMemberRequest(ctx context.Context, ns config.Namespace, token, method, id, ip string, at time.Time, status int, body []byte, md map[string]string) {
+	st.queueMemberWork(ctx, tokenRef{ns, token}, func(ctx context.Context) {
+		if status/100 == 2 {
+			st.updateMemberMetadata(ctx, ns, token, method, id, md)
+		}
+		st.recordMember(ctx, ns, token, method, id, ip, at, status, body)
+	})
+}
+
+// recordMember does the bookkeeping of recordMemberRequest.
+func (st *State) recordMember(ctx context.Context, ns config.Namespace, token, method, id, ip string, at time.Time, status int, body []byte) {
+	defer st.migrateToken(ns, token)
+
+	ev := event{Time: at.UTC(), Member: id, ClientIP: ip}
+	switch {
+	case status/100 != 2:
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(body, &e)
+		ev.Type, ev.Status, ev.Reason = eventRejected, status, e.Message
+	case method == http.MethodPut:
+		var resp client.Response
+		if err := json.Unmarshal(body, &resp); err == nil && resp.Node != nil {
+			ev.PeerURLs = parseMember(resp.Node).PeerURLs
+		}
+		ev.Type = eventRegistered
+	default:
+		ev.Type = eventUnregistered
+	}
+
+	// requests to unknown tokens leave no history
+	ttl, err := st.tokenTTL(ctx, ns, token)
+	if err != nil {
+		if !client.IsKeyNotFound(err) {
+			logging.Warnf("failed to read ttl of %s: %v", token, err)
+		}
+		return
+	}
+	if err := st.recordEvent(ctx, ns, token, ev, ttl); err != nil {
+		logging.Warnf("failed to record %s event of %s: %v", ev.Type, token, err)
+	}
+	if ev.Type == eventRegistered {
+		st.recordRegistration(ctx, ns, token, body)
+	}
+}
+
+// tokenTTL returns how long token has left to live, 0 if it does not
+// expire.
+func (st *State) tokenTTL(ctx context.Context, ns config.Namespace, token string) (time.Duration, error) {
+	sh := st.tokenShard(ctx, ns, token)
+	ctx, done := startEtcd(ctx, "token_get", sh.endpoint)
+	resp, err := sh.keysAPI().Get(ctx, tokenKey(ns, token), nil)
+	done(err)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(resp.Node.TTL) * time.Second, nil
+}
+
+// tokenHistory returns the recorded events of token, oldest first.
+func (st *State) tokenHistory(ctx context.Context, ns config.Namespace, token string) ([]event, error) {
+	sh := st.tokenShard(ctx, ns, token)
+	ctx, done := startEtcd(ctx, "history_get", sh.endpoint)
+	resp, err := sh.keysAPI().Get(ctx, historyKey(ns, token), &client.GetOptions{Sort: true})
+	done(err)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	nodes := resp.Node.Nodes
+	if len(nodes) > maxHistory {
+		// not yet trimmed
+		nodes = nodes[len(nodes)-maxHistory:]
+	}
+	events := make([]event, 0, len(nodes))
+	for _, n := range nodes {
+		var ev event
+		if err := json.Unmarshal([]byte(n.Value), &ev); err != nil {
+			logging.Warnf("skipping malformed history event %s: %v", n.Key, err)
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// HistoryHandler returns the recorded events of a token, oldest first.
+func HistoryHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	ns, ok := st.namespace(r)
+	if !ok {
+		httperror.Error(w, r, "unknown namespace", http.StatusNotFound, tokenCounter)
+		return
+	}
+
+	token := mux.Vars(r)["token"]
+	st.awaitMemberWork(ctx, tokenRef{ns, token})
+	if _, err := st.tokenTTL(ctx, ns, token); err != nil {
+		if client.IsKeyNotFound(err) {
+			httperror.Error(w, r, "token not found", http.StatusNotFound, tokenCounter)
+			return
+		}
+		logging.Errorf("Error reading token: %v", err)
+		httperror.Error(w, r, "", http.StatusInternalServerError, tokenCounter)
+		return
+	}
+	events, err := st.tokenHistory(ctx, ns, token)
+	if err != nil {
+		logging.Errorf("Error reading history of %s: %v", token, err)
+		httperror.Error(w, r, "", http.StatusInternalServerError, tokenCounter)
+		return
+	}
+	if events == nil {
+		events = []event{}
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Token  string  `json:"token"`
+		Events []event `json:"events"`
+	}{token, events})
+	tokenCounter.WithLabelValues("200", r.Method).Add(1)
+}
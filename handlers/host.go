@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedParam returns the first value of param in the RFC 7239
+// Forwarded header of r.
+func forwardedParam(r *http.Request, param string) string {
+	fwd := r.Header.Get("Forwarded")
+	if fwd == "" {
+		return ""
+	}
+	// only the element added by the proxy closest to the client counts
+	first := strings.SplitN(fwd, ",", 2)[0]
+	for _, pair := range strings.Split(first, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], param) {
+			return strings.Trim(kv[1], `"`)
+		}
+	}
+	return ""
+}
+
+// firstValue returns the first element of a comma separated header.
+func firstValue(v string) string {
+	return strings.TrimSpace(strings.SplitN(v, ",", 2)[0])
+}
+
+// requestHost returns the scheme and host r was addressed to. Behind
+// a trusted proxy they are the ones the client used, as reported by
+// the proxy; the headers of anyone else are ignored, since token urls
+// are built from them.
+func (st *State) requestHost(r *http.Request) (scheme, host string) {
+	trusted := st.fromTrustedProxy(r)
+	if trusted {
+		host = forwardedParam(r, "host")
+		if host == "" {
+			host = firstValue(r.Header.Get("X-Forwarded-Host"))
+		}
+	}
+	if host == "" {
+		host = r.Host
+	}
+
+	if trusted {
+		scheme = forwardedParam(r, "proto")
+		if scheme == "" {
+			scheme = firstValue(r.Header.Get("X-Forwarded-Proto"))
+		}
+	}
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	return strings.ToLower(scheme), strings.ToLower(host)
+}
+
+// forwardedFor returns the client addresses the proxies r went
+// through reported, in the Forwarded header or else the
+// X-Forwarded-For header, the one added by the proxy closest to the
+// client first.
+func forwardedFor(r *http.Request) []string {
+	var ips []string
+	if fwd := r.Header.Get("Forwarded"); fwd != "" {
+		for _, elem := range strings.Split(fwd, ",") {
+			ip := ""
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					ip = strings.Trim(kv[1], `"`)
+				}
+			}
+			ips = append(ips, ip)
+		}
+		return ips
+	}
+	for _, h := range r.Header["X-Forwarded-For"] {
+		for _, ip := range strings.Split(h, ",") {
+			ips = append(ips, strings.TrimSpace(ip))
+		}
+	}
+	return ips
+}
+
+// hostIP returns the address of addr without its port.
+func hostIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// literalAddrs returns the addresses host stands for without resolving
+// it: those of localhost, or host itself if it is an address.
+func literalAddrs(host string) []net.IP {
+	if host == "localhost" {
+		return []net.IP{net.IPv6loopback, net.IPv4(127, 0, 0, 1)}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	return nil
+}
+
+// localKind tells why ip only reaches its own machine or link, or
+// returns "" if it does not.
+func localKind(ip net.IP) string {
+	switch {
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsUnspecified():
+		return "unspecified"
+	case ip.IsLinkLocalUnicast():
+		return "link-local"
+	}
+	return ""
+}
+
+// parseNets returns the networks of cidrs, validated by config.Load.
+func parseNets(cidrs []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if _, n, err := net.ParseCIDR(cidr); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// inNets reports whether ip is in one of nets.
+func inNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromTrustedProxy reports whether r came straight from one of the
+// trusted proxies.
+func (st *State) fromTrustedProxy(r *http.Request) bool {
+	nets := parseNets(st.config().TrustedProxies)
+	return inNets(nets, net.ParseIP(hostIP(r.RemoteAddr)))
+}
+
+// ClientIP returns the address of the client r came from. Requests
+// from trusted proxies are followed back through the addresses the
+// proxies reported, up to the first one not of a trusted proxy, so
+// clients cannot pass themselves off as anyone else.
+func (st *State) ClientIP(r *http.Request) string {
+	ip := hostIP(r.RemoteAddr)
+	if !st.fromTrustedProxy(r) {
+		return ip
+	}
+	nets := parseNets(st.config().TrustedProxies)
+	hops := forwardedFor(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip = hostIP(hops[i])
+		if !inNets(nets, net.ParseIP(ip)) {
+			break
+		}
+	}
+	return ip
+}
+
+// discoveryHost returns the url prefix of the tokens created by r. It
+// is the host r was addressed to if that host is allowed, and the
+// configured discovery host otherwise. When only the host matches an
+// allowed url, for instance behind a TLS terminating proxy that does
+// not forward the scheme, the scheme of the allowed url is used.
+func (st *State) discoveryHost(r *http.Request) string {
+	cfg := st.config()
+	if len(cfg.AllowedHosts) == 0 {
+		return st.discHost
+	}
+
+	scheme, host := st.requestHost(r)
+	fallback := ""
+	for _, allowed := range cfg.AllowedHosts {
+		i := strings.Index(allowed, "://")
+		if !strings.EqualFold(allowed[i+3:], host) {
+			continue
+		}
+		if strings.EqualFold(allowed[:i], scheme) {
+			return allowed
+		}
+		if fallback == "" {
+			fallback = allowed
+		}
+	}
+	if fallback != "" {
+		return fallback
+	}
+	return st.discHost
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/discovery.etcd.io/handlers/httperror"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/etcd/client"
+	"github.com/gorilla/mux"
+)
+
+// Media types of the bootstrap config of a token.
+const (
+	mediaText    = "text/plain"
+	mediaJSON    = "application/json"
+	mediaEnv     = "text/x-env"
+	mediaSystemd = "text/x-systemd-unit"
+)
+
+var (
+	initialClusterOffers = []string{mediaText, mediaJSON, mediaEnv, mediaSystemd}
+
+	// initialClusterFormats lets clients without control over the
+	// Accept header pick a format with ?format=.
+	initialClusterFormats = map[string]string{
+		"text":    mediaText,
+		"json":    mediaJSON,
+		"env":     mediaEnv,
+		"systemd": mediaSystemd,
+	}
+)
+
+// bootstrapConfig is the JSON form of the initial cluster of a token.
+type bootstrapConfig struct {
+	InitialCluster string   `json:"initialCluster"`
+	Members        []member `json:"members"`
+}
+
+// InitialClusterHandler returns the etcd bootstrap config of a full
+// token in the negotiated format: the --initial-cluster flag value, a
+// JSON document, an environment file or a systemd drop-in.
+func InitialClusterHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	ns, ok := st.namespace(r)
+	if !ok {
+		httperror.Error(w, r, "unknown namespace", http.StatusNotFound, tokenCounter)
+		return
+	}
+
+	mediaType := negotiate(r, initialClusterOffers)
+	if f := r.URL.Query().Get("format"); f != "" {
+		if mediaType, ok = initialClusterFormats[f]; !ok {
+			httperror.Error(w, r, fmt.Sprintf("unknown format %q", f), http.StatusBadRequest, tokenCounter)
+			return
+		}
+	}
+	if mediaType == "" {
+		httperror.Error(w, r, "supported types are text/plain, application/json, text/x-env and text/x-systemd-unit", http.StatusNotAcceptable, tokenCounter)
+		return
+	}
+
+	token := mux.Vars(r)["token"]
+	size, ms, err := st.tokenMembers(ctx, ns, token)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			httperror.Error(w, r, "token not found", http.StatusNotFound, tokenCounter)
+			return
+		}
+		logging.Errorf("Error reading token members: %v", err)
+		httperror.Error(w, r, "", http.StatusInternalServerError, tokenCounter)
+		return
+	}
+	if size == 0 || len(ms) < size {
+		msg := fmt.Sprintf("cluster is not complete, %d of %d members registered", len(ms), size)
+		if ex, err := st.tokenExpectation(ctx, ns, token); err == nil && ex != nil {
+			if missing := ex.missing(ms); len(missing) > 0 {
+				msg += ", waiting for " + strings.Join(missing, ", ")
+			}
+		}
+		httperror.Error(w, r, msg, http.StatusConflict, tokenCounter)
+		return
+	}
+	ms = ms[:size]
+	ic := initialCluster(ms)
+
+	w.Header().Set("Vary", "Accept")
+	switch mediaType {
+	case mediaJSON:
+		writeJSON(w, http.StatusOK, bootstrapConfig{InitialCluster: ic, Members: ms})
+	case mediaEnv:
+		w.Header().Set("Content-Type", mediaEnv)
+		fmt.Fprintf(w, "ETCD_INITIAL_CLUSTER=%s\nETCD_INITIAL_CLUSTER_STATE=new\n", ic)
+	case mediaSystemd:
+		w.Header().Set("Content-Type", mediaSystemd)
+		fmt.Fprintf(w, "[Service]\nEnvironment=\"ETCD_INITIAL_CLUSTER=%s\"\nEnvironment=\"ETCD_INITIAL_CLUSTER_STATE=new\"\n", ic)
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, ic)
+	}
+	tokenCounter.WithLabelValues("200", r.Method).Add(1)
+}
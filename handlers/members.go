@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/etcd/client"
+)
+
+// member is a registration with a token. Its value lists name=peerURL
+// pairs, as etcd registers them.
+type member struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	PeerURLs     []string `json:"peerURLs"`
+	CreatedIndex uint64   `json:"createdIndex"`
+	// Quorum is whether the member is one of the first size members,
+	// rather than an overflow registration that becomes a proxy.
+	Quorum bool `json:"quorum"`
+	// Metadata is what the member told about itself when it
+	// registered, such as its zone.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	value    string
+}
+
+func parseMember(n *client.Node) member {
+	m := member{ID: path.Base(n.Key), CreatedIndex: n.CreatedIndex, value: n.Value}
+	for _, pair := range strings.Split(n.Value, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if m.Name == "" {
+			m.Name = kv[0]
+		}
+		m.PeerURLs = append(m.PeerURLs, kv[1])
+	}
+	return m
+}
+
+// tokenMembers returns the size of token in ns, 0 if it has none, and
+// its members in registration order. Like etcd, the first size members
+// form the cluster. The metadata of the members includes the member
+// requests answered before.
+func (st *State) tokenMembers(ctx context.Context, ns config.Namespace, token string) (int, []member, error) {
+	st.awaitMemberWork(ctx, tokenRef{ns, token})
+	cfg, err := st.tokenConfig(ctx, ns, token)
+	if err != nil && !client.IsKeyNotFound(err) {
+		return 0, nil, err
+	}
+	size, _ := strconv.Atoi(cfg["size"])
+
+	sh := st.tokenShard(ctx, ns, token)
+	getCtx, done := startEtcd(ctx, "token_get", sh.endpoint)
+	resp, err := sh.keysAPI().Get(getCtx, tokenKey(ns, token), nil)
+	done(err)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var ms []member
+	for _, n := range resp.Node.Nodes {
+		if !n.Dir {
+			ms = append(ms, parseMember(n))
+		}
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].CreatedIndex < ms[j].CreatedIndex })
+	mds, err := st.membersMetadata(ctx, ns, token)
+	if err != nil {
+		return 0, nil, err
+	}
+	for i := range ms {
+		ms[i].Quorum = i < size
+		ms[i].Metadata = mds[ms[i].ID]
+	}
+	return size, ms, nil
+}
+
+// initialCluster returns the --initial-cluster flag value of ms.
+func initialCluster(ms []member) string {
+	values := make([]string, len(ms))
+	for i, m := range ms {
+		values[i] = m.value
+	}
+	return strings.Join(values, ",")
+}
+
+// markQuorum adds a quorum field to the members of a token listing,
+// true for the first size members, which form the cluster, and false
+// for the overflow. Listings it cannot read are returned as they are.
+func markQuorum(listing []byte, size int) []byte {
+	var resp map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(listing))
+	dec.UseNumber()
+	if err := dec.Decode(&resp); err != nil {
+		return listing
+	}
+	node, _ := resp["node"].(map[string]interface{})
+	nodes, _ := node["nodes"].([]interface{})
+
+	type ranked struct {
+		node  map[string]interface{}
+		index int64
+	}
+	var ms []ranked
+	for _, n := range nodes {
+		n, ok := n.(map[string]interface{})
+		if !ok || n["dir"] == true {
+			continue
+		}
+		index, _ := n["createdIndex"].(json.Number)
+		i, err := index.Int64()
+		if err != nil {
+			return listing
+		}
+		ms = append(ms, ranked{n, i})
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].index < ms[j].index })
+	for i, m := range ms {
+		m.node["quorum"] = i < size
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return listing
+	}
+	return append(b, '\n')
+}
+
+// sizeCacheTTL is how long the size of a token is cached for marking
+// its listings. Sizes only change when the token is reset, which drops
+// the cached size of the instance that reset it; other instances pick
+// the new size up within the ttl.
+const sizeCacheTTL = time.Minute
+
+// cachedSize is the size of a token as read at some time.
+type cachedSize struct {
+	size int
+	at   time.Time
+}
+
+// tokenSize returns the size of token, cached for sizeCacheTTL.
+func (st *State) tokenSize(ctx context.Context, ns config.Namespace, token string) (int, error) {
+	ref := tokenRef{ns, token}
+	st.sizesMu.Lock()
+	c, ok := st.sizes[ref]
+	st.sizesMu.Unlock()
+	if ok && time.Since(c.at) < sizeCacheTTL {
+		return c.size, nil
+	}
+
+	cfg, err := st.tokenConfig(ctx, ns, token)
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.Atoi(cfg["size"])
+	if err != nil {
+		return 0, err
+	}
+	st.sizesMu.Lock()
+	if st.sizes == nil {
+		st.sizes = make(map[tokenRef]cachedSize)
+	}
+	st.sizes[ref] = cachedSize{size, time.Now()}
+	st.sizesMu.Unlock()
+	return size, nil
+}
+
+// forgetSize drops the cached size of token.
+func (st *State) forgetSize(ns config.Namespace, token string) {
+	st.sizesMu.Lock()
+	delete(st.sizes, tokenRef{ns, token})
+	st.sizesMu.Unlock()
+}
+
+// pruneSizes drops the cached sizes older than sizeCacheTTL, which
+// include those of tokens that expired.
+func (st *State) pruneSizes() {
+	st.sizesMu.Lock()
+	for ref, c := range st.sizes {
+		if time.Since(c.at) >= sizeCacheTTL {
+			delete(st.sizes, ref)
+		}
+	}
+	st.sizesMu.Unlock()
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/etcd/client"
+)
+
+// metadataKey returns the etcd key of the metadata of the members of
+// token in ns, joined with elems. Members register their metadata
+// while others watch the token, so it is kept out of the token
+// directory, and members read the same registry as without it.
+func metadataKey(ns config.Namespace, token string, elems ...string) string {
+	return path.Join(append([]string{ns.Prefix, "_metadata", token}, elems...)...)
+}
+
+// parseMetadata reads member metadata given as key=value pairs, with
+// the same limits as token labels. It returns nil if there are none.
+func parseMetadata(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	if len(pairs) > maxLabels {
+		return nil, fmt.Errorf("more than %d metadata entries", maxLabels)
+	}
+	md := make(map[string]string)
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || !labelKey.MatchString(kv[0]) || len(kv[1]) > 256 {
+			return nil, fmt.Errorf("invalid metadata %q", pair)
+		}
+		md[kv[0]] = kv[1]
+	}
+	return md, nil
+}
+
+// registration is the JSON form of a member registration, which may
+// carry the metadata of the member.
+type registration struct {
+	Name     string            `json:"name"`
+	PeerURLs []string          `json:"peerURLs"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// readRegistration reads the registration value and metadata of a
+// member from the form body and meta query parameters of a request,
+// or from a JSON body. It returns the form body to pass on to etcd.
+func readRegistration(body []byte, contentType string, query url.Values) (string, map[string]string, []byte, error) {
+	if !strings.HasPrefix(contentType, mediaJSON) {
+		form, _ := url.ParseQuery(string(body))
+		md, err := parseMetadata(query["meta"])
+		return form.Get("value"), md, body, err
+	}
+
+	var reg registration
+	if err := json.Unmarshal(body, &reg); err != nil {
+		return "", nil, nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if reg.Name == "" || len(reg.PeerURLs) == 0 {
+		return "", nil, nil, fmt.Errorf("a name and peer urls are required")
+	}
+	pairs := make([]string, len(reg.PeerURLs))
+	for i, p := range reg.PeerURLs {
+		pairs[i] = reg.Name + "=" + p
+	}
+	value := strings.Join(pairs, ",")
+
+	var mdPairs []string
+	for k, v := range reg.Metadata {
+		mdPairs = append(mdPairs, k+"="+v)
+	}
+	sort.Strings(mdPairs)
+	md, err := parseMetadata(mdPairs)
+	return value, md, []byte(url.Values{"value": {value}}.Encode()), err
+}
+
+// setMemberMetadata records the metadata of member id, expiring along
+// with the token after ttl unless it is 0.
+func (st *State) setMemberMetadata(ctx context.Context, ns config.Namespace, token, id string, md map[string]string, ttl time.Duration) error {
+	b, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	sh := st.tokenShard(ctx, ns, token)
+	ctx, done := startEtcd(ctx, "metadata_set", sh.endpoint)
+	_, err = sh.keysAPI().Set(ctx, metadataKey(ns, token, id), string(b), &client.SetOptions{TTL: ttl})
+	done(err)
+	return err
+}
+
+// deleteMemberMetadata removes the metadata of member id.
+func (st *State) deleteMemberMetadata(ctx context.Context, ns config.Namespace, token, id string) error {
+	sh := st.tokenShard(ctx, ns, token)
+	ctx, done := startEtcd(ctx, "metadata_delete", sh.endpoint)
+	_, err := sh.keysAPI().Delete(ctx, metadataKey(ns, token, id), nil)
+	done(err)
+	if err != nil && !client.IsKeyNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// membersMetadata returns the metadata of the members of token, by
+// member id.
+func (st *State) membersMetadata(ctx context.Context, ns config.Namespace, token string) (map[string]map[string]string, error) {
+	sh := st.tokenShard(ctx, ns, token)
+	getCtx, done := startEtcd(ctx, "metadata_get", sh.endpoint)
+	resp, err := sh.keysAPI().Get(getCtx, metadataKey(ns, token), nil)
+	done(err)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	mds := make(map[string]map[string]string)
+	for _, n := range resp.Node.Nodes {
+		var md map[string]string
+		if err := json.Unmarshal([]byte(n.Value), &md); err == nil {
+			mds[path.Base(n.Key)] = md
+		}
+	}
+	return mds, nil
+}
+
+// failureDomains are the metadata keys naming where members run, which
+// no more than a minority of the cluster should share.
+var failureDomains = []string{"zone", "rack"}
+
+// diagnoseMetadata checks how the members forming the cluster of a
+// token of the given size spread over failure domains, and that they
+// run the same etcd version.
+func diagnoseMetadata(size int, ms []member) []finding {
+	if size > 0 && len(ms) > size {
+		ms = ms[:size]
+	}
+	var fs []finding
+	if size >= 3 {
+		for _, key := range failureDomains {
+			domains := make(map[string][]string)
+			for _, m := range ms {
+				if d := m.Metadata[key]; d != "" {
+					domains[d] = append(domains[d], m.ID)
+				}
+			}
+			for _, d := range sortedKeys(domains) {
+				if ids := domains[d]; len(ids) > size/2 {
+					fs = append(fs, finding{
+						Severity: severityWarning,
+						Check:    key,
+						Message:  fmt.Sprintf("%d of %d members are in %s %s, losing it loses quorum", len(ids), size, key, d),
+						Members:  ids,
+					})
+				}
+			}
+		}
+	}
+
+	versions := make(map[string][]string)
+	for _, m := range ms {
+		if v := m.Metadata["version"]; v != "" {
+			versions[v] = append(versions[v], m.ID)
+		}
+	}
+	if len(versions) > 1 {
+		fs = append(fs, finding{
+			Severity: severityWarning,
+			Check:    "version",
+			Message:  fmt.Sprintf("members run etcd versions %s", strings.Join(sortedKeys(versions), ", ")),
+		})
+	}
+	return fs
+}
+
+// updateMemberMetadata records the metadata md of a member that
+// registered, or removes that of a member that unregistered.
+func (st *State) updateMemberMetadata(ctx context.Context, ns config.Namespace, token, method, id string, md map[string]string) {
+	var err error
+	switch {
+	case method == http.MethodDelete:
+		err = st.deleteMemberMetadata(ctx, ns, token, id)
+	case len(md) > 0:
+		var ttl time.Duration
+		if ttl, err = st.tokenTTL(ctx, ns, token); err == nil {
+			err = st.setMemberMetadata(ctx, ns, token, id, md, ttl)
+		}
+	}
+	if err != nil {
+		logging.Warnf("failed to update metadata of member %s of %s: %v", id, token, err)
+	}
+}
+
+// metadataString formats metadata as sorted key=value pairs.
+func metadataString(md map[string]string) string {
+	pairs := make([]string, 0, len(md))
+	for k, v := range md {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/metrics"
+	"github.com/coreos/discovery.etcd.io/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	etcdRequestDuration  *prometheus.HistogramVec
+	etcdRequestErrors    *prometheus.CounterVec
+	longPollsInFlight    prometheus.Gauge
+	proxyRetries         prometheus.Counter
+	leaderRedirects      prometheus.Counter
+	liveTokens           prometheus.Gauge
+	completedBootstraps  prometheus.Gauge
+	stalledBootstraps    prometheus.Gauge
+	requestedSize        *prometheus.HistogramVec
+	tokensCreated        *prometheus.CounterVec
+	tokensRejected       *prometheus.CounterVec
+	tenantLiveTokens     *prometheus.GaugeVec
+	firstMemberDuration  prometheus.Histogram
+	completeDuration     prometheus.Histogram
+	overflowMembers      prometheus.Counter
+	shardUp              *prometheus.GaugeVec
+	shardTokens          *prometheus.GaugeVec
+	shardMisplacedTokens *prometheus.GaugeVec
+	mirrorUpstreamUp     prometheus.Gauge
+	mirrorLastSync       prometheus.Gauge
+	mirrorCachedTokens   prometheus.Gauge
+	mirrorSyncErrors     prometheus.Counter
+	mirrorFallbacks      prometheus.Counter
+	peerChecks           *prometheus.CounterVec
+)
+
+func init() {
+	etcdRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "etcd_request_duration_seconds",
+			Help:    "Latency of requests to etcd, partitioned by operation and etcd endpoint.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		},
+		[]string{"operation", "endpoint"},
+	)
+	etcdRequestErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "etcd_request_errors_total",
+			Help: "How many requests to etcd failed, partitioned by operation and etcd endpoint.",
+		},
+		[]string{"operation", "endpoint"},
+	)
+	longPollsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "token_long_polls_in_flight",
+			Help: "How many wait=true token requests are currently being served.",
+		},
+	)
+	proxyRetries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "proxy_retries_total",
+			Help: "How many times a proxied token request was retried against etcd.",
+		},
+	)
+	leaderRedirects = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "proxy_leader_redirects_total",
+			Help: "How many times etcd redirected a proxied token request to a new leader.",
+		},
+	)
+	liveTokens = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tokens_live",
+			Help: "How many tokens exist in the registry, as of the last registry scan.",
+		},
+	)
+	completedBootstraps = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tokens_completed_bootstraps",
+			Help: "How many tokens have at least as many members as their size, as of the last registry scan.",
+		},
+	)
+	stalledBootstraps = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tokens_stalled_bootstraps",
+			Help: "How many partially filled tokens are older than the stall threshold, as of the last registry scan.",
+		},
+	)
+	requestedSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "bootstrap_requested_size",
+			Help:    "Cluster sizes requested through /new, partitioned by tenant.",
+			Buckets: []float64{1, 2, 3, 4, 5, 6, 7, 9, 11, 15, 25, 50, 100},
+		},
+		[]string{"tenant"},
+	)
+	tokensCreated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tokens_created_total",
+			Help: "How many tokens were created through /new, partitioned by tenant.",
+		},
+		[]string{"tenant"},
+	)
+	tokensRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tokens_rejected_total",
+			Help: "How many token creations exceeded a tenant limit, partitioned by tenant and limit.",
+		},
+		[]string{"tenant", "reason"},
+	)
+	tenantLiveTokens = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tenant_tokens_live",
+			Help: "How many tokens exist in the registry, partitioned by tenant, as of the last registry scan.",
+		},
+		[]string{"tenant"},
+	)
+	firstMemberDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "bootstrap_first_member_seconds",
+			Help:    "Time from token creation to the first member registration.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 18),
+		},
+	)
+	completeDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "bootstrap_complete_seconds",
+			Help:    "Time from token creation until as many members as its size registered.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 18),
+		},
+	)
+	overflowMembers = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "bootstrap_overflow_registrations_total",
+			Help: "How many members registered with tokens that already had as many members as their size.",
+		},
+	)
+	shardUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "shard_up",
+			Help: "Whether the last scan of a shard succeeded, partitioned by shard.",
+		},
+		[]string{"shard"},
+	)
+	shardTokens = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "shard_tokens_live",
+			Help: "How many tokens exist on a shard, partitioned by shard, as of the last shard scan.",
+		},
+		[]string{"shard"},
+	)
+	shardMisplacedTokens = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "shard_misplaced_tokens",
+			Help: "How many tokens on a shard belong on another shard until they are rebalanced, partitioned by shard.",
+		},
+		[]string{"shard"},
+	)
+	mirrorUpstreamUp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mirror_upstream_up",
+			Help: "Whether the last request to the mirror upstream succeeded.",
+		},
+	)
+	mirrorLastSync = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mirror_last_sync_timestamp_seconds",
+			Help: "When every cached token was last refreshed from the mirror upstream.",
+		},
+	)
+	mirrorCachedTokens = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mirror_cached_tokens",
+			Help: "How many upstream tokens are cached, as of the last refresh.",
+		},
+	)
+	mirrorSyncErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mirror_sync_errors_total",
+			Help: "How many times refreshing a cached token from the mirror upstream failed.",
+		},
+	)
+	mirrorFallbacks = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mirror_fallback_requests_total",
+			Help: "How many token reads were served from the cache because the mirror upstream was unreachable.",
+		},
+	)
+	peerChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "peer_checks_total",
+			Help: "How many registrations passed or failed each peer url check, partitioned by check and result.",
+		},
+		[]string{"check", "result"},
+	)
+	metrics.Registry.MustRegister(
+		etcdRequestDuration,
+		etcdRequestErrors,
+		longPollsInFlight,
+		proxyRetries,
+		leaderRedirects,
+		liveTokens,
+		completedBootstraps,
+		stalledBootstraps,
+		requestedSize,
+		tokensCreated,
+		tokensRejected,
+		tenantLiveTokens,
+		firstMemberDuration,
+		completeDuration,
+		overflowMembers,
+		shardUp,
+		shardTokens,
+		shardMisplacedTokens,
+		mirrorUpstreamUp,
+		mirrorLastSync,
+		mirrorCachedTokens,
+		mirrorSyncErrors,
+		mirrorFallbacks,
+		peerChecks,
+	)
+}
+
+// startEtcd times one etcd request and traces it as a child of the
+// span carried by ctx. The returned function records the outcome of
+// the request.
+func startEtcd(ctx context.Context, op, endpoint string) (context.Context, func(error)) {
+	ctx, span := tracing.Start(ctx, "etcd "+op, tracing.KindClient)
+	span.SetAttribute("etcd.endpoint", endpoint)
+	start := time.Now()
+	return ctx, func(err error) {
+		etcdRequestDuration.WithLabelValues(op, endpoint).Observe(time.Since(start).Seconds())
+		if err != nil {
+			etcdRequestErrors.WithLabelValues(op, endpoint).Add(1)
+		}
+		span.SetError(err)
+		span.End()
+	}
+}
@@ -0,0 +1,627 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/handlers/httperror"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// migrationInterval is how often the whole registry is copied to v3
+// again and verified while migrating.
+const migrationInterval = 5 * time.Minute
+
+// migrationCopyTimeout bounds the copy to v3 of one token written
+// through the service.
+const migrationCopyTimeout = time.Second
+
+// maxMigrationTxn is how many writes go into one v3 transaction, below
+// the default limit of etcd.
+const maxMigrationTxn = 64
+
+// Phases of the migration to v3.
+const (
+	phaseCopying   = "copying"
+	phaseVerifying = "verifying"
+	phaseSynced    = "synced"
+	phaseOutOfSync = "out-of-sync"
+)
+
+var errMigrationDisabled = errors.New("migration to v3 is not enabled")
+
+// dir returns the v3 key prefix of the token directory of ref.
+func (ref tokenRef) dir() string {
+	return "/" + tokenKey(ref.ns, ref.token) + "/"
+}
+
+// v3Key returns the v3 key the v2 key of ref is migrated to. The v3
+// layout keeps the v2 paths, with directories implied by the keys
+// under them, except for members: they move to members/ beside the
+// _config of the token, where etcd v3 discovery looks for them.
+func (ref tokenRef) v3Key(v2Key string) string {
+	key := "/" + strings.TrimPrefix(v2Key, "/")
+	if id := strings.TrimPrefix(key, ref.dir()); id != key && !strings.Contains(id, "/") {
+		return ref.dir() + "members/" + id
+	}
+	return key
+}
+
+// stateKeys returns the directories of the state of ref copied to v3
+// with it. The config index is left out: it only spares v2 registry
+// scans from reading the hidden config of every token.
+func (ref tokenRef) stateKeys() []string {
+	return []string{progressKey(ref.ns, ref.token), historyKey(ref.ns, ref.token), metadataKey(ref.ns, ref.token), peerCheckKey(ref.ns, ref.token)}
+}
+
+// migrationReport compares the v2 and v3 copies of the registry.
+type migrationReport struct {
+	Time   time.Time `json:"time"`
+	Tokens int       `json:"tokens"`
+	Keys   int       `json:"keys"`
+	// Missing, Extra and Mismatched are the v3 keys missing from v3,
+	// left in v3 after their v2 key was removed, and holding another
+	// value or expiry than in v2.
+	Missing    []string `json:"missing"`
+	Extra      []string `json:"extra"`
+	Mismatched []string `json:"mismatched"`
+	// Pending are the tokens written since they were verified, whose
+	// copy is still to be made.
+	Pending []string `json:"pending"`
+}
+
+func (r *migrationReport) clean() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Mismatched) == 0
+}
+
+// migrationStatus is the progress of the migration to v3.
+type migrationStatus struct {
+	Phase string `json:"phase"`
+	// Rounds counts the copies of the whole registry.
+	Rounds int `json:"rounds"`
+	// Synced counts the tokens copied after they were written, and
+	// Written the v3 keys put or deleted.
+	Synced    int              `json:"syncedTokens"`
+	Written   int              `json:"writtenKeys"`
+	LastError string           `json:"lastError,omitempty"`
+	Report    *migrationReport `json:"report,omitempty"`
+}
+
+// migrator copies the registry from the v2 store to the v3 keyspace
+// while the service keeps serving from v2. Tokens written through the
+// service are marked pending and copied again in the background right
+// after, so v3 follows v2 through the cutover; the whole registry is
+// copied and verified periodically to repair the copies that failed and
+// what changed behind the service's back. Members keep talking v2 and
+// are never held up by the copies.
+type migrator struct {
+	st *State
+	c  *clientv3.Client
+
+	mu      sync.Mutex
+	pending map[tokenRef]bool
+	status  migrationStatus
+	// leases holds a lease per expiry time, in unix seconds.
+	leases map[int64]clientv3.LeaseID
+
+	// locks serialize the copies of each token, hashed by its key, so
+	// that no copy made from an older read of v2 lands last.
+	locks [64]sync.Mutex
+	// kick wakes the copying of pending tokens.
+	kick   chan struct{}
+	rounds chan chan migrationStatus
+}
+
+// StartMigration starts copying the registry to v3 if the migration is
+// enabled in the configuration of st.
+func StartMigration(ctx context.Context, st *State) error {
+	if !st.config().MigrateV3 {
+		return nil
+	}
+	c, err := clientv3.New(clientv3.Config{Endpoints: []string{st.endpoint()}})
+	if err != nil {
+		return err
+	}
+	m := &migrator{
+		st:      st,
+		c:       c,
+		pending: make(map[tokenRef]bool),
+		status:  migrationStatus{Phase: phaseCopying},
+		leases:  make(map[int64]clientv3.LeaseID),
+		kick:    make(chan struct{}, 1),
+		rounds:  make(chan chan migrationStatus),
+	}
+	st.mu.Lock()
+	st.migrator = m
+	st.mu.Unlock()
+	go m.run(ctx)
+	return nil
+}
+
+func (st *State) getMigrator() *migrator {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.migrator
+}
+
+// migrateToken marks token to be copied to v3 in the background after
+// it was written, if the registry is being migrated. It never waits for
+// the copy.
+func (st *State) migrateToken(ns config.Namespace, token string) {
+	m := st.getMigrator()
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.pending[tokenRef{ns, token}] = true
+	m.mu.Unlock()
+	select {
+	case m.kick <- struct{}{}:
+	default:
+	}
+}
+
+// tokenLock returns the lock of the copies of ref.
+func (m *migrator) tokenLock(ref tokenRef) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(tokenKey(ref.ns, ref.token)))
+	return &m.locks[h.Sum32()%uint32(len(m.locks))]
+}
+
+// pendingTokens returns the keys of the tokens still to be copied.
+func (m *migrator) pendingTokens() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.pending))
+	for ref := range m.pending {
+		keys = append(keys, "/"+tokenKey(ref.ns, ref.token))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *migrator) run(ctx context.Context) {
+	defer m.c.Close()
+	ticker := time.NewTicker(migrationInterval)
+	defer ticker.Stop()
+
+	// pending tokens are copied while whole rounds run
+	go m.copyPending(ctx)
+	m.round(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.round(ctx)
+		case reply := <-m.rounds:
+			reply <- m.round(ctx)
+		}
+	}
+}
+
+// copyPending copies the pending tokens whenever tokens are marked,
+// until ctx is canceled. A copy that fails leaves its token pending
+// until it is written again or the next round.
+func (m *migrator) copyPending(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.kick:
+		}
+		m.mu.Lock()
+		refs := m.pending
+		m.pending = make(map[tokenRef]bool)
+		m.mu.Unlock()
+		for ref := range refs {
+			copyCtx, cancel := context.WithTimeout(ctx, migrationCopyTimeout)
+			n, err := m.syncToken(copyCtx, ref)
+			cancel()
+			m.update(func(s *migrationStatus) {
+				s.Synced++
+				s.Written += n
+				if err != nil {
+					s.LastError = err.Error()
+				}
+			})
+			if err != nil {
+				logging.Warnf("failed to copy %s to v3: %v", ref.token, err)
+				m.mu.Lock()
+				m.pending[ref] = true
+				m.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (m *migrator) update(f func(*migrationStatus)) migrationStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f(&m.status)
+	return m.status
+}
+
+// round copies every token of the registry to v3, then verifies the
+// copy. Tokens that differ are copied once more before they are
+// reported, since members may have registered in between. Tokens left
+// pending before the round are no longer once it copied them.
+func (m *migrator) round(ctx context.Context) migrationStatus {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = make(map[tokenRef]bool)
+	m.mu.Unlock()
+	m.update(func(s *migrationStatus) { s.Phase, s.LastError = phaseCopying, "" })
+	fail := func(err error) migrationStatus {
+		m.mu.Lock()
+		for ref := range pending {
+			m.pending[ref] = true
+		}
+		m.mu.Unlock()
+		logging.Errorf("migration to v3 failed: %v", err)
+		return m.update(func(s *migrationStatus) { s.Phase, s.LastError = phaseOutOfSync, err.Error() })
+	}
+
+	var refs []tokenRef
+	for _, ns := range m.st.config().AllNamespaces() {
+		tokens, err := m.namespaceTokens(ctx, ns)
+		if err != nil {
+			return fail(err)
+		}
+		for _, token := range tokens {
+			refs = append(refs, tokenRef{ns, token})
+		}
+	}
+	written := 0
+	for _, ref := range refs {
+		n, err := m.syncToken(ctx, ref)
+		written += n
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	m.update(func(s *migrationStatus) { s.Phase = phaseVerifying })
+	report := &migrationReport{Time: time.Now().UTC(), Missing: []string{}, Extra: []string{}, Mismatched: []string{}, Pending: []string{}}
+	for _, ref := range refs {
+		diff, keys, err := m.compareToken(ctx, ref)
+		if err == nil && !diff.clean() {
+			var n int
+			n, err = m.syncToken(ctx, ref)
+			written += n
+			if err == nil {
+				diff, keys, err = m.compareToken(ctx, ref)
+			}
+		}
+		if err != nil {
+			return fail(err)
+		}
+		report.Tokens++
+		report.Keys += keys
+		report.Missing = append(report.Missing, diff.Missing...)
+		report.Extra = append(report.Extra, diff.Extra...)
+		report.Mismatched = append(report.Mismatched, diff.Mismatched...)
+	}
+
+	report.Pending = m.pendingTokens()
+
+	phase := phaseSynced
+	if !report.clean() {
+		phase = phaseOutOfSync
+	}
+	logging.Infof("migration round copied %d tokens to v3, %d keys written, %s", report.Tokens, written, phase)
+	m.expireLeases()
+	return m.update(func(s *migrationStatus) {
+		s.Phase = phase
+		s.Rounds++
+		s.Written += written
+		s.Report = report
+	})
+}
+
+// namespaceTokens returns the tokens of ns found in v2 or v3, including
+// the state left of removed tokens.
+func (m *migrator) namespaceTokens(ctx context.Context, ns config.Namespace) ([]string, error) {
+	set := make(map[string]bool)
+	kapi := m.st.keysAPI()
+	// without a token, the state keys are the directories holding the
+	// state of every token
+	for _, dir := range append([]string{ns.Prefix}, (tokenRef{ns: ns}).stateKeys()...) {
+		scanCtx, done := startEtcd(ctx, "registry_scan", m.st.endpoint())
+		resp, err := kapi.Get(scanCtx, dir, nil)
+		done(err)
+		if err != nil {
+			if client.IsKeyNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, n := range resp.Node.Nodes {
+			if n.Dir {
+				set[path.Base(n.Key)] = true
+			}
+		}
+	}
+
+	prefix := "/" + ns.Prefix + "/"
+	resp, err := m.c.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range resp.Kvs {
+		parts := strings.Split(strings.TrimPrefix(string(kv.Key), prefix), "/")
+		switch {
+		case len(parts) < 2:
+		case strings.HasPrefix(parts[0], "_"):
+			// the state of a token, kept beside it
+			set[parts[1]] = true
+		default:
+			set[parts[0]] = true
+		}
+	}
+
+	tokens := make([]string, 0, len(set))
+	for token := range set {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	return tokens, nil
+}
+
+// v2Leaf is a v2 key with its value, the expiry it inherits from its
+// directories and its creation index.
+type v2Leaf struct {
+	key     string
+	value   string
+	expires *time.Time
+	created uint64
+}
+
+// readV2 returns the keys of ref in v2 by v3 key: its members and
+// config, which expire with the token, and its state.
+func (m *migrator) readV2(ctx context.Context, ref tokenRef) (map[string]v2Leaf, error) {
+	leaves := make(map[string]v2Leaf)
+	var flatten func(n *client.Node, expires *time.Time)
+	flatten = func(n *client.Node, expires *time.Time) {
+		if n.Expiration != nil && (expires == nil || n.Expiration.Before(*expires)) {
+			expires = n.Expiration
+		}
+		if !n.Dir {
+			key := ref.v3Key(n.Key)
+			leaves[key] = v2Leaf{key: key, value: n.Value, expires: expires, created: n.CreatedIndex}
+			return
+		}
+		for _, c := range n.Nodes {
+			flatten(c, expires)
+		}
+	}
+
+	kapi := m.st.keysAPI()
+	get := func(key string) (*client.Node, error) {
+		getCtx, done := startEtcd(ctx, "migration_get", m.st.endpoint())
+		resp, err := kapi.Get(getCtx, key, &client.GetOptions{Recursive: true})
+		done(err)
+		if err != nil {
+			if client.IsKeyNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return resp.Node, nil
+	}
+
+	// _config is hidden from listings of the token, so it is read on
+	// its own and inherits the expiry of the token
+	dir, err := get(tokenKey(ref.ns, ref.token))
+	if err != nil {
+		return nil, err
+	}
+	if dir != nil {
+		flatten(dir, nil)
+		cfg, err := get(tokenKey(ref.ns, ref.token, "_config"))
+		if err != nil {
+			return nil, err
+		}
+		if cfg != nil {
+			flatten(cfg, dir.Expiration)
+		}
+	}
+	for _, key := range ref.stateKeys() {
+		n, err := get(key)
+		if err != nil {
+			return nil, err
+		}
+		if n != nil {
+			flatten(n, nil)
+		}
+	}
+	return leaves, nil
+}
+
+// readV3 returns the v3 keys of ref.
+func (m *migrator) readV3(ctx context.Context, ref tokenRef) (map[string]*mvccpb.KeyValue, error) {
+	kvs := make(map[string]*mvccpb.KeyValue)
+	for _, key := range append([]string{tokenKey(ref.ns, ref.token)}, ref.stateKeys()...) {
+		resp, err := m.c.Get(ctx, "/"+key+"/", clientv3.WithPrefix())
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			kvs[string(kv.Key)] = kv
+		}
+	}
+	return kvs, nil
+}
+
+// lease returns the lease of keys expiring at t, granting it if needed.
+func (m *migrator) lease(ctx context.Context, t time.Time) (clientv3.LeaseID, error) {
+	m.mu.Lock()
+	id, ok := m.leases[t.Unix()]
+	m.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	ttl := int64(time.Until(t).Seconds() + 1)
+	resp, err := m.c.Grant(ctx, ttl)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	m.leases[t.Unix()] = resp.ID
+	m.mu.Unlock()
+	return resp.ID, nil
+}
+
+// expireLeases forgets the leases that expired.
+func (m *migrator) expireLeases() {
+	now := time.Now().Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for t := range m.leases {
+		if t < now {
+			delete(m.leases, t)
+		}
+	}
+}
+
+// syncToken makes the v3 copy of ref match v2 as read under the lock
+// of ref, and returns how many keys it put or deleted. Keys are created in the order they were
+// created in v2, so members keep their order in v3.
+func (m *migrator) syncToken(ctx context.Context, ref tokenRef) (int, error) {
+	mu := m.tokenLock(ref)
+	mu.Lock()
+	defer mu.Unlock()
+
+	leaves, err := m.readV2(ctx, ref)
+	if err != nil {
+		return 0, err
+	}
+	kvs, err := m.readV3(ctx, ref)
+	if err != nil {
+		return 0, err
+	}
+
+	sorted := make([]v2Leaf, 0, len(leaves))
+	for _, l := range leaves {
+		sorted = append(sorted, l)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].created < sorted[j].created })
+
+	// keys written in one transaction share their revision, so new keys
+	// are created one by one to keep their order
+	var ops []clientv3.Op
+	created := 0
+	for _, l := range sorted {
+		var opts []clientv3.OpOption
+		var id clientv3.LeaseID
+		if l.expires != nil {
+			if time.Until(*l.expires) < time.Second {
+				continue
+			}
+			if id, err = m.lease(ctx, *l.expires); err != nil {
+				return 0, err
+			}
+			opts = append(opts, clientv3.WithLease(id))
+		}
+		kv := kvs[l.key]
+		switch {
+		case kv == nil:
+			if _, err := m.c.Put(ctx, l.key, l.value, opts...); err != nil {
+				return created, err
+			}
+			created++
+		case string(kv.Value) != l.value || clientv3.LeaseID(kv.Lease) != id:
+			ops = append(ops, clientv3.OpPut(l.key, l.value, opts...))
+		}
+	}
+	for key := range kvs {
+		if _, ok := leaves[key]; !ok {
+			ops = append(ops, clientv3.OpDelete(key))
+		}
+	}
+
+	written := created + len(ops)
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maxMigrationTxn {
+			n = maxMigrationTxn
+		}
+		if _, err := m.c.Txn(ctx).Then(ops[:n]...).Commit(); err != nil {
+			return created, err
+		}
+		ops = ops[n:]
+	}
+	return written, nil
+}
+
+// compareToken reports how the v3 copy of ref differs from v2, and how
+// many v2 keys it compared.
+func (m *migrator) compareToken(ctx context.Context, ref tokenRef) (migrationReport, int, error) {
+	var diff migrationReport
+	leaves, err := m.readV2(ctx, ref)
+	if err != nil {
+		return diff, 0, err
+	}
+	kvs, err := m.readV3(ctx, ref)
+	if err != nil {
+		return diff, 0, err
+	}
+	for key, l := range leaves {
+		if l.expires != nil && time.Until(*l.expires) < time.Second {
+			continue
+		}
+		kv := kvs[key]
+		switch {
+		case kv == nil:
+			diff.Missing = append(diff.Missing, key)
+		case string(kv.Value) != l.value || (kv.Lease != 0) != (l.expires != nil):
+			diff.Mismatched = append(diff.Mismatched, key)
+		}
+	}
+	for key := range kvs {
+		if _, ok := leaves[key]; !ok {
+			diff.Extra = append(diff.Extra, key)
+		}
+	}
+	sort.Strings(diff.Missing)
+	sort.Strings(diff.Extra)
+	sort.Strings(diff.Mismatched)
+	return diff, len(leaves), nil
+}
+
+// MigrationHandler reports the progress of the migration to v3 with
+// the report of the last verification. POST copies and verifies the
+// whole registry right away.
+func MigrationHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	m := st.getMigrator()
+	if m == nil {
+		httperror.Error(w, r, errMigrationDisabled.Error(), http.StatusNotFound, adminCounter)
+		return
+	}
+	if r.Method == http.MethodPost {
+		reply := make(chan migrationStatus, 1)
+		select {
+		case m.rounds <- reply:
+		case <-r.Context().Done():
+			return
+		}
+		writeJSON(w, http.StatusOK, <-reply)
+		adminCounter.WithLabelValues("200", r.Method).Add(1)
+		return
+	}
+	writeJSON(w, http.StatusOK, m.update(func(*migrationStatus) {}))
+	adminCounter.WithLabelValues("200", r.Method).Add(1)
+}
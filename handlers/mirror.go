@@ -0,0 +1,531 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/audit"
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/handlers/httperror"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/etcd/client"
+	"github.com/gorilla/mux"
+)
+
+// mirrorTimeout bounds the upstream requests other than long polls.
+const mirrorTimeout = 10 * time.Second
+
+// mirroredHeaders are the request headers passed on to the upstream.
+// Credentials are for the mirror, and are never passed on.
+var mirroredHeaders = []string{"Accept", "Content-Type"}
+
+var tokenID = regexp.MustCompile(`^[a-f0-9]{32}$`)
+
+// cacheIndexBase is added to the etcd indexes of the answers served
+// from the cache. Members watch from the indexes of the answers they
+// got, and indexes of the cache mean nothing to the upstream: shifted,
+// they are told apart from the indexes of the upstream, which stay far
+// below.
+const cacheIndexBase = 1 << 40
+
+// mirror forwards the tokens of the default namespace to an upstream
+// discovery service, and keeps a copy of them in etcd to serve reads
+// and watches from while the upstream cannot be reached.
+type mirror struct {
+	st       *State
+	upstream string
+	apiKey   string
+	client   *http.Client
+
+	mu sync.Mutex
+	up bool
+	// pending are the tokens to cache again once the upstream changed
+	// them, each at most once however often it changed.
+	pending map[string]bool
+	kick    chan struct{}
+}
+
+// StartMirror starts refreshing the cached tokens if an upstream is
+// configured for st.
+func StartMirror(ctx context.Context, st *State) {
+	cfg := st.config().Mirror
+	if cfg.Upstream == "" {
+		return
+	}
+	m := &mirror{
+		st:       st,
+		upstream: cfg.Upstream,
+		apiKey:   cfg.APIKey,
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:       http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+		}},
+		up:      true,
+		pending: make(map[string]bool),
+		kick:    make(chan struct{}, 1),
+	}
+	st.mu.Lock()
+	st.mirror = m
+	st.mu.Unlock()
+	mirrorUpstreamUp.Set(1)
+	go m.run(ctx, cfg.SyncInterval)
+	go m.syncPending(ctx)
+}
+
+// mirrored returns the mirror forwarding the tokens of ns, or nil if
+// they are served locally.
+func (st *State) mirrored(ns config.Namespace) *mirror {
+	if ns.Name != "" {
+		return nil
+	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.mirror
+}
+
+func (m *mirror) setUp(up bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if up != m.up {
+		if up {
+			logging.Infof("mirror upstream %s is reachable again", m.upstream)
+		} else {
+			logging.Warnf("mirror upstream %s is unreachable, serving reads from the cache", m.upstream)
+		}
+	}
+	m.up = up
+	if up {
+		mirrorUpstreamUp.Set(1)
+	} else {
+		mirrorUpstreamUp.Set(0)
+	}
+}
+
+func (m *mirror) isUp() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.up
+}
+
+// do sends a request to the upstream, with the API key of the mirror
+// if keyed. Answers with a 5xx status count as the upstream being
+// unreachable.
+func (m *mirror) do(ctx context.Context, method, p, query string, body []byte, header http.Header, keyed bool) (*http.Response, error) {
+	u := m.upstream + p
+	if query != "" {
+		u += "?" + query
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for _, h := range mirroredHeaders {
+		if v := header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	if keyed && m.apiKey != "" {
+		req.Header.Set(APIKeyHeader, m.apiKey)
+	}
+	resp, err := m.client.Do(req)
+	if err == nil && resp.StatusCode >= 500 {
+		resp.Body.Close()
+		err = fmt.Errorf("upstream answered %s", resp.Status)
+	}
+	m.setUp(err == nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// get reads an etcd response of the upstream at p, which is nil if
+// there is no such key.
+func (m *mirror) get(ctx context.Context, p string) (*client.Response, error) {
+	resp, err := m.do(ctx, http.MethodGet, p, "", nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream answered %s", resp.Status)
+	}
+	var r client.Response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	if r.Node == nil {
+		return nil, fmt.Errorf("upstream answered without a node")
+	}
+	return &r, nil
+}
+
+// serveNew creates a token for tenant at the upstream and caches it,
+// once r was admitted locally. Tokens cannot be created while the
+// upstream is unreachable.
+func (m *mirror) serveNew(ctx context.Context, w http.ResponseWriter, r *http.Request, ns config.Namespace, tenant string) {
+	// the form body was read in admitting r
+	body := []byte(r.PostForm.Encode())
+	upCtx, cancel := context.WithTimeout(r.Context(), mirrorTimeout)
+	defer cancel()
+	resp, err := m.do(upCtx, r.Method, "/new", r.URL.RawQuery, body, r.Header, true)
+	if err != nil {
+		m.st.quotas.release(tenant, false)
+		logging.Errorf("mirror failed to create a token: %v", err)
+		httperror.Error(w, r, "Unable to reach the upstream", http.StatusServiceUnavailable, newCounter)
+		return
+	}
+	defer resp.Body.Close()
+	answer, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		m.st.quotas.release(tenant, false)
+		logging.Errorf("mirror failed to read a new token: %v", err)
+		httperror.Error(w, r, "Unable to reach the upstream", http.StatusServiceUnavailable, newCounter)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		m.st.quotas.release(tenant, false)
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		w.Write(answer)
+		newCounter.WithLabelValues(strconv.Itoa(resp.StatusCode), r.Method).Add(1)
+		return
+	}
+	token := path.Base(strings.TrimSpace(string(answer)))
+	if !tokenID.MatchString(token) {
+		m.st.quotas.release(tenant, false)
+		logging.Errorf("mirror got an invalid token url from the upstream: %q", answer)
+		httperror.Error(w, r, "Unable to generate token", http.StatusBadGateway, newCounter)
+		return
+	}
+	audit.SetToken(ctx, token)
+
+	if err := m.syncToken(ctx, token); err != nil {
+		logging.Warnf("mirror failed to cache %s: %v", token, err)
+	} else if tenant != anonymousTenant {
+		// the cached token counts against the tenant, and resets
+		// through the mirror are checked against it
+		if _, err := m.st.setTokenValue(ctx, ns, token, "tenant", tenant, true); err != nil {
+			logging.Warnf("failed to tag %s with tenant %s: %v", token, tenant, err)
+		}
+	}
+	m.st.quotas.release(tenant, true)
+	tokensCreated.WithLabelValues(tenant).Inc()
+	logging.Infof("New cluster created %s at %s for %s", token, m.upstream, tenant)
+
+	fmt.Fprint(w, m.st.tokenURL(r, ns, token))
+	newCounter.WithLabelValues("200", r.Method).Add(1)
+}
+
+// serveToken forwards a token request to the upstream, with the API key
+// of the mirror if keyed, and refreshes the cached token after changes.
+// It returns false without answering if the upstream is unreachable and
+// r may be served from the cache.
+func (m *mirror) serveToken(ctx context.Context, w http.ResponseWriter, r *http.Request, ns config.Namespace, keyed bool) bool {
+	token := mux.Vars(r)["token"]
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	q := r.URL.Query()
+	if i, err := strconv.ParseUint(q.Get("waitIndex"), 10, 64); err == nil && i >= cacheIndexBase {
+		// the member watches from an answer of the cache, which the
+		// upstream cannot resume from: it lists the token again
+		if m.isUp() {
+			refuseCacheIndex(w, r)
+			return true
+		}
+		mirrorFallbacks.Inc()
+		q.Set("waitIndex", strconv.FormatUint(i-cacheIndexBase, 10))
+		r.URL.RawQuery = q.Encode()
+		return false
+	}
+
+	upCtx := r.Context()
+	wait := q.Get("wait") == "true"
+	if !wait {
+		var cancel context.CancelFunc
+		upCtx, cancel = context.WithTimeout(upCtx, mirrorTimeout)
+		defer cancel()
+	}
+	resp, err := m.do(upCtx, r.Method, r.URL.Path, r.URL.RawQuery, body, r.Header, keyed)
+	if err != nil {
+		if r.Method != http.MethodGet {
+			logging.Errorf("mirror failed to forward %s %s: %v", r.Method, r.URL.Path, err)
+			httperror.Error(w, r, "Unable to reach the upstream", http.StatusServiceUnavailable, tokenCounter)
+			return true
+		}
+		mirrorFallbacks.Inc()
+		// indexes of the upstream mean nothing to the cache, so
+		// watches start from its current state
+		q.Del("waitIndex")
+		r.URL.RawQuery = q.Encode()
+		return false
+	}
+	defer resp.Body.Close()
+
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	tokenCounter.WithLabelValues(strconv.Itoa(resp.StatusCode), r.Method).Add(1)
+
+	if resp.StatusCode < 300 {
+		_, err := m.st.tokenConfig(ctx, ns, token)
+		if r.Method != http.MethodGet || wait || client.IsKeyNotFound(err) {
+			m.queueSync(token)
+		}
+	}
+	return true
+}
+
+// refuseCacheIndex answers a watch from an index of the cache the way
+// etcd answers watches from indexes past its history, which etcd
+// members answer by listing the token again.
+func refuseCacheIndex(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusBadRequest, struct {
+		ErrorCode int    `json:"errorCode"`
+		Message   string `json:"message"`
+		Cause     string `json:"cause"`
+	}{client.ErrorCodeEventIndexCleared, "The event in requested index is outdated and cleared", "the index was given out by the mirror cache"})
+	tokenCounter.WithLabelValues(strconv.Itoa(http.StatusBadRequest), r.Method).Add(1)
+}
+
+// shiftCacheIndexes adds cacheIndexBase to the X-Etcd-Index header and
+// to the indexes of answer, an etcd answer of the cache. Answers it
+// cannot read are returned as they are.
+func shiftCacheIndexes(header http.Header, answer []byte) []byte {
+	if i, err := strconv.ParseUint(header.Get("X-Etcd-Index"), 10, 64); err == nil {
+		header.Set("X-Etcd-Index", strconv.FormatUint(i+cacheIndexBase, 10))
+	}
+	var resp map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(answer))
+	dec.UseNumber()
+	if err := dec.Decode(&resp); err != nil {
+		return answer
+	}
+	shiftIndex(resp, "index")
+	shiftNodeIndexes(resp["node"])
+	shiftNodeIndexes(resp["prevNode"])
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return answer
+	}
+	return append(b, '\n')
+}
+
+// shiftNodeIndexes adds cacheIndexBase to the indexes of the etcd node
+// n and of the nodes under it.
+func shiftNodeIndexes(n interface{}) {
+	node, ok := n.(map[string]interface{})
+	if !ok {
+		return
+	}
+	shiftIndex(node, "createdIndex")
+	shiftIndex(node, "modifiedIndex")
+	nodes, _ := node["nodes"].([]interface{})
+	for _, c := range nodes {
+		shiftNodeIndexes(c)
+	}
+}
+
+func shiftIndex(v map[string]interface{}, key string) {
+	if n, ok := v[key].(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			v[key] = i + cacheIndexBase
+		}
+	}
+}
+
+// queueSync marks token to be cached again in the background.
+func (m *mirror) queueSync(token string) {
+	m.mu.Lock()
+	m.pending[token] = true
+	m.mu.Unlock()
+	select {
+	case m.kick <- struct{}{}:
+	default:
+	}
+}
+
+// syncPending caches the pending tokens again whenever tokens are
+// queued, until ctx is canceled.
+func (m *mirror) syncPending(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.kick:
+		}
+		m.mu.Lock()
+		tokens := m.pending
+		m.pending = make(map[string]bool)
+		m.mu.Unlock()
+		for token := range tokens {
+			if err := m.syncToken(ctx, token); err != nil {
+				mirrorSyncErrors.Inc()
+				logging.Warnf("mirror failed to cache %s: %v", token, err)
+			}
+		}
+	}
+}
+
+// syncToken copies the members of token from the upstream to the
+// cache, along with its size when it is first cached, or removes it
+// from the cache if the upstream has no such token.
+func (m *mirror) syncToken(ctx context.Context, token string) error {
+	ns, _ := m.st.config().Namespace("")
+	getCtx, cancel := context.WithTimeout(ctx, mirrorTimeout)
+	defer cancel()
+	listing, err := m.get(getCtx, "/"+token)
+	if err != nil {
+		return err
+	}
+	if listing == nil {
+		err := m.st.deleteToken(ctx, ns, token)
+		if client.IsKeyNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	size, err := m.get(getCtx, "/"+token+"/_config/size")
+	if err != nil {
+		return err
+	}
+
+	sh := m.st.tokenShard(ctx, ns, token)
+	kapi := sh.keysAPI()
+	ttl := time.Duration(listing.Node.TTL) * time.Second
+	dirCtx, done := startEtcd(ctx, "token_create", sh.endpoint)
+	_, err = kapi.Set(dirCtx, tokenKey(ns, token), "", &client.SetOptions{Dir: true, TTL: ttl, PrevExist: client.PrevNoExist})
+	done(err)
+	if err != nil {
+		if cerr, ok := err.(client.Error); !ok || cerr.Code != client.ErrorCodeNodeExist {
+			return err
+		}
+	} else {
+		// the size is only written before the token is handed out,
+		// and the upstream is kept out of the token directory
+		if err := m.st.createStateDirs(ctx, ns, token, ttl, tokenStateKeys(ns, token)...); err != nil {
+			return err
+		}
+		if size != nil {
+			if _, err := m.st.setTokenValue(ctx, ns, token, "size", size.Node.Value, true); err != nil {
+				return err
+			}
+		}
+		if err := m.st.indexTokenValue(ctx, ns, token, "upstream", m.upstream); err != nil {
+			return err
+		}
+	}
+
+	getCtx, done = startEtcd(ctx, "token_get", sh.endpoint)
+	resp, err := kapi.Get(getCtx, tokenKey(ns, token), nil)
+	done(err)
+	if err != nil {
+		return err
+	}
+	cached := make(map[string]string)
+	for _, n := range resp.Node.Nodes {
+		if !n.Dir {
+			cached[path.Base(n.Key)] = n.Value
+		}
+	}
+	// members are added in their upstream order, which keeps their
+	// quorum membership
+	nodes := listing.Node.Nodes
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].CreatedIndex < nodes[j].CreatedIndex })
+	for _, n := range nodes {
+		id := path.Base(n.Key)
+		if n.Dir || strings.HasPrefix(id, "_") {
+			continue
+		}
+		if v, ok := cached[id]; !ok || v != n.Value {
+			setCtx, done := startEtcd(ctx, "member_create", sh.endpoint)
+			_, err := kapi.Set(setCtx, tokenKey(ns, token, id), n.Value, nil)
+			done(err)
+			if err != nil {
+				return err
+			}
+		}
+		delete(cached, id)
+	}
+	for id := range cached {
+		delCtx, done := startEtcd(ctx, "member_delete", sh.endpoint)
+		_, err := kapi.Delete(delCtx, tokenKey(ns, token, id), nil)
+		done(err)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncAll refreshes every cached token, which the config index tags
+// with the upstream. Tokens of the default namespace created before
+// mirroring are left alone.
+func (m *mirror) syncAll(ctx context.Context) {
+	ns, _ := m.st.config().Namespace("")
+	var cached, failed int
+	for _, sh := range m.st.shardList() {
+		tokens, err := m.st.shardTokens(ctx, sh, ns)
+		if err != nil {
+			logging.Errorf("mirror failed to list the cached tokens of shard %s: %v", sh.name, err)
+			return
+		}
+		configs, err := m.st.namespaceConfigs(withShard(ctx, sh), ns)
+		if err != nil {
+			logging.Errorf("mirror failed to read the cached tokens of shard %s: %v", sh.name, err)
+			return
+		}
+		for _, token := range tokens {
+			if configs[token]["upstream"] != m.upstream {
+				continue
+			}
+			cached++
+			if err := m.syncToken(withShard(ctx, sh), token); err != nil {
+				failed++
+				mirrorSyncErrors.Inc()
+				logging.Warnf("mirror failed to refresh %s: %v", token, err)
+				if !m.isUp() {
+					return
+				}
+			}
+		}
+	}
+	mirrorCachedTokens.Set(float64(cached))
+	if failed == 0 {
+		mirrorLastSync.SetToCurrentTime()
+	}
+}
+
+// run refreshes the cached tokens every interval until ctx is
+// canceled.
+func (m *mirror) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.syncAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// negotiate picks the media type of offers the request accepts best,
+// preferring earlier offers on ties. The first offer is picked when
+// the request has no Accept header, and "" when it accepts none.
+func negotiate(r *http.Request, offers []string) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		for _, spec := range strings.Split(accept, ",") {
+			params := strings.Split(spec, ";")
+			mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+			q := 1.0
+			for _, p := range params[1:] {
+				kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+				if len(kv) == 2 && kv[0] == "q" {
+					q, _ = strconv.ParseFloat(kv[1], 64)
+				}
+			}
+			if q > bestQ && mediaTypeMatches(mediaType, offer) {
+				best, bestQ = offer, q
+			}
+		}
+	}
+	return best
+}
+
+// mediaTypeMatches reports whether the media range pattern, such as
+// "text/*", covers mediaType.
+func mediaTypeMatches(pattern, mediaType string) bool {
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	return strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+}
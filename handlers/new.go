@@ -1,21 +1,26 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"net/url"
 	"path"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/coreos/discovery.etcd.io/audit"
+	"github.com/coreos/discovery.etcd.io/config"
 	"github.com/coreos/discovery.etcd.io/handlers/httperror"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/discovery.etcd.io/metrics"
 	"github.com/coreos/etcd/client"
+	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -29,11 +34,13 @@ func init() {
 		},
 		[]string{"code", "method"},
 	)
-	prometheus.MustRegister(newCounter)
+	metrics.Registry.MustRegister(newCounter)
 }
 
-func generateCluster() string {
-	b := make([]byte, 16)
+// randomHex returns n random bytes hex encoded, or "" if there is not
+// enough randomness.
+func randomHex(n int) string {
+	b := make([]byte, n)
 	_, err := rand.Read(b)
 	if err != nil {
 		return ""
@@ -42,62 +49,179 @@ func generateCluster() string {
 	return hex.EncodeToString(b)
 }
 
+func generateCluster() string {
+	return randomHex(16)
+}
+
 func Setup(etcdCURL, disc string) *State {
-	u, _ := url.Parse(etcdCURL)
-	return &State{
-		etcdHost:      etcdCURL,
-		etcdCURL:      u,
-		currentLeader: u.Host,
-		discHost:      disc,
+	return SetupConfig(config.New(etcdCURL, disc))
+}
+
+func SetupConfig(cfg config.Config) *State {
+	st := &State{
+		shards:   make(map[string]*shard),
+		discHost: cfg.Host,
+		cfg:      cfg,
+		quotas:   newQuotas(),
 	}
+	var names []string
+	for _, s := range cfg.AllShards() {
+		st.shards[s.Name] = newShard(s)
+		names = append(names, s.Name)
+	}
+	st.primary = st.shards[config.DefaultShard]
+	st.ring = newRing(names)
+	return st
+}
+
+// namespace returns the namespace r was routed to, or false if it is
+// not configured.
+func (st *State) namespace(r *http.Request) (config.Namespace, bool) {
+	return st.config().Namespace(mux.Vars(r)["namespace"])
+}
+
+// tokenKey returns the etcd key of token in ns, joined with elems.
+func tokenKey(ns config.Namespace, token string, elems ...string) string {
+	return path.Join(append([]string{ns.Prefix, token}, elems...)...)
 }
 
-func (st *State) setupToken(size int) (string, error) {
+// setupToken creates a token of the given size in ns, which expires
+// after ttl unless it is 0.
+func (st *State) setupToken(ctx context.Context, ns config.Namespace, size int, ttl time.Duration) (string, error) {
 	token := generateCluster()
 	if token == "" {
 		return "", errors.New("Couldn't generate a token")
 	}
 
-	c, _ := client.New(client.Config{
-		Endpoints: []string{st.endpoint()},
-		Transport: client.DefaultTransport,
-		// set timeout per request to fail fast when the target endpoint is unavailable
-		HeaderTimeoutPerRequest: time.Second,
-	})
-	kapi := client.NewKeysAPI(c)
+	sh := st.tokenShard(ctx, ns, token)
+	kapi := sh.keysAPI()
 
-	key := path.Join("_etcd", "registry", token)
-	resp, err := kapi.Create(context.Background(), path.Join(key, "_config", "size"), strconv.Itoa(size))
+	key := tokenKey(ns, token)
+	if ttl > 0 {
+		dirCtx, done := startEtcd(ctx, "token_create", sh.endpoint)
+		_, err := kapi.Set(dirCtx, key, "", &client.SetOptions{
+			Dir:       true,
+			TTL:       ttl,
+			PrevExist: client.PrevNoExist,
+		})
+		done(err)
+		if err != nil {
+			return "", fmt.Errorf("Couldn't setup state %v", err)
+		}
+	}
+
+	if err := st.createStateDirs(ctx, ns, token, ttl, tokenStateKeys(ns, token)...); err != nil {
+		return "", fmt.Errorf("Couldn't setup state %v", err)
+	}
+
+	createCtx, done := startEtcd(ctx, "token_create", sh.endpoint)
+	resp, err := kapi.Create(createCtx, path.Join(key, "_config", "size"), strconv.Itoa(size))
+	done(err)
 	if err != nil {
 		return "", fmt.Errorf("Couldn't setup state %v %v", resp, err)
 	}
 	return token, nil
 }
 
-func (st *State) deleteToken(token string) error {
-	c, _ := client.New(client.Config{
-		Endpoints: []string{st.endpoint()},
-		Transport: client.DefaultTransport,
-		// set timeout per request to fail fast when the target endpoint is unavailable
-		HeaderTimeoutPerRequest: time.Second,
-	})
-	kapi := client.NewKeysAPI(c)
+// tokenStateKeys returns the directories kept beside token in ns for
+// its state.
+func tokenStateKeys(ns config.Namespace, token string) []string {
+	return []string{progressKey(ns, token), historyKey(ns, token), metadataKey(ns, token), peerCheckKey(ns, token), configIndexKey(ns, token)}
+}
+
+// createStateDirs creates the directories keys of the state of token,
+// which expire along with it after ttl unless it is 0. Their entries
+// are written with the TTL too, but the directories themselves would
+// otherwise outlive the token. Existing directories are kept.
+func (st *State) createStateDirs(ctx context.Context, ns config.Namespace, token string, ttl time.Duration, keys ...string) error {
+	if ttl <= 0 {
+		return nil
+	}
+	sh := st.tokenShard(ctx, ns, token)
+	for _, key := range keys {
+		dirCtx, done := startEtcd(ctx, "token_state_create", sh.endpoint)
+		_, err := sh.keysAPI().Set(dirCtx, key, "", &client.SetOptions{Dir: true, TTL: ttl, PrevExist: client.PrevNoExist})
+		done(err)
+		if err != nil {
+			if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeNodeExist {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *State) deleteToken(ctx context.Context, ns config.Namespace, token string) error {
+	sh := st.tokenShard(ctx, ns, token)
+	kapi := sh.keysAPI()
 
 	if token == "" {
 		return errors.New("No token given")
 	}
 
+	delCtx, done := startEtcd(ctx, "token_delete", sh.endpoint)
 	_, err := kapi.Delete(
-		context.Background(),
-		path.Join("_etcd", "registry", token),
+		delCtx,
+		tokenKey(ns, token),
 		&client.DeleteOptions{Recursive: true},
 	)
-	return err
+	done(err)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range tokenStateKeys(ns, token) {
+		delCtx, done = startEtcd(ctx, "token_state_delete", sh.endpoint)
+		_, err = kapi.Delete(delCtx, key, &client.DeleteOptions{Recursive: true})
+		done(err)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxLabels is how many labels a token may have.
+const maxLabels = 16
+
+var labelKey = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]{0,62}$`)
+
+// parseLabels reads token labels given as key=value pairs.
+func parseLabels(pairs []string) (map[string]string, error) {
+	if len(pairs) > maxLabels {
+		return nil, fmt.Errorf("more than %d labels", maxLabels)
+	}
+	labels := make(map[string]string)
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || !labelKey.MatchString(kv[0]) || len(kv[1]) > 256 {
+			return nil, fmt.Errorf("invalid label %q", pair)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+// tokenURL returns the discovery url of token in ns, as requested
+// through r.
+func (st *State) tokenURL(r *http.Request, ns config.Namespace, token string) string {
+	host := strings.TrimRight(st.discoveryHost(r), "/")
+	if ns.Name != "" {
+		return fmt.Sprintf("%s/ns/%s/%s", host, ns.Name, token)
+	}
+	return fmt.Sprintf("%s/%s", host, token)
 }
 
 func NewTokenHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	st := ctx.Value(stateKey).(*State)
 
+	ns, ok := st.namespace(r)
+	if !ok {
+		httperror.Error(w, r, "unknown namespace", http.StatusNotFound, newCounter)
+		return
+	}
+
 	var err error
 	size := 3
 	s := r.FormValue("size")
@@ -108,16 +232,136 @@ func NewTokenHandler(ctx context.Context, w http.ResponseWriter, r *http.Request
 			return
 		}
 	}
-	token, err := st.setupToken(size)
+	ex, err := parseExpectation(r.Form["expect"], r.FormValue("expect-pattern"))
+	if err != nil {
+		httperror.Error(w, r, err.Error(), http.StatusBadRequest, newCounter)
+		return
+	}
+	// a token expecting only named members is sized for them
+	if ex != nil && ex.Pattern == "" {
+		if s == "" {
+			size = len(ex.Members)
+		} else if size > len(ex.Members) {
+			httperror.Error(w, r, fmt.Sprintf("size %d exceeds the %d expected members", size, len(ex.Members)), http.StatusBadRequest, newCounter)
+			return
+		}
+	}
+	if max := ns.MaxSize; max > 0 && size > max {
+		httperror.Error(w, r, fmt.Sprintf("size %d exceeds the maximum of %d", size, max), http.StatusBadRequest, newCounter)
+		return
+	}
+	ttl := ns.TokenTTL
+	if s := r.FormValue("ttl"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			httperror.Error(w, r, fmt.Sprintf("invalid ttl %q", s), http.StatusBadRequest, newCounter)
+			return
+		}
+		if ns.TokenTTL > 0 && d > ns.TokenTTL {
+			httperror.Error(w, r, fmt.Sprintf("ttl %v exceeds the maximum of %v", d, ns.TokenTTL), http.StatusBadRequest, newCounter)
+			return
+		}
+		ttl = d
+	}
+	labels, err := parseLabels(r.Form["label"])
+	if err != nil {
+		httperror.Error(w, r, err.Error(), http.StatusBadRequest, newCounter)
+		return
+	}
+
+	tenant, limits, err := st.requestTenant(ctx, r)
+	switch err {
+	case nil:
+	case errInvalidKey, errAnonymousDisabled:
+		httperror.Error(w, r, err.Error(), http.StatusUnauthorized, newCounter)
+		return
+	default:
+		logging.Errorf("failed to authenticate API key: %v", err)
+		httperror.Error(w, r, "Unable to check API key", http.StatusInternalServerError, newCounter)
+		return
+	}
+	if max := limits.MaxSize; max > 0 && size > max {
+		tokensRejected.WithLabelValues(tenant, "max_size").Inc()
+		httperror.Error(w, r, fmt.Sprintf("size %d exceeds the maximum of %d", size, max), http.StatusBadRequest, newCounter)
+		return
+	}
+	// live tokens are counted from the index once, and then kept up
+	// to date by the stats rounds
+	if limits.MaxTokens > 0 && !st.quotas.counted() {
+		counts, err := st.tenantTokens(ctx)
+		if err != nil {
+			logging.Errorf("failed to count live tokens: %v", err)
+			httperror.Error(w, r, "Unable to check quota", http.StatusInternalServerError, newCounter)
+			return
+		}
+		st.quotas.setLive(counts)
+	}
+	switch st.quotas.admit(tenant, limits) {
+	case "max_tokens":
+		tokensRejected.WithLabelValues(tenant, "max_tokens").Inc()
+		httperror.Error(w, r, fmt.Sprintf("limit of %d live tokens reached", limits.MaxTokens), http.StatusTooManyRequests, newCounter)
+		return
+	case "create_rate":
+		tokensRejected.WithLabelValues(tenant, "create_rate").Inc()
+		httperror.Error(w, r, fmt.Sprintf("limit of %d new tokens per minute reached", limits.CreateRate), http.StatusTooManyRequests, newCounter)
+		return
+	}
+	if m := st.mirrored(ns); m != nil {
+		m.serveNew(ctx, w, r, ns, tenant)
+		return
+	}
+
+	token, err := st.setupToken(ctx, ns, size, ttl)
 
 	if err != nil {
-		log.Printf("setupToken returned: %v", err)
+		st.quotas.release(tenant, false)
+		logging.Errorf("setupToken returned: %v", err)
 		httperror.Error(w, r, "Unable to generate token", 400, newCounter)
 		return
 	}
+	audit.SetToken(ctx, token)
+	if err := st.indexTokenValue(ctx, ns, token, "size", strconv.Itoa(size)); err != nil {
+		logging.Warnf("failed to index size of %s: %v", token, err)
+	}
+	// once tagged, the token counts against its tenant in the index
+	if tenant != anonymousTenant {
+		if _, err := st.setTokenValue(ctx, ns, token, "tenant", tenant, true); err != nil {
+			logging.Warnf("failed to tag %s with tenant %s: %v", token, tenant, err)
+		}
+	}
+	st.quotas.release(tenant, true)
+
+	// without its expected members recorded, the token would admit
+	// anyone
+	if ex != nil {
+		b, _ := json.Marshal(ex)
+		if _, err := st.setTokenValue(ctx, ns, token, "expected", string(b), true); err != nil {
+			st.deleteToken(ctx, ns, token)
+			st.quotas.remove(tenant)
+			logging.Errorf("failed to record expected members of %s: %v", token, err)
+			httperror.Error(w, r, "Unable to generate token", http.StatusInternalServerError, newCounter)
+			return
+		}
+	}
+	if _, err := st.setTokenTime(ctx, ns, token, "created", time.Now(), true); err != nil {
+		logging.Warnf("failed to record creation of %s: %v", token, err)
+	}
+	if len(labels) > 0 {
+		b, _ := json.Marshal(labels)
+		if _, err := st.setTokenValue(ctx, ns, token, "labels", string(b), true); err != nil {
+			logging.Warnf("failed to label %s: %v", token, err)
+		}
+	}
+	ev := event{Time: time.Now().UTC(), Type: eventCreated, Actor: tenant, ClientIP: st.ClientIP(r), Size: size}
+	if err := st.recordEvent(ctx, ns, token, ev, ttl); err != nil {
+		logging.Warnf("failed to record creation event of %s: %v", token, err)
+	}
+	st.migrateToken(ns, token)
+	tokensCreated.WithLabelValues(tenant).Inc()
+	requestedSize.WithLabelValues(tenant).Observe(float64(size))
 
-	log.Println("New cluster created", token)
+	logging.Infof("New cluster created %s for %s", token, tenant)
 
-	fmt.Fprintf(w, "%s/%s", bytes.TrimRight([]byte(st.discHost), "/"), token)
+	fmt.Fprint(w, st.tokenURL(r, ns, token))
 	newCounter.WithLabelValues("200", r.Method).Add(1)
 }
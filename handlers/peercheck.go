@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/etcd/client"
+)
+
+// peerCheckTimeout bounds the peer checks of a registration, name
+// resolution and probes included, well within the time etcd gives a
+// registration.
+const peerCheckTimeout = 2 * time.Second
+
+// Checks of the peer urls of a registration, as counted by the
+// peer_checks_total metric.
+const (
+	peerCheckURL     = "url"
+	peerCheckLocal   = "local"
+	peerCheckNetwork = "network"
+	peerCheckProbe   = "probe"
+)
+
+// peerCheckKey returns the etcd key of the peer url checks of the
+// members of token in ns, joined with elems. Like metadata, they are
+// written while others watch the token, so they are kept out of the
+// token directory.
+func peerCheckKey(ns config.Namespace, token string, elems ...string) string {
+	return path.Join(append([]string{ns.Prefix, "_peer-checks", token}, elems...)...)
+}
+
+// peerCheck is the outcome of the checks of the peer urls a member
+// last registered with.
+type peerCheck struct {
+	Member   string    `json:"member"`
+	Time     time.Time `json:"time"`
+	PeerURLs []string  `json:"peerURLs"`
+	Passed   bool      `json:"passed"`
+	Probed   bool      `json:"probed"`
+	// Problems tell why the registration was refused.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// peerAddrs returns the addresses of host, resolving names. Names that
+// do not resolve are left unchecked, since members may use names only
+// their own network knows.
+func peerAddrs(ctx context.Context, host string) []net.IP {
+	if ips := literalAddrs(host); ips != nil {
+		return ips
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		logging.Debugf("left peer host %s unchecked: %v", host, err)
+		return nil
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips
+}
+
+// checkPeers checks the peer urls of the registration m as pc
+// configures, within peerCheckTimeout, counting the outcome of each
+// check. Only peer urls whose addresses all passed the allowed
+// networks are probed, at those addresses, so registrations cannot
+// make the service connect anywhere else.
+func checkPeers(ctx context.Context, pc config.PeerCheck, m member) peerCheck {
+	ctx, cancel := context.WithTimeout(ctx, peerCheckTimeout)
+	defer cancel()
+	pcheck := peerCheck{Member: m.ID, Time: time.Now().UTC(), PeerURLs: m.PeerURLs}
+	failed := make(map[string]bool)
+	nets := parseNets(pc.AllowedCIDRs)
+	type target struct {
+		url  string
+		port string
+		ips  []net.IP
+	}
+	var targets []target
+	for _, p := range m.PeerURLs {
+		u, err := url.Parse(p)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Port() == "" {
+			pcheck.Problems = append(pcheck.Problems, fmt.Sprintf("peer url %q is not an http(s) url with a port", p))
+			failed[peerCheckURL] = true
+			continue
+		}
+		if !pc.RejectLocal && len(nets) == 0 {
+			continue
+		}
+		ips := peerAddrs(ctx, u.Hostname())
+		passed := true
+		for _, ip := range ips {
+			if kind := localKind(ip); pc.RejectLocal && kind != "" {
+				pcheck.Problems = append(pcheck.Problems, fmt.Sprintf("peer url %q is on the %s address %s, other members cannot reach it", p, kind, ip))
+				failed[peerCheckLocal] = true
+				passed = false
+				break
+			}
+			if len(nets) > 0 && !inNets(nets, ip) {
+				pcheck.Problems = append(pcheck.Problems, fmt.Sprintf("peer url %q is on %s, outside the allowed networks", p, ip))
+				failed[peerCheckNetwork] = true
+				passed = false
+				break
+			}
+		}
+		if passed && len(nets) > 0 && len(ips) > 0 {
+			targets = append(targets, target{p, u.Port(), ips})
+		}
+	}
+	if pc.ProbeTimeout > 0 && len(pcheck.Problems) == 0 && len(targets) > 0 {
+		pcheck.Probed = true
+		for _, t := range targets {
+			if !probeAddrs(ctx, t.ips, t.port, pc.ProbeTimeout) {
+				pcheck.Problems = append(pcheck.Problems, fmt.Sprintf("peer url %q did not accept a connection", t.url))
+				failed[peerCheckProbe] = true
+			}
+		}
+	}
+	pcheck.Passed = len(pcheck.Problems) == 0
+
+	checks := map[string]bool{peerCheckURL: true, peerCheckLocal: pc.RejectLocal, peerCheckNetwork: len(nets) > 0, peerCheckProbe: pcheck.Probed}
+	for check, ran := range checks {
+		switch {
+		case failed[check]:
+			peerChecks.WithLabelValues(check, "failed").Inc()
+		case ran:
+			peerChecks.WithLabelValues(check, "passed").Inc()
+		}
+	}
+	return pcheck
+}
+
+// probeAddrs reports whether one of ips accepts a connection on port
+// within timeout, or before ctx is done. Why the others did not is left
+// out of what registrations are told.
+func probeAddrs(ctx context.Context, ips []net.IP, port string, timeout time.Duration) bool {
+	dialer := net.Dialer{Timeout: timeout}
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			conn.Close()
+			return true
+		}
+		logging.Debugf("peer probe of %s failed: %v", net.JoinHostPort(ip.String(), port), err)
+	}
+	return false
+}
+
+// refusal returns the error a registration that failed pcheck is
+// refused with.
+func (pcheck peerCheck) refusal() error {
+	return fmt.Errorf("peer url checks failed: %s", strings.Join(pcheck.Problems, "; "))
+}
+
+// recordPeerCheck records pcheck as the last check of its member,
+// expiring along with the token.
+func (st *State) recordPeerCheck(ctx context.Context, ns config.Namespace, token string, pcheck peerCheck) {
+	ttl, err := st.tokenTTL(ctx, ns, token)
+	if err == nil {
+		var b []byte
+		if b, err = json.Marshal(pcheck); err == nil {
+			sh := st.tokenShard(ctx, ns, token)
+			setCtx, done := startEtcd(ctx, "peer_check_set", sh.endpoint)
+			_, err = sh.keysAPI().Set(setCtx, peerCheckKey(ns, token, pcheck.Member), string(b), &client.SetOptions{TTL: ttl})
+			done(err)
+		}
+	}
+	if err != nil && !client.IsKeyNotFound(err) {
+		logging.Warnf("failed to record peer checks of member %s of %s: %v", pcheck.Member, token, err)
+	}
+}
+
+// tokenPeerChecks returns the last peer url checks of the members that
+// registered with token, oldest first.
+func (st *State) tokenPeerChecks(ctx context.Context, ns config.Namespace, token string) ([]peerCheck, error) {
+	sh := st.tokenShard(ctx, ns, token)
+	getCtx, done := startEtcd(ctx, "peer_check_get", sh.endpoint)
+	resp, err := sh.keysAPI().Get(getCtx, peerCheckKey(ns, token), nil)
+	done(err)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var checks []peerCheck
+	for _, n := range resp.Node.Nodes {
+		var pcheck peerCheck
+		if err := json.Unmarshal([]byte(n.Value), &pcheck); err == nil {
+			checks = append(checks, pcheck)
+		}
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Time.Before(checks[j].Time) })
+	return checks, nil
+}
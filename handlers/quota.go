@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	"golang.org/x/time/rate"
+)
+
+// quotas tracks the live tokens of each tenant, the tokens it is
+// creating and its creation rate. Live tokens are counted from the
+// config index, which restarts and the other instances of the service
+// share, once and then on every stats round; in between, each instance
+// counts the tokens it creates and deletes itself. Creation rates are
+// limited by each instance on its own.
+type quotas struct {
+	mu       sync.Mutex
+	live     map[string]int
+	creating map[string]int
+	limiters map[string]*rate.Limiter
+}
+
+func newQuotas() *quotas {
+	return &quotas{
+		creating: make(map[string]int),
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// counted reports whether the live tokens have been counted from the
+// config index yet.
+func (q *quotas) counted() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.live != nil
+}
+
+// setLive replaces the live token counts with the ones of the config
+// index.
+func (q *quotas) setLive(live map[string]int) {
+	q.mu.Lock()
+	q.live = live
+	q.mu.Unlock()
+}
+
+// admit counts a new token of tenant if it is within limits. Otherwise
+// it returns the reason the token is refused.
+func (q *quotas) admit(tenant string, limits config.Limits) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if limits.MaxTokens > 0 && q.live[tenant]+q.creating[tenant] >= limits.MaxTokens {
+		return "max_tokens"
+	}
+	if limits.CreateRate > 0 {
+		every := rate.Every(time.Minute / time.Duration(limits.CreateRate))
+		lim := q.limiters[tenant]
+		if lim == nil || lim.Limit() != every || lim.Burst() != limits.CreateRate {
+			lim = rate.NewLimiter(every, limits.CreateRate)
+			q.limiters[tenant] = lim
+		}
+		if !lim.Allow() {
+			return "create_rate"
+		}
+	}
+	q.creating[tenant]++
+	return ""
+}
+
+// release uncounts a token of tenant that admit counted, once it was
+// created, when it counts as live from then on, or failed.
+func (q *quotas) release(tenant string, created bool) {
+	q.mu.Lock()
+	if q.creating[tenant] > 0 {
+		q.creating[tenant]--
+	}
+	if created && q.live != nil {
+		q.live[tenant]++
+	}
+	q.mu.Unlock()
+}
+
+// remove uncounts a live token of tenant that was deleted.
+func (q *quotas) remove(tenant string) {
+	q.mu.Lock()
+	if q.live[tenant] > 0 {
+		q.live[tenant]--
+	}
+	q.mu.Unlock()
+}
+
+// configTenant returns the tenant of the token with config cfg.
+func configTenant(cfg map[string]string) string {
+	if cfg["tenant"] == "" {
+		return anonymousTenant
+	}
+	return cfg["tenant"]
+}
+
+// tenantTokens counts the live tokens of every tenant in the config
+// index of every namespace on every shard.
+func (st *State) tenantTokens(ctx context.Context) (map[string]int, error) {
+	counts := make(map[string]int)
+	for _, sh := range st.shardList() {
+		for _, ns := range st.config().AllNamespaces() {
+			configs, err := st.namespaceConfigs(withShard(ctx, sh), ns)
+			if err != nil {
+				return nil, err
+			}
+			for _, cfg := range configs {
+				counts[configTenant(cfg)]++
+			}
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/handlers/httperror"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/etcd/client"
+	"github.com/gorilla/mux"
+)
+
+// ResetHandler clears the member registrations of a token so its
+// machines can retry a failed bootstrap with the same discovery url.
+// The token keeps its config; size changes it for the next attempt.
+// The members must be stopped first: members still watching the token
+// would see the reset as changes to the cluster.
+func ResetHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	ns, ok := st.namespace(r)
+	if !ok {
+		httperror.Error(w, r, "unknown namespace", http.StatusNotFound, tokenCounter)
+		return
+	}
+	token := mux.Vars(r)["token"]
+	cfg, err := st.tokenConfig(ctx, ns, token)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			httperror.Error(w, r, "token not found", http.StatusNotFound, tokenCounter)
+			return
+		}
+		logging.Errorf("failed to read config of %s: %v", token, err)
+		httperror.Error(w, r, "", http.StatusInternalServerError, tokenCounter)
+		return
+	}
+
+	actor, err := st.tokenActor(ctx, r, cfg)
+	if err != nil {
+		actorError(w, r, err)
+		return
+	}
+	// mirrored tokens were created with the key of the mirror, which
+	// resets them for the tenant
+	if m := st.mirrored(ns); m != nil && m.serveToken(ctx, w, r, ns, true) {
+		return
+	}
+
+	prevSize, _ := strconv.Atoi(cfg["size"])
+	size := prevSize
+	if s := r.FormValue("size"); s != "" {
+		size, err = strconv.Atoi(s)
+		if err != nil || size <= 0 {
+			httperror.Error(w, r, fmt.Sprintf("invalid size %q", s), http.StatusBadRequest, tokenCounter)
+			return
+		}
+		if max := ns.MaxSize; max > 0 && size > max {
+			httperror.Error(w, r, fmt.Sprintf("size %d exceeds the maximum of %d", size, max), http.StatusBadRequest, tokenCounter)
+			return
+		}
+	}
+	if size > prevSize {
+		// the token may grow only as far as /new would have let it
+		ex, err := parseTokenExpectation(cfg)
+		if err != nil {
+			logging.Errorf("failed to read expected members of %s: %v", token, err)
+			httperror.Error(w, r, "", http.StatusInternalServerError, tokenCounter)
+			return
+		}
+		if ex != nil && ex.Pattern == "" && size > len(ex.Members) {
+			httperror.Error(w, r, fmt.Sprintf("size %d exceeds the %d expected members", size, len(ex.Members)), http.StatusBadRequest, tokenCounter)
+			return
+		}
+		limits, err := st.tenantLimits(ctx, cfg)
+		if err != nil {
+			logging.Errorf("failed to read limits of tenant of %s: %v", token, err)
+			httperror.Error(w, r, "", http.StatusInternalServerError, tokenCounter)
+			return
+		}
+		if max := limits.MaxSize; max > 0 && size > max {
+			httperror.Error(w, r, fmt.Sprintf("size %d exceeds the maximum of %d", size, max), http.StatusBadRequest, tokenCounter)
+			return
+		}
+	}
+
+	ev := event{Time: time.Now().UTC(), Type: eventReset, Actor: actor, ClientIP: st.ClientIP(r), Size: size}
+	if size != prevSize {
+		ev.PrevSize = prevSize
+	}
+	ev.Removed, err = st.resetToken(ctx, ns, token, ev, cfg["size"])
+	st.forgetSize(ns, token)
+	st.migrateToken(ns, token)
+	if err != nil {
+		logging.Errorf("failed to reset %s: %v", token, err)
+		httperror.Error(w, r, "Unable to reset token", http.StatusInternalServerError, tokenCounter)
+		return
+	}
+
+	logging.Infof("token %s reset by %s, %d members removed", token, actor, len(ev.Removed))
+	writeJSON(w, http.StatusOK, ev)
+	tokenCounter.WithLabelValues("200", r.Method).Add(1)
+}
+
+// resetToken removes the members and bootstrap progress of token,
+// sets the size of ev if it differs from prevSize, and records ev with
+// the removed members in the history of token. It returns the ids of
+// the removed members.
+func (st *State) resetToken(ctx context.Context, ns config.Namespace, token string, ev event, prevSize string) ([]string, error) {
+	sh := st.tokenShard(ctx, ns, token)
+	kapi := sh.keysAPI()
+
+	getCtx, done := startEtcd(ctx, "token_get", sh.endpoint)
+	resp, err := kapi.Get(getCtx, tokenKey(ns, token), &client.GetOptions{Sort: true})
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range resp.Node.Nodes {
+		if n.Dir {
+			continue
+		}
+		delCtx, done := startEtcd(ctx, "member_delete", sh.endpoint)
+		_, err := kapi.Delete(delCtx, n.Key, nil)
+		done(err)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return ev.Removed, err
+		}
+		ev.Removed = append(ev.Removed, path.Base(n.Key))
+	}
+
+	cleared := []string{progressKey(ns, token), metadataKey(ns, token), peerCheckKey(ns, token)}
+	for _, key := range cleared {
+		delCtx, done := startEtcd(ctx, "token_state_delete", sh.endpoint)
+		_, err = kapi.Delete(delCtx, key, &client.DeleteOptions{Recursive: true})
+		done(err)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return ev.Removed, err
+		}
+	}
+	ttl := time.Duration(resp.Node.TTL) * time.Second
+	if err := st.createStateDirs(ctx, ns, token, ttl, append(cleared, historyKey(ns, token), configIndexKey(ns, token))...); err != nil {
+		return ev.Removed, err
+	}
+
+	// unlike other config writes, this one comes after the token was
+	// handed out, see setTokenValue
+	if s := strconv.Itoa(ev.Size); ev.Size > 0 && s != prevSize {
+		setCtx, done := startEtcd(ctx, "config_set", sh.endpoint)
+		_, err = kapi.Set(setCtx, tokenKey(ns, token, "_config", "size"), s, &client.SetOptions{PrevValue: prevSize})
+		done(err)
+		if err != nil {
+			return ev.Removed, err
+		}
+		if err := st.indexTokenValue(ctx, ns, token, "size", s); err != nil {
+			return ev.Removed, err
+		}
+	}
+
+	if err := st.recordEvent(ctx, ns, token, ev, ttl); err != nil {
+		logging.Warnf("failed to record reset of %s: %v", token, err)
+	}
+	return ev.Removed, nil
+}
@@ -0,0 +1,549 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/handlers/httperror"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/etcd/client"
+	"github.com/gorilla/mux"
+)
+
+// shard is an etcd cluster holding part of the tokens.
+type shard struct {
+	name     string
+	endpoint string
+
+	mu     sync.RWMutex
+	leader string
+}
+
+func newShard(s config.Shard) *shard {
+	u, _ := url.Parse(s.URL)
+	return &shard{name: s.Name, endpoint: s.URL, leader: u.Host}
+}
+
+func (sh *shard) keysAPI() client.KeysAPI {
+	c, _ := client.New(client.Config{
+		Endpoints: []string{sh.endpoint},
+		Transport: client.DefaultTransport,
+		// set timeout per request to fail fast when the target endpoint is unavailable
+		HeaderTimeoutPerRequest: time.Second,
+	})
+	return client.NewKeysAPI(c)
+}
+
+// scanTimeout bounds each request of a registry scan. Scans read whole
+// directories, which take longer than the requests keysAPI fails fast
+// on, and their callers bound the whole scan with their own deadline.
+const scanTimeout = 30 * time.Second
+
+// scanAPI is keysAPI for the requests of registry scans.
+func (sh *shard) scanAPI() client.KeysAPI {
+	c, _ := client.New(client.Config{
+		Endpoints:               []string{sh.endpoint},
+		Transport:               client.DefaultTransport,
+		HeaderTimeoutPerRequest: scanTimeout,
+	})
+	return client.NewKeysAPI(c)
+}
+
+func (sh *shard) getLeader() (leader string) {
+	sh.mu.RLock()
+	leader = sh.leader
+	sh.mu.RUnlock()
+	return leader
+}
+
+func (sh *shard) setLeader(leader string) {
+	sh.mu.Lock()
+	sh.leader = leader
+	sh.mu.Unlock()
+}
+
+// ringPoints is how many points each shard has on the ring. More points
+// spread the tokens more evenly.
+const ringPoints = 128
+
+// ring places tokens on shards by consistent hashing: adding a shard
+// only moves the tokens that now hash closest to one of its points.
+type ring struct {
+	shards []string
+	points []uint64
+	owners []string
+}
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func newRing(shards []string) *ring {
+	r := &ring{shards: append([]string(nil), shards...)}
+	sort.Strings(r.shards)
+	type point struct {
+		hash  uint64
+		owner string
+	}
+	var ps []point
+	for _, name := range r.shards {
+		for i := 0; i < ringPoints; i++ {
+			ps = append(ps, point{ringHash(fmt.Sprintf("%s-%d", name, i)), name})
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		if ps[i].hash != ps[j].hash {
+			return ps[i].hash < ps[j].hash
+		}
+		return ps[i].owner < ps[j].owner
+	})
+	for _, p := range ps {
+		r.points = append(r.points, p.hash)
+		r.owners = append(r.owners, p.owner)
+	}
+	return r
+}
+
+// owner returns the name of the shard token belongs on.
+func (r *ring) owner(token string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(token)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// shardsKey is where the shards tokens were last balanced across are
+// kept, on the default shard.
+func (st *State) shardsKey() string {
+	return path.Join(st.config().RegistryPrefix, "_shards")
+}
+
+// shardList returns the shards ordered by name, the default one first.
+func (st *State) shardList() []*shard {
+	var shards []*shard
+	for _, s := range st.config().AllShards() {
+		shards = append(shards, st.shards[s.Name])
+	}
+	return shards
+}
+
+// withShard returns a copy of ctx that pins the token requests made
+// with it to sh.
+func withShard(ctx context.Context, sh *shard) context.Context {
+	return context.WithValue(ctx, shardKey, sh)
+}
+
+// ctxShard returns the shard ctx is pinned to, or the default one.
+func (st *State) ctxShard(ctx context.Context) *shard {
+	if sh, ok := ctx.Value(shardKey).(*shard); ok {
+		return sh
+	}
+	return st.primary
+}
+
+func (st *State) getPrevRing() *ring {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.prevRing
+}
+
+// prevPlacement returns the ring ref was placed by before the shards
+// changed, or nil if the shards are balanced or ref is known to have
+// moved since.
+func (st *State) prevPlacement(ref tokenRef) *ring {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if st.moved[ref] {
+		return nil
+	}
+	return st.prevRing
+}
+
+// tokenShard returns the shard token of ns lives on, unless ctx is
+// pinned to one. Tokens live where the ring places them, but until a
+// rebalance after the shards changed they may still be where the
+// previous ring placed them. Tokens found missing there and found where
+// the ring places them are remembered as moved, so they are looked for
+// only once.
+func (st *State) tokenShard(ctx context.Context, ns config.Namespace, token string) *shard {
+	if sh, ok := ctx.Value(shardKey).(*shard); ok {
+		return sh
+	}
+	sh := st.shards[st.ring.owner(token)]
+	ref := tokenRef{ns, token}
+	prev := st.prevPlacement(ref)
+	if prev == nil {
+		return sh
+	}
+	old := st.shards[prev.owner(token)]
+	if old == nil || old == sh {
+		return sh
+	}
+	getCtx, done := startEtcd(ctx, "token_locate", old.endpoint)
+	_, err := old.keysAPI().Get(getCtx, tokenKey(ns, token), nil)
+	done(err)
+	if err == nil {
+		return old
+	}
+	if client.IsKeyNotFound(err) {
+		// only tokens found where they live now are remembered, so
+		// that requests for unknown tokens add nothing
+		getCtx, done := startEtcd(ctx, "token_locate", sh.endpoint)
+		_, err := sh.keysAPI().Get(getCtx, tokenKey(ns, token), nil)
+		done(err)
+		if err == nil {
+			st.tokenMoved(ref)
+		}
+	}
+	return sh
+}
+
+// tokenMoved remembers that ref is no longer where the previous ring
+// placed it. Tokens never move back, so this holds until the shards
+// are balanced.
+func (st *State) tokenMoved(ref tokenRef) {
+	st.mu.Lock()
+	if st.prevRing != nil {
+		st.moved[ref] = true
+	}
+	st.mu.Unlock()
+}
+
+// TokenShard looks the shard of the token a request is for up once,
+// and pins the context of h to it.
+func TokenShard(h ContextHandler) ContextHandler {
+	return ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		st := ctx.Value(stateKey).(*State)
+		if ns, ok := st.namespace(r); ok {
+			ctx = withShard(ctx, st.tokenShard(ctx, ns, mux.Vars(r)["token"]))
+		}
+		h.ServeHTTPContext(ctx, w, r)
+	})
+}
+
+// LoadShards compares the shards to the ones tokens were last balanced
+// across. If they changed, tokens are also looked for where they were
+// placed before, until they are rebalanced.
+func LoadShards(ctx context.Context, st *State) error {
+	ctx, done := startEtcd(ctx, "shards_get", st.endpoint())
+	resp, err := st.keysAPI().Get(ctx, st.shardsKey(), nil)
+	done(err)
+	prev := []string{config.DefaultShard}
+	switch {
+	case err == nil:
+		prev = nil
+		if err := json.Unmarshal([]byte(resp.Node.Value), &prev); err != nil {
+			return fmt.Errorf("invalid %s: %v", st.shardsKey(), err)
+		}
+	case !client.IsKeyNotFound(err):
+		return err
+	}
+	if reflect.DeepEqual(prev, st.ring.shards) {
+		return nil
+	}
+	for _, name := range prev {
+		if st.shards[name] == nil {
+			logging.Warnf("shard %s is no longer configured, its tokens cannot be found", name)
+		}
+	}
+	logging.Warnf("shards changed from %s to %s, tokens need to be rebalanced", strings.Join(prev, ","), strings.Join(st.ring.shards, ","))
+	st.mu.Lock()
+	st.prevRing = newRing(prev)
+	st.moved = make(map[tokenRef]bool)
+	st.mu.Unlock()
+	return nil
+}
+
+// shardStatus describes a shard to the admin API.
+type shardStatus struct {
+	Name     string `json:"name"`
+	Endpoint string `json:"endpoint"`
+	Healthy  bool   `json:"healthy"`
+	Error    string `json:"error,omitempty"`
+	// Tokens counts the tokens of every namespace on the shard, and
+	// Misplaced those of them the ring places on another shard.
+	Tokens    int `json:"tokens"`
+	Misplaced int `json:"misplaced"`
+}
+
+type shardsReport struct {
+	// Rebalance is set while tokens may not be where the ring places
+	// them.
+	Rebalance bool          `json:"rebalance"`
+	Shards    []shardStatus `json:"shards"`
+}
+
+// shardStatuses counts the tokens of every shard and whether it can be
+// reached, and refreshes the shard gauges.
+func (st *State) shardStatuses(ctx context.Context) []shardStatus {
+	var statuses []shardStatus
+	for _, sh := range st.shardList() {
+		s := shardStatus{Name: sh.name, Endpoint: sh.endpoint, Healthy: true}
+		for _, ns := range st.config().AllNamespaces() {
+			tokens, err := st.shardTokens(ctx, sh, ns)
+			if err != nil {
+				s.Healthy, s.Error = false, err.Error()
+				break
+			}
+			for _, token := range tokens {
+				s.Tokens++
+				if st.ring.owner(token) != sh.name {
+					s.Misplaced++
+				}
+			}
+		}
+		s.setGauges()
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// setGauges refreshes the gauges of the shard s describes.
+func (s shardStatus) setGauges() {
+	if s.Healthy {
+		shardUp.WithLabelValues(s.Name).Set(1)
+		shardTokens.WithLabelValues(s.Name).Set(float64(s.Tokens))
+		shardMisplacedTokens.WithLabelValues(s.Name).Set(float64(s.Misplaced))
+	} else {
+		shardUp.WithLabelValues(s.Name).Set(0)
+	}
+}
+
+// scanShards describes the tokens of every namespace on every shard,
+// without their members, and refreshes the shard gauges on the way. It
+// returns the first error of the shards that could not be read.
+func (st *State) scanShards(ctx context.Context) ([]tokenInfo, error) {
+	var infos []tokenInfo
+	var scanErr error
+	for _, sh := range st.shardList() {
+		s := shardStatus{Name: sh.name, Endpoint: sh.endpoint, Healthy: true}
+		for _, ns := range st.config().AllNamespaces() {
+			nsInfos, err := st.listNamespaceTokens(withShard(ctx, sh), ns, false)
+			if err != nil {
+				s.Healthy, s.Error = false, err.Error()
+				if scanErr == nil {
+					scanErr = fmt.Errorf("shard %s: %v", sh.name, err)
+				}
+				break
+			}
+			for _, ti := range nsInfos {
+				s.Tokens++
+				if st.ring.owner(ti.token) != sh.name {
+					s.Misplaced++
+				}
+			}
+			infos = append(infos, nsInfos...)
+		}
+		s.setGauges()
+	}
+	return infos, scanErr
+}
+
+// shardTokens lists the tokens of ns on sh.
+func (st *State) shardTokens(ctx context.Context, sh *shard, ns config.Namespace) ([]string, error) {
+	ctx, done := startEtcd(ctx, "registry_scan", sh.endpoint)
+	resp, err := sh.scanAPI().Get(ctx, ns.Prefix, nil)
+	done(err)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var tokens []string
+	for _, n := range resp.Node.Nodes {
+		if n.Dir {
+			tokens = append(tokens, path.Base(n.Key))
+		}
+	}
+	return tokens, nil
+}
+
+// ShardsHandler reports the health and the tokens of every shard.
+func ShardsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+	writeJSON(w, http.StatusOK, shardsReport{Rebalance: st.getPrevRing() != nil, Shards: st.shardStatuses(ctx)})
+	adminCounter.WithLabelValues("200", r.Method).Add(1)
+}
+
+// movedToken is a token a rebalance moved, or would move.
+type movedToken struct {
+	Namespace string `json:"namespace,omitempty"`
+	Token     string `json:"token"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+}
+
+type rebalanceReport struct {
+	DryRun bool         `json:"dryRun"`
+	Moved  []movedToken `json:"moved"`
+	// Skipped are the tokens left where they are because members may
+	// still be waiting for the others.
+	Skipped []movedToken `json:"skipped"`
+}
+
+// moveAttempts is how often a token is copied before giving up on it
+// changing while it is moved.
+const moveAttempts = 3
+
+// settled reports whether no member of t can still be waiting for the
+// others on the shard it is on, because t was filled, or never
+// registered with, longer than threshold ago. etcd counts every change
+// of the token directory as a member while it waits, including the
+// removal of the directory when the token is moved.
+func (t backupToken) settled(threshold time.Duration, now time.Time) bool {
+	since := parseTokenTime(t.Progress["full"])
+	if since.IsZero() {
+		size, _ := strconv.Atoi(t.Config["size"])
+		if len(t.Members) > 0 && len(t.Members) < size {
+			return false
+		}
+		since = parseTokenTime(t.Config["created"])
+	}
+	return now.Sub(since) > threshold
+}
+
+// sameMembers reports whether ms are the members bms, registered in
+// the same order with the same values.
+func sameMembers(ms []member, bms []backupMember) bool {
+	if len(ms) != len(bms) {
+		return false
+	}
+	for i, m := range ms {
+		if m.ID != bms[i].ID || m.value != bms[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+// moveToken copies t with its state from one shard to another and
+// removes it from the first. Members registering, leaving or changing
+// during the copy make it start over.
+func (st *State) moveToken(ctx context.Context, ns config.Namespace, t backupToken, from, to *shard) error {
+	fromCtx, toCtx := withShard(ctx, from), withShard(ctx, to)
+	for i := 0; ; i++ {
+		var ttl time.Duration
+		if t.Expires != nil {
+			if ttl = time.Until(*t.Expires).Round(time.Second); ttl < time.Second {
+				// about to expire anyway
+				return st.deleteToken(fromCtx, ns, t.Token)
+			}
+		}
+		if err := st.restoreToken(toCtx, ns, t, ttl); err != nil {
+			return err
+		}
+		_, ms, err := st.tokenMembers(fromCtx, ns, t.Token)
+		if err != nil {
+			return err
+		}
+		if sameMembers(ms, t.Members) {
+			return st.deleteToken(fromCtx, ns, t.Token)
+		}
+		if err := st.deleteToken(toCtx, ns, t.Token); err != nil {
+			return err
+		}
+		if i+1 == moveAttempts {
+			return fmt.Errorf("members kept registering during %d attempts", moveAttempts)
+		}
+		ts, err := st.exportTokens(fromCtx, ns)
+		if err != nil {
+			return err
+		}
+		for _, bt := range ts {
+			if bt.Token == t.Token {
+				t = bt
+			}
+		}
+	}
+}
+
+// rebalance moves every settled token the ring places on another shard
+// than the one it is on. Once all are moved, the shards are recorded as
+// balanced. In a dry run nothing is moved.
+func (st *State) rebalance(ctx context.Context, dryRun bool) (rebalanceReport, error) {
+	report := rebalanceReport{DryRun: dryRun, Moved: []movedToken{}, Skipped: []movedToken{}}
+	threshold := st.config().StallThreshold
+	for _, from := range st.shardList() {
+		for _, ns := range st.config().AllNamespaces() {
+			ts, err := st.exportTokens(withShard(ctx, from), ns)
+			if err != nil {
+				return report, fmt.Errorf("shard %s: %v", from.name, err)
+			}
+			for _, t := range ts {
+				to := st.shards[st.ring.owner(t.Token)]
+				if to == from {
+					continue
+				}
+				mt := movedToken{Namespace: ns.Name, Token: t.Token, From: from.name, To: to.name}
+				if !t.settled(threshold, time.Now()) {
+					report.Skipped = append(report.Skipped, mt)
+					continue
+				}
+				if !dryRun {
+					if err := st.moveToken(ctx, ns, t, from, to); err != nil {
+						return report, fmt.Errorf("moving %s from %s to %s: %v", t.Token, from.name, to.name, err)
+					}
+					st.tokenMoved(tokenRef{ns, t.Token})
+					logging.Infof("Moved %s from shard %s to %s", t.Token, from.name, to.name)
+				}
+				report.Moved = append(report.Moved, mt)
+			}
+		}
+	}
+	if dryRun || len(report.Skipped) > 0 {
+		return report, nil
+	}
+
+	b, _ := json.Marshal(st.ring.shards)
+	setCtx, done := startEtcd(ctx, "shards_set", st.endpoint())
+	_, err := st.keysAPI().Set(setCtx, st.shardsKey(), string(b), nil)
+	done(err)
+	if err != nil {
+		return report, err
+	}
+	st.mu.Lock()
+	st.prevRing, st.moved = nil, nil
+	st.mu.Unlock()
+	return report, nil
+}
+
+// RebalanceHandler moves tokens to the shards the ring places them on,
+// or with dry-run=true only reports which it would move. Tokens members
+// may still be waiting on are skipped, and left for a later rebalance.
+func RebalanceHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	dryRun, err := strconv.ParseBool(r.URL.Query().Get("dry-run"))
+	if err != nil && r.URL.Query().Get("dry-run") != "" {
+		httperror.Error(w, r, "invalid dry-run", http.StatusBadRequest, adminCounter)
+		return
+	}
+	report, err := st.rebalance(ctx, dryRun)
+	if err != nil {
+		logging.Errorf("rebalance failed: %v", err)
+		httperror.Error(w, r, fmt.Sprintf("rebalance failed after moving %d tokens: %v", len(report.Moved), err), http.StatusInternalServerError, adminCounter)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+	adminCounter.WithLabelValues("200", r.Method).Add(1)
+}
@@ -1,36 +1,66 @@
 package handlers
 
 import (
-	"net/url"
 	"sync"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/etcd/client"
 )
 
 // State is the discovery server configuration
 // state shared between handlers.
 type State struct {
-	mu            sync.RWMutex
-	etcdHost      string
-	etcdCURL      *url.URL
-	currentLeader string
-	discHost      string
+	mu       sync.RWMutex
+	primary  *shard
+	shards   map[string]*shard
+	ring     *ring
+	prevRing *ring
+	// moved lists the tokens no longer where prevRing placed them.
+	moved    map[tokenRef]bool
+	discHost string
+	cfg      config.Config
+	quotas   *quotas
+	migrator *migrator
+	mirror   *mirror
+
+	// grown lists the tokens whose history grew since it was last
+	// trimmed.
+	historyMu sync.Mutex
+	grown     map[tokenRef]bool
+
+	// memberQueues holds the bookkeeping of member requests still to
+	// be done, by token.
+	memberMu     sync.Mutex
+	memberQueues map[tokenRef]*memberQueue
+
+	// sizes caches the sizes of the tokens whose listings were marked.
+	sizesMu sync.Mutex
+	sizes   map[tokenRef]cachedSize
 }
 
-func (st *State) endpoint() (ep string) {
-	st.mu.RLock()
-	ep = st.etcdHost
-	st.mu.RUnlock()
-	return ep
+// endpoint returns the etcd endpoint of the default shard, which keeps
+// everything that is not kept per token.
+func (st *State) endpoint() string {
+	return st.primary.endpoint
+}
+
+func (st *State) keysAPI() client.KeysAPI {
+	return st.primary.keysAPI()
 }
 
-func (st *State) getCurrentLeader() (leader string) {
+func (st *State) config() (cfg config.Config) {
 	st.mu.RLock()
-	leader = st.currentLeader
+	cfg = st.cfg
 	st.mu.RUnlock()
-	return leader
+	return cfg
 }
 
-func (st *State) setCurrentLeader(leader string) {
+// Reload applies the settings of cfg that may change while serving.
+// It returns the keys of the changed settings that need a restart.
+func (st *State) Reload(cfg config.Config) []string {
 	st.mu.Lock()
-	st.currentLeader = leader
-	st.mu.Unlock()
+	defer st.mu.Unlock()
+	var restart []string
+	st.cfg, restart = config.Reload(st.cfg, cfg)
+	return restart
 }
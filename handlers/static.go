@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/audit"
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/handlers/httperror"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/etcd/client"
+)
+
+// maxStaticBody bounds the initial cluster a static token is created
+// from.
+const maxStaticBody = 1 << 20
+
+// parseInitialCluster reads the members of an --initial-cluster value,
+// in the order their names first appear.
+func parseInitialCluster(s string) ([]member, error) {
+	var ms []member
+	byName := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid member %q, expected name=url", pair)
+		}
+		i, ok := byName[kv[0]]
+		if !ok {
+			i = len(ms)
+			byName[kv[0]] = i
+			ms = append(ms, member{Name: kv[0]})
+		}
+		ms[i].PeerURLs = append(ms[i].PeerURLs, kv[1])
+	}
+	return ms, nil
+}
+
+// checkStaticMembers checks that ms can be registered, and normalizes
+// their peer urls the way etcd does.
+func checkStaticMembers(ms []member) error {
+	if len(ms) == 0 {
+		return errors.New("no members given")
+	}
+	names := make(map[string]bool)
+	seen := make(map[string]string)
+	for i, m := range ms {
+		if m.Name == "" || strings.ContainsAny(m.Name, "=,") {
+			return fmt.Errorf("invalid member name %q", m.Name)
+		}
+		if names[m.Name] {
+			return fmt.Errorf("member %s given twice", m.Name)
+		}
+		names[m.Name] = true
+		if len(m.PeerURLs) == 0 {
+			return fmt.Errorf("member %s has no peer urls", m.Name)
+		}
+		for j, p := range m.PeerURLs {
+			u, err := url.Parse(p)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid peer url %q of %s", p, m.Name)
+			}
+			ms[i].PeerURLs[j] = u.String()
+			if other, ok := seen[u.String()]; ok {
+				return fmt.Errorf("peer url %s of %s is also given for %s", u, m.Name, other)
+			}
+			seen[u.String()] = m.Name
+		}
+		sort.Strings(ms[i].PeerURLs)
+	}
+	return nil
+}
+
+// etcdMemberID returns the id etcd gives a member with peerURLs when
+// it bootstraps with the discovery url durl, which etcd also takes as
+// the cluster token.
+func etcdMemberID(peerURLs []string, durl string) string {
+	var b []byte
+	for _, p := range peerURLs {
+		b = append(b, p...)
+	}
+	b = append(b, durl...)
+	sum := sha1.Sum(b)
+	return strconv.FormatUint(binary.BigEndian.Uint64(sum[:8]), 16)
+}
+
+// staticValue returns the registration value etcd writes for m.
+func staticValue(m member) string {
+	pairs := make([]string, len(m.PeerURLs))
+	for i, p := range m.PeerURLs {
+		pairs[i] = m.Name + "=" + p
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// staticToken is a token created from a known member set.
+type staticToken struct {
+	Token   string   `json:"token"`
+	URL     string   `json:"url"`
+	Members []member `json:"members"`
+}
+
+// createStatic creates a token in ns with ms registered, in their
+// order, under the ids etcd gives them for the discovery url durl.
+func (st *State) createStatic(ctx context.Context, ns config.Namespace, r *http.Request, ms []member, ttl time.Duration) (staticToken, error) {
+	token, err := st.setupToken(ctx, ns, len(ms), ttl)
+	if err != nil {
+		return staticToken{}, err
+	}
+	t := staticToken{Token: token, URL: st.tokenURL(r, ns, token)}
+	if err := st.indexTokenValue(ctx, ns, token, "size", strconv.Itoa(len(ms))); err != nil {
+		logging.Warnf("failed to index size of %s: %v", token, err)
+	}
+	if _, err := st.setTokenValue(ctx, ns, token, "static", "true", true); err != nil {
+		st.deleteToken(ctx, ns, token)
+		return staticToken{}, err
+	}
+	if _, err := st.setTokenTime(ctx, ns, token, "created", time.Now(), true); err != nil {
+		logging.Warnf("failed to record creation of %s: %v", token, err)
+	}
+
+	sh := st.tokenShard(ctx, ns, token)
+	kapi := sh.keysAPI()
+	for _, m := range ms {
+		m.ID = etcdMemberID(m.PeerURLs, t.URL)
+		m.value = staticValue(m)
+		memberCtx, done := startEtcd(ctx, "member_create", sh.endpoint)
+		resp, err := kapi.Create(memberCtx, tokenKey(ns, token, m.ID), m.value)
+		done(err)
+		if err != nil {
+			st.deleteToken(ctx, ns, token)
+			return staticToken{}, err
+		}
+		m.CreatedIndex = resp.Node.CreatedIndex
+		m.Quorum = true
+		t.Members = append(t.Members, m)
+	}
+
+	ev := event{Time: time.Now().UTC(), Type: eventCreated, Actor: audit.PrincipalAdmin, ClientIP: st.ClientIP(r), Size: len(ms)}
+	if err := st.recordEvent(ctx, ns, token, ev, ttl); err != nil {
+		logging.Warnf("failed to record creation event of %s: %v", token, err)
+	}
+	return t, nil
+}
+
+// claimStatic lets the member id take over its registration of the
+// static token: etcd refuses to bootstrap if its registration already
+// exists, so it is removed for the member to register again. Anything
+// but a registration with the same value is left alone.
+func (st *State) claimStatic(ctx context.Context, ns config.Namespace, token, id, value string) {
+	sh := st.tokenShard(ctx, ns, token)
+	delCtx, done := startEtcd(ctx, "member_delete", sh.endpoint)
+	_, err := sh.keysAPI().Delete(delCtx, tokenKey(ns, token, id), &client.DeleteOptions{PrevValue: value})
+	done(err)
+	if err == nil {
+		logging.Infof("member %s claimed its registration with %s", id, token)
+	}
+}
+
+// StaticTokenHandler creates a token with its members already
+// registered, from an --initial-cluster value in the request body, or
+// the initialCluster or members of a JSON body. The token is created
+// in the namespace given as a query parameter.
+func StaticTokenHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	ns, ok := st.config().Namespace(r.URL.Query().Get("namespace"))
+	if !ok {
+		httperror.Error(w, r, "unknown namespace", http.StatusNotFound, adminCounter)
+		return
+	}
+	if st.mirrored(ns) != nil {
+		httperror.Error(w, r, "tokens of the namespace are created by the mirror upstream", http.StatusConflict, adminCounter)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxStaticBody))
+	if err != nil {
+		httperror.Error(w, r, "request body too large", http.StatusRequestEntityTooLarge, adminCounter)
+		return
+	}
+
+	var ms []member
+	if strings.HasPrefix(r.Header.Get("Content-Type"), mediaJSON) {
+		var bc bootstrapConfig
+		if err := json.Unmarshal(body, &bc); err != nil {
+			httperror.Error(w, r, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest, adminCounter)
+			return
+		}
+		ms = bc.Members
+		if len(ms) == 0 {
+			ms, err = parseInitialCluster(bc.InitialCluster)
+		}
+	} else {
+		ms, err = parseInitialCluster(string(body))
+	}
+	if err == nil {
+		err = checkStaticMembers(ms)
+	}
+	if err != nil {
+		httperror.Error(w, r, err.Error(), http.StatusBadRequest, adminCounter)
+		return
+	}
+	if max := ns.MaxSize; max > 0 && len(ms) > max {
+		httperror.Error(w, r, fmt.Sprintf("size %d exceeds the maximum of %d", len(ms), max), http.StatusBadRequest, adminCounter)
+		return
+	}
+	ttl := ns.TokenTTL
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 || (ns.TokenTTL > 0 && d > ns.TokenTTL) {
+			httperror.Error(w, r, fmt.Sprintf("invalid ttl %q", s), http.StatusBadRequest, adminCounter)
+			return
+		}
+		ttl = d
+	}
+
+	t, err := st.createStatic(ctx, ns, r, ms, ttl)
+	if err != nil {
+		logging.Errorf("failed to create a static token: %v", err)
+		httperror.Error(w, r, "Unable to create token", http.StatusInternalServerError, adminCounter)
+		return
+	}
+	audit.SetToken(ctx, t.Token)
+	st.migrateToken(ns, t.Token)
+	logging.Infof("Static cluster created %s with %d members", t.Token, len(t.Members))
+
+	writeJSON(w, http.StatusCreated, t)
+	adminCounter.WithLabelValues("201", r.Method).Add(1)
+}
@@ -0,0 +1,629 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/etcd/client"
+)
+
+// tokenInfo describes one token found in the registry. Tokens created
+// before creation times were recorded have a zero created time, and
+// tokens listed without their members have no members.
+type tokenInfo struct {
+	namespace string
+	shard     string
+	token     string
+	tenant    string
+	size      int
+	members   int
+	created   time.Time
+	first     time.Time
+	full      time.Time
+	labels    map[string]string
+}
+
+// tokenView is a token as listed by the admin API.
+type tokenView struct {
+	Namespace string            `json:"namespace,omitempty"`
+	Token     string            `json:"token"`
+	Shard     string            `json:"shard,omitempty"`
+	Tenant    string            `json:"tenant"`
+	Size      int               `json:"size"`
+	Members   int               `json:"members"`
+	Created   *time.Time        `json:"created,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+func (ti tokenInfo) view() tokenView {
+	v := tokenView{
+		Namespace: ti.namespace,
+		Token:     ti.token,
+		Shard:     ti.shard,
+		Tenant:    ti.tenant,
+		Size:      ti.size,
+		Members:   ti.members,
+		Labels:    ti.labels,
+	}
+	if !ti.created.IsZero() {
+		v.Created = &ti.created
+	}
+	return v
+}
+
+// complete reports whether the token was filled, as recorded by its
+// bootstrap progress or seen from its members.
+func (ti tokenInfo) complete() bool {
+	return !ti.full.IsZero() || ti.size > 0 && ti.members >= ti.size
+}
+
+// stalled reports whether the token is partially filled and older
+// than threshold.
+func (ti tokenInfo) stalled(threshold time.Duration, now time.Time) bool {
+	return (ti.members > 0 || !ti.first.IsZero()) && !ti.complete() &&
+		!ti.created.IsZero() && now.Sub(ti.created) > threshold
+}
+
+// durationSummary summarizes a set of bootstrap durations in seconds.
+type durationSummary struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50Seconds"`
+	P90   float64 `json:"p90Seconds"`
+	Max   float64 `json:"maxSeconds"`
+}
+
+func summarizeDurations(ds []float64) durationSummary {
+	if len(ds) == 0 {
+		return durationSummary{}
+	}
+	sort.Float64s(ds)
+	return durationSummary{
+		Count: len(ds),
+		P50:   ds[len(ds)*50/100],
+		P90:   ds[len(ds)*90/100],
+		Max:   ds[len(ds)-1],
+	}
+}
+
+// tokenStats summarizes the tokens found in one registry scan.
+type tokenStats struct {
+	Live        int             `json:"live"`
+	Completed   int             `json:"completed"`
+	Stalled     int             `json:"stalled"`
+	Sizes       map[string]int  `json:"sizes"`
+	Namespaces  map[string]int  `json:"namespaces,omitempty"`
+	Tenants     map[string]int  `json:"tenants"`
+	FirstMember durationSummary `json:"firstMember"`
+	Complete    durationSummary `json:"complete"`
+}
+
+func summarizeTokens(infos []tokenInfo, threshold time.Duration, now time.Time) tokenStats {
+	ts := tokenStats{Sizes: make(map[string]int), Tenants: make(map[string]int)}
+	var first, full []float64
+	for _, ti := range infos {
+		ts.Live++
+		ts.Sizes[strconv.Itoa(ti.size)]++
+		ts.Tenants[ti.tenant]++
+		if ti.namespace != "" {
+			if ts.Namespaces == nil {
+				ts.Namespaces = make(map[string]int)
+			}
+			ts.Namespaces[ti.namespace]++
+		}
+		if ti.complete() {
+			ts.Completed++
+		}
+		if ti.stalled(threshold, now) {
+			ts.Stalled++
+		}
+		if !ti.created.IsZero() && !ti.first.IsZero() {
+			first = append(first, ti.first.Sub(ti.created).Seconds())
+		}
+		if !ti.created.IsZero() && !ti.full.IsZero() {
+			full = append(full, ti.full.Sub(ti.created).Seconds())
+		}
+	}
+	ts.FirstMember = summarizeDurations(first)
+	ts.Complete = summarizeDurations(full)
+	return ts
+}
+
+// tokenConfig returns the keys stored under the _config directory of
+// token. Hidden keys are left out of directory listings, so they have
+// to be fetched on their own.
+func (st *State) tokenConfig(ctx context.Context, ns config.Namespace, token string) (map[string]string, error) {
+	sh := st.tokenShard(ctx, ns, token)
+	ctx, done := startEtcd(ctx, "config_get", sh.endpoint)
+	resp, err := sh.keysAPI().Get(ctx, tokenKey(ns, token, "_config"), &client.GetOptions{Recursive: true})
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := make(map[string]string)
+	for _, n := range resp.Node.Nodes {
+		if !n.Dir {
+			cfg[path.Base(n.Key)] = n.Value
+		}
+	}
+	return cfg, nil
+}
+
+func parseTokenTime(v string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, v)
+	return t
+}
+
+// setTokenValue records value under the _config directory of token.
+// Keys under _config are hidden from members listing the token, but
+// watches replaying past events still see them, so they may only be
+// written before the token is handed out. Resets are the exception:
+// they change the size once the members are stopped, and members
+// started afterwards watch from the listing they register on, which
+// is past the new size. Unless overwrite is set, an already recorded
+// value is kept and false is returned.
+func (st *State) setTokenValue(ctx context.Context, ns config.Namespace, token, name, value string, overwrite bool) (bool, error) {
+	opts := &client.SetOptions{}
+	if !overwrite {
+		opts.PrevExist = client.PrevNoExist
+	}
+
+	sh := st.tokenShard(ctx, ns, token)
+	setCtx, done := startEtcd(ctx, "config_set", sh.endpoint)
+	_, err := sh.keysAPI().Set(setCtx, tokenKey(ns, token, "_config", name), value, opts)
+	done(err)
+	if err != nil {
+		if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeNodeExist {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, st.indexTokenValue(ctx, ns, token, name, value)
+}
+
+// setTokenTime records t under the _config directory of token, like
+// setTokenValue.
+func (st *State) setTokenTime(ctx context.Context, ns config.Namespace, token, name string, t time.Time, overwrite bool) (bool, error) {
+	return st.setTokenValue(ctx, ns, token, name, t.UTC().Format(time.RFC3339Nano), overwrite)
+}
+
+// progressKey returns the etcd key of the bootstrap progress of token
+// in ns, joined with elems. Progress is recorded while members
+// register, so it is kept out of the token directory members watch.
+func progressKey(ns config.Namespace, token string, elems ...string) string {
+	return path.Join(append([]string{ns.Prefix, "_progress", token}, elems...)...)
+}
+
+// setProgressTime records the time the bootstrap of token reached a
+// step, expiring along with the token after ttl unless it is 0. An
+// already recorded time is kept and false is returned.
+func (st *State) setProgressTime(ctx context.Context, ns config.Namespace, token, name string, t time.Time, ttl time.Duration) (bool, error) {
+	sh := st.tokenShard(ctx, ns, token)
+	ctx, done := startEtcd(ctx, "progress_set", sh.endpoint)
+	_, err := sh.keysAPI().Set(ctx, progressKey(ns, token, name), t.UTC().Format(time.RFC3339Nano), &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+		TTL:       ttl,
+	})
+	done(err)
+	if err != nil {
+		if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeNodeExist {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// namespaceProgress returns the recorded bootstrap steps of every
+// token in ns on the shard of ctx, by token.
+func (st *State) namespaceProgress(ctx context.Context, ns config.Namespace) (map[string]map[string]string, error) {
+	return st.scanTokenState(ctx, path.Join(ns.Prefix, "_progress"), "progress_scan")
+}
+
+// configIndexKey returns the etcd key of the copy of the config of
+// token in ns, joined with elems. The _config directory of a token is
+// hidden from recursive listings, so registry scans read the copy
+// rather than fetching the config of every token on its own.
+func configIndexKey(ns config.Namespace, token string, elems ...string) string {
+	return path.Join(append([]string{ns.Prefix, "_configs", token}, elems...)...)
+}
+
+// indexTokenValue copies a value recorded under the _config directory
+// of token to its config index.
+func (st *State) indexTokenValue(ctx context.Context, ns config.Namespace, token, name, value string) error {
+	sh := st.tokenShard(ctx, ns, token)
+	ctx, done := startEtcd(ctx, "config_index_set", sh.endpoint)
+	_, err := sh.keysAPI().Set(ctx, configIndexKey(ns, token, name), value, nil)
+	done(err)
+	return err
+}
+
+// namespaceConfigs returns the indexed config of every token in ns on
+// the shard of ctx, by token.
+func (st *State) namespaceConfigs(ctx context.Context, ns config.Namespace) (map[string]map[string]string, error) {
+	return st.scanTokenState(ctx, path.Join(ns.Prefix, "_configs"), "config_index_scan")
+}
+
+// scanTokenState reads the directory key, kept beside the tokens of a
+// namespace on the shard of ctx, in one request. It returns the keys of
+// each token by token.
+func (st *State) scanTokenState(ctx context.Context, key, op string) (map[string]map[string]string, error) {
+	sh := st.ctxShard(ctx)
+	ctx, done := startEtcd(ctx, op, sh.endpoint)
+	resp, err := sh.scanAPI().Get(ctx, key, &client.GetOptions{Recursive: true})
+	done(err)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	state := make(map[string]map[string]string)
+	for _, n := range resp.Node.Nodes {
+		values := make(map[string]string)
+		for _, v := range n.Nodes {
+			values[path.Base(v.Key)] = v.Value
+		}
+		state[path.Base(n.Key)] = values
+	}
+	return state, nil
+}
+
+// listTokens walks the registry of every namespace on every shard and
+// describes its tokens with their members.
+func (st *State) listTokens(ctx context.Context) ([]tokenInfo, error) {
+	var infos []tokenInfo
+	for _, sh := range st.shardList() {
+		for _, ns := range st.config().AllNamespaces() {
+			nsInfos, err := st.listNamespaceTokens(withShard(ctx, sh), ns, true)
+			if err != nil {
+				return nil, fmt.Errorf("shard %s: %v", sh.name, err)
+			}
+			infos = append(infos, nsInfos...)
+		}
+	}
+	return infos, nil
+}
+
+// listNamespaceTokens walks the registry of ns on the shard of ctx and
+// describes its tokens, with their members if members is set. The
+// configs of the tokens are taken from the config index.
+func (st *State) listNamespaceTokens(ctx context.Context, ns config.Namespace, members bool) ([]tokenInfo, error) {
+	sh := st.ctxShard(ctx)
+	configs, err := st.namespaceConfigs(ctx, ns)
+	if err != nil {
+		return nil, err
+	}
+	scanCtx, done := startEtcd(ctx, "registry_scan", sh.endpoint)
+	resp, err := sh.scanAPI().Get(scanCtx, ns.Prefix, &client.GetOptions{Recursive: members, Sort: true})
+	done(err)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	progress, err := st.namespaceProgress(ctx, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []tokenInfo
+	for _, n := range resp.Node.Nodes {
+		if !n.Dir {
+			continue
+		}
+
+		ti := tokenInfo{namespace: ns.Name, shard: sh.name, token: path.Base(n.Key), members: len(n.Nodes)}
+		cfg := configs[ti.token]
+		ti.size, _ = strconv.Atoi(cfg["size"])
+		ti.tenant = configTenant(cfg)
+		ti.created = parseTokenTime(cfg["created"])
+		ti.first = parseTokenTime(progress[ti.token]["first"])
+		ti.full = parseTokenTime(progress[ti.token]["full"])
+		if l := cfg["labels"]; l != "" {
+			json.Unmarshal([]byte(l), &ti.labels)
+		}
+		infos = append(infos, ti)
+	}
+	return infos, nil
+}
+
+// recordRegistration records bootstrap progress after a member was
+// registered with token in ns. body is the etcd response to the
+// registration.
+func (st *State) recordRegistration(ctx context.Context, ns config.Namespace, token string, body []byte) {
+	var resp client.Response
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Node == nil || resp.PrevNode != nil {
+		// not a new registration
+		return
+	}
+
+	cfg, err := st.tokenConfig(ctx, ns, token)
+	if err != nil {
+		logging.Warnf("failed to read config of %s: %v", token, err)
+		return
+	}
+	created := parseTokenTime(cfg["created"])
+	size, _ := strconv.Atoi(cfg["size"])
+	if created.IsZero() || size <= 0 {
+		return
+	}
+
+	sh := st.tokenShard(ctx, ns, token)
+	getCtx, done := startEtcd(ctx, "token_get", sh.endpoint)
+	members, err := sh.keysAPI().Get(getCtx, tokenKey(ns, token), nil)
+	done(err)
+	if err != nil {
+		logging.Warnf("failed to list members of %s: %v", token, err)
+		return
+	}
+
+	// the rank of the new member follows the CreatedIndex ordering
+	// etcd uses to pick the cluster members. The member itself counts
+	// even if it was removed since it was answered.
+	rank := 1
+	for _, n := range members.Node.Nodes {
+		if n.CreatedIndex < resp.Node.CreatedIndex {
+			rank++
+		}
+	}
+
+	if rank > size {
+		// etcd makes the member a proxy, or exits with
+		// discovery-fallback=exit
+		overflowMembers.Inc()
+		return
+	}
+
+	ttl := time.Duration(members.Node.TTL) * time.Second
+	now := time.Now()
+	if rank == 1 {
+		if ok, err := st.setProgressTime(ctx, ns, token, "first", now, ttl); err != nil {
+			logging.Warnf("failed to record first member of %s: %v", token, err)
+		} else if ok {
+			firstMemberDuration.Observe(now.Sub(created).Seconds())
+		}
+	}
+	if rank == size {
+		if ok, err := st.setProgressTime(ctx, ns, token, "full", now, ttl); err != nil {
+			logging.Warnf("failed to record completion of %s: %v", token, err)
+		} else if ok {
+			completeDuration.Observe(now.Sub(created).Seconds())
+			ev := event{Time: now.UTC(), Type: eventFull, Size: size, Member: path.Base(resp.Node.Key)}
+			if err := st.recordEvent(ctx, ns, token, ev, ttl); err != nil {
+				logging.Warnf("failed to record full event of %s: %v", token, err)
+			}
+		}
+	}
+}
+
+// backfillConfigIndex indexes the configs of the tokens that were set
+// up before configs were indexed, on every shard.
+func (st *State) backfillConfigIndex(ctx context.Context) error {
+	for _, sh := range st.shardList() {
+		for _, ns := range st.config().AllNamespaces() {
+			if err := st.backfillNamespaceConfigs(withShard(ctx, sh), ns); err != nil {
+				return fmt.Errorf("shard %s: %v", sh.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// backfillNamespaceConfigs indexes the configs of the tokens of ns on
+// the shard of ctx that have no size in the config index. Tokens are
+// listed before the index is read, and indexed values are never
+// overwritten, so that tokens set up meanwhile keep their own.
+func (st *State) backfillNamespaceConfigs(ctx context.Context, ns config.Namespace) error {
+	sh := st.ctxShard(ctx)
+	scanCtx, done := startEtcd(ctx, "registry_scan", sh.endpoint)
+	resp, err := sh.scanAPI().Get(scanCtx, ns.Prefix, nil)
+	done(err)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	configs, err := st.namespaceConfigs(ctx, ns)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range resp.Node.Nodes {
+		token := path.Base(n.Key)
+		if !n.Dir || configs[token]["size"] != "" {
+			continue
+		}
+		cfg, err := st.tokenConfig(ctx, ns, token)
+		if err != nil {
+			if client.IsKeyNotFound(err) {
+				continue
+			}
+			return err
+		}
+		for name, value := range cfg {
+			setCtx, done := startEtcd(ctx, "config_index_set", sh.endpoint)
+			_, err := sh.keysAPI().Set(setCtx, configIndexKey(ns, token, name), value, &client.SetOptions{PrevExist: client.PrevNoExist})
+			done(err)
+			if err != nil {
+				if cerr, ok := err.(client.Error); !ok || cerr.Code != client.ErrorCodeNodeExist {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// statsKey returns the etcd key, on the default shard, of the state
+// shared by the stats rounds of every instance, joined with elems.
+func (st *State) statsKey(elems ...string) string {
+	return path.Join(append([]string{st.config().RegistryPrefix, "_stats"}, elems...)...)
+}
+
+// leadStats reports whether the instance called id runs the registry
+// scans, taking or renewing the scanner lock for ttl. Only one instance
+// scans at a time; the others read the counts it publishes.
+func (st *State) leadStats(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	kapi := st.keysAPI()
+	lockCtx, done := startEtcd(ctx, "stats_lock", st.endpoint())
+	_, err := kapi.Set(lockCtx, st.statsKey("scanner"), id, &client.SetOptions{PrevValue: id, TTL: ttl})
+	done(err)
+	if err == nil {
+		return true, nil
+	}
+	if !client.IsKeyNotFound(err) {
+		if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeTestFailed {
+			return false, nil
+		}
+		return false, err
+	}
+
+	lockCtx, done = startEtcd(ctx, "stats_lock", st.endpoint())
+	_, err = kapi.Set(lockCtx, st.statsKey("scanner"), id, &client.SetOptions{PrevExist: client.PrevNoExist, TTL: ttl})
+	done(err)
+	if err != nil {
+		if cerr, ok := err.(client.Error); ok && cerr.Code == client.ErrorCodeNodeExist {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// scanTokenStats scans the registry and publishes what it found for the
+// instances that do not scan.
+func (st *State) scanTokenStats(ctx context.Context) (tokenStats, error) {
+	// the per shard gauges are refreshed even when a shard is down
+	infos, err := st.scanShards(ctx)
+	if err != nil {
+		return tokenStats{}, err
+	}
+	ts := summarizeTokens(infos, st.config().StallThreshold, time.Now())
+	b, err := json.Marshal(ts)
+	if err != nil {
+		return tokenStats{}, err
+	}
+	setCtx, done := startEtcd(ctx, "stats_publish", st.endpoint())
+	_, err = st.keysAPI().Set(setCtx, st.statsKey("tokens"), string(b), nil)
+	done(err)
+	return ts, err
+}
+
+// publishedTokenStats reads the counts of the last registry scan.
+func (st *State) publishedTokenStats(ctx context.Context) (tokenStats, error) {
+	var ts tokenStats
+	getCtx, done := startEtcd(ctx, "stats_read", st.endpoint())
+	resp, err := st.keysAPI().Get(getCtx, st.statsKey("tokens"), nil)
+	done(err)
+	if err != nil {
+		return ts, err
+	}
+	err = json.Unmarshal([]byte(resp.Node.Value), &ts)
+	return ts, err
+}
+
+// refreshTokenStats sets the token gauges and the live token counts of
+// the quotas from a registry scan if the instance called id leads the
+// scans, and from the counts of the last scan otherwise. A round gets
+// interval to complete.
+func (st *State) refreshTokenStats(ctx context.Context, id string, interval time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, interval)
+	defer cancel()
+
+	lead, err := st.leadStats(ctx, id, statsLockTTL(interval))
+	if err != nil {
+		return err
+	}
+	var ts tokenStats
+	if lead {
+		ts, err = st.scanTokenStats(ctx)
+	} else {
+		ts, err = st.publishedTokenStats(ctx)
+	}
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			// no scan completed yet
+			return nil
+		}
+		return err
+	}
+
+	liveTokens.Set(float64(ts.Live))
+	completedBootstraps.Set(float64(ts.Completed))
+	stalledBootstraps.Set(float64(ts.Stalled))
+
+	tenantLiveTokens.Reset()
+	for tenant, n := range ts.Tenants {
+		tenantLiveTokens.WithLabelValues(tenant).Set(float64(n))
+	}
+	// the quotas catch up with expired tokens and with the tokens of
+	// other instances
+	st.quotas.setLive(ts.Tenants)
+	return nil
+}
+
+// statsLockTTL is how long the scanner lock outlives the round that
+// took it, so that another instance takes over the scans when the
+// scanner stops.
+func statsLockTTL(interval time.Duration) time.Duration {
+	ttl := 3 * interval
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return ttl
+}
+
+// watchTokenStats refreshes the token gauges every interval until ctx
+// is canceled. The configs of older tokens are indexed as the instance
+// starts, until that succeeds once. The first scan waits for the first
+// interval, so that an instance restarting over and over does not take
+// the scans over.
+func (st *State) watchTokenStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	id := randomHex(8)
+	backfilled := false
+	for {
+		if !backfilled {
+			backfillCtx, cancel := context.WithTimeout(ctx, interval)
+			if err := st.backfillConfigIndex(backfillCtx); err != nil {
+				if ctx.Err() == nil {
+					logging.Errorf("config index backfill failed: %v", err)
+				}
+			} else {
+				backfilled = true
+			}
+			cancel()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := st.refreshTokenStats(ctx, id, interval); err != nil && ctx.Err() == nil {
+			logging.Errorf("token stats refresh failed: %v", err)
+		}
+		st.trimHistories(ctx)
+		st.pruneSizes()
+	}
+}
+
+// StartTokenStats refreshes the token gauges in the background until
+// ctx is canceled.
+func StartTokenStats(ctx context.Context, st *State) {
+	go st.watchTokenStats(ctx, st.config().StatsInterval)
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/coreos/discovery.etcd.io/handlers/httperror"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/etcd/client"
+	"github.com/gorilla/mux"
+)
+
+// summary is the report of /summary.
+type summary struct {
+	Token      string   `json:"token"`
+	Size       int      `json:"size"`
+	Registered int      `json:"registered"`
+	Full       bool     `json:"full"`
+	Quorum     []member `json:"quorum"`
+	Overflow   []member `json:"overflow"`
+	// Expected are the members the token expects by name, and
+	// Missing those of them that have not registered yet.
+	Expected []expectedMember `json:"expected,omitempty"`
+	Missing  []string         `json:"missing,omitempty"`
+	// PeerChecks are the last peer url checks of the members that
+	// registered, including those refused.
+	PeerChecks []peerCheck `json:"peerChecks,omitempty"`
+}
+
+// SummaryHandler tells the members of a token that form its cluster
+// from those that registered after it was full, ordered by
+// CreatedIndex as etcd orders them.
+func SummaryHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	ns, ok := st.namespace(r)
+	if !ok {
+		httperror.Error(w, r, "unknown namespace", http.StatusNotFound, tokenCounter)
+		return
+	}
+
+	token := mux.Vars(r)["token"]
+	size, ms, err := st.tokenMembers(ctx, ns, token)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			httperror.Error(w, r, "token not found", http.StatusNotFound, tokenCounter)
+			return
+		}
+		logging.Errorf("Error reading token members: %v", err)
+		httperror.Error(w, r, "", http.StatusInternalServerError, tokenCounter)
+		return
+	}
+
+	s := summary{
+		Token:      token,
+		Size:       size,
+		Registered: len(ms),
+		Full:       size > 0 && len(ms) >= size,
+		Quorum:     []member{},
+		Overflow:   []member{},
+	}
+	for _, m := range ms {
+		if m.Quorum {
+			s.Quorum = append(s.Quorum, m)
+		} else {
+			s.Overflow = append(s.Overflow, m)
+		}
+	}
+	ex, err := st.tokenExpectation(ctx, ns, token)
+	if err != nil && !client.IsKeyNotFound(err) {
+		logging.Errorf("Error reading expected members: %v", err)
+		httperror.Error(w, r, "", http.StatusInternalServerError, tokenCounter)
+		return
+	}
+	if ex != nil {
+		s.Expected, s.Missing = ex.Members, ex.missing(ms)
+	}
+	if s.PeerChecks, err = st.tokenPeerChecks(ctx, ns, token); err != nil {
+		logging.Errorf("Error reading peer checks: %v", err)
+		httperror.Error(w, r, "", http.StatusInternalServerError, tokenCounter)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+	tokenCounter.WithLabelValues("200", r.Method).Add(1)
+}
@@ -0,0 +1,385 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/coreos/discovery.etcd.io/audit"
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/handlers/httperror"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/etcd/client"
+	"github.com/gorilla/mux"
+)
+
+// APIKeyHeader is the request header /new takes API keys from.
+const APIKeyHeader = "X-Api-Key"
+
+// anonymousTenant stands for tokens created without an API key, in
+// quotas and metrics. No tenant can be called that.
+const anonymousTenant = "anonymous"
+
+var (
+	tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	keyID      = regexp.MustCompile(`^[a-f0-9]{8}$`)
+
+	errInvalidKey        = errors.New("invalid API key")
+	errAnonymousDisabled = errors.New("an API key is required")
+	errNoCredentials     = errors.New("an API key or the admin token is required")
+	errNotOwner          = errors.New("the token belongs to another tenant")
+)
+
+// tenant is a user of the service, identified by its API keys.
+type tenant struct {
+	Name string `json:"name"`
+	config.Limits
+	// Keys are the ids of the API keys of the tenant.
+	Keys []string `json:"keys"`
+	// Live is how many live tokens the tenant has.
+	Live int `json:"live"`
+}
+
+// tenantKey returns the etcd key of the tenant settings joined with
+// elems. Tenants keep their limits under <prefix>/<tenant>/limits and
+// a hash of each API key under <prefix>/<tenant>/keys/<id>.
+func (st *State) tenantKey(elems ...string) string {
+	return path.Join(append([]string{st.config().TenantPrefix}, elems...)...)
+}
+
+// parseTenant reads a tenant out of its etcd directory.
+func parseTenant(n *client.Node) (tenant, error) {
+	t := tenant{Name: path.Base(n.Key), Keys: []string{}}
+	for _, c := range n.Nodes {
+		switch path.Base(c.Key) {
+		case "limits":
+			if err := json.Unmarshal([]byte(c.Value), &t.Limits); err != nil {
+				return t, err
+			}
+		case "keys":
+			for _, k := range c.Nodes {
+				t.Keys = append(t.Keys, path.Base(k.Key))
+			}
+		}
+	}
+	return t, nil
+}
+
+func (st *State) getTenant(ctx context.Context, name string) (tenant, *client.Node, error) {
+	ctx, done := startEtcd(ctx, "tenant_get", st.endpoint())
+	resp, err := st.keysAPI().Get(ctx, st.tenantKey(name), &client.GetOptions{Recursive: true})
+	done(err)
+	if err != nil {
+		return tenant{}, nil, err
+	}
+	t, err := parseTenant(resp.Node)
+	return t, resp.Node, err
+}
+
+func (st *State) listTenants(ctx context.Context) ([]tenant, error) {
+	ctx, done := startEtcd(ctx, "tenant_list", st.endpoint())
+	resp, err := st.keysAPI().Get(ctx, st.tenantKey(), &client.GetOptions{Recursive: true, Sort: true})
+	done(err)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return []tenant{}, nil
+		}
+		return nil, err
+	}
+
+	ts := []tenant{}
+	for _, n := range resp.Node.Nodes {
+		t, err := parseTenant(n)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+func (st *State) putTenant(ctx context.Context, name string, limits config.Limits) error {
+	b, err := json.Marshal(limits)
+	if err != nil {
+		return err
+	}
+	ctx, done := startEtcd(ctx, "tenant_put", st.endpoint())
+	_, err = st.keysAPI().Set(ctx, st.tenantKey(name, "limits"), string(b), nil)
+	done(err)
+	return err
+}
+
+func (st *State) deleteTenant(ctx context.Context, name string) error {
+	ctx, done := startEtcd(ctx, "tenant_delete", st.endpoint())
+	_, err := st.keysAPI().Delete(ctx, st.tenantKey(name), &client.DeleteOptions{Recursive: true, Dir: true})
+	done(err)
+	return err
+}
+
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// createKey issues a new API key for tenant. Only a hash of the key is
+// stored, so it cannot be recovered later.
+func (st *State) createKey(ctx context.Context, name string) (id, key string, err error) {
+	id, secret := randomHex(4), randomHex(16)
+	if id == "" || secret == "" {
+		return "", "", errors.New("Couldn't generate a key")
+	}
+
+	ctx, done := startEtcd(ctx, "key_create", st.endpoint())
+	_, err = st.keysAPI().Create(ctx, st.tenantKey(name, "keys", id), hashKey(secret))
+	done(err)
+	if err != nil {
+		return "", "", err
+	}
+	return id, strings.Join([]string{name, id, secret}, "."), nil
+}
+
+func (st *State) deleteKey(ctx context.Context, name, id string) error {
+	ctx, done := startEtcd(ctx, "key_delete", st.endpoint())
+	_, err := st.keysAPI().Delete(ctx, st.tenantKey(name, "keys", id), nil)
+	done(err)
+	return err
+}
+
+// authenticate returns the tenant holding key, which has the form
+// <tenant>.<id>.<secret>.
+func (st *State) authenticate(ctx context.Context, key string) (tenant, error) {
+	parts := strings.Split(key, ".")
+	if len(parts) != 3 || !tenantName.MatchString(parts[0]) {
+		return tenant{}, errInvalidKey
+	}
+	t, n, err := st.getTenant(ctx, parts[0])
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return tenant{}, errInvalidKey
+		}
+		return tenant{}, err
+	}
+
+	want := path.Join(n.Key, "keys", parts[1])
+	for _, c := range n.Nodes {
+		for _, k := range c.Nodes {
+			if k.Key == want && subtle.ConstantTimeCompare([]byte(k.Value), []byte(hashKey(parts[2]))) == 1 {
+				return t, nil
+			}
+		}
+	}
+	return tenant{}, errInvalidKey
+}
+
+// requestTenant returns the name and limits of the tenant creating a
+// token with r, as identified by its API key.
+func (st *State) requestTenant(ctx context.Context, r *http.Request) (string, config.Limits, error) {
+	cfg := st.config()
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		if cfg.AnonymousDisabled {
+			return "", config.Limits{}, errAnonymousDisabled
+		}
+		return anonymousTenant, cfg.Anonymous, nil
+	}
+	t, err := st.authenticate(ctx, key)
+	if err != nil {
+		return "", config.Limits{}, err
+	}
+	audit.SetPrincipal(ctx, t.Name)
+	return t.Name, t.Limits, nil
+}
+
+// tokenActor returns who r acts as on a token with the given config:
+// the admin, or the tenant that created it. It records the principal
+// of r for the audit log once it is known.
+func (st *State) tokenActor(ctx context.Context, r *http.Request, cfg map[string]string) (string, error) {
+	if st.isAdmin(r) {
+		audit.SetPrincipal(ctx, audit.PrincipalAdmin)
+		return audit.PrincipalAdmin, nil
+	}
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return "", errNoCredentials
+	}
+	t, err := st.authenticate(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	audit.SetPrincipal(ctx, t.Name)
+	if cfg["tenant"] != t.Name {
+		return "", errNotOwner
+	}
+	return t.Name, nil
+}
+
+// actorError reports the error of tokenActor.
+func actorError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errNoCredentials, errInvalidKey:
+		httperror.Error(w, r, err.Error(), http.StatusUnauthorized, tokenCounter)
+	case errNotOwner:
+		httperror.Error(w, r, err.Error(), http.StatusForbidden, tokenCounter)
+	default:
+		logging.Errorf("failed to authenticate API key: %v", err)
+		httperror.Error(w, r, "Unable to check API key", http.StatusInternalServerError, tokenCounter)
+	}
+}
+
+// tenantLimits returns the limits of the tenant that created a token
+// with config cfg. Tokens of tenants since deleted have no limits.
+func (st *State) tenantLimits(ctx context.Context, cfg map[string]string) (config.Limits, error) {
+	name := cfg["tenant"]
+	if name == "" || name == anonymousTenant {
+		return st.config().Anonymous, nil
+	}
+	t, _, err := st.getTenant(ctx, name)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return config.Limits{}, nil
+		}
+		return config.Limits{}, err
+	}
+	return t.Limits, nil
+}
+
+// tenantError reports a failed tenant operation, mapping missing etcd
+// keys to 404.
+func tenantError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	if client.IsKeyNotFound(err) {
+		httperror.Error(w, r, "not found", http.StatusNotFound, adminCounter)
+		return
+	}
+	logging.Errorf("%s: %v", msg, err)
+	httperror.Error(w, r, msg, http.StatusInternalServerError, adminCounter)
+}
+
+// TenantsHandler lists the tenants with their limits, key ids and live
+// token counts.
+func TenantsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	ts, err := st.listTenants(ctx)
+	if err != nil {
+		tenantError(w, r, "Unable to list tenants", err)
+		return
+	}
+	live, err := st.tenantTokens(ctx)
+	if err != nil {
+		tenantError(w, r, "Unable to count tokens", err)
+		return
+	}
+	for i := range ts {
+		ts[i].Live = live[ts[i].Name]
+	}
+	writeJSON(w, http.StatusOK, ts)
+	adminCounter.WithLabelValues("200", r.Method).Add(1)
+}
+
+// TenantHandler shows, creates or updates, and deletes a tenant. PUT
+// takes the limits of the tenant as JSON.
+func TenantHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	name := mux.Vars(r)["tenant"]
+	if !tenantName.MatchString(name) || name == anonymousTenant {
+		httperror.Error(w, r, "invalid tenant name", http.StatusBadRequest, adminCounter)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var limits config.Limits
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			httperror.Error(w, r, "invalid limits: "+err.Error(), http.StatusBadRequest, adminCounter)
+			return
+		}
+		if err := limits.Validate(); err != nil {
+			httperror.Error(w, r, "invalid limits: "+err.Error(), http.StatusBadRequest, adminCounter)
+			return
+		}
+		if err := st.putTenant(ctx, name, limits); err != nil {
+			tenantError(w, r, "Unable to store tenant", err)
+			return
+		}
+		logging.Infof("tenant %s set to %+v", name, limits)
+	case http.MethodDelete:
+		if err := st.deleteTenant(ctx, name); err != nil {
+			tenantError(w, r, "Unable to delete tenant", err)
+			return
+		}
+		logging.Infof("tenant %s deleted", name)
+		w.WriteHeader(http.StatusNoContent)
+		adminCounter.WithLabelValues("204", r.Method).Add(1)
+		return
+	}
+
+	t, _, err := st.getTenant(ctx, name)
+	if err != nil {
+		tenantError(w, r, "Unable to read tenant", err)
+		return
+	}
+	live, err := st.tenantTokens(ctx)
+	if err != nil {
+		tenantError(w, r, "Unable to count tokens", err)
+		return
+	}
+	t.Live = live[name]
+	writeJSON(w, http.StatusOK, t)
+	adminCounter.WithLabelValues("200", r.Method).Add(1)
+}
+
+// NewKeyHandler issues an API key for a tenant. The key is only ever
+// shown in this response.
+func NewKeyHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	name := mux.Vars(r)["tenant"]
+	if !tenantName.MatchString(name) || name == anonymousTenant {
+		httperror.Error(w, r, "invalid tenant name", http.StatusBadRequest, adminCounter)
+		return
+	}
+	if _, _, err := st.getTenant(ctx, name); err != nil {
+		tenantError(w, r, "Unable to read tenant", err)
+		return
+	}
+	id, key, err := st.createKey(ctx, name)
+	if err != nil {
+		tenantError(w, r, "Unable to create key", err)
+		return
+	}
+	logging.Infof("key %s issued to tenant %s", id, name)
+
+	writeJSON(w, http.StatusCreated, map[string]string{"id": id, "key": key})
+	adminCounter.WithLabelValues("201", r.Method).Add(1)
+}
+
+// KeyHandler revokes an API key of a tenant.
+func KeyHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	st := ctx.Value(stateKey).(*State)
+
+	vars := mux.Vars(r)
+	if !tenantName.MatchString(vars["tenant"]) || vars["tenant"] == anonymousTenant {
+		httperror.Error(w, r, "invalid tenant name", http.StatusBadRequest, adminCounter)
+		return
+	}
+	if !keyID.MatchString(vars["key"]) {
+		httperror.Error(w, r, "invalid key id", http.StatusBadRequest, adminCounter)
+		return
+	}
+	if err := st.deleteKey(ctx, vars["tenant"], vars["key"]); err != nil {
+		tenantError(w, r, "Unable to revoke key", err)
+		return
+	}
+	logging.Infof("key %s of tenant %s revoked", vars["key"], vars["tenant"])
+
+	w.WriteHeader(http.StatusNoContent)
+	adminCounter.WithLabelValues("204", r.Method).Add(1)
+}
@@ -6,13 +6,20 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"path"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/coreos/discovery.etcd.io/config"
 	"github.com/coreos/discovery.etcd.io/handlers/httperror"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/discovery.etcd.io/metrics"
+	"github.com/coreos/discovery.etcd.io/tracing"
+	"github.com/coreos/etcd/client"
+	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -24,19 +31,30 @@ func init() {
 		},
 		[]string{"code", "method"},
 	)
-	prometheus.MustRegister(tokenCounter)
+	metrics.Registry.MustRegister(tokenCounter)
 }
 
 var tokenCounter *prometheus.CounterVec
 
-func (st *State) proxyRequest(r *http.Request) (*http.Response, error) {
+func (st *State) proxyRequest(ctx context.Context, ns config.Namespace, r *http.Request) (resp *http.Response, err error) {
+	ctx, span := tracing.Start(ctx, "proxy", tracing.KindInternal)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
 	body, _ := ioutil.ReadAll(r.Body)
 
+	// the key starts at the token, past any namespace route prefix
+	token := mux.Vars(r)["token"]
+	key := path.Join(ns.Prefix, r.URL.Path[strings.Index(r.URL.Path, token):])
+	sh := st.tokenShard(ctx, ns, token)
+
 	for i := 0; i <= 10; i++ {
 		u := url.URL{
 			Scheme:   "http",
-			Host:     st.getCurrentLeader(),
-			Path:     path.Join("v2", "keys", "_etcd", "registry", r.URL.Path),
+			Host:     sh.getLeader(),
+			Path:     path.Join("v2", "keys", key),
 			RawQuery: r.URL.RawQuery,
 		}
 
@@ -48,8 +66,20 @@ func (st *State) proxyRequest(r *http.Request) (*http.Response, error) {
 
 		copyHeader(outreq.Header, r.Header)
 
+		if i > 0 {
+			proxyRetries.Add(1)
+		}
+		attemptCtx, done := startEtcd(ctx, "proxy_"+strings.ToLower(r.Method), u.Host)
+		attempt := tracing.FromContext(attemptCtx)
+		attempt.SetAttribute("proxy.attempt", i)
+		tracing.Inject(attemptCtx, outreq.Header)
+
 		client := http.Client{}
 		resp, err := client.Do(outreq)
+		if err == nil {
+			attempt.SetAttribute("http.status_code", resp.StatusCode)
+		}
+		done(err)
 		if err != nil {
 			return nil, err
 		}
@@ -61,7 +91,8 @@ func (st *State) proxyRequest(r *http.Request) (*http.Response, error) {
 			if err != nil {
 				return nil, err
 			}
-			st.setCurrentLeader(u.Host)
+			leaderRedirects.Add(1)
+			sh.setLeader(u.Host)
 			continue
 		}
 
@@ -83,14 +114,163 @@ func copyHeader(dst, src http.Header) {
 func TokenHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	st := ctx.Value(stateKey).(*State)
 
-	resp, err := st.proxyRequest(r)
+	ns, ok := st.namespace(r)
+	if !ok {
+		httperror.Error(w, r, "unknown namespace", http.StatusNotFound, tokenCounter)
+		return
+	}
+	cached := false
+	if m := st.mirrored(ns); m != nil {
+		if m.serveToken(ctx, w, r, ns, false) {
+			return
+		}
+		// the upstream cannot be reached, and r is served from the
+		// cache
+		cached = true
+	}
+
+	if r.URL.Query().Get("wait") == "true" {
+		longPollsInFlight.Inc()
+		defer longPollsInFlight.Dec()
+	}
+
+	// registrations are admitted by the token before they reach etcd,
+	// which only sees their value
+	var metadata map[string]string
+	at := time.Now()
+	if vars := mux.Vars(r); r.Method == "PUT" && vars["machine"] != "" {
+		body, _ := ioutil.ReadAll(r.Body)
+		q := r.URL.Query()
+		value, md, body, err := readRegistration(body, r.Header.Get("Content-Type"), q)
+		if err != nil {
+			httperror.Error(w, r, err.Error(), http.StatusBadRequest, tokenCounter)
+			return
+		}
+		metadata = md
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if _, ok := q["meta"]; ok {
+			q.Del("meta")
+			r.URL.RawQuery = q.Encode()
+		}
+		// registrations with unknown tokens are left to etcd to refuse,
+		// but no others get past the checks
+		cfg, err := st.tokenConfig(ctx, ns, vars["token"])
+		if err != nil && !client.IsKeyNotFound(err) {
+			logging.Errorf("failed to read config of %s: %v", vars["token"], err)
+			httperror.Error(w, r, "", http.StatusInternalServerError, tokenCounter)
+			return
+		}
+		if err == nil {
+			ex, err := parseTokenExpectation(cfg)
+			if err != nil {
+				logging.Errorf("failed to read expected members of %s: %v", vars["token"], err)
+				httperror.Error(w, r, "", http.StatusInternalServerError, tokenCounter)
+				return
+			}
+			if ex != nil {
+				if err := ex.admit(parseMember(&client.Node{Key: vars["machine"], Value: value})); err != nil {
+					logging.Infof("refused registration of %s with %s: %v", vars["machine"], vars["token"], err)
+					b := refusal(err)
+					st.recordMemberRequest(ctx, ns, vars["token"], r.Method, vars["machine"], st.ClientIP(r), at, http.StatusForbidden, b, nil)
+					refuseMember(w, r, b)
+					return
+				}
+			}
+			// peer urls other members cannot reach fail the bootstrap
+			// later, so they are refused while etcd can still tell why
+			if pc := st.config().PeerCheck; pc.Enabled() && value != "" {
+				m := parseMember(&client.Node{Key: vars["machine"], Value: value})
+				pcheck := checkPeers(r.Context(), pc, m)
+				st.recordPeerCheck(ctx, ns, vars["token"], pcheck)
+				if !pcheck.Passed {
+					err := pcheck.refusal()
+					logging.Infof("refused registration of %s with %s: %v", vars["machine"], vars["token"], err)
+					b := refusal(err)
+					st.recordMemberRequest(ctx, ns, vars["token"], r.Method, vars["machine"], st.ClientIP(r), at, http.StatusForbidden, b, nil)
+					refuseMember(w, r, b)
+					return
+				}
+			}
+			// members of a static token register over their own
+			// registration
+			if cfg["static"] == "true" && r.URL.Query().Get("prevExist") == "false" && value != "" {
+				st.claimStatic(ctx, ns, vars["token"], vars["machine"], value)
+			}
+		}
+	}
+
+	// etcd does not know the mark parameter
+	q := r.URL.Query()
+	mark := r.Method == "GET" && q.Get("mark") == "quorum" && q.Get("wait") != "true"
+	if _, ok := q["mark"]; ok {
+		q.Del("mark")
+		r.URL.RawQuery = q.Encode()
+	}
+
+	resp, err := st.proxyRequest(ctx, ns, r)
 	if err != nil {
-		log.Printf("Error making request: %v", err)
+		logging.Errorf("Error making request: %v", err)
 		httperror.Error(w, r, "", 500, tokenCounter)
+		return
+	}
+	defer resp.Body.Close()
+
+	// member changes are recorded in the history once the member is
+	// answered
+	var body io.Reader = resp.Body
+	var change []byte
+	vars := mux.Vars(r)
+	memberChange := (r.Method == "PUT" || r.Method == "DELETE") && vars["machine"] != ""
+	if memberChange {
+		if change, err = ioutil.ReadAll(resp.Body); err != nil {
+			logging.Errorf("Error reading member change: %v", err)
+			httperror.Error(w, r, "", 500, tokenCounter)
+			return
+		}
+		body = bytes.NewReader(change)
+	}
+
+	// mark which members of a listing form the cluster, for clients
+	// that ask
+	token := vars["token"]
+	if mark && resp.StatusCode == http.StatusOK && path.Base(r.URL.Path) == token {
+		listing, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			logging.Errorf("Error reading token listing: %v", err)
+			httperror.Error(w, r, "", 500, tokenCounter)
+			return
+		}
+		if size, err := st.tokenSize(ctx, ns, token); err != nil {
+			logging.Warnf("failed to read size of %s: %v", token, err)
+		} else {
+			listing = markQuorum(listing, size)
+		}
+		resp.Header.Set("Content-Length", strconv.Itoa(len(listing)))
+		body = bytes.NewReader(listing)
+	}
+
+	// members are not given indexes of the cache they could take to
+	// the upstream
+	if cached {
+		answer, err := ioutil.ReadAll(body)
+		if err != nil {
+			logging.Errorf("Error reading cached answer: %v", err)
+			httperror.Error(w, r, "", 500, tokenCounter)
+			return
+		}
+		answer = shiftCacheIndexes(resp.Header, answer)
+		resp.Header.Set("Content-Length", strconv.Itoa(len(answer)))
+		body = bytes.NewReader(answer)
+	}
+
+	if memberChange {
+		st.recordMemberRequest(ctx, ns, token, r.Method, vars["machine"], st.ClientIP(r), at, resp.StatusCode, change, metadata)
 	}
 
 	copyHeader(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	io.Copy(w, body)
 	tokenCounter.WithLabelValues(strconv.Itoa(resp.StatusCode), r.Method).Add(1)
 }
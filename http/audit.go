@@ -0,0 +1,92 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/coreos/discovery.etcd.io/audit"
+	"github.com/coreos/discovery.etcd.io/handlers"
+	"github.com/gorilla/mux"
+)
+
+// namespacePrefix is the route prefix of tokens of named namespaces.
+const namespacePrefix = "/ns/{namespace:[a-z0-9][a-z0-9-]*}"
+
+// auditedOperations names the mutating requests by method and route
+// template, without the namespace prefix.
+var auditedOperations = map[string]string{
+	"POST /new":                                 "token.create",
+	"PUT /{token}/{machine}":                    "member.register",
+	"DELETE /{token}/{machine}":                 "member.unregister",
+	"POST /{token}/reset":                       "token.reset",
+	"POST /admin/migration":                     "admin.migration.sync",
+	"POST /admin/import":                        "admin.import",
+	"POST /admin/shards/rebalance":              "admin.shards.rebalance",
+	"POST /admin/tokens":                        "admin.token.create",
+	"DELETE /admin/tokens/{token}":              "admin.token.delete",
+	"PUT /admin/tenants/{tenant}":               "admin.tenant.put",
+	"DELETE /admin/tenants/{tenant}":            "admin.tenant.delete",
+	"POST /admin/tenants/{tenant}/keys":         "admin.key.create",
+	"DELETE /admin/tenants/{tenant}/keys/{key}": "admin.key.delete",
+}
+
+// operation returns the name of the operation r asks for, and whether
+// it changes anything. /new creates tokens whatever the method.
+func operation(r *http.Request) (string, bool) {
+	route := strings.TrimPrefix(routeName(r), namespacePrefix)
+	route = strings.Replace(route, "{token:[a-f0-9]{32}}", "{token}", -1)
+	if route == "/new" {
+		return auditedOperations["POST /new"], true
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return "", false
+	}
+	op := r.Method + " " + route
+	if name, ok := auditedOperations[op]; ok {
+		return name, true
+	}
+	return op, true
+}
+
+// auditRequests returns a middleware writing an audit record of every
+// mutating request matched by the router, once it was answered. Client
+// addresses are resolved by st.
+func auditRequests(st *handlers.State) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			op, mutating := operation(r)
+			if !mutating || !audit.Enabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := audit.NewContext(r.Context())
+			sr := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+			next.ServeHTTP(sr, r.WithContext(ctx))
+
+			vars := mux.Vars(r)
+			rec := audit.Record{
+				ClientIP:  st.ClientIP(r),
+				Operation: op,
+				Namespace: vars["namespace"],
+				Token:     vars["token"],
+				Member:    vars["machine"],
+				Tenant:    vars["tenant"],
+				Result:    audit.ResultOf(sr.code),
+				Status:    sr.code,
+			}
+			if key := vars["key"]; key != "" {
+				rec.Detail = "key " + key
+			}
+			var token string
+			rec.Principal, token = audit.FromContext(ctx)
+			if rec.Principal == "" {
+				rec.Principal = audit.PrincipalAnonymous
+			}
+			if rec.Token == "" {
+				rec.Token = token
+			}
+			audit.Log(rec)
+		})
+	}
+}
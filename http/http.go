@@ -5,53 +5,150 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/coreos/discovery.etcd.io/config"
 	"github.com/coreos/discovery.etcd.io/handlers"
+	"github.com/coreos/discovery.etcd.io/logging"
+	"github.com/coreos/discovery.etcd.io/metrics"
 
 	gorillaHandlers "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"github.com/prometheus/client_golang/prometheus"
 )
 
-func Setup(ctx context.Context, etcdHost, discHost string) {
-	handler := RegisterHandlers(ctx, etcdHost, discHost)
-	logH := gorillaHandlers.LoggingHandler(os.Stdout, handler)
+func Setup(ctx context.Context, cfg config.Config) *handlers.State {
+	st := handlers.SetupConfig(cfg)
+	handler := RegisterHandlersState(ctx, st)
+	logH := gorillaHandlers.LoggingHandler(logging.Writer(logging.LevelInfo, os.Stdout), handler)
 
 	http.Handle("/", logH)
-	http.Handle("/metrics", prometheus.Handler())
+	http.Handle("/metrics", metrics.Handler())
+	return st
 }
 
 func RegisterHandlers(ctx context.Context, etcdHost, discHost string) http.Handler {
-	st := handlers.Setup(etcdHost, discHost)
+	return RegisterHandlersConfig(ctx, config.New(etcdHost, discHost))
+}
+
+func RegisterHandlersConfig(ctx context.Context, cfg config.Config) http.Handler {
+	return RegisterHandlersState(ctx, handlers.SetupConfig(cfg))
+}
+
+func RegisterHandlersState(ctx context.Context, st *handlers.State) http.Handler {
+	if err := handlers.LoadShards(ctx, st); err != nil {
+		logging.Errorf("failed to read the balanced shards: %v", err)
+	}
+	handlers.StartTokenStats(ctx, st)
+	handlers.StartMirror(ctx, st)
+	if err := handlers.StartMigration(ctx, st); err != nil {
+		logging.Errorf("failed to start the migration to v3: %v", err)
+	}
 	r := mux.NewRouter()
+	r.Use(instrument, trace, auditRequests(st))
 
 	r.HandleFunc("/", handlers.HomeHandler)
-	r.Handle("/new", &handlers.ContextAdapter{
-		Ctx:     ctx,
-		Handler: handlers.With(handlers.ContextHandlerFunc(handlers.NewTokenHandler), st),
-	})
 	r.Handle("/health", &handlers.ContextAdapter{
 		Ctx:     ctx,
 		Handler: handlers.With(handlers.ContextHandlerFunc(handlers.HealthHandler), st),
 	})
 	r.HandleFunc("/robots.txt", handlers.RobotsHandler)
 
-	// Only allow exact tokens with GETs and PUTs
-	r.Handle("/{token:[a-f0-9]{32}}", &handlers.ContextAdapter{
+	r.Handle("/admin/stats", &handlers.ContextAdapter{
 		Ctx:     ctx,
-		Handler: handlers.With(handlers.ContextHandlerFunc(handlers.TokenHandler), st),
-	}).Methods("GET", "PUT")
-	r.Handle("/{token:[a-f0-9]{32}}/", &handlers.ContextAdapter{
+		Handler: handlers.With(handlers.RequireAdmin(handlers.ContextHandlerFunc(handlers.StatsHandler)), st),
+	}).Methods("GET")
+	r.Handle("/admin/tokens", &handlers.ContextAdapter{
 		Ctx:     ctx,
-		Handler: handlers.With(handlers.ContextHandlerFunc(handlers.TokenHandler), st),
-	}).Methods("GET", "PUT")
-	r.Handle("/{token:[a-f0-9]{32}}/{machine}", &handlers.ContextAdapter{
+		Handler: handlers.With(handlers.RequireAdmin(handlers.ContextHandlerFunc(handlers.TokensHandler)), st),
+	}).Methods("GET")
+	r.Handle("/admin/tokens", &handlers.ContextAdapter{
 		Ctx:     ctx,
-		Handler: handlers.With(handlers.ContextHandlerFunc(handlers.TokenHandler), st),
-	}).Methods("GET", "PUT", "DELETE")
-	r.Handle("/{token:[a-f0-9]{32}}/_config/size", &handlers.ContextAdapter{
+		Handler: handlers.With(handlers.RequireAdmin(handlers.ContextHandlerFunc(handlers.StaticTokenHandler)), st),
+	}).Methods("POST")
+	r.Handle("/admin/tokens/{token:[a-f0-9]{32}}", &handlers.ContextAdapter{
 		Ctx:     ctx,
-		Handler: handlers.With(handlers.ContextHandlerFunc(handlers.TokenHandler), st),
+		Handler: handlers.With(handlers.RequireAdmin(handlers.ContextHandlerFunc(handlers.DeleteTokenHandler)), st),
+	}).Methods("DELETE")
+	r.Handle("/admin/export", &handlers.ContextAdapter{
+		Ctx:     ctx,
+		Handler: handlers.With(handlers.RequireAdmin(handlers.ContextHandlerFunc(handlers.ExportHandler)), st),
 	}).Methods("GET")
+	r.Handle("/admin/import", &handlers.ContextAdapter{
+		Ctx:     ctx,
+		Handler: handlers.With(handlers.RequireAdmin(handlers.ContextHandlerFunc(handlers.ImportHandler)), st),
+	}).Methods("POST")
+	r.Handle("/admin/shards", &handlers.ContextAdapter{
+		Ctx:     ctx,
+		Handler: handlers.With(handlers.RequireAdmin(handlers.ContextHandlerFunc(handlers.ShardsHandler)), st),
+	}).Methods("GET")
+	r.Handle("/admin/shards/rebalance", &handlers.ContextAdapter{
+		Ctx:     ctx,
+		Handler: handlers.With(handlers.RequireAdmin(handlers.ContextHandlerFunc(handlers.RebalanceHandler)), st),
+	}).Methods("POST")
+	r.Handle("/admin/migration", &handlers.ContextAdapter{
+		Ctx:     ctx,
+		Handler: handlers.With(handlers.RequireAdmin(handlers.ContextHandlerFunc(handlers.MigrationHandler)), st),
+	}).Methods("GET", "POST")
+	r.Handle("/admin/tenants", &handlers.ContextAdapter{
+		Ctx:     ctx,
+		Handler: handlers.With(handlers.RequireAdmin(handlers.ContextHandlerFunc(handlers.TenantsHandler)), st),
+	}).Methods("GET")
+	r.Handle("/admin/tenants/{tenant}", &handlers.ContextAdapter{
+		Ctx:     ctx,
+		Handler: handlers.With(handlers.RequireAdmin(handlers.ContextHandlerFunc(handlers.TenantHandler)), st),
+	}).Methods("GET", "PUT", "DELETE")
+	r.Handle("/admin/tenants/{tenant}/keys", &handlers.ContextAdapter{
+		Ctx:     ctx,
+		Handler: handlers.With(handlers.RequireAdmin(handlers.ContextHandlerFunc(handlers.NewKeyHandler)), st),
+	}).Methods("POST")
+	r.Handle("/admin/tenants/{tenant}/keys/{key}", &handlers.ContextAdapter{
+		Ctx:     ctx,
+		Handler: handlers.With(handlers.RequireAdmin(handlers.ContextHandlerFunc(handlers.KeyHandler)), st),
+	}).Methods("DELETE")
+
+	// Tokens of named namespaces live under /ns/<namespace>/
+	for _, prefix := range []string{"", namespacePrefix} {
+		r.Handle(prefix+"/new", &handlers.ContextAdapter{
+			Ctx:     ctx,
+			Handler: handlers.With(handlers.ContextHandlerFunc(handlers.NewTokenHandler), st),
+		})
+
+		// Only allow exact tokens with GETs and PUTs
+		r.Handle(prefix+"/{token:[a-f0-9]{32}}", &handlers.ContextAdapter{
+			Ctx:     ctx,
+			Handler: handlers.With(handlers.TokenShard(handlers.ContextHandlerFunc(handlers.TokenHandler)), st),
+		}).Methods("GET", "PUT")
+		r.Handle(prefix+"/{token:[a-f0-9]{32}}/", &handlers.ContextAdapter{
+			Ctx:     ctx,
+			Handler: handlers.With(handlers.TokenShard(handlers.ContextHandlerFunc(handlers.TokenHandler)), st),
+		}).Methods("GET", "PUT")
+		r.Handle(prefix+"/{token:[a-f0-9]{32}}/initial-cluster", &handlers.ContextAdapter{
+			Ctx:     ctx,
+			Handler: handlers.With(handlers.TokenShard(handlers.ContextHandlerFunc(handlers.InitialClusterHandler)), st),
+		}).Methods("GET")
+		r.Handle(prefix+"/{token:[a-f0-9]{32}}/diagnose", &handlers.ContextAdapter{
+			Ctx:     ctx,
+			Handler: handlers.With(handlers.TokenShard(handlers.ContextHandlerFunc(handlers.DiagnoseHandler)), st),
+		}).Methods("GET")
+		r.Handle(prefix+"/{token:[a-f0-9]{32}}/summary", &handlers.ContextAdapter{
+			Ctx:     ctx,
+			Handler: handlers.With(handlers.TokenShard(handlers.ContextHandlerFunc(handlers.SummaryHandler)), st),
+		}).Methods("GET")
+		r.Handle(prefix+"/{token:[a-f0-9]{32}}/reset", &handlers.ContextAdapter{
+			Ctx:     ctx,
+			Handler: handlers.With(handlers.TokenShard(handlers.ContextHandlerFunc(handlers.ResetHandler)), st),
+		}).Methods("POST")
+		r.Handle(prefix+"/{token:[a-f0-9]{32}}/history", &handlers.ContextAdapter{
+			Ctx:     ctx,
+			Handler: handlers.With(handlers.TokenShard(handlers.ContextHandlerFunc(handlers.HistoryHandler)), st),
+		}).Methods("GET")
+		r.Handle(prefix+"/{token:[a-f0-9]{32}}/{machine}", &handlers.ContextAdapter{
+			Ctx:     ctx,
+			Handler: handlers.With(handlers.TokenShard(handlers.ContextHandlerFunc(handlers.TokenHandler)), st),
+		}).Methods("GET", "PUT", "DELETE")
+		r.Handle(prefix+"/{token:[a-f0-9]{32}}/_config/size", &handlers.ContextAdapter{
+			Ctx:     ctx,
+			Handler: handlers.With(handlers.TokenShard(handlers.ContextHandlerFunc(handlers.TokenHandler)), st),
+		}).Methods("GET")
+	}
 
 	return r
 }
@@ -0,0 +1,29 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/coreos/discovery.etcd.io/tracing"
+)
+
+// trace records a server span for every request matched by the router,
+// continuing the trace given in the traceparent header, if any.
+func trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeName(r)
+		ctx := tracing.Extract(r.Context(), r.Header)
+		ctx, span := tracing.Start(ctx, fmt.Sprintf("%s %s", r.Method, route), tracing.KindServer)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.target", r.URL.RequestURI())
+
+		sr := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sr, r.WithContext(ctx))
+		span.SetAttribute("http.status_code", sr.code)
+		if sr.code >= 500 {
+			span.SetError(fmt.Errorf("%d %s", sr.code, http.StatusText(sr.code)))
+		}
+		span.End()
+	})
+}
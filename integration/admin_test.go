@@ -0,0 +1,299 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	discoveryhttp "github.com/coreos/discovery.etcd.io/http"
+	"github.com/coreos/etcd/client"
+)
+
+const testAdminToken = "test-admin-token"
+
+// startService starts a service with its configuration adjusted by
+// modify, failing the test if it does not come up.
+func startService(t *testing.T, modify func(*config.Config)) *Service {
+	cport := int(atomic.LoadInt32(&basePort))
+	atomic.AddInt32(&basePort, int32(5))
+
+	svs := NewServiceConfig(t, cport, cport+1, cport+2, modify)
+	errc := svs.Start(t)
+	select {
+	case err := <-errc:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		// wait for http listeners to start
+	}
+	return svs
+}
+
+// newToken creates a token of the given size and returns its id.
+func newToken(t *testing.T, svs *Service, size int) string {
+	resp, err := http.Get(svs.httpEp + fmt.Sprintf("/new?size=%d", size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gracefulClose(resp)
+	bts, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimPrefix(string(bts), testDiscoveryHost+"/")
+}
+
+// register registers a member with token the way etcd does.
+func register(t *testing.T, svs *Service, token, id, value string) *http.Response {
+	form := url.Values{"value": {value}}
+	req, err := http.NewRequest(http.MethodPut, svs.httpEp+"/"+token+"/"+id, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// adminGet issues an admin API GET request with the given token.
+func adminGet(t *testing.T, svs *Service, p, token string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, svs.httpEp+p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestAdminStats(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) { cfg.AdminToken = testAdminToken })
+	defer svs.Stop(t)
+
+	full := newToken(t, svs, 2)
+	partial := newToken(t, svs, 3)
+	for i := 0; i < 2; i++ {
+		gracefulClose(register(t, svs, full, fmt.Sprintf("id%d", i), fmt.Sprintf("id%d=http://10.0.0.%d:2380", i, i)))
+	}
+	gracefulClose(register(t, svs, partial, "id0", "id0=http://10.0.0.1:2380"))
+
+	resp := adminGet(t, svs, "/admin/stats", "")
+	gracefulClose(resp)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status expected %d without credentials, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	resp = adminGet(t, svs, "/admin/stats", testAdminToken)
+	var stats struct {
+		Live      int            `json:"live"`
+		Completed int            `json:"completed"`
+		Sizes     map[string]int `json:"sizes"`
+		Complete  struct {
+			Count int `json:"count"`
+		} `json:"complete"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&stats)
+	gracefulClose(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Live != 2 || stats.Completed != 1 {
+		t.Fatalf("expected 2 live and 1 completed token, got %+v", stats)
+	}
+	if stats.Sizes["2"] != 1 || stats.Sizes["3"] != 1 {
+		t.Fatalf("unexpected size distribution %v", stats.Sizes)
+	}
+	if stats.Complete.Count != 1 {
+		t.Fatalf("expected 1 recorded completion, got %d", stats.Complete.Count)
+	}
+
+	// members replaying the history of the token from their
+	// registration on only see registrations, up to the last one
+	first, err := http.Get(svs.httpEp + "/" + full + "/id0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id0 client.Response
+	err = json.NewDecoder(first.Body).Decode(&id0)
+	gracefulClose(first)
+	if err != nil || id0.Node == nil {
+		t.Fatalf("failed to read the registration of id0: %v", err)
+	}
+	gracefulClose(register(t, svs, full, "id9", "id9=http://10.0.0.9:2380"))
+	for index := id0.Node.CreatedIndex; ; {
+		resp, err := http.Get(fmt.Sprintf("%s/%s?wait=true&recursive=true&waitIndex=%d", svs.httpEp, full, index))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cresp client.Response
+		err = json.NewDecoder(resp.Body).Decode(&cresp)
+		gracefulClose(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path.Dir(cresp.Node.Key) != "/"+path.Join("_etcd", "registry", full) {
+			t.Fatalf("expected only member events, got %s of %s", cresp.Action, cresp.Node.Key)
+		}
+		if path.Base(cresp.Node.Key) == "id9" {
+			break
+		}
+		index = cresp.Node.ModifiedIndex + 1
+	}
+}
+
+func TestTokenStateExpires(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) {
+		cfg.AdminToken = testAdminToken
+		cfg.TokenTTL = time.Hour
+	})
+	defer svs.Stop(t)
+
+	resp, err := http.Get(svs.httpEp + "/new?size=1&ttl=3s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	gracefulClose(resp)
+	token := path.Base(string(b))
+	gracefulClose(register(t, svs, token, "id0", "id0=http://10.0.0.1:2380"))
+
+	ec, err := client.New(client.Config{Endpoints: []string{svs.etcdCURL.String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(ec)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// registry scans read the config of tokens from its index
+	size, err := kapi.Get(ctx, "/_etcd/registry/_configs/"+token+"/size", nil)
+	if err != nil || size.Node.Value != "1" {
+		t.Fatalf("expected the size of %s in the config index, got %v", token, err)
+	}
+	resp = adminGet(t, svs, "/admin/tokens", testAdminToken)
+	var tokens []struct {
+		Token string `json:"token"`
+		Size  int    `json:"size"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	gracefulClose(resp)
+	if err != nil || len(tokens) != 1 || tokens[0].Token != token || tokens[0].Size != 1 {
+		t.Fatalf("expected %s of size 1 to be listed, got %+v (%v)", token, tokens, err)
+	}
+
+	time.Sleep(4 * time.Second)
+	for _, dir := range []string{"_progress", "_history", "_metadata", "_peer-checks", "_configs", ""} {
+		key := path.Join("/_etcd/registry", dir, token)
+		if _, err := kapi.Get(ctx, key, nil); !client.IsKeyNotFound(err) {
+			t.Errorf("expected %s to expire with the token, got %v", key, err)
+		}
+	}
+}
+
+func TestConfigIndexBackfill(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) { cfg.AdminToken = testAdminToken })
+	defer svs.Stop(t)
+
+	token := newToken(t, svs, 3)
+	ec, err := client.New(client.Config{Endpoints: []string{svs.etcdCURL.String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(ec)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// a token set up before configs were indexed
+	key := "/_etcd/registry/_configs/" + token
+	if _, err := kapi.Delete(ctx, key, &client.DeleteOptions{Recursive: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// instances index the configs of older tokens as they start
+	hctx, hcancel := context.WithCancel(context.Background())
+	defer hcancel()
+	other := httptest.NewServer(discoveryhttp.RegisterHandlersConfig(hctx, config.New(svs.etcdCURL.String(), "http://"+testDiscoveryHost)))
+	defer other.Close()
+	for i := 0; ; i++ {
+		size, err := kapi.Get(ctx, key+"/size", nil)
+		if err == nil && size.Node.Value == "3" {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("expected the size of %s to be indexed, got %v", token, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestStatsScanner(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) { cfg.StatsInterval = 200 * time.Millisecond })
+	defer svs.Stop(t)
+
+	ec, err := client.New(client.Config{Endpoints: []string{svs.etcdCURL.String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := client.NewKeysAPI(ec)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	hctx, hcancel := context.WithCancel(context.Background())
+	defer hcancel()
+	cfg := config.New(svs.etcdCURL.String(), "http://"+testDiscoveryHost)
+	cfg.StatsInterval = 200 * time.Millisecond
+	other := httptest.NewServer(discoveryhttp.RegisterHandlersConfig(hctx, cfg))
+	defer other.Close()
+
+	newToken(t, svs, 3)
+	var scanner string
+	for i := 0; ; i++ {
+		resp, err := kapi.Get(ctx, "/_etcd/registry/_stats/tokens", nil)
+		if err == nil {
+			var ts struct {
+				Live int `json:"live"`
+			}
+			if err := json.Unmarshal([]byte(resp.Node.Value), &ts); err != nil {
+				t.Fatal(err)
+			}
+			if ts.Live == 1 {
+				break
+			}
+		}
+		if i == 50 {
+			t.Fatalf("expected the scan to count the token, got %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// one instance keeps the scans over several rounds
+	for i := 0; i < 5; i++ {
+		resp, err := kapi.Get(ctx, "/_etcd/registry/_stats/scanner", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scanner == "" {
+			scanner = resp.Node.Value
+		} else if resp.Node.Value != scanner {
+			t.Fatalf("expected %s to keep scanning, got %s", scanner, resp.Node.Value)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
@@ -0,0 +1,142 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/audit"
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/coreos/discovery.etcd.io/config"
+)
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+	l, err := audit.NewFileLogger(file, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.SetLogger(l)
+	defer audit.SetLogger(nil)
+
+	svs := startService(t, func(cfg *config.Config) {
+		cfg.AdminToken = testAdminToken
+		cfg.TrustedProxies = []string{"127.0.0.1/32"}
+	})
+	defer svs.Stop(t)
+
+	token := newToken(t, svs, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c := client.New(svs.httpEp)
+	m := client.Member{ID: "id0", Name: "node0", PeerURLs: []string{"http://10.0.0.1:2380"}}
+	if _, err := c.Register(ctx, svs.httpEp+"/"+token, m); err != nil {
+		t.Fatal(err)
+	}
+	// registering twice is refused by etcd
+	c.Register(ctx, svs.httpEp+"/"+token, m)
+	resp, err := http.Get(svs.httpEp + "/" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gracefulClose(resp)
+	// forwarded addresses count only from trusted proxies, and only up
+	// to the first address not of a trusted proxy
+	untrusted := &http.Client{Transport: &http.Transport{
+		DialContext: (&net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}).DialContext,
+	}}
+	for _, tt := range []struct {
+		c   *http.Client
+		xff string
+	}{
+		{http.DefaultClient, "203.0.113.7"},
+		{http.DefaultClient, "198.51.100.9, 203.0.113.7"},
+		{untrusted, "203.0.113.7"},
+	} {
+		u := strings.Replace(svs.httpEp, "localhost", "127.0.0.1", 1) + "/admin/tokens/" + token
+		req, err := http.NewRequest(http.MethodDelete, u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-For", tt.xff)
+		if resp, err = tt.c.Do(req); err != nil {
+			t.Fatal(err)
+		}
+		gracefulClose(resp)
+	}
+	gracefulClose(adminDo(t, svs, http.MethodDelete, "/admin/tokens/"+token, ""))
+	l.Close()
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var rec audit.Record
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d %s %s %s %s %s %d %s", rec.Seq, rec.Operation, rec.Principal, rec.Token, rec.Member, rec.Result, rec.Status, rec.ClientIP))
+	}
+	exp := []string{
+		fmt.Sprintf("1 token.create anonymous %s  ok 200 127.0.0.1", token),
+		fmt.Sprintf("2 member.register anonymous %s id0 ok 201 127.0.0.1", token),
+		fmt.Sprintf("3 member.register anonymous %s id0 rejected 412 127.0.0.1", token),
+		fmt.Sprintf("4 admin.token.delete anonymous %s  denied 401 203.0.113.7", token),
+		fmt.Sprintf("5 admin.token.delete anonymous %s  denied 401 203.0.113.7", token),
+		fmt.Sprintf("6 admin.token.delete anonymous %s  denied 401 127.0.0.2", token),
+		fmt.Sprintf("7 admin.token.delete admin %s  ok 204 127.0.0.1", token),
+	}
+	if strings.Join(got, "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("expected records\n%s\ngot\n%s", strings.Join(exp, "\n"), strings.Join(got, "\n"))
+	}
+	last, n, err := audit.Verify(bytes.NewReader(b), "")
+	if err != nil || n != 7 {
+		t.Fatalf("expected a valid chain of 7 records, got %d (%v)", n, err)
+	}
+
+	// editing a record breaks the chain
+	tampered := bytes.Replace(b, []byte(`"principal":"admin"`), []byte(`"principal":"team-a"`), 1)
+	if _, _, err := audit.Verify(bytes.NewReader(tampered), ""); err == nil {
+		t.Fatal("expected a modified record to be detected")
+	}
+	lines := bytes.SplitN(b, []byte("\n"), 3)
+	if _, _, err := audit.Verify(bytes.NewReader(append(lines[0], lines[2]...)), ""); err == nil {
+		t.Fatal("expected a removed record to be detected")
+	}
+
+	// a restarted logger continues the chain, and rotation keeps it
+	if l, err = audit.NewFileLogger(file, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Log(audit.Record{Principal: audit.PrincipalLocal, Operation: "config.reload", Result: audit.ResultOK}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if _, err := os.Stat(file + ".1"); err != nil {
+		t.Fatalf("expected the log to be rotated, got %v", err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, n, err := audit.Verify(f, last); err != nil || n != 1 {
+		t.Fatalf("expected the rotated log to continue the chain, got %d records (%v)", n, err)
+	}
+}
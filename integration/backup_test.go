@@ -0,0 +1,144 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/coreos/discovery.etcd.io/config"
+)
+
+func TestExportImport(t *testing.T) {
+	modify := func(cfg *config.Config) {
+		cfg.AdminToken = testAdminToken
+		cfg.Namespaces = []config.Namespace{{Name: "staging", Prefix: "discovery/staging", TokenTTL: time.Hour}}
+	}
+	src := startService(t, modify)
+	defer src.Stop(t)
+	dst := startService(t, modify)
+	defer dst.Stop(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	key := newTenantKey(t, src, "team-a")
+	owner := &client.Client{Endpoint: src.httpEp, APIKey: key}
+	u, err := owner.Create(ctx, client.CreateOptions{Size: 3, Labels: map[string]string{"env": "prod"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := path.Base(u)
+	for i := 0; i < 2; i++ {
+		m := client.Member{ID: fmt.Sprintf("id%d", 1-i), Name: fmt.Sprintf("node%d", i), PeerURLs: []string{fmt.Sprintf("http://10.0.0.%d:2380", i)}}
+		if _, err := owner.Register(ctx, src.httpEp+"/"+token, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u, err = client.New(src.httpEp).Create(ctx, client.CreateOptions{Size: 1, Namespace: "staging"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging := path.Base(u)
+	time.Sleep(200 * time.Millisecond)
+
+	srcAdmin := &client.Client{Endpoint: src.httpEp, AdminToken: testAdminToken}
+	var export bytes.Buffer
+	if err := srcAdmin.Export(ctx, &export, nil); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(export.String()), "\n")
+	if len(lines) != 5 || !strings.Contains(lines[0], `"type":"header"`) || !strings.Contains(lines[4], `"end":{"tenants":1,"tokens":2,"members":2}`) {
+		t.Fatalf("expected a header, a tenant, two tokens and an end record, got\n%s", export.String())
+	}
+
+	dstAdmin := &client.Client{Endpoint: dst.httpEp, AdminToken: testAdminToken}
+	for _, tt := range []struct {
+		name, export, message string
+	}{
+		{"truncated", strings.Join(lines[:4], "\n"), "missing end record"},
+		{"miscounted", strings.Replace(export.String(), `"members":2}`, `"members":3}`, 1), "the end record counts"},
+		{"corrupt", strings.Replace(export.String(), `"size":"3"`, `"size":"x"`, 1), `invalid size "x"`},
+		{"not an export", "{}", "missing header"},
+	} {
+		_, err := dstAdmin.Import(ctx, strings.NewReader(tt.export), false)
+		if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusBadRequest || !strings.Contains(e.Message, tt.message) {
+			t.Fatalf("expected the %s export to be refused with %q, got %v", tt.name, tt.message, err)
+		}
+	}
+
+	report, err := dstAdmin.Import(ctx, bytes.NewReader(export.Bytes()), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || report.Tenants != 1 || report.Tokens != 2 || report.Members != 2 {
+		t.Fatalf("expected a dry run to report 1 tenant, 2 tokens and 2 members, got %+v", report)
+	}
+	if ts, err := dstAdmin.Tokens(ctx); err != nil || len(ts) != 0 {
+		t.Fatalf("expected a dry run to import nothing, got %v (%v)", ts, err)
+	}
+
+	if report, err = dstAdmin.Import(ctx, bytes.NewReader(export.Bytes()), false); err != nil {
+		t.Fatal(err)
+	}
+	if report.DryRun || report.Tenants != 1 || report.Tokens != 2 || len(report.Skipped) != 0 {
+		t.Fatalf("expected 1 tenant and 2 tokens to be imported, got %+v", report)
+	}
+
+	// the API key of the tenant keeps working, and the token keeps its
+	// members in order, its config and its history
+	restored := &client.Client{Endpoint: dst.httpEp, APIKey: key}
+	srcMembers, _, err := owner.Members(ctx, src.httpEp+"/"+token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstMembers, _, err := restored.Members(ctx, dst.httpEp+"/"+token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range srcMembers {
+		srcMembers[i].CreatedIndex, dstMembers[i].CreatedIndex = 0, 0
+	}
+	if !reflect.DeepEqual(srcMembers, dstMembers) {
+		t.Fatalf("expected members %+v, got %+v", srcMembers, dstMembers)
+	}
+	srcHistory, err := owner.History(ctx, src.httpEp+"/"+token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstHistory, err := restored.History(ctx, dst.httpEp+"/"+token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(srcHistory, dstHistory) {
+		t.Fatalf("expected history %+v, got %+v", srcHistory, dstHistory)
+	}
+	ts, err := dstAdmin.Tokens(ctx)
+	if err != nil || len(ts) != 2 {
+		t.Fatalf("expected 2 tokens, got %v (%v)", ts, err)
+	}
+	for _, ti := range ts {
+		if ti.Token == token && (ti.Tenant != "team-a" || ti.Size != 3 || ti.Labels["env"] != "prod") {
+			t.Fatalf("expected the token config to be imported, got %+v", ti)
+		}
+		if ti.Token == staging && ti.Namespace != "staging" {
+			t.Fatalf("expected %s to be imported into staging, got %+v", staging, ti)
+		}
+	}
+	if _, err := restored.Reset(ctx, dst.httpEp+"/"+token, 0); err != nil {
+		t.Fatalf("expected the restored key to own the token, got %v", err)
+	}
+
+	if report, err = dstAdmin.Import(ctx, bytes.NewReader(export.Bytes()), false); err != nil {
+		t.Fatal(err)
+	}
+	if report.Tenants != 0 || report.Tokens != 0 || len(report.Skipped) != 3 {
+		t.Fatalf("expected existing tenants and tokens to be skipped, got %+v", report)
+	}
+}
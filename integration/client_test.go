@@ -0,0 +1,134 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/coreos/discovery.etcd.io/config"
+)
+
+func TestClient(t *testing.T) {
+	svs := startService(t, nil)
+	defer svs.Stop(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	c := client.New(svs.httpEp)
+	u, err := c.Create(ctx, client.CreateOptions{Size: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Dir(u) != testDiscoveryHost {
+		t.Fatalf("expected token url under %q, got %q", testDiscoveryHost, u)
+	}
+	// the configured discovery host is not reachable from the test
+	tokenURL := svs.httpEp + "/" + path.Base(u)
+
+	if size, err := c.Size(ctx, tokenURL); err != nil || size != 3 {
+		t.Fatalf("expected size 3, got %d (%v)", size, err)
+	}
+
+	// a member that leaves again does not count
+	if _, err := c.Register(ctx, tokenURL, client.Member{ID: "gone", Name: "gone", PeerURLs: []string{"http://10.0.0.9:2380"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Unregister(ctx, tokenURL, "gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		ms  []client.Member
+		err error
+	}
+	waitc := make(chan result, 1)
+	go func() {
+		ms, err := c.WaitFull(ctx, tokenURL)
+		waitc <- result{ms, err}
+	}()
+
+	for i := 0; i < 4; i++ {
+		m := client.Member{
+			ID:       fmt.Sprintf("id%d", i),
+			Name:     fmt.Sprintf("node%d", i),
+			PeerURLs: []string{fmt.Sprintf("http://10.0.0.%d:2380", i)},
+		}
+		if _, err := c.Register(ctx, tokenURL, m); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := c.Register(ctx, tokenURL, client.Member{ID: "id0", Name: "node0", PeerURLs: []string{"http://10.0.0.0:2380"}}); !client.IsExist(err) {
+		t.Fatalf("expected registering a member twice to fail, got %v", err)
+	}
+
+	res := <-waitc
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	exp := "node0=http://10.0.0.0:2380,node1=http://10.0.0.1:2380,node2=http://10.0.0.2:2380"
+	if ic := client.InitialCluster(res.ms); ic != exp {
+		t.Fatalf("initial cluster expected %q, got %q", exp, ic)
+	}
+
+	ms, _, err := c.Members(ctx, tokenURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 4 {
+		t.Fatalf("expected 4 members, got %+v", ms)
+	}
+
+	if _, _, err := c.Members(ctx, svs.httpEp+"/"+strings.Repeat("0", 32)); !client.IsNotFound(err) {
+		t.Fatalf("expected an unknown token not to be found, got %v", err)
+	}
+}
+
+func TestClientAdmin(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) {
+		cfg.AdminToken = testAdminToken
+		cfg.TokenTTL = time.Hour
+	})
+	defer svs.Stop(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	c := &client.Client{Endpoint: svs.httpEp, AdminToken: testAdminToken}
+	if _, err := c.Create(ctx, client.CreateOptions{TTL: 2 * time.Hour}); err == nil {
+		t.Fatal("expected a ttl above the namespace ttl to be refused")
+	}
+	u, err := c.Create(ctx, client.CreateOptions{Size: 5, TTL: time.Minute, Labels: map[string]string{"env": "test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := path.Base(u)
+
+	ts, err := c.Tokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != 1 || ts[0].Token != token || ts[0].Size != 5 || ts[0].Labels["env"] != "test" {
+		t.Fatalf("expected token %s of size 5 labeled env=test, got %+v", token, ts)
+	}
+
+	if err := c.DeleteToken(ctx, "", token); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Members(ctx, svs.httpEp+"/"+token); !client.IsNotFound(err) {
+		t.Fatalf("expected the deleted token not to be found, got %v", err)
+	}
+	if err := c.DeleteToken(ctx, "", token); !client.IsNotFound(err) {
+		t.Fatalf("expected deleting the token twice to fail, got %v", err)
+	}
+
+	c.AdminToken = "wrong"
+	if _, err := c.Stats(ctx); err == nil {
+		t.Fatal("expected stats with a wrong admin token to be refused")
+	}
+}
@@ -0,0 +1,106 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/coreos/discovery.etcd.io/config"
+)
+
+func TestDiagnose(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) { cfg.AdminToken = testAdminToken })
+	defer svs.Stop(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	token := newToken(t, svs, 3)
+	for _, m := range [][2]string{
+		{"a1", "node0=http://" + closed.Addr().String()},
+		{"0a1", "node1=http://" + closed.Addr().String()},
+		{"b2", "node0=http://" + ln.Addr().String()},
+		{"c3", "node3=http://10.0.0.3,node3=http://[fe80::3]:2380"},
+	} {
+		gracefulClose(register(t, svs, token, m[0], m[1]))
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := client.New(svs.httpEp)
+	d, err := c.Diagnose(ctx, svs.httpEp+"/"+token, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := func(d *client.Diagnosis) map[string]string {
+		checks := make(map[string]string)
+		for _, f := range d.Findings {
+			checks[f.Check] += strings.Join(f.Members, ",") + ";"
+		}
+		return checks
+	}
+	exp := map[string]string{
+		"overflow":           "c3;",
+		"peer-url":           "a1;0a1;b2;c3;c3;",
+		"duplicate-name":     "a1,b2;",
+		"duplicate-id":       "a1,0a1;",
+		"duplicate-peer-url": "a1,0a1;",
+	}
+	if checks := found(d); fmt.Sprint(checks) != fmt.Sprint(exp) {
+		t.Fatalf("expected findings %v, got %v", exp, checks)
+	}
+	if d.Size != 3 || len(d.Members) != 4 || d.Probed {
+		t.Fatalf("expected 4 unprobed members of a token of size 3, got %+v", d)
+	}
+
+	if _, err := c.Diagnose(ctx, svs.httpEp+"/"+token, 500*time.Millisecond); err == nil || err.(*client.Error).StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected probing without credentials to be refused, got %v", err)
+	}
+	admin := &client.Client{Endpoint: svs.httpEp, AdminToken: testAdminToken}
+	d, err = admin.Diagnose(ctx, svs.httpEp+"/"+token, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the listener accepts connections, the peer url without a
+	// port cannot be dialed at all, and the link-local one has no zone
+	if unreachable := found(d)["unreachable"]; unreachable != "0a1;a1;c3;" {
+		t.Fatalf("expected a1, 0a1 and c3 to be unreachable, got %q", unreachable)
+	}
+	for _, f := range d.Findings {
+		if f.Check == "unreachable" && !strings.HasSuffix(f.Message, ": unreachable") {
+			t.Fatalf("expected probes to only report the peer url unreachable, got %q", f.Message)
+		}
+	}
+
+	resp, err := http.Get(svs.httpEp + "/" + token + "/diagnose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gracefulClose(resp)
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "token "+token+": size 3, 4 members registered\n") || !strings.Contains(string(b), "error   duplicate-name: 2 members are named \"node0\" (a1, b2)\n") {
+		t.Fatalf("unexpected text report:\n%s", b)
+	}
+
+	if _, err := c.Diagnose(ctx, svs.httpEp+"/"+strings.Repeat("0", 32), 0); !client.IsNotFound(err) {
+		t.Fatalf("expected an unknown token not to be found, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/embedded"
+	discoveryhttp "github.com/coreos/discovery.etcd.io/http"
+)
+
+func TestEmbeddedEtcd(t *testing.T) {
+	port := int(atomic.LoadInt32(&basePort))
+	atomic.AddInt32(&basePort, int32(5))
+	dataDir, err := ioutil.TempDir(os.TempDir(), "test-embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	cfg := config.New("", "http://"+testDiscoveryHost)
+	cfg.Addr = fmt.Sprintf("localhost:%d", port+2)
+	cfg.Embedded = config.EmbeddedEtcd{
+		Enabled:        true,
+		DataDir:        dataDir,
+		ClientURL:      fmt.Sprintf("http://localhost:%d/", port),
+		PeerURL:        fmt.Sprintf("http://localhost:%d", port+1),
+		SnapshotCount:  100,
+		AutoCompaction: time.Hour,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Etcd != fmt.Sprintf("http://localhost:%d", port) {
+		t.Fatalf("expected the embedded etcd to back the service, got %q", cfg.Etcd)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// serve runs the service on the embedded etcd until stop is called.
+	serve := func() (c *client.Client, stop func()) {
+		e, err := embedded.Start(cfg.Embedded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hctx, hcancel := context.WithCancel(context.Background())
+		srv := httptest.NewServer(discoveryhttp.RegisterHandlersConfig(hctx, cfg))
+		return client.New(srv.URL), func() {
+			srv.Close()
+			hcancel()
+			e.Close()
+		}
+	}
+
+	c, stop := serve()
+	u, err := c.Create(ctx, client.CreateOptions{Size: 3})
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	token := path.Base(u)
+	m := client.Member{ID: "id0", Name: "node0", PeerURLs: []string{"http://10.0.0.1:2380"}}
+	if _, err := c.Register(ctx, c.Endpoint+"/"+token, m); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	stop()
+
+	// the registry survives a restart on the same data directory
+	c, stop = serve()
+	defer stop()
+	if size, err := c.Size(ctx, c.Endpoint+"/"+token); err != nil || size != 3 {
+		t.Fatalf("expected size 3 after the restart, got %d (%v)", size, err)
+	}
+	ms, _, err := c.Members(ctx, c.Endpoint+"/"+token)
+	if err != nil || len(ms) != 1 || ms[0].Name != "node0" {
+		t.Fatalf("expected node0 to be registered after the restart, got %v (%v)", ms, err)
+	}
+}
@@ -0,0 +1,124 @@
+package integration
+
+import (
+	"context"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+	etcd "github.com/coreos/etcd/client"
+)
+
+func TestExpectedMembers(t *testing.T) {
+	svs := startService(t, nil)
+	defer svs.Stop(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c := client.New(svs.httpEp)
+
+	u, err := c.Create(ctx, client.CreateOptions{
+		Expect:        []string{"infra0=10.0.0.1", "infra1", "infra2"},
+		ExpectPattern: "proxy-[0-9]+",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenURL := svs.httpEp + "/" + path.Base(u)
+	if size, err := c.Size(ctx, tokenURL); err != nil || size != 3 {
+		t.Fatalf("expected the default size 3, got %d (%v)", size, err)
+	}
+
+	for _, m := range []client.Member{
+		{ID: "id0", Name: "infra0", PeerURLs: []string{"http://10.0.0.1:2380"}},
+		{ID: "id1", Name: "infra1", PeerURLs: []string{"http://10.0.0.2:2380"}},
+	} {
+		if _, err := c.Register(ctx, tokenURL, m); err != nil {
+			t.Fatalf("expected %s to register, got %v", m.Name, err)
+		}
+	}
+	for _, m := range []client.Member{
+		{ID: "id3", Name: "infra3", PeerURLs: []string{"http://10.0.0.3:2380"}},
+		{ID: "id4", Name: "infra0", PeerURLs: []string{"http://10.0.0.4:2380"}},
+	} {
+		_, err := c.Register(ctx, tokenURL, m)
+		if e, ok := err.(*client.Error); !ok || e.StatusCode != 403 {
+			t.Fatalf("expected %s at %s to be refused, got %v", m.Name, m.PeerURLs[0], err)
+		}
+	}
+
+	// etcd reports why it was refused
+	ec, err := etcd.New(etcd.Config{Endpoints: []string{svs.httpEp}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kapi := etcd.NewKeysAPIWithPrefix(ec, "/"+path.Base(u))
+	_, err = kapi.Create(ctx, "/id5", "intruder=http://10.0.0.5:2380")
+	if e, ok := err.(etcd.Error); !ok || !strings.Contains(e.Message, "member intruder is not expected") {
+		t.Fatalf("expected etcd to read the reason of the refusal, got %v", err)
+	}
+
+	s, err := c.Summary(ctx, tokenURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Expected) != 3 || s.Expected[0].Host != "10.0.0.1" || len(s.Missing) != 1 || s.Missing[0] != "infra2" {
+		t.Fatalf("expected infra2 to be missing, got %+v", s)
+	}
+	_, err = c.BootstrapConfig(ctx, tokenURL)
+	if !client.IsIncomplete(err) || !strings.Contains(err.Error(), "waiting for infra2") {
+		t.Fatalf("expected the initial cluster to wait for infra2, got %v", err)
+	}
+
+	// other members register if their name matches the pattern
+	m := client.Member{ID: "id9", Name: "proxy-9", PeerURLs: []string{"http://10.0.0.9:2380"}}
+	if _, err := c.Register(ctx, tokenURL, m); err != nil {
+		t.Fatalf("expected %s to register, got %v", m.Name, err)
+	}
+	d, err := c.Diagnose(ctx, tokenURL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := false
+	for _, f := range d.Findings {
+		missing = missing || (f.Check == "missing" && strings.Contains(f.Message, "infra2"))
+	}
+	if !missing {
+		t.Fatalf("expected diagnose to report infra2 missing, got %+v", d.Findings)
+	}
+
+	h, err := c.History(ctx, tokenURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := 0
+	for _, ev := range h {
+		if ev.Type == "rejected" && ev.Status == 403 {
+			rejected++
+		}
+	}
+	if rejected != 3 {
+		t.Fatalf("expected 3 refusals in the history, got %+v", h)
+	}
+
+	// tokens expecting only named members are sized for them
+	u, err = c.Create(ctx, client.CreateOptions{Expect: []string{"infra0", "infra1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, err := c.Size(ctx, svs.httpEp+"/"+path.Base(u)); err != nil || size != 2 {
+		t.Fatalf("expected the token to be sized for its 2 members, got %d (%v)", size, err)
+	}
+	for _, q := range []client.CreateOptions{
+		{Expect: []string{"infra0", "infra0"}},
+		{Expect: []string{"infra0="}},
+		{Expect: []string{"infra0"}, Size: 3},
+		{ExpectPattern: "infra("},
+	} {
+		if _, err := c.Create(ctx, q); err == nil {
+			t.Fatalf("expected %+v to be refused", q)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/coreos/discovery.etcd.io/config"
+)
+
+func TestHistory(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) {
+		cfg.AdminToken = testAdminToken
+		cfg.TrustedProxies = []string{"127.0.0.0/8", "10.0.0.0/8"}
+	})
+	defer svs.Stop(t)
+
+	req, err := http.NewRequest(http.MethodPost, svs.httpEp+"/new?size=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	gracefulClose(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := strings.TrimPrefix(string(b), testDiscoveryHost+"/")
+	tokenURL := svs.httpEp + "/" + token
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c := &client.Client{Endpoint: svs.httpEp, AdminToken: testAdminToken}
+	for _, id := range []string{"id0", "id0", "id1"} {
+		// a registration that fails is recorded as rejected
+		c.Register(ctx, tokenURL, client.Member{ID: id, Name: "node-" + id, PeerURLs: []string{"http://10.0.0.9:2380"}})
+	}
+	if err := c.Unregister(ctx, tokenURL, "id1"); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := c.History(ctx, tokenURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ev := range events {
+		got = append(got, fmt.Sprintf("%s %s %d %s", ev.Type, ev.Member, ev.Status, ev.ClientIP))
+	}
+	exp := []string{
+		"created  0 203.0.113.7",
+		"registered id0 0 127.0.0.1",
+		"rejected id0 412 127.0.0.1",
+		"registered id1 0 127.0.0.1",
+		"full id1 0 ",
+		"unregistered id1 0 127.0.0.1",
+	}
+	if strings.Join(got, "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("expected history\n%s\ngot\n%s", strings.Join(exp, "\n"), strings.Join(got, "\n"))
+	}
+	if events[0].Size != 2 || events[0].Actor != "anonymous" || events[1].PeerURLs[0] != "http://10.0.0.9:2380" {
+		t.Fatalf("expected the creation and registration details to be recorded, got %+v", events[:2])
+	}
+
+	if err := c.DeleteToken(ctx, "", token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.History(ctx, tokenURL); !client.IsNotFound(err) {
+		t.Fatalf("expected the history of a deleted token not to be found, got %v", err)
+	}
+	resp, err = http.Get(svs.etcdCURL.String() + "/v2/keys/_etcd/registry/_history/" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gracefulClose(resp)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the history to be purged with the token, got status %d", resp.StatusCode)
+	}
+}
+
+func TestHistoryTrim(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) { cfg.StatsInterval = 200 * time.Millisecond })
+	defer svs.Stop(t)
+
+	token := newToken(t, svs, 3)
+	historyURL := svs.etcdCURL.String() + "/v2/keys/_etcd/registry/_history/" + token
+	for i := 0; i < 300; i++ {
+		resp, err := http.PostForm(historyURL, url.Values{"value": {fmt.Sprintf(`{"type":"rejected","status":%d}`, i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gracefulClose(resp)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	events, err := client.New(svs.httpEp).History(ctx, svs.httpEp+"/"+token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 256 || events[255].Status != 299 {
+		t.Fatalf("expected the latest 256 events, got %d ending with %+v", len(events), events[len(events)-1])
+	}
+
+	// the registry scans trim the histories the service added to
+	gracefulClose(register(t, svs, token, "id0", "id0=http://10.0.0.1:2380"))
+	var stored int
+	for i := 0; i < 50; i++ {
+		resp, err := http.Get(historyURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r struct {
+			Node struct {
+				Nodes []struct{} `json:"nodes"`
+			} `json:"node"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&r)
+		gracefulClose(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored = len(r.Node.Nodes); stored <= 256 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if stored != 256 {
+		t.Fatalf("expected the history to be trimmed to 256 events, got %d", stored)
+	}
+}
@@ -0,0 +1,83 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+)
+
+func TestInitialCluster(t *testing.T) {
+	svs := startService(t, nil)
+	defer svs.Stop(t)
+
+	token := newToken(t, svs, 2)
+	get := func(accept, query string) (int, string, string) {
+		req, err := http.NewRequest(http.MethodGet, svs.httpEp+"/"+token+"/initial-cluster"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer gracefulClose(resp)
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header.Get("Content-Type"), string(b)
+	}
+
+	for i := 0; i < 3; i++ {
+		if code, _, _ := get("", ""); i < 2 && code != http.StatusConflict {
+			t.Fatalf("expected %d for %d of 2 members, got %d", http.StatusConflict, i, code)
+		}
+		resp := register(t, svs, token, fmt.Sprintf("id%d", i), fmt.Sprintf("node%d=http://10.0.0.%d:2380", i, i))
+		gracefulClose(resp)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	ic := "node0=http://10.0.0.0:2380,node1=http://10.0.0.1:2380"
+	tests := []struct {
+		accept, query string
+		contentType   string
+		body          string
+	}{
+		{"", "", "text/plain; charset=utf-8", ic + "\n"},
+		{"text/*", "", "text/plain; charset=utf-8", ic + "\n"},
+		{"text/x-env", "", "text/x-env", "ETCD_INITIAL_CLUSTER=" + ic + "\nETCD_INITIAL_CLUSTER_STATE=new\n"},
+		{"application/json;q=0.5, text/x-systemd-unit", "", "text/x-systemd-unit",
+			"[Service]\nEnvironment=\"ETCD_INITIAL_CLUSTER=" + ic + "\"\nEnvironment=\"ETCD_INITIAL_CLUSTER_STATE=new\"\n"},
+		{"text/html", "?format=env", "text/x-env", "ETCD_INITIAL_CLUSTER=" + ic + "\nETCD_INITIAL_CLUSTER_STATE=new\n"},
+	}
+	for i, tt := range tests {
+		code, contentType, body := get(tt.accept, tt.query)
+		if code != http.StatusOK || contentType != tt.contentType || body != tt.body {
+			t.Errorf("#%d: expected 200 %q %q, got %d %q %q", i, tt.contentType, tt.body, code, contentType, body)
+		}
+	}
+	if code, _, _ := get("text/html", ""); code != http.StatusNotAcceptable {
+		t.Errorf("expected %d for text/html, got %d", http.StatusNotAcceptable, code)
+	}
+	if code, _, _ := get("", "?format=yaml"); code != http.StatusBadRequest {
+		t.Errorf("expected %d for an unknown format, got %d", http.StatusBadRequest, code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	bc, err := client.New(svs.httpEp).BootstrapConfig(ctx, svs.httpEp+"/"+token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bc.InitialCluster != ic || len(bc.Members) != 2 || bc.Members[1].Name != "node1" || bc.Members[1].PeerURLs[0] != "http://10.0.0.1:2380" {
+		t.Fatalf("expected the first two members in the bootstrap config, got %+v", bc)
+	}
+}
@@ -0,0 +1,102 @@
+package integration
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+)
+
+func TestMemberMetadata(t *testing.T) {
+	svs := startService(t, nil)
+	defer svs.Stop(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c := client.New(svs.httpEp)
+
+	u, err := c.Create(ctx, client.CreateOptions{Size: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenURL := svs.httpEp + "/" + path.Base(u)
+
+	for _, m := range []client.Member{
+		{ID: "a0", Name: "infra0", PeerURLs: []string{"http://10.0.0.1:2380"}, Metadata: map[string]string{"zone": "us-east-1a", "version": "3.3.25"}},
+		{ID: "a1", Name: "infra1", PeerURLs: []string{"http://10.0.0.2:2380"}, Metadata: map[string]string{"zone": "us-east-1a", "version": "3.4.0"}},
+	} {
+		if _, err := c.Register(ctx, tokenURL, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body := `{"name": "infra2", "peerURLs": ["http://10.0.0.3:2380"], "metadata": {"zone": "us-east-1b", "rack": "r7"}}`
+	req, err := http.NewRequest(http.MethodPut, tokenURL+"/a2?prevExist=false", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gracefulClose(resp)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected the JSON registration to be created, got %d", resp.StatusCode)
+	}
+
+	// etcd reads the registrations as they always were
+	resp, err = http.Get(tokenURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing, _ := ioutil.ReadAll(resp.Body)
+	gracefulClose(resp)
+	if !strings.Contains(string(listing), `"value":"infra2=http://10.0.0.3:2380"`) || strings.Contains(string(listing), "us-east-1") {
+		t.Fatalf("expected plain registrations in the listing, got %s", listing)
+	}
+
+	s, err := c.Summary(ctx, tokenURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Quorum) != 3 || s.Quorum[0].Metadata["version"] != "3.3.25" || s.Quorum[2].Metadata["rack"] != "r7" {
+		t.Fatalf("expected the summary to carry the metadata, got %+v", s.Quorum)
+	}
+
+	d, err := c.Diagnose(ctx, tokenURL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := make(map[string]string)
+	for _, f := range d.Findings {
+		checks[f.Check] = f.Message
+	}
+	if !strings.Contains(checks["zone"], "2 of 3 members are in zone us-east-1a") || !strings.Contains(checks["version"], "3.3.25, 3.4.0") {
+		t.Fatalf("expected zone and version findings, got %+v", d.Findings)
+	}
+	if len(d.Members) != 3 || d.Members[1].Metadata["zone"] != "us-east-1a" {
+		t.Fatalf("expected diagnose to list the metadata, got %+v", d.Members)
+	}
+
+	// metadata goes away with its member
+	if err := c.Unregister(ctx, tokenURL, "a1"); err != nil {
+		t.Fatal(err)
+	}
+	m := client.Member{ID: "a1", Name: "infra1", PeerURLs: []string{"http://10.0.0.2:2380"}}
+	if _, err := c.Register(ctx, tokenURL, m); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = c.Summary(ctx, tokenURL); err != nil || len(s.Quorum) != 3 || s.Quorum[2].ID != "a1" || s.Quorum[2].Metadata != nil {
+		t.Fatalf("expected a1 to register again without metadata, got %+v (%v)", s, err)
+	}
+
+	m = client.Member{ID: "a3", Name: "infra3", PeerURLs: []string{"http://10.0.0.4:2380"}, Metadata: map[string]string{"-zone": "x"}}
+	if _, err := c.Register(ctx, tokenURL, m); err == nil {
+		t.Fatal("expected invalid metadata to be refused")
+	}
+}
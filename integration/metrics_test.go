@@ -0,0 +1,75 @@
+package integration
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/coreos/discovery.etcd.io/metrics"
+)
+
+// metricSum returns the sum of the samples of the named series on the
+// registry of the service whose labels contain every one of labels.
+func metricSum(t *testing.T, name string, labels ...string) float64 {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	var sum float64
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if !strings.HasPrefix(line, name+"{") && !strings.HasPrefix(line, name+" ") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		matched := true
+		for _, l := range labels {
+			matched = matched && strings.Contains(line[:i], l)
+		}
+		if !matched {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid sample %q: %v", line, err)
+		}
+		sum += v
+	}
+	return sum
+}
+
+func TestMetrics(t *testing.T) {
+	svs := startService(t, nil)
+	defer svs.Stop(t)
+
+	series := []struct {
+		name   string
+		labels []string
+	}{
+		{"endpoint_new_requests_total", []string{`code="200"`, `method="GET"`}},
+		{"endpoint_token_requests_total", []string{`code="201"`, `method="PUT"`}},
+		{"tokens_created_total", []string{`tenant="anonymous"`}},
+		{"bootstrap_requested_size_count", []string{`tenant="anonymous"`}},
+		{"http_request_duration_seconds_count", []string{`method="GET"`, `route="/new"`}},
+		{"http_request_duration_seconds_count", []string{`code="201"`, `method="PUT"`, `route="/{token:[a-f0-9]{32}}/{machine}"`}},
+		{"etcd_request_duration_seconds_count", []string{`operation="proxy_put"`}},
+	}
+	before := make([]float64, len(series))
+	for i, s := range series {
+		before[i] = metricSum(t, s.name, s.labels...)
+	}
+
+	token := newToken(t, svs, 3)
+	resp := register(t, svs, token, "m0", "infra0=http://10.0.0.1:2380")
+	gracefulClose(resp)
+	if resp.StatusCode != 201 {
+		t.Fatalf("expected the member to register, got %d", resp.StatusCode)
+	}
+
+	for i, s := range series {
+		if v := metricSum(t, s.name, s.labels...); v <= before[i] {
+			t.Errorf("expected %s%v to grow from %v, got %v", s.name, s.labels, before[i], v)
+		}
+	}
+	if v := metricSum(t, "bootstrap_requested_size_sum", `tenant="anonymous"`); v < 3 {
+		t.Errorf("expected the requested size to be observed, got %v", v)
+	}
+}
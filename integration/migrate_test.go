@@ -0,0 +1,133 @@
+package integration
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/etcd/clientv3"
+)
+
+func TestMigrateV3(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) {
+		cfg.AdminToken = testAdminToken
+		cfg.MigrateV3 = true
+		cfg.Namespaces = []config.Namespace{{Name: "staging", Prefix: "discovery/staging", TokenTTL: time.Hour}}
+	})
+	defer svs.Stop(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	v3, err := clientv3.New(clientv3.Config{Endpoints: []string{svs.etcdCURL.String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v3.Close()
+
+	// v3Members returns the members of a token in v3, in creation order
+	v3Members := func(prefix, token string) string {
+		resp, err := v3.Get(ctx, "/"+prefix+"/"+token+"/members/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, kv := range resp.Kvs {
+			ids = append(ids, path.Base(string(kv.Key)))
+		}
+		return strings.Join(ids, ",")
+	}
+	waitMembers := func(prefix, token, exp string) {
+		for i := 0; i < 50 && v3Members(prefix, token) != exp; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if got := v3Members(prefix, token); got != exp {
+			t.Fatalf("expected members %q of %s in v3, got %q", exp, token, got)
+		}
+	}
+
+	// writes through the service are copied right away
+	c := client.New(svs.httpEp)
+	u, err := c.Create(ctx, client.CreateOptions{Size: 3, Namespace: "staging"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := path.Base(u)
+	for _, id := range []string{"id2", "id0", "id1"} {
+		m := client.Member{ID: id, Name: "node-" + id, PeerURLs: []string{"http://10.0.0.9:2380"}}
+		if _, err := c.Register(ctx, svs.httpEp+"/ns/staging/"+token, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitMembers("discovery/staging", token, "id2,id0,id1")
+	resp, err := v3.Get(ctx, "/discovery/staging/"+token+"/_config/size")
+	if err != nil || len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != "3" || resp.Kvs[0].Lease == 0 {
+		t.Fatalf("expected the size of %s to be copied with a lease, got %v (%v)", token, resp, err)
+	}
+	if err := c.Unregister(ctx, svs.httpEp+"/ns/staging/"+token, "id0"); err != nil {
+		t.Fatal(err)
+	}
+	waitMembers("discovery/staging", token, "id2,id1")
+
+	// members sit beside the config of the token, as etcd v3 discovery
+	// expects
+	resp, err = v3.Get(ctx, "/discovery/staging/"+token+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, kv := range resp.Kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	dir := "/discovery/staging/" + token + "/"
+	exp := []string{dir + "_config/created", dir + "_config/size", dir + "members/id1", dir + "members/id2"}
+	if strings.Join(keys, "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("expected v3 keys\n%s\ngot\n%s", strings.Join(exp, "\n"), strings.Join(keys, "\n"))
+	}
+
+	// keys written behind the service's back are copied by the next round
+	other := newToken(t, svs, 1)
+	form := url.Values{"value": {"node0=http://10.0.0.1:2380"}}
+	req, err := http.NewRequest(http.MethodPut, svs.etcdCURL.String()+"/v2/keys/_etcd/registry/"+other+"/id9", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else {
+		gracefulClose(resp)
+	}
+
+	admin := &client.Client{Endpoint: svs.httpEp, AdminToken: testAdminToken}
+	s, err := admin.SyncMigration(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Phase != "synced" || s.Report == nil || s.Report.Tokens != 2 || len(s.Report.Missing)+len(s.Report.Extra)+len(s.Report.Mismatched)+len(s.Report.Pending) != 0 {
+		t.Fatalf("expected a clean verification of 2 tokens, got %+v %+v", s, s.Report)
+	}
+	waitMembers("_etcd/registry", other, "id9")
+
+	if err := admin.DeleteToken(ctx, "", other); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if resp, err = v3.Get(ctx, "/_etcd/registry/", clientv3.WithPrefix(), clientv3.WithCountOnly()); err == nil && resp.Count == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil || resp.Count != 0 {
+		t.Fatalf("expected a deleted token to be removed from v3, got %d keys (%v)", resp.Count, err)
+	}
+
+	if s, err = admin.Migration(ctx); err != nil || s.Phase != "synced" || s.SyncedTokens == 0 {
+		t.Fatalf("expected the migration to stay synced, got %+v (%v)", s, err)
+	}
+}
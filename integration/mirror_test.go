@@ -0,0 +1,254 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/handlers"
+	discoveryhttp "github.com/coreos/discovery.etcd.io/http"
+	"github.com/coreos/discovery.etcd.io/metrics"
+)
+
+// metricValue returns the line of the named metric exposed by the
+// service.
+func metricValue(t *testing.T, name string) string {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			return line
+		}
+	}
+	return ""
+}
+
+func TestMirror(t *testing.T) {
+	upstream := startService(t, nil)
+	defer upstream.Stop(t)
+	cache := startService(t, nil)
+	defer cache.Stop(t)
+
+	// the upstream as seen by the mirror, which can be cut off
+	var down int32
+	target, _ := url.Parse(upstream.httpEp)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	standIn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			panic(http.ErrAbortHandler)
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer standIn.Close()
+
+	cfg := config.New(cache.etcdCURL.String(), "http://"+testDiscoveryHost)
+	cfg.Addr = "localhost:0"
+	cfg.Mirror = config.Mirror{Upstream: standIn.URL, SyncInterval: 200 * time.Millisecond}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	hctx, hcancel := context.WithCancel(context.Background())
+	defer hcancel()
+	srv := httptest.NewServer(discoveryhttp.RegisterHandlersConfig(hctx, cfg))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c := client.New(srv.URL)
+	up := client.New(upstream.httpEp)
+
+	u, err := c.Create(ctx, client.CreateOptions{Size: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := path.Base(u)
+	if u != "http://"+testDiscoveryHost+"/"+token {
+		t.Fatalf("expected a token url of the mirror, got %s", u)
+	}
+	if size, err := up.Size(ctx, upstream.httpEp+"/"+token); err != nil || size != 2 {
+		t.Fatalf("expected the token to be created upstream with size 2, got %d (%v)", size, err)
+	}
+
+	m0 := client.Member{ID: "id0", Name: "node0", PeerURLs: []string{"http://10.0.0.1:2380"}}
+	if _, err := c.Register(ctx, srv.URL+"/"+token, m0); err != nil {
+		t.Fatal(err)
+	}
+	m1 := client.Member{ID: "id1", Name: "node1", PeerURLs: []string{"http://10.0.0.2:2380"}}
+	if _, err := up.Register(ctx, upstream.httpEp+"/"+token, m1); err != nil {
+		t.Fatal(err)
+	}
+	if ms, _, err := up.Members(ctx, upstream.httpEp+"/"+token); err != nil || len(ms) != 2 {
+		t.Fatalf("expected the registrations to reach the upstream, got %v (%v)", ms, err)
+	}
+	time.Sleep(time.Second)
+
+	// the upstream of a cached token is kept out of the token directory
+	for key, code := range map[string]int{
+		"_etcd/registry/" + token + "/_config/upstream":  http.StatusNotFound,
+		"_etcd/registry/_configs/" + token + "/upstream": http.StatusOK,
+	} {
+		resp, err := http.Get(cache.etcdCURL.String() + "/v2/keys/" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gracefulClose(resp)
+		if resp.StatusCode != code {
+			t.Fatalf("expected %s to answer %d, got %d", key, code, resp.StatusCode)
+		}
+	}
+
+	// reads are served from the cache while the upstream is cut off
+	atomic.StoreInt32(&down, 1)
+	ms, _, err := c.Members(ctx, srv.URL+"/"+token)
+	if err != nil || len(ms) != 2 || ms[0].Name != "node0" || ms[1].Name != "node1" {
+		t.Fatalf("expected node0 and node1 from the cache, got %v (%v)", ms, err)
+	}
+	resp, err := http.Get(srv.URL + "/" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gracefulClose(resp)
+	cacheIndex, err := strconv.ParseUint(resp.Header.Get("X-Etcd-Index"), 10, 64)
+	if err != nil || cacheIndex < 1<<40 {
+		t.Fatalf("expected the cache to give out indexes of its own, got %q", resp.Header.Get("X-Etcd-Index"))
+	}
+	if size, err := c.Size(ctx, srv.URL+"/"+token); err != nil || size != 2 {
+		t.Fatalf("expected size 2 from the cache, got %d (%v)", size, err)
+	}
+	m2 := client.Member{ID: "id2", Name: "node2", PeerURLs: []string{"http://10.0.0.3:2380"}}
+	if _, err := c.Register(ctx, srv.URL+"/"+token, m2); err == nil {
+		t.Fatal("expected registrations to fail while the upstream is unreachable")
+	}
+	if _, err := c.Create(ctx, client.CreateOptions{Size: 3}); err == nil {
+		t.Fatal("expected token creation to fail while the upstream is unreachable")
+	}
+	if v := metricValue(t, "mirror_upstream_up"); v != "mirror_upstream_up 0" {
+		t.Fatalf("expected the upstream to be reported down, got %q", v)
+	}
+
+	// watches served from the cache see the upstream changes once it
+	// is back
+	watch := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(srv.URL + "/" + token + "?wait=true&recursive=true")
+		if err != nil {
+			watch <- err.Error()
+			return
+		}
+		defer gracefulClose(resp)
+		b, _ := ioutil.ReadAll(resp.Body)
+		watch <- string(b)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	if _, err := up.Register(ctx, upstream.httpEp+"/"+token, m2); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&down, 0)
+	select {
+	case ev := <-watch:
+		if !strings.Contains(ev, "node2") {
+			t.Fatalf("expected the watch to see node2, got %s", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the watch to return once the upstream was back")
+	}
+	if v := metricValue(t, "mirror_upstream_up"); v != "mirror_upstream_up 1" {
+		t.Fatalf("expected the upstream to be reported up, got %q", v)
+	}
+
+	// watches from an index of the cache are sent to list the token
+	// again rather than to the upstream
+	resp, err = http.Get(fmt.Sprintf("%s/%s?wait=true&waitIndex=%d", srv.URL, token, cacheIndex+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e struct {
+		ErrorCode int `json:"errorCode"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&e)
+	gracefulClose(resp)
+	if err != nil || resp.StatusCode != http.StatusBadRequest || e.ErrorCode != 401 {
+		t.Fatalf("expected the cache index to be refused as cleared, got %d %+v (%v)", resp.StatusCode, e, err)
+	}
+	if v := metricValue(t, "mirror_cached_tokens"); v != "mirror_cached_tokens 1" {
+		t.Fatalf("expected one cached token, got %q", v)
+	}
+}
+
+func TestMirrorCredentials(t *testing.T) {
+	upstream := startService(t, func(cfg *config.Config) {
+		cfg.AdminToken = testAdminToken
+		cfg.AnonymousDisabled = true
+	})
+	defer upstream.Stop(t)
+	cache := startService(t, nil)
+	defer cache.Stop(t)
+	mirrorKey := newTenantKey(t, upstream, "mirror")
+	upstreamKey := newTenantKey(t, upstream, "team-up")
+
+	// the API keys the upstream sees
+	var seen atomic.Value
+	seen.Store("")
+	target, _ := url.Parse(upstream.httpEp)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	standIn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || strings.HasPrefix(r.URL.Path, "/new") {
+			seen.Store(seen.Load().(string) + r.Header.Get(handlers.APIKeyHeader) + ";")
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer standIn.Close()
+
+	cfg := config.New(cache.etcdCURL.String(), "http://"+testDiscoveryHost)
+	cfg.Addr = "localhost:0"
+	cfg.AdminToken = testAdminToken
+	cfg.Mirror = config.Mirror{Upstream: standIn.URL, SyncInterval: time.Minute, APIKey: mirrorKey}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	hctx, hcancel := context.WithCancel(context.Background())
+	defer hcancel()
+	srv := httptest.NewServer(discoveryhttp.RegisterHandlersConfig(hctx, cfg))
+	defer srv.Close()
+	mirror := &Service{httpEp: srv.URL}
+	localKey := newTenantKey(t, mirror, "team-a")
+	gracefulClose(adminDo(t, mirror, http.MethodPut, "/admin/tenants/team-a", `{"maxTokens": 1}`))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	local := &client.Client{Endpoint: srv.URL, APIKey: localKey}
+	if _, err := (&client.Client{Endpoint: srv.URL, APIKey: upstreamKey}).Create(ctx, client.CreateOptions{Size: 1}); err == nil || err.(*client.Error).StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected an upstream key to be refused by the mirror, got %v", err)
+	}
+	u, err := local.Create(ctx, client.CreateOptions{Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := local.Create(ctx, client.CreateOptions{Size: 1}); err == nil || err.(*client.Error).StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected the local quota to hold, got %v", err)
+	}
+
+	tokenURL := srv.URL + "/" + path.Base(u)
+	if _, err := client.New(srv.URL).Reset(ctx, tokenURL, 0); err == nil || err.(*client.Error).StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a reset without credentials to be refused, got %v", err)
+	}
+	if _, err := local.Reset(ctx, tokenURL, 0); err != nil {
+		t.Fatalf("expected the tenant to reset its token through the mirror, got %v", err)
+	}
+	if exp := mirrorKey + ";" + mirrorKey + ";"; seen.Load() != exp {
+		t.Fatalf("expected the upstream to only see the key of the mirror, got %q", seen.Load())
+	}
+}
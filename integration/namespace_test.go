@@ -0,0 +1,87 @@
+package integration
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/etcd/client"
+)
+
+func TestNamespaces(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) {
+		cfg.RegistryPrefix = "discovery/prod"
+		cfg.Namespaces = []config.Namespace{
+			{Name: "staging", Prefix: "discovery/staging", MaxSize: 3, TokenTTL: time.Hour},
+		}
+	})
+	defer svs.Stop(t)
+
+	resp, err := http.Get(svs.httpEp + "/ns/staging/new?size=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bts, err := ioutil.ReadAll(resp.Body)
+	gracefulClose(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := testDiscoveryHost + "/ns/staging/"
+	if !strings.HasPrefix(string(bts), prefix) {
+		t.Fatalf("expected token url with prefix %q, got %q", prefix, string(bts))
+	}
+	token := strings.TrimPrefix(string(bts), prefix)
+
+	// the token is kept under the namespace prefix, with its ttl
+	resp, err = http.Get(svs.etcdCURL.String() + "/" + path.Join("v2", "keys", "discovery", "staging", token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cresp client.Response
+	err = json.NewDecoder(resp.Body).Decode(&cresp)
+	gracefulClose(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cresp.Node == nil || cresp.Node.TTL <= 0 {
+		t.Fatalf("expected token directory with a ttl, got %+v", cresp.Node)
+	}
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/ns/staging/" + token, http.StatusOK},
+		{"/ns/staging/" + token + "/_config/size", http.StatusOK},
+		{"/" + token, http.StatusNotFound},
+		{"/ns/unknown/" + token, http.StatusNotFound},
+		{"/ns/unknown/new", http.StatusNotFound},
+		{"/ns/staging/new?size=5", http.StatusBadRequest},
+	}
+	for i, tt := range tests {
+		resp, err := http.Get(svs.httpEp + tt.path)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		gracefulClose(resp)
+		if resp.StatusCode != tt.code {
+			t.Fatalf("#%d: status of %s expected %d, got %d", i, tt.path, tt.code, resp.StatusCode)
+		}
+	}
+
+	// tokens of the default namespace use the configured prefix
+	token = newToken(t, svs, 5)
+	resp, err = http.Get(svs.etcdCURL.String() + "/" + path.Join("v2", "keys", "discovery", "prod", token, "_config", "size"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gracefulClose(resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected token under the registry prefix, got status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,72 @@
+package integration
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/coreos/discovery.etcd.io/config"
+)
+
+func TestNewAllowedHosts(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) {
+		cfg.AllowedHosts = []string{"http://internal.example.com", "https://discovery.example.com"}
+		cfg.MaxSize = 5
+		cfg.TrustedProxies = []string{"127.0.0.1/32"}
+	})
+	defer svs.Stop(t)
+
+	// forwarded hosts count only from trusted proxies
+	untrusted := &http.Client{Transport: &http.Transport{
+		DialContext: (&net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}).DialContext,
+	}}
+	forwarded := http.Header{"X-Forwarded-Host": {"discovery.example.com"}, "X-Forwarded-Proto": {"https"}}
+	tests := []struct {
+		c      *http.Client
+		host   string
+		header http.Header
+		prefix string
+	}{
+		{http.DefaultClient, "internal.example.com", nil, "http://internal.example.com/"},
+		{http.DefaultClient, "discovery.example.com", nil, "https://discovery.example.com/"},
+		{http.DefaultClient, "localhost", forwarded, "https://discovery.example.com/"},
+		{http.DefaultClient, "localhost", http.Header{"Forwarded": {`for=10.0.0.1;host=internal.example.com;proto=http`}}, "http://internal.example.com/"},
+		{http.DefaultClient, "unknown.example.com", nil, testDiscoveryHost + "/"},
+		{untrusted, "localhost", forwarded, testDiscoveryHost + "/"},
+		{untrusted, "internal.example.com", forwarded, "http://internal.example.com/"},
+	}
+	ep := strings.Replace(svs.httpEp, "localhost", "127.0.0.1", 1)
+	for i, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, ep+"/new", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = tt.host
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		resp, err := tt.c.Do(req)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		bts, err := ioutil.ReadAll(resp.Body)
+		gracefulClose(resp)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !strings.HasPrefix(string(bts), tt.prefix) {
+			t.Fatalf("#%d: expected token url with prefix %q, got %q", i, tt.prefix, string(bts))
+		}
+	}
+
+	resp, err := http.Get(svs.httpEp + "/new?size=7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gracefulClose(resp)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d above the maximum size, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
@@ -0,0 +1,134 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/coreos/discovery.etcd.io/config"
+)
+
+func TestPeerCheckAddresses(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) {
+		cfg.PeerCheck = config.PeerCheck{RejectLocal: true, AllowedCIDRs: []string{"10.0.0.0/8"}}
+	})
+	defer svs.Stop(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c := client.New(svs.httpEp)
+	tokenURL := svs.httpEp + "/" + newToken(t, svs, 3)
+	failed := metricSum(t, "peer_checks_total", `check="local"`, `result="failed"`)
+
+	for _, tt := range []struct {
+		m      client.Member
+		reason string
+	}{
+		{client.Member{ID: "id0", Name: "infra0", PeerURLs: []string{"http://127.0.0.1:2380"}}, "loopback address"},
+		{client.Member{ID: "id1", Name: "infra1", PeerURLs: []string{"http://[fe80::1]:2380"}}, "link-local address"},
+		{client.Member{ID: "id2", Name: "infra2", PeerURLs: []string{"http://192.168.0.2:2380"}}, "outside the allowed networks"},
+		{client.Member{ID: "id3", Name: "infra3", PeerURLs: []string{"http://10.0.0.3"}}, "with a port"},
+	} {
+		_, err := c.Register(ctx, tokenURL, tt.m)
+		if e, ok := err.(*client.Error); !ok || e.StatusCode != 403 || !strings.Contains(e.Message, tt.reason) {
+			t.Fatalf("expected %s to be refused for %q, got %v", tt.m.PeerURLs[0], tt.reason, err)
+		}
+	}
+	m := client.Member{ID: "id4", Name: "infra4", PeerURLs: []string{"http://10.0.0.4:2380"}}
+	if _, err := c.Register(ctx, tokenURL, m); err != nil {
+		t.Fatalf("expected %s to register, got %v", m.PeerURLs[0], err)
+	}
+
+	s, err := c.Summary(ctx, tokenURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.PeerChecks) != 5 || s.Registered != 1 {
+		t.Fatalf("expected the checks of 5 members and 1 registration, got %+v", s)
+	}
+	for _, pc := range s.PeerChecks {
+		if pc.Passed != (pc.Member == "id4") || pc.Probed {
+			t.Errorf("expected only id4 to pass unprobed, got %+v", pc)
+		}
+	}
+	if v := metricSum(t, "peer_checks_total", `check="local"`, `result="failed"`); v != failed+2 {
+		t.Errorf("expected 2 more failed local checks than %v, got %v", failed, v)
+	}
+
+	h, err := c.History(ctx, tokenURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := 0
+	for _, ev := range h {
+		if ev.Type == "rejected" && strings.Contains(ev.Reason, "peer url checks failed") {
+			rejected++
+		}
+	}
+	if rejected != 4 {
+		t.Fatalf("expected 4 refusals in the history, got %+v", h)
+	}
+}
+
+func TestPeerCheckProbe(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) {
+		cfg.PeerCheck = config.PeerCheck{AllowedCIDRs: []string{"127.0.0.0/8"}, ProbeTimeout: time.Second}
+	})
+	defer svs.Stop(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c := client.New(svs.httpEp)
+	tokenURL := svs.httpEp + "/" + newToken(t, svs, 3)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := "http://" + ln.Addr().String()
+	if _, err := c.Register(ctx, tokenURL, client.Member{ID: "id0", Name: "infra0", PeerURLs: []string{peer}}); err != nil {
+		t.Fatalf("expected a listening peer to register, got %v", err)
+	}
+
+	ln.Close()
+	_, err = c.Register(ctx, tokenURL, client.Member{ID: "id1", Name: "infra1", PeerURLs: []string{peer}})
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != 403 || !strings.HasSuffix(e.Message, fmt.Sprintf("peer url %q did not accept a connection", peer)) {
+		t.Fatalf("expected a closed peer to be refused, got %v", err)
+	}
+
+	// only addresses in the allowed networks are connected to, and
+	// names that do not resolve cannot be bound to any
+	_, err = c.Register(ctx, tokenURL, client.Member{ID: "id2", Name: "infra2", PeerURLs: []string{"http://10.0.0.2:2380"}})
+	if e, ok := err.(*client.Error); !ok || e.StatusCode != 403 || !strings.Contains(e.Message, "outside the allowed networks") {
+		t.Fatalf("expected a peer outside the allowed networks to be refused, got %v", err)
+	}
+	if _, err := c.Register(ctx, tokenURL, client.Member{ID: "id3", Name: "infra3", PeerURLs: []string{"http://peer.invalid:2380"}}); err != nil {
+		t.Fatalf("expected an unresolved peer to register unprobed, got %v", err)
+	}
+
+	s, err := c.Summary(ctx, tokenURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{"id0 probed passed", "id1 probed failed", "id2 failed", "id3 passed"}
+	var got []string
+	for _, pc := range s.PeerChecks {
+		g := pc.Member
+		if pc.Probed {
+			g += " probed"
+		}
+		if pc.Passed {
+			g += " passed"
+		} else {
+			g += " failed"
+		}
+		got = append(got, g)
+	}
+	if strings.Join(got, ", ") != strings.Join(exp, ", ") {
+		t.Fatalf("expected peer checks %v, got %v", exp, got)
+	}
+}
@@ -0,0 +1,196 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/coreos/discovery.etcd.io/config"
+	etcdclient "github.com/coreos/etcd/client"
+)
+
+// newTenantKey creates a tenant without limits and returns an API key
+// of it.
+func newTenantKey(t *testing.T, svs *Service, tenant string) string {
+	gracefulClose(adminDo(t, svs, http.MethodPut, "/admin/tenants/"+tenant, `{}`))
+	resp := adminDo(t, svs, http.MethodPost, "/admin/tenants/"+tenant+"/keys", "")
+	defer gracefulClose(resp)
+	var key struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+		t.Fatal(err)
+	}
+	return key.Key
+}
+
+func TestReset(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) {
+		cfg.AdminToken = testAdminToken
+	})
+	defer svs.Stop(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	owner := &client.Client{Endpoint: svs.httpEp, APIKey: newTenantKey(t, svs, "team-a")}
+	other := &client.Client{Endpoint: svs.httpEp, APIKey: newTenantKey(t, svs, "team-b")}
+	u, err := owner.Create(ctx, client.CreateOptions{Size: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := path.Base(u)
+	tokenURL := svs.httpEp + "/" + token
+	for i := 0; i < 2; i++ {
+		m := client.Member{ID: fmt.Sprintf("id%d", i), Name: fmt.Sprintf("node%d", i), PeerURLs: []string{fmt.Sprintf("http://10.0.0.%d:2380", i)}}
+		if _, err := owner.Register(ctx, tokenURL, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		c    *client.Client
+		code int
+	}{
+		{client.New(svs.httpEp), http.StatusUnauthorized},
+		{&client.Client{Endpoint: svs.httpEp, APIKey: "team-a.00000000.00000000"}, http.StatusUnauthorized},
+		{other, http.StatusForbidden},
+	} {
+		if _, err := tt.c.Reset(ctx, tokenURL, 0); err == nil || err.(*client.Error).StatusCode != tt.code {
+			t.Fatalf("expected status %d resetting as %q, got %v", tt.code, tt.c.APIKey, err)
+		}
+	}
+
+	removed, err := owner.Reset(ctx, tokenURL, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(removed) != "[id0 id1]" {
+		t.Fatalf("expected id0 and id1 to be removed, got %v", removed)
+	}
+	if ms, _, err := owner.Members(ctx, tokenURL); err != nil || len(ms) != 0 {
+		t.Fatalf("expected no members after the reset, got %v (%v)", ms, err)
+	}
+	if size, err := owner.Size(ctx, tokenURL); err != nil || size != 5 {
+		t.Fatalf("expected size 5 after the reset, got %d (%v)", size, err)
+	}
+
+	// tokens grow no further than their tenant and expected members
+	// allow
+	resp := adminDo(t, svs, http.MethodPut, "/admin/tenants/team-a", `{"maxSize": 5}`)
+	gracefulClose(resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d limiting a tenant, got %d", http.StatusOK, resp.StatusCode)
+	}
+	expecting, err := owner.Create(ctx, client.CreateOptions{Expect: []string{"node0", "node1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		c        *client.Client
+		tokenURL string
+		size     int
+		code     int
+	}{
+		{owner, tokenURL, 6, http.StatusBadRequest},
+		{&client.Client{Endpoint: svs.httpEp, AdminToken: testAdminToken}, tokenURL, 6, http.StatusBadRequest},
+		{owner, svs.httpEp + "/" + path.Base(expecting), 3, http.StatusBadRequest},
+		{owner, svs.httpEp + "/" + path.Base(expecting), 1, 0},
+	} {
+		_, err := tt.c.Reset(ctx, tt.tokenURL, tt.size)
+		if e, ok := err.(*client.Error); tt.code == 0 && err != nil || tt.code != 0 && (!ok || e.StatusCode != tt.code) {
+			t.Fatalf("expected status %d resetting %s to size %d, got %v", tt.code, tt.tokenURL, tt.size, err)
+		}
+	}
+	if size, err := owner.Size(ctx, tokenURL); err != nil || size != 5 {
+		t.Fatalf("expected size 5 after the refused resets, got %d (%v)", size, err)
+	}
+
+	// anonymous tokens can only be reset by the admin
+	anon := newToken(t, svs, 3)
+	if _, err := owner.Reset(ctx, svs.httpEp+"/"+anon, 0); err == nil || err.(*client.Error).StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a tenant resetting an anonymous token to be refused, got %v", err)
+	}
+	admin := &client.Client{Endpoint: svs.httpEp, AdminToken: testAdminToken}
+	if _, err := admin.Reset(ctx, svs.httpEp+"/"+anon, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := owner.History(ctx, tokenURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := events[len(events)-1]
+	if ev.Type != "reset" || ev.Actor != "team-a" || ev.Size != 5 || ev.PrevSize != 3 || len(ev.Removed) != 2 {
+		t.Fatalf("expected the reset by team-a to be recorded, got %+v", ev)
+	}
+}
+
+// watchToken waits for the next change to token after index, as the
+// etcd discovery client watches it, hidden keys included.
+func watchToken(t *testing.T, svs *Service, token string, index uint64) *etcdclient.Response {
+	resp, err := http.Get(fmt.Sprintf("%s/%s?wait=true&recursive=true&waitIndex=%d", svs.httpEp, token, index+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gracefulClose(resp)
+	var r etcdclient.Response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil || r.Node == nil {
+		t.Fatalf("failed to read the change after %d: %v", index, err)
+	}
+	return &r
+}
+
+func TestResetWatch(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) {
+		cfg.AdminToken = testAdminToken
+	})
+	defer svs.Stop(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	admin := &client.Client{Endpoint: svs.httpEp, AdminToken: testAdminToken}
+	token := newToken(t, svs, 3)
+	tokenURL := svs.httpEp + "/" + token
+	if _, err := admin.Register(ctx, tokenURL, client.Member{ID: "id0", Name: "node0", PeerURLs: []string{"http://10.0.0.0:2380"}}); err != nil {
+		t.Fatal(err)
+	}
+	_, before, err := admin.Members(ctx, tokenURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admin.Reset(ctx, tokenURL, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	// members still watching replay the reset, the size included,
+	// which is why they must be stopped first
+	r := watchToken(t, svs, token, before)
+	if r.Action != "delete" || path.Base(r.Node.Key) != "id0" {
+		t.Fatalf("expected the reset to remove id0 first, got %s of %s", r.Action, r.Node.Key)
+	}
+	if r = watchToken(t, svs, token, r.Node.ModifiedIndex); path.Base(r.Node.Key) != "size" {
+		t.Fatalf("expected the reset to set the size next, got %s of %s", r.Action, r.Node.Key)
+	}
+
+	// members started after the reset watch from the listing they
+	// register on, past the new size
+	_, after, err := admin.Members(ctx, tokenURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admin.Register(ctx, tokenURL, client.Member{ID: "id1", Name: "node1", PeerURLs: []string{"http://10.0.0.1:2380"}}); err != nil {
+		t.Fatal(err)
+	}
+	if r = watchToken(t, svs, token, after); r.Action != "create" || path.Base(r.Node.Key) != "id1" {
+		t.Fatalf("expected only the registration of id1 after the reset, got %s of %s", r.Action, r.Node.Key)
+	}
+	if size, err := admin.Size(ctx, tokenURL); err != nil || size != 5 {
+		t.Fatalf("expected size 5 after the reset, got %d (%v)", size, err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/coreos/discovery.etcd.io/config"
 	discoveryhttp "github.com/coreos/discovery.etcd.io/http"
 
 	"github.com/coreos/etcd/embed"
@@ -35,6 +36,12 @@ const testDiscoveryHost = "handler-test"
 
 // NewService creates a new service.
 func NewService(t *testing.T, etcdClientPort, etcdPeerPort, httpPort int) *Service {
+	return NewServiceConfig(t, etcdClientPort, etcdPeerPort, httpPort, nil)
+}
+
+// NewServiceConfig creates a new service whose discovery server
+// configuration is adjusted by modify, if given.
+func NewServiceConfig(t *testing.T, etcdClientPort, etcdPeerPort, httpPort int, modify func(*config.Config)) *Service {
 	dataDir, err := ioutil.TempDir(os.TempDir(), "test-data")
 	if err != nil {
 		t.Fatal(err)
@@ -55,6 +62,11 @@ func NewService(t *testing.T, etcdClientPort, etcdPeerPort, httpPort int) *Servi
 	// cfg.AutoCompactionMode = compactor.ModePeriodic
 	// cfg.AutoCompactionRetention = 1
 
+	dcfg := config.New(cfg.LCUrls[0].String(), testDiscoveryHost)
+	if modify != nil {
+		modify(&dcfg)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Service{
 		rootCtx:    ctx,
@@ -67,7 +79,7 @@ func NewService(t *testing.T, etcdClientPort, etcdPeerPort, httpPort int) *Servi
 		httpEp: fmt.Sprintf("http://localhost:%d", httpPort),
 		httpServer: &http.Server{
 			Addr:    fmt.Sprintf("localhost:%d", httpPort),
-			Handler: discoveryhttp.RegisterHandlers(ctx, cfg.LCUrls[0].String(), testDiscoveryHost),
+			Handler: discoveryhttp.RegisterHandlersConfig(ctx, dcfg),
 		},
 		httpErrc: make(chan error),
 	}
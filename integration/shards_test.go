@@ -0,0 +1,196 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/coreos/discovery.etcd.io/config"
+	discoveryhttp "github.com/coreos/discovery.etcd.io/http"
+)
+
+func TestShards(t *testing.T) {
+	modify := func(cfg *config.Config) {
+		cfg.AdminToken = testAdminToken
+		cfg.TokenTTL = time.Hour
+		cfg.StallThreshold = time.Second
+	}
+	svs := startService(t, modify)
+	defer svs.Stop(t)
+	extra := startService(t, nil)
+	defer extra.Stop(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	// tokens created before the extra shard was added, filled but for
+	// the last few
+	c := &client.Client{Endpoint: svs.httpEp, AdminToken: testAdminToken}
+	var tokens []string
+	partial := make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		size := 1
+		if i >= 20 {
+			size = 3
+		}
+		u, err := c.Create(ctx, client.CreateOptions{Size: size})
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := path.Base(u)
+		m := client.Member{ID: "id0", Name: "node-" + token, PeerURLs: []string{"http://10.0.0.1:2380"}}
+		if _, err := c.Register(ctx, svs.httpEp+"/"+token, m); err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+		partial[token] = size > 1
+	}
+	// past the stall threshold
+	time.Sleep(1100 * time.Millisecond)
+
+	sharded := func() (*client.Client, func()) {
+		cfg := config.New(svs.etcdCURL.String(), "http://"+testDiscoveryHost)
+		modify(&cfg)
+		cfg.Addr = "localhost:0"
+		cfg.Shards = []config.Shard{{Name: "extra", URL: extra.etcdCURL.String()}}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		hctx, hcancel := context.WithCancel(context.Background())
+		srv := httptest.NewServer(discoveryhttp.RegisterHandlersConfig(hctx, cfg))
+		return &client.Client{Endpoint: srv.URL, AdminToken: testAdminToken}, func() {
+			srv.Close()
+			hcancel()
+		}
+	}
+	c, stop := sharded()
+	defer func() { stop() }()
+
+	checkMembers := func(when string) {
+		for _, token := range tokens {
+			ms, _, err := c.Members(ctx, c.Endpoint+"/"+token)
+			if err != nil || len(ms) != 1 || ms[0].Name != "node-"+token {
+				t.Fatalf("expected %s to keep its member %s, got %v (%v)", token, when, ms, err)
+			}
+		}
+	}
+	checkMembers("before the rebalance")
+
+	report, err := c.Shards(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Rebalance || len(report.Shards) != 2 || report.Shards[0].Name != config.DefaultShard || report.Shards[1].Name != "extra" {
+		t.Fatalf("expected the default and extra shards to need a rebalance, got %+v", report)
+	}
+	misplaced := report.Shards[0].Misplaced
+	if report.Shards[0].Tokens != len(tokens) || misplaced == 0 || misplaced == len(tokens) || report.Shards[1].Tokens != 0 {
+		t.Fatalf("expected some of the %d tokens to belong on the extra shard, got %+v", len(tokens), report.Shards)
+	}
+
+	dry, err := c.Rebalance(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dry.DryRun || len(dry.Moved)+len(dry.Skipped) != misplaced {
+		t.Fatalf("expected a dry run to move or skip %d tokens, got %+v", misplaced, dry)
+	}
+	// members of partially filled tokens may still be waiting for the
+	// others, and would take the removal of the token for a member
+	for _, m := range dry.Skipped {
+		if !partial[m.Token] {
+			t.Fatalf("expected only partially filled tokens to be skipped, got %s", m.Token)
+		}
+	}
+	for _, m := range dry.Moved {
+		if partial[m.Token] {
+			t.Fatalf("expected partially filled token %s to be skipped", m.Token)
+		}
+	}
+	if report, err = c.Shards(ctx); err != nil || report.Shards[1].Tokens != 0 {
+		t.Fatalf("expected a dry run to move nothing, got %+v (%v)", report, err)
+	}
+
+	moved, err := c.Rebalance(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved.Moved) != len(dry.Moved) || len(moved.Skipped) != len(dry.Skipped) {
+		t.Fatalf("expected %d tokens to move and %d to be skipped, got %+v", len(dry.Moved), len(dry.Skipped), moved)
+	}
+	for _, m := range moved.Moved {
+		if m.From != config.DefaultShard || m.To != "extra" {
+			t.Fatalf("expected tokens to move to the extra shard, got %+v", m)
+		}
+	}
+	report, err = c.Shards(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rebalance != (len(moved.Skipped) > 0) || report.Shards[0].Misplaced != len(moved.Skipped) || report.Shards[1].Tokens != len(moved.Moved) {
+		t.Fatalf("expected the tokens but the skipped ones to be balanced, got %+v", report)
+	}
+	// each request looks for its token on the shard it was on before
+	// at most once, and not at all once it moved
+	locates := metricSum(t, "etcd_request_duration_seconds_count", `operation="token_locate"`)
+	checkMembers("after the rebalance")
+	if v := metricSum(t, "etcd_request_duration_seconds_count", `operation="token_locate"`); v != locates+float64(len(moved.Skipped)) {
+		t.Fatalf("expected %d lookups of the skipped tokens on their previous shard, got %v", len(moved.Skipped), v-locates)
+	}
+
+	// once the skipped tokens are gone the shards are balanced
+	for _, m := range moved.Skipped {
+		if err := c.DeleteToken(ctx, "", m.Token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	again, err := c.Rebalance(ctx, false)
+	if err != nil || len(again.Moved) != 0 || len(again.Skipped) != 0 {
+		t.Fatalf("expected nothing left to move, got %+v (%v)", again, err)
+	}
+	report, err = c.Shards(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rebalance || report.Shards[0].Misplaced != 0 || report.Shards[0].Tokens+report.Shards[1].Tokens != len(tokens)-len(moved.Skipped) {
+		t.Fatalf("expected the tokens to be balanced, got %+v", report)
+	}
+
+	// members keep registering with moved tokens
+	token := moved.Moved[0].Token
+	m := client.Member{ID: "id1", Name: "node1", PeerURLs: []string{"http://10.0.0.2:2380"}}
+	if _, err := c.Register(ctx, c.Endpoint+"/"+token, m); err != nil {
+		t.Fatal(err)
+	}
+	if ms, _, err := c.Members(ctx, c.Endpoint+"/"+token); err != nil || len(ms) != 2 {
+		t.Fatalf("expected two members of the moved token %s, got %v (%v)", token, ms, err)
+	}
+
+	// the balanced shards are remembered, and new tokens spread across
+	// both
+	stop()
+	c, stop = sharded()
+	if report, err = c.Shards(ctx); err != nil || report.Rebalance {
+		t.Fatalf("expected no rebalance after a restart, got %+v (%v)", report, err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := c.Create(ctx, client.CreateOptions{Size: 3}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts, err := c.Tokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for _, ti := range ts {
+		counts[ti.Shard]++
+	}
+	if want := len(tokens) - len(moved.Skipped) + 20; len(ts) != want || counts[config.DefaultShard] == 0 || counts["extra"] == 0 {
+		t.Fatalf("expected %d tokens on both shards, got %s", want, fmt.Sprint(counts))
+	}
+}
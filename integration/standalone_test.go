@@ -0,0 +1,196 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	discoveryhttp "github.com/coreos/discovery.etcd.io/http"
+	"github.com/coreos/discovery.etcd.io/standalone"
+)
+
+var indexField = regexp.MustCompile(`"(createdIndex|modifiedIndex|index)":(\d+)`)
+
+// transcript runs the requests of a bootstrap against the discovery
+// service at ep and returns what it answered, with the token and the
+// indexes made relative to the creation of the token.
+func transcript(t *testing.T, ep string) []string {
+	do := func(method, p string, form url.Values) (int, http.Header, string) {
+		req, err := http.NewRequest(method, ep+p, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer gracefulClose(resp)
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header, string(b)
+	}
+
+	_, _, u := do("POST", "/new?size=2", nil)
+	token := u[strings.LastIndex(u, "/")+1:]
+	time.Sleep(200 * time.Millisecond)
+
+	var (
+		base  uint64
+		lines []string
+	)
+	record := func(code int, h http.Header, body string) {
+		if base == 0 {
+			m := indexField.FindStringSubmatch(body)
+			if m == nil {
+				t.Fatalf("expected the token listing to hold its index, got %s", body)
+			}
+			base, _ = strconv.ParseUint(m[2], 10, 64)
+		}
+		body = indexField.ReplaceAllStringFunc(strings.Replace(body, token, "TOKEN", -1), func(s string) string {
+			m := indexField.FindStringSubmatch(s)
+			n, _ := strconv.ParseUint(m[2], 10, 64)
+			return fmt.Sprintf(`"%s":%d`, m[1], n-base)
+		})
+		index, _ := strconv.ParseUint(h.Get("X-Etcd-Index"), 10, 64)
+		lines = append(lines, fmt.Sprintf("%d %s %d %s", code, h.Get("Content-Type"), index-base, strings.TrimSpace(body)))
+	}
+
+	record(do("GET", "/"+token, nil))
+
+	// a member long polling for the others
+	watch := make(chan func())
+	go func() {
+		code, h, body := do("GET", "/"+token+"?wait=true&recursive=true", nil)
+		watch <- func() { record(code, h, body) }
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	steps := []struct {
+		method, path string
+		form         url.Values
+	}{
+		{"PUT", "/" + token + "/id0", url.Values{"value": {"node0=http://10.0.0.1:2380"}, "prevExist": {"false"}}},
+		{"PUT", "/" + token + "/id0", url.Values{"value": {"node0=http://10.0.0.1:2380"}, "prevExist": {"false"}}},
+		{"GET", "/" + token + "/_config/size", nil},
+		{"PUT", "/" + token + "/id1", url.Values{"value": {"node1=http://10.0.0.2:2380"}}},
+		{"GET", "/" + token + "?recursive=true&sorted=true", nil},
+		{"DELETE", "/" + token + "/id1", nil},
+		{"GET", "/" + token + "/id1", nil},
+	}
+	var first uint64
+	for i, s := range steps {
+		code, h, body := do(s.method, s.path, s.form)
+		if i == 0 {
+			m := indexField.FindStringSubmatch(body)
+			if m == nil {
+				t.Fatalf("expected the registration to hold its index, got %s", body)
+			}
+			first, _ = strconv.ParseUint(m[2], 10, 64)
+		}
+		record(code, h, body)
+		if i == 0 {
+			select {
+			case f := <-watch:
+				f()
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the long poll to return the registration")
+			}
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	// a member catching up from its registration
+	record(do("GET", fmt.Sprintf("/%s?wait=true&recursive=true&waitIndex=%d", token, first), nil))
+	return lines
+}
+
+func TestStandalone(t *testing.T) {
+	svs := startService(t, nil)
+	defer svs.Stop(t)
+	exp := transcript(t, svs.httpEp)
+
+	dir, err := ioutil.TempDir(os.TempDir(), "test-standalone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	port := int(atomic.LoadInt32(&basePort))
+	atomic.AddInt32(&basePort, int32(5))
+	bcfg := config.Bolt{Path: filepath.Join(dir, "discovery.db"), ClientURL: fmt.Sprintf("http://localhost:%d", port)}
+
+	bolt, err := standalone.Start(bcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.New(bcfg.ClientURL, testDiscoveryHost)
+	cfg.Bolt = bcfg
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := httptest.NewServer(discoveryhttp.RegisterHandlersConfig(ctx, cfg))
+	defer srv.Close()
+
+	got := transcript(t, srv.URL)
+	if strings.Join(got, "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("expected the bolt backend to answer like etcd\n%s\ngot\n%s", strings.Join(exp, "\n"), strings.Join(got, "\n"))
+	}
+
+	get := func(key string) (int, string, string) {
+		resp, err := http.Get(bcfg.ClientURL + "/v2/keys/" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer gracefulClose(resp)
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header.Get("X-Etcd-Index"), string(b)
+	}
+
+	// keys expire, and the expiry survives a restart
+	req, err := http.NewRequest("PUT", bcfg.ClientURL+"/v2/keys/short?ttl=1&value=x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gracefulClose(resp)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected the key to be created, got status %d", resp.StatusCode)
+	}
+	time.Sleep(2 * time.Second)
+	if code, _, _ := get("short"); code != http.StatusNotFound {
+		t.Fatalf("expected the key to expire, got status %d", code)
+	}
+
+	_, index, registry := get("_etcd/registry?recursive=true&sorted=true")
+	if err := bolt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bolt, err = standalone.Start(bcfg); err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+	if _, i, r := get("_etcd/registry?recursive=true&sorted=true"); i != index || r != registry {
+		t.Fatalf("expected the registry at index %s after a restart\n%s\ngot index %s\n%s", index, registry, i, r)
+	}
+	if code, _, _ := get("short"); code != http.StatusNotFound {
+		t.Fatalf("expected the key to stay expired after a restart, got status %d", code)
+	}
+}
@@ -0,0 +1,84 @@
+package integration
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/etcd/etcdserver/membership"
+	"github.com/coreos/etcd/pkg/types"
+)
+
+func TestStaticToken(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) { cfg.AdminToken = testAdminToken })
+	defer svs.Stop(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c := &client.Client{Endpoint: svs.httpEp, AdminToken: testAdminToken}
+
+	cluster := "infra0=http://10.0.0.1:2380,infra1=http://10.0.0.2:2380,infra1=http://10.0.0.12:2380,infra2=http://10.0.0.3:2380"
+	st, err := c.CreateStatic(ctx, "", cluster, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Members) != 3 {
+		t.Fatalf("expected 3 members, got %+v", st.Members)
+	}
+	// the members are registered under the ids etcd gives them
+	for _, m := range st.Members {
+		id := membership.NewMember(m.Name, types.MustNewURLs(m.PeerURLs), st.URL, nil).ID.String()
+		if m.ID != id {
+			t.Fatalf("expected %s to be registered as %s, got %s", m.Name, id, m.ID)
+		}
+	}
+
+	// the configured discovery host is not reachable from the test
+	tokenURL := svs.httpEp + "/" + st.Token
+	if size, err := c.Size(ctx, tokenURL); err != nil || size != 3 {
+		t.Fatalf("expected size 3, got %d (%v)", size, err)
+	}
+	ms, _, err := c.Members(ctx, tokenURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 3 || ms[0].Name != "infra0" || ms[1].Name != "infra1" || ms[2].Name != "infra2" || ms[2].Quorum == nil || !*ms[2].Quorum {
+		t.Fatalf("expected infra0, infra1 and infra2 in the quorum, got %+v", ms)
+	}
+	if len(ms[1].PeerURLs) != 2 || ms[1].PeerURLs[0] != "http://10.0.0.12:2380" {
+		t.Fatalf("expected both peer urls of infra1, sorted, got %v", ms[1].PeerURLs)
+	}
+
+	// a member registering the way etcd does takes its registration over
+	if _, err := c.Register(ctx, tokenURL, ms[1]); err != nil {
+		t.Fatalf("expected infra1 to register, got %v", err)
+	}
+	// anything else cannot
+	other := client.Member{ID: ms[0].ID, Name: "intruder", PeerURLs: []string{"http://10.0.0.9:2380"}}
+	if _, err := c.Register(ctx, tokenURL, other); err == nil {
+		t.Fatal("expected another member to be refused the id of infra0")
+	}
+	if ms, _, err = c.Members(ctx, tokenURL); err != nil || len(ms) != 3 || ms[0].Name != "infra0" || ms[1].Quorum == nil || !*ms[1].Quorum {
+		t.Fatalf("expected the registry to stay complete, got %+v (%v)", ms, err)
+	}
+
+	ts, err := c.Tokens(ctx)
+	if err != nil || len(ts) != 1 || ts[0].Token != st.Token || ts[0].Members != 3 {
+		t.Fatalf("expected the static token to be listed with 3 members, got %+v (%v)", ts, err)
+	}
+
+	for _, bad := range []string{
+		"",
+		"infra0",
+		"infra0=ftp://10.0.0.1:2380",
+		"infra0=http://10.0.0.1:2380,infra1=http://10.0.0.1:2380",
+	} {
+		if _, err := c.CreateStatic(ctx, "", bad, 0); err == nil {
+			t.Fatalf("expected %q to be refused", bad)
+		} else if e, ok := err.(*client.Error); !ok || e.StatusCode != 400 {
+			t.Fatalf("expected %q to be a bad request, got %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/client"
+)
+
+func TestQuorum(t *testing.T) {
+	svs := startService(t, nil)
+	defer svs.Stop(t)
+
+	token := newToken(t, svs, 2)
+	// registration order, not key order, decides the cluster
+	for i, id := range []string{"c3", "a1", "b2"} {
+		gracefulClose(register(t, svs, token, id, fmt.Sprintf("node%d=http://10.0.0.%d:2380", i, i)))
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// plain listings are left as etcd returns them
+	resp, err := http.Get(svs.httpEp + "/" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	gracefulClose(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), `"quorum"`) {
+		t.Fatalf("expected an unmarked listing, got %s", b)
+	}
+
+	resp, err = http.Get(svs.httpEp + "/" + token + "?mark=quorum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listing struct {
+		Node struct {
+			Nodes []struct {
+				Key    string `json:"key"`
+				Quorum *bool  `json:"quorum"`
+			} `json:"nodes"`
+		} `json:"node"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&listing)
+	gracefulClose(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quorum := make(map[string]bool)
+	for _, n := range listing.Node.Nodes {
+		if n.Quorum == nil {
+			t.Fatalf("expected %s to be marked", n.Key)
+		}
+		quorum[n.Key[len(n.Key)-2:]] = *n.Quorum
+	}
+	if exp := map[string]bool{"c3": true, "a1": true, "b2": false}; fmt.Sprint(quorum) != fmt.Sprint(exp) {
+		t.Fatalf("expected quorum %v, got %v", exp, quorum)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := client.New(svs.httpEp).Summary(ctx, svs.httpEp+"/"+token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Full || s.Size != 2 || s.Registered != 3 || len(s.Quorum) != 2 || s.Quorum[0].ID != "c3" || s.Quorum[1].ID != "a1" ||
+		len(s.Overflow) != 1 || s.Overflow[0].ID != "b2" || *s.Overflow[0].Quorum {
+		t.Fatalf("expected c3 and a1 in the quorum and b2 in the overflow, got %+v", s)
+	}
+}
@@ -0,0 +1,171 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/handlers"
+	discoveryhttp "github.com/coreos/discovery.etcd.io/http"
+)
+
+// adminDo issues an admin API request with a JSON body.
+func adminDo(t *testing.T, svs *Service, method, p, body string) *http.Response {
+	req, err := http.NewRequest(method, svs.httpEp+p, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// newTenantToken requests a token of the given size with an API key.
+func newTenantToken(t *testing.T, svs *Service, key, size string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, svs.httpEp+"/new?size="+size, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		req.Header.Set(handlers.APIKeyHeader, key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestTenants(t *testing.T) {
+	svs := startService(t, func(cfg *config.Config) {
+		cfg.AdminToken = testAdminToken
+		cfg.AnonymousDisabled = true
+	})
+	defer svs.Stop(t)
+
+	resp := adminDo(t, svs, http.MethodPut, "/admin/tenants/team-a", `{"maxSize": 5, "maxTokens": 2}`)
+	gracefulClose(resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d creating a tenant, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	resp = adminDo(t, svs, http.MethodPost, "/admin/tenants/team-a/keys", "")
+	var key struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&key)
+	gracefulClose(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated || key.Key == "" {
+		t.Fatalf("expected a new key, got status %d and %+v", resp.StatusCode, key)
+	}
+
+	tests := []struct {
+		key  string
+		size string
+		code int
+	}{
+		{"", "3", http.StatusUnauthorized},
+		{"team-a.00000000.00000000", "3", http.StatusUnauthorized},
+		{key.Key, "7", http.StatusBadRequest},
+		{key.Key, "3", http.StatusOK},
+		{key.Key, "5", http.StatusOK},
+		{key.Key, "3", http.StatusTooManyRequests},
+	}
+	var created string
+	for i, tt := range tests {
+		resp := newTenantToken(t, svs, tt.key, tt.size)
+		b, err := ioutil.ReadAll(resp.Body)
+		gracefulClose(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.code {
+			t.Fatalf("#%d: expected status %d, got %d", i, tt.code, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusOK {
+			created = path.Base(strings.TrimSpace(string(b)))
+		}
+	}
+
+	// deleting a token makes room for another
+	resp = adminDo(t, svs, http.MethodDelete, "/admin/tokens/"+created, "")
+	gracefulClose(resp)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d deleting a token, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	resp = newTenantToken(t, svs, key.Key, "3")
+	gracefulClose(resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d after deleting a token, got %d", http.StatusOK, resp.StatusCode)
+	}
+	resp = newTenantToken(t, svs, key.Key, "3")
+	gracefulClose(resp)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d at the limit again, got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+
+	// another instance sharing the registry holds the tenant to the
+	// same limit
+	cfg := config.New(svs.etcdCURL.String(), "http://"+testDiscoveryHost)
+	cfg.AnonymousDisabled = true
+	hctx, hcancel := context.WithCancel(context.Background())
+	defer hcancel()
+	other := httptest.NewServer(discoveryhttp.RegisterHandlersConfig(hctx, cfg))
+	defer other.Close()
+	resp = newTenantToken(t, &Service{httpEp: other.URL}, key.Key, "3")
+	gracefulClose(resp)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d from another instance, got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+
+	resp = adminGet(t, svs, "/admin/tenants/team-a", testAdminToken)
+	var tenant struct {
+		Keys []string `json:"keys"`
+		Live int      `json:"live"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tenant)
+	gracefulClose(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tenant.Live != 2 || len(tenant.Keys) != 1 || tenant.Keys[0] != key.ID {
+		t.Fatalf("expected 2 live tokens and key %s, got %+v", key.ID, tenant)
+	}
+
+	for _, p := range []string{"/admin/tenants/Team_A/keys", "/admin/tenants/team-a/keys/zz"} {
+		method := http.MethodPost
+		if strings.Contains(p, "/keys/") {
+			method = http.MethodDelete
+		}
+		resp = adminDo(t, svs, method, p, "")
+		gracefulClose(resp)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s %s, got %d", http.StatusBadRequest, method, p, resp.StatusCode)
+		}
+	}
+
+	// revoked keys are refused
+	resp = adminDo(t, svs, http.MethodDelete, "/admin/tenants/team-a/keys/"+key.ID, "")
+	gracefulClose(resp)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d revoking a key, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	resp = newTenantToken(t, svs, key.Key, "3")
+	gracefulClose(resp)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status %d with a revoked key, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+}
@@ -0,0 +1,141 @@
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/coreos/discovery.etcd.io/tracing"
+)
+
+type collectedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Attributes   []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+}
+
+func (s collectedSpan) attr(key string) string {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value.StringValue
+		}
+	}
+	return ""
+}
+
+// collector stands in for an OTLP/HTTP collector.
+type collector struct {
+	mu    sync.Mutex
+	spans []collectedSpan
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []collectedSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&req) != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	c.mu.Unlock()
+}
+
+func (c *collector) byName(name string) []collectedSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var found []collectedSpan
+	for _, s := range c.spans {
+		if s.Name == name {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+func TestTracing(t *testing.T) {
+	col := &collector{}
+	srv := httptest.NewServer(col)
+	defer srv.Close()
+
+	tracing.SetExporter(tracing.NewOTLPExporter(srv.URL + "/v1/traces"))
+	defer tracing.SetExporter(nil)
+
+	svs := startService(t, nil)
+	defer svs.Stop(t)
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	req, err := http.NewRequest(http.MethodGet, svs.httpEp+"/new?size=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", "00-"+traceID+"-"+spanID+"-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gracefulClose(resp)
+	token := newToken(t, svs, 1)
+	gracefulClose(register(t, svs, token, "id0", "id0=http://10.0.0.1:2380"))
+
+	if err = tracing.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := col.byName("GET /new")
+	if len(handler) != 2 {
+		t.Fatalf("expected 2 /new handler spans, got %+v", handler)
+	}
+	var newSpan collectedSpan
+	for _, s := range handler {
+		if s.TraceID == traceID {
+			newSpan = s
+		}
+	}
+	if newSpan.ParentSpanID != spanID {
+		t.Fatalf("expected /new span continuing trace %s from %s, got %+v", traceID, spanID, handler)
+	}
+
+	var created bool
+	for _, s := range col.byName("etcd token_create") {
+		if s.TraceID == traceID && s.ParentSpanID == newSpan.SpanID {
+			created = true
+		}
+	}
+	if !created {
+		t.Fatal("expected a token_create etcd span under the /new span")
+	}
+
+	proxy := col.byName("proxy")
+	if len(proxy) != 1 {
+		t.Fatalf("expected 1 proxy span, got %+v", proxy)
+	}
+	put := col.byName("etcd proxy_put")
+	if len(put) == 0 || put[0].ParentSpanID != proxy[0].SpanID {
+		t.Fatalf("expected proxy attempts under the proxy span, got %+v", put)
+	}
+	if put[0].attr("proxy.attempt") != "0" {
+		t.Fatalf("expected first attempt to be numbered 0, got %q", put[0].attr("proxy.attempt"))
+	}
+}
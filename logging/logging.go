@@ -0,0 +1,85 @@
+// Package logging adds levels on top of the standard logger.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+)
+
+// Level is the minimum severity of the messages that are logged.
+type Level int32
+
+// Log levels, from the most to the least verbose.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[string]Level{
+	"debug": LevelDebug,
+	"info":  LevelInfo,
+	"warn":  LevelWarn,
+	"error": LevelError,
+}
+
+// ParseLevel returns the level called name.
+func ParseLevel(name string) (Level, error) {
+	l, ok := levelNames[name]
+	if !ok {
+		return 0, fmt.Errorf("Expected one of debug, info, warn or error (%s)", name)
+	}
+	return l, nil
+}
+
+var level = int32(LevelInfo)
+
+// SetLevel changes the minimum level of logged messages.
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// Enabled reports whether messages at l are logged.
+func Enabled(l Level) bool {
+	return int32(l) >= atomic.LoadInt32(&level)
+}
+
+func logf(l Level, format string, v ...interface{}) {
+	if Enabled(l) {
+		log.Output(3, fmt.Sprintf(format, v...))
+	}
+}
+
+// Debugf logs a message useful when troubleshooting.
+func Debugf(format string, v ...interface{}) { logf(LevelDebug, format, v...) }
+
+// Infof logs a routine message.
+func Infof(format string, v ...interface{}) { logf(LevelInfo, format, v...) }
+
+// Warnf logs a message about a recoverable problem.
+func Warnf(format string, v ...interface{}) { logf(LevelWarn, format, v...) }
+
+// Errorf logs a message about a failed operation.
+func Errorf(format string, v ...interface{}) { logf(LevelError, format, v...) }
+
+// levelWriter drops writes while its level is disabled.
+type levelWriter struct {
+	l Level
+	w io.Writer
+}
+
+func (lw levelWriter) Write(p []byte) (int, error) {
+	if !Enabled(lw.l) {
+		return len(p), nil
+	}
+	return lw.w.Write(p)
+}
+
+// Writer returns a writer passing writes on to w only while messages
+// at l are logged.
+func Writer(l Level, w io.Writer) io.Writer {
+	return levelWriter{l: l, w: w}
+}
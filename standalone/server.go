@@ -0,0 +1,259 @@
+package standalone
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/config"
+	"github.com/coreos/discovery.etcd.io/logging"
+
+	etcdErr "github.com/coreos/etcd/error"
+	"github.com/coreos/etcd/store"
+)
+
+const keysPrefix = "/v2/keys"
+
+// Handler returns the HTTP handler of the etcd v2 keys API served out
+// of s.
+func (s *Store) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(keysPrefix, s.serveKeys)
+	mux.HandleFunc(keysPrefix+"/", s.serveKeys)
+	return mux
+}
+
+// keyRequest is a request to the keys API.
+type keyRequest struct {
+	op
+	Wait             bool
+	WaitIndex        uint64
+	Stream           bool
+	Sorted           bool
+	NoValueOnSuccess bool
+}
+
+func getUint64(form url.Values, key string) (i uint64, err error) {
+	if vals, ok := form[key]; ok {
+		i, err = strconv.ParseUint(vals[0], 10, 64)
+	}
+	return
+}
+
+func getBool(form url.Values, key string) (b bool, err error) {
+	if vals, ok := form[key]; ok {
+		b, err = strconv.ParseBool(vals[0])
+	}
+	return
+}
+
+// parseKeyRequest reads a keys API request the way etcd does.
+func parseKeyRequest(r *http.Request) (keyRequest, error) {
+	var req keyRequest
+	if err := r.ParseForm(); err != nil {
+		return req, etcdErr.NewRequestError(etcdErr.EcodeInvalidForm, err.Error())
+	}
+	req.Method = r.Method
+	req.Path = path.Join("/", strings.TrimPrefix(r.URL.Path, keysPrefix))
+
+	var err error
+	if req.PrevIndex, err = getUint64(r.Form, "prevIndex"); err != nil {
+		return req, etcdErr.NewRequestError(etcdErr.EcodeIndexNaN, `invalid value for "prevIndex"`)
+	}
+	if req.WaitIndex, err = getUint64(r.Form, "waitIndex"); err != nil {
+		return req, etcdErr.NewRequestError(etcdErr.EcodeIndexNaN, `invalid value for "waitIndex"`)
+	}
+	for _, f := range []struct {
+		name string
+		b    *bool
+	}{
+		{"recursive", &req.Recursive},
+		{"sorted", &req.Sorted},
+		{"wait", &req.Wait},
+		{"dir", &req.Dir},
+		{"quorum", new(bool)},
+		{"stream", &req.Stream},
+		{"noValueOnSuccess", &req.NoValueOnSuccess},
+	} {
+		if *f.b, err = getBool(r.Form, f.name); err != nil {
+			return req, etcdErr.NewRequestError(etcdErr.EcodeInvalidField, fmt.Sprintf("invalid value for %q", f.name))
+		}
+	}
+	if req.Wait && r.Method != "GET" {
+		return req, etcdErr.NewRequestError(etcdErr.EcodeInvalidField, `"wait" can only be used with GET requests`)
+	}
+
+	req.PrevValue = r.FormValue("prevValue")
+	if _, ok := r.Form["prevValue"]; ok && req.PrevValue == "" {
+		return req, etcdErr.NewRequestError(etcdErr.EcodePrevValueRequired, `"prevValue" cannot be empty`)
+	}
+	req.Value = r.FormValue("value")
+
+	if len(r.FormValue("ttl")) > 0 {
+		ttl, err := getUint64(r.Form, "ttl")
+		if err != nil {
+			return req, etcdErr.NewRequestError(etcdErr.EcodeTTLNaN, `invalid value for "ttl"`)
+		}
+		req.Time = time.Now().Add(time.Duration(ttl) * time.Second).UnixNano()
+	}
+	if _, ok := r.Form["prevExist"]; ok {
+		pe, err := getBool(r.Form, "prevExist")
+		if err != nil {
+			return req, etcdErr.NewRequestError(etcdErr.EcodeInvalidField, "invalid value for prevExist")
+		}
+		req.PrevExist = &pe
+	}
+	if _, ok := r.Form["refresh"]; ok {
+		if req.Refresh, err = getBool(r.Form, "refresh"); err != nil {
+			return req, etcdErr.NewRequestError(etcdErr.EcodeInvalidField, "invalid value for refresh")
+		}
+		if req.Refresh {
+			if _, ok := r.Form["value"]; ok && req.Value != "" {
+				return req, etcdErr.NewRequestError(etcdErr.EcodeRefreshValue, "A value was provided on a refresh")
+			}
+			if req.Time == 0 {
+				return req, etcdErr.NewRequestError(etcdErr.EcodeRefreshTTLRequired, "No TTL value set")
+			}
+		}
+	}
+	return req, nil
+}
+
+func (s *Store) serveKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD", "PUT", "POST", "DELETE":
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := parseKeyRequest(r)
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+
+	var ev *store.Event
+	switch {
+	case req.Wait:
+		wa, err := s.Watch(req.Path, req.Recursive, req.Stream, req.WaitIndex)
+		if err != nil {
+			writeKeyError(w, err)
+			return
+		}
+		handleKeyWatch(w, r, wa, req.Stream)
+		return
+	case r.Method == "GET" || r.Method == "HEAD":
+		ev, err = s.Get(req.Path, req.Recursive, req.Sorted)
+	default:
+		ev, err = s.do(req.op)
+	}
+	if err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	writeKeyEvent(w, ev, req.NoValueOnSuccess)
+}
+
+func writeKeyEvent(w http.ResponseWriter, ev *store.Event, noValueOnSuccess bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", fmt.Sprint(ev.EtcdIndex))
+	if ev.IsCreated() {
+		w.WriteHeader(http.StatusCreated)
+	}
+	if noValueOnSuccess &&
+		(ev.Action == store.Set || ev.Action == store.CompareAndSwap ||
+			ev.Action == store.Create || ev.Action == store.Update) {
+		ev = ev.Clone()
+		ev.Node = nil
+		ev.PrevNode = nil
+	}
+	json.NewEncoder(w).Encode(ev)
+}
+
+func writeKeyError(w http.ResponseWriter, err error) {
+	e, ok := err.(*etcdErr.Error)
+	if !ok {
+		e = etcdErr.NewError(etcdErr.EcodeRaftInternal, err.Error(), 0)
+	}
+	e.WriteTo(w)
+}
+
+// handleKeyWatch answers a long poll with the events of wa, until the
+// first one unless stream is set.
+func handleKeyWatch(w http.ResponseWriter, r *http.Request, wa store.Watcher, stream bool) {
+	defer wa.Remove()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", fmt.Sprint(wa.StartIndex()))
+	w.WriteHeader(http.StatusOK)
+	// flush the headers early, the events may take a while
+	w.(http.Flusher).Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-wa.EventChan():
+			if !ok {
+				// the watcher fell too far behind
+				return
+			}
+			if err := json.NewEncoder(w).Encode(ev); err != nil {
+				logging.Warnf("standalone: error writing event: %v", err)
+				return
+			}
+			if !stream {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// Server serves a store on its client url.
+type Server struct {
+	store *Store
+	srv   *http.Server
+}
+
+// Start opens the bbolt file of cfg and serves it on the client url.
+func Start(cfg config.Bolt) (*Server, error) {
+	u, err := url.Parse(cfg.ClientURL)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Open(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "80")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	srv := &http.Server{Handler: s.Handler()}
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			logging.Errorf("standalone: serving %s failed: %v", cfg.ClientURL, err)
+		}
+	}()
+	return &Server{store: s, srv: srv}, nil
+}
+
+// Close stops serving and closes the store.
+func (s *Server) Close() error {
+	s.srv.Close()
+	return s.store.Close()
+}
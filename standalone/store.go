@@ -0,0 +1,310 @@
+// Package standalone serves the etcd v2 keys API out of a local bbolt
+// file, so the discovery service can run without any etcd cluster.
+//
+// Requests are answered by the v2 store etcd itself uses, so responses,
+// indexes, TTLs and watches behave as they do with etcd. The bbolt file
+// holds a snapshot of the store and a log of the changes applied since,
+// which are replayed when the file is opened again. Changes are logged
+// before watchers see them.
+package standalone
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/logging"
+
+	bolt "github.com/coreos/bbolt"
+	etcdErr "github.com/coreos/etcd/error"
+	"github.com/coreos/etcd/store"
+)
+
+var (
+	metaBucket = []byte("meta")
+	logBucket  = []byte("log")
+
+	snapshotKey = []byte("snapshot")
+	indexKey    = []byte("index")
+)
+
+const (
+	// compactAfter is how many changes are logged before they are
+	// folded into a new snapshot.
+	compactAfter = 10000
+	// expireInterval is how often expired keys are removed.
+	expireInterval = 500 * time.Millisecond
+)
+
+// op is a change to the store, as it is logged.
+type op struct {
+	// Method is PUT, POST or DELETE for a request, or expire for the
+	// removal of the keys that expired by Time.
+	Method    string `json:"method"`
+	Path      string `json:"path,omitempty"`
+	Value     string `json:"value,omitempty"`
+	Dir       bool   `json:"dir,omitempty"`
+	Recursive bool   `json:"recursive,omitempty"`
+	PrevValue string `json:"prevValue,omitempty"`
+	PrevIndex uint64 `json:"prevIndex,omitempty"`
+	PrevExist *bool  `json:"prevExist,omitempty"`
+	Refresh   bool   `json:"refresh,omitempty"`
+	// Time is when the key expires in unix nanoseconds, 0 for never,
+	// or the cutoff of an expire.
+	Time int64 `json:"time,omitempty"`
+}
+
+func (o op) ttl() store.TTLOptionSet {
+	opts := store.TTLOptionSet{Refresh: o.Refresh}
+	if o.Time != 0 {
+		opts.ExpireTime = time.Unix(0, o.Time)
+	}
+	return opts
+}
+
+// Store is a v2 store persisted to a bbolt file.
+type Store struct {
+	// mu keeps changes in the order they are logged
+	mu sync.Mutex
+	db *bolt.DB
+	st store.Store
+	// next is a copy of st without watchers. Changes are tried on it
+	// first, and only made to st once they are logged.
+	next store.Store
+	seq  uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open opens the store kept in the bbolt file at path, creating it if
+// needed.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{db: db, st: store.New(), stop: make(chan struct{}), done: make(chan struct{})}
+	if err := s.load(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("standalone: cannot load %s: %v", path, err)
+	}
+	go s.expire()
+	return s, nil
+}
+
+// load recovers the snapshot, replays the log on top of it and folds
+// the result into a new snapshot.
+func (s *Store) load() error {
+	var ops []op
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(metaBucket); meta != nil {
+			if b := meta.Get(snapshotKey); b != nil {
+				if err := s.st.Recovery(b); err != nil {
+					return err
+				}
+			}
+		}
+		if log := tx.Bucket(logBucket); log != nil {
+			return log.ForEach(func(k, v []byte) error {
+				var o op
+				if err := json.Unmarshal(v, &o); err != nil {
+					return fmt.Errorf("log entry %d: %v", binary.BigEndian.Uint64(k), err)
+				}
+				ops = append(ops, o)
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, o := range ops {
+		// only changes that were applied are logged, so they apply
+		// again the same way
+		if _, err := apply(s.st, o); err != nil {
+			logging.Warnf("standalone: replaying %s %s: %v", o.Method, o.Path, err)
+		}
+	}
+	if s.next, err = copyStore(s.st); err != nil {
+		return err
+	}
+	return s.db.Update(s.compact)
+}
+
+// copyStore returns a copy of st without its watchers.
+func copyStore(st store.Store) (store.Store, error) {
+	b, err := st.Save()
+	if err != nil {
+		return nil, err
+	}
+	c := store.New()
+	if err := c.Recovery(b); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// apply makes the change o to st.
+func apply(st store.Store, o op) (*store.Event, error) {
+	switch o.Method {
+	case "POST":
+		return st.Create(o.Path, o.Dir, o.Value, true, o.ttl())
+	case "PUT":
+		switch {
+		case o.PrevExist != nil && *o.PrevExist:
+			if o.PrevIndex == 0 && o.PrevValue == "" {
+				return st.Update(o.Path, o.Value, o.ttl())
+			}
+			return st.CompareAndSwap(o.Path, o.PrevValue, o.PrevIndex, o.Value, o.ttl())
+		case o.PrevExist != nil:
+			return st.Create(o.Path, o.Dir, o.Value, false, o.ttl())
+		case o.PrevIndex > 0 || o.PrevValue != "":
+			return st.CompareAndSwap(o.Path, o.PrevValue, o.PrevIndex, o.Value, o.ttl())
+		default:
+			return st.Set(o.Path, o.Dir, o.Value, o.ttl())
+		}
+	case "DELETE":
+		if o.PrevIndex > 0 || o.PrevValue != "" {
+			return st.CompareAndDelete(o.Path, o.PrevValue, o.PrevIndex)
+		}
+		return st.Delete(o.Path, o.Dir, o.Recursive)
+	case "expire":
+		st.DeleteExpiredKeys(time.Unix(0, o.Time))
+		return nil, nil
+	}
+	return nil, etcdErr.NewRequestError(etcdErr.EcodeInvalidForm, "unknown method "+o.Method)
+}
+
+// do applies o and logs it if it changed the store. The change is tried
+// on the copy of the store first, and only made to the store watchers
+// see once it is logged, so that they never see a change that is not
+// on disk.
+func (s *Store) do(o op) (*store.Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	index := s.next.Index()
+	ev, err := apply(s.next, o)
+	if err != nil || s.next.Index() == index {
+		return ev, err
+	}
+	if err := s.db.Update(func(tx *bolt.Tx) error { return s.log(tx, o) }); err != nil {
+		logging.Errorf("standalone: failed to log %s %s: %v", o.Method, o.Path, err)
+		// take the change back from the copy
+		if next, cerr := copyStore(s.st); cerr != nil {
+			logging.Errorf("standalone: failed to copy the store: %v", cerr)
+		} else {
+			s.next = next
+		}
+		return nil, etcdErr.NewError(etcdErr.EcodeRaftInternal, err.Error(), s.st.Index())
+	}
+	return apply(s.st, o)
+}
+
+// log appends o to the log, and compacts it once it is long enough.
+func (s *Store) log(tx *bolt.Tx, o op) error {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	log, err := tx.CreateBucketIfNotExists(logBucket)
+	if err != nil {
+		return err
+	}
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:], s.seq+1)
+	if err := log.Put(k[:], b); err != nil {
+		return err
+	}
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	var index [8]byte
+	binary.BigEndian.PutUint64(index[:], s.next.Index())
+	if err := meta.Put(indexKey, index[:]); err != nil {
+		return err
+	}
+	s.seq++
+	if s.seq >= compactAfter {
+		return s.compact(tx)
+	}
+	return nil
+}
+
+// compact replaces the snapshot with the copy of the store, which has
+// every logged change, and empties the log.
+func (s *Store) compact(tx *bolt.Tx) error {
+	b, err := s.next.Save()
+	if err != nil {
+		return err
+	}
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	if err := meta.Put(snapshotKey, b); err != nil {
+		return err
+	}
+	var index [8]byte
+	binary.BigEndian.PutUint64(index[:], s.next.Index())
+	if err := meta.Put(indexKey, index[:]); err != nil {
+		return err
+	}
+	if tx.Bucket(logBucket) != nil {
+		if err := tx.DeleteBucket(logBucket); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.CreateBucket(logBucket); err != nil {
+		return err
+	}
+	s.seq = 0
+	return nil
+}
+
+// expire removes expired keys until the store is closed.
+func (s *Store) expire() {
+	defer close(s.done)
+	t := time.NewTicker(expireInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-t.C:
+			if !s.st.HasTTLKeys() {
+				continue
+			}
+			s.do(op{Method: "expire", Time: now.UnixNano()})
+		}
+	}
+}
+
+// Index returns the current etcd index of the store.
+func (s *Store) Index() uint64 {
+	return s.st.Index()
+}
+
+// Get returns the node at path, as a v2 get would.
+func (s *Store) Get(path string, recursive, sorted bool) (*store.Event, error) {
+	return s.st.Get(path, recursive, sorted)
+}
+
+// Watch watches path for changes after sinceIndex, or from now if it is
+// 0.
+func (s *Store) Watch(path string, recursive, stream bool, sinceIndex uint64) (store.Watcher, error) {
+	return s.st.Watch(path, recursive, stream, sinceIndex)
+}
+
+// Close stops expiring keys and closes the bbolt file.
+func (s *Store) Close() error {
+	close(s.stop)
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.Close()
+}
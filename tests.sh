@@ -76,6 +76,7 @@ done
 
 echo "Building discovery.etcd.io..."
 go build -v -o ./bin/discovery .
+go build -v -o ./bin/discoveryctl ./discoveryctl
 
 echo "Running tests..." $TESTS
 EXPECT_DEBUG=1 go test -v $TESTS;
@@ -0,0 +1,305 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/discovery.etcd.io/logging"
+)
+
+// Attribute is a key/value pair recorded on a span.
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// SpanData is a finished span as handed to exporters.
+type SpanData struct {
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID
+	Name         string
+	Kind         Kind
+	Start        time.Time
+	End          time.Time
+	Attributes   []Attribute
+	// Error is the failure the span ended with, if any.
+	Error string
+}
+
+// Exporter sends finished spans to a tracing backend.
+type Exporter interface {
+	ExportSpans(spans []SpanData) error
+}
+
+const (
+	// exportInterval is how often queued spans are exported.
+	exportInterval = 5 * time.Second
+	// exportBatchSize is how many queued spans trigger an early export.
+	exportBatchSize = 512
+	// maxQueuedSpans bounds the spans kept while the exporter is failing.
+	maxQueuedSpans = 8 * exportBatchSize
+)
+
+// provider queues finished spans and hands them to the exporter.
+type provider struct {
+	mu       sync.Mutex
+	exporter Exporter
+	queue    []SpanData
+	exportMu sync.Mutex
+	kick     chan struct{}
+	stop     chan struct{}
+}
+
+var global = &provider{}
+
+func (p *provider) enabled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.exporter != nil
+}
+
+func (p *provider) enqueue(s SpanData) {
+	p.mu.Lock()
+	if p.exporter == nil {
+		p.mu.Unlock()
+		return
+	}
+	if len(p.queue) >= maxQueuedSpans {
+		p.queue = p.queue[1:]
+	}
+	p.queue = append(p.queue, s)
+	full := len(p.queue) >= exportBatchSize
+	kick := p.kick
+	p.mu.Unlock()
+
+	if full {
+		select {
+		case kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (p *provider) flush() error {
+	p.exportMu.Lock()
+	defer p.exportMu.Unlock()
+
+	p.mu.Lock()
+	spans, e := p.queue, p.exporter
+	p.queue = nil
+	p.mu.Unlock()
+
+	if e == nil || len(spans) == 0 {
+		return nil
+	}
+	return e.ExportSpans(spans)
+}
+
+func (p *provider) run(kick, stop chan struct{}) {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-kick:
+		}
+		if err := p.flush(); err != nil {
+			logging.Warnf("failed to export spans: %v", err)
+		}
+	}
+}
+
+// SetExporter starts recording spans and exporting them to e in the
+// background. A nil e stops recording; spans still queued are dropped.
+func SetExporter(e Exporter) {
+	global.mu.Lock()
+	defer global.mu.Unlock()
+
+	if global.stop != nil {
+		close(global.stop)
+		global.stop, global.kick = nil, nil
+	}
+	global.exporter = e
+	global.queue = nil
+	if e != nil {
+		global.kick, global.stop = make(chan struct{}, 1), make(chan struct{})
+		go global.run(global.kick, global.stop)
+	}
+}
+
+// Flush exports every queued span right away.
+func Flush() error {
+	return global.flush()
+}
+
+// The otlp types follow the JSON encoding of the OTLP trace protocol.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              Kind           `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// OTLP status codes.
+const (
+	otlpStatusOK    = 1
+	otlpStatusError = 2
+)
+
+// serviceName is reported as the service.name resource attribute.
+const serviceName = "discovery.etcd.io"
+
+func toOTLP(s SpanData) otlpSpan {
+	out := otlpSpan{
+		TraceID:           s.TraceID.String(),
+		SpanID:            s.SpanID.String(),
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		Status:            otlpStatus{Code: otlpStatusOK},
+	}
+	if s.ParentSpanID != (SpanID{}) {
+		out.ParentSpanID = s.ParentSpanID.String()
+	}
+	for _, a := range s.Attributes {
+		out.Attributes = append(out.Attributes, otlpKeyValue{Key: a.Key, Value: otlpValue{StringValue: a.Value}})
+	}
+	if s.Error != "" {
+		out.Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+	}
+	return out
+}
+
+// OTLPExporter posts spans to an OTLP/HTTP collector using the JSON
+// encoding.
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewOTLPExporter returns an exporter posting to endpoint, the full url
+// of the collector traces resource (usually ending in /v1/traces).
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *OTLPExporter) ExportSpans(spans []SpanData) error {
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: otlpValue{StringValue: serviceName}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: serviceName}}},
+	}}}
+	for _, s := range spans {
+		req.ResourceSpans[0].ScopeSpans[0].Spans = append(req.ResourceSpans[0].ScopeSpans[0].Spans, toOTLP(s))
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector %s returned %s", e.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// FileExporter appends spans to a file as JSON lines, one OTLP span
+// object per line.
+type FileExporter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewFileExporter opens path for appending spans.
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{f: f}, nil
+}
+
+func (e *FileExporter) ExportSpans(spans []SpanData) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, s := range spans {
+		if err := enc.Encode(toOTLP(s)); err != nil {
+			return err
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.f.Write(buf.Bytes())
+	return err
+}
+
+// Close closes the underlying file.
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.f.Close()
+}